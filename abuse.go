@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MAX_REPORT_REASON = 1000
+
+var (
+	suspensions = map[string]*Suspension{}
+	offenses    = map[string][]Offense{}
+	blocked     = map[string]time.Time{}
+	abuseLock   sync.Mutex
+
+	ErrSuspended      = errors.New("transfer is suspended pending review")
+	ErrUploadsBlocked = errors.New("uploads from your address are blocked")
+)
+
+type AbuseConfig struct {
+	Enabled     bool
+	BlockAfter  int
+	BlockHours  int
+	OffenseDays int
+}
+
+type AbuseReport struct {
+	Reporter string
+	Reason   string
+	Time     time.Time
+}
+
+type Suspension struct {
+	Key       string
+	Group     bool
+	Uploaders []string
+	Reports   []AbuseReport
+	Since     time.Time
+}
+
+type Offense struct {
+	Key  string
+	Time time.Time
+}
+
+type AbuseOverview struct {
+	Suspended []*Suspension
+	Blocked   map[string]time.Time
+}
+
+func Suspended(id string) bool {
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	_, ok := suspensions[id]
+	return ok
+}
+
+func UploadBlocked(ip net.IP) bool {
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	until, ok := blocked[ip.String()]
+	return ok && clock.Now().Before(until)
+}
+
+func uploaders(id string) ([]string, bool, bool) {
+	if transfer, ok := GetTransfer(id); ok {
+		transfer.Lock()
+		defer transfer.Unlock()
+		return []string{ClientIP(transfer.upload).String()}, false, true
+	}
+	groupsLock.Lock()
+	group, ok := groups[id]
+	groupsLock.Unlock()
+	if !ok {
+		return nil, false, false
+	}
+	group.Lock()
+	defer group.Unlock()
+	ips := []string{}
+	seen := map[string]bool{}
+	for _, c := range group.Contributions {
+		if c.uploader == nil || seen[c.uploader.String()] {
+			continue
+		}
+		seen[c.uploader.String()] = true
+		ips = append(ips, c.uploader.String())
+	}
+	return ips, true, true
+}
+
+func recentOffenses(ip string, now time.Time) []Offense {
+	window := time.Duration(conf.Abuse.OffenseDays) * 24 * time.Hour
+	list := []Offense{}
+	for _, o := range offenses[ip] {
+		if now.Sub(o.Time) < window {
+			list = append(list, o)
+		}
+	}
+	return list
+}
+
+func Report(id string, report AbuseReport) (*Suspension, []string, error) {
+	ips, group, ok := uploaders(id)
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	s, suspended := suspensions[id]
+	if !ok && !suspended {
+		return nil, nil, ErrTransferNotFound
+	}
+	if suspended {
+		for _, rep := range s.Reports {
+			if rep.Reporter == report.Reporter {
+				return s, nil, nil
+			}
+		}
+		s.Reports = append(s.Reports, report)
+		return s, nil, nil
+	}
+
+	s = &Suspension{id, group, ips, []AbuseReport{report}, report.Time}
+	suspensions[id] = s
+	newlyBlocked := []string{}
+	for _, ip := range ips {
+		list := append(recentOffenses(ip, report.Time), Offense{id, report.Time})
+		offenses[ip] = list
+		if conf.Abuse.BlockAfter > 0 && len(list) >= conf.Abuse.BlockAfter {
+			if _, already := blocked[ip]; !already {
+				newlyBlocked = append(newlyBlocked, ip)
+			}
+			blocked[ip] = report.Time.Add(time.Duration(conf.Abuse.BlockHours) * time.Hour)
+		}
+	}
+	return s, newlyBlocked, nil
+}
+
+func dismiss(id string) bool {
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	s, ok := suspensions[id]
+	if !ok {
+		return false
+	}
+	delete(suspensions, id)
+	for _, ip := range s.Uploaders {
+		list := []Offense{}
+		for _, o := range offenses[ip] {
+			if o.Key != id {
+				list = append(list, o)
+			}
+		}
+		offenses[ip] = list
+		if len(list) == 0 {
+			delete(offenses, ip)
+		}
+	}
+	return true
+}
+
+func removeReported(id string) error {
+	transfer, group := findHoldable(id)
+	switch {
+	case transfer != nil:
+		if transfer.Held() {
+			return ErrOnHold
+		}
+		transfer.SetStatus(ABORTED)
+	case group != nil:
+		group.Lock()
+		defer group.Unlock()
+		if group.Hold != nil {
+			return ErrOnHold
+		}
+		group.Status.Set(ABORTED)
+		group.forwardUntil = time.Time{}
+		JournalClose(id)
+	}
+	abuseLock.Lock()
+	delete(suspensions, id)
+	abuseLock.Unlock()
+	return nil
+}
+
+func CleanAbuse() {
+	ids := []string{}
+	abuseLock.Lock()
+	for id := range suspensions {
+		ids = append(ids, id)
+	}
+	abuseLock.Unlock()
+	gone := []string{}
+	for _, id := range ids {
+		if _, _, ok := uploaders(id); !ok {
+			gone = append(gone, id)
+		}
+	}
+
+	abuseLock.Lock()
+	defer abuseLock.Unlock()
+	for _, id := range gone {
+		delete(suspensions, id)
+	}
+	now := clock.Now()
+	for ip, until := range blocked {
+		if now.After(until) {
+			delete(blocked, ip)
+		}
+	}
+	for ip := range offenses {
+		if list := recentOffenses(ip, now); len(list) > 0 {
+			offenses[ip] = list
+		} else {
+			delete(offenses, ip)
+		}
+	}
+}
+
+func CheckUploader(w http.ResponseWriter, r *http.Request) bool {
+	if CurrentMaintenance() != nil {
+		RequestLog(r).Info("Rejected upload during maintenance")
+		WriteError(w, r, ErrMaintenance)
+		return false
+	}
+	if !conf.Abuse.Enabled || !UploadBlocked(ClientIP(r)) {
+		return true
+	}
+	RequestLog(r).Info("Rejected upload from blocked address %s", ClientIP(r))
+	WriteError(w, r, ErrUploadsBlocked)
+	return false
+}
+
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !conf.Abuse.Enabled {
+		Error(w, r, "abuse reports are disabled", http.StatusNotFound)
+		return
+	}
+	ip := ClientIP(r).String()
+	if !AttemptsLeft(ip) {
+		Error(w, r, "too many reports for unknown transfers", http.StatusTooManyRequests)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Reason string
+		}
+		json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req)
+		reason = strings.TrimSpace(req.Reason)
+	}
+	if len(reason) > MAX_REPORT_REASON {
+		Error(w, r, "reason is too long", http.StatusBadRequest)
+		return
+	}
+
+	s, newlyBlocked, err := Report(id, AbuseReport{ip, reason, clock.Now()})
+	if err != nil {
+		FailedAttempt(ip)
+		WriteError(w, r, err)
+		return
+	}
+	Audit(r, "abuse reported", id, reason)
+	if tl, ok := FindTimeline(id); ok {
+		tl.Record("reported", 0, ip)
+	}
+	for _, blockedIP := range newlyBlocked {
+		logger.Warn("Blocked uploads from %s after repeated abuse reports", blockedIP)
+	}
+	if WantsHTML(r) {
+		http.Redirect(w, r, "/receive?code="+id, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript")
+	w.WriteHeader(http.StatusAccepted)
+	jenc := json.NewEncoder(w)
+	jenc.Encode(struct {
+		Key       string
+		Suspended bool
+	}{s.Key, true})
+}
+
+func ReportsHandler(w http.ResponseWriter, r *http.Request) {
+	overview := AbuseOverview{[]*Suspension{}, map[string]time.Time{}}
+	abuseLock.Lock()
+	for _, s := range suspensions {
+		overview.Suspended = append(overview.Suspended, s)
+	}
+	for ip, until := range blocked {
+		overview.Blocked[ip] = until
+	}
+	b, _ := json.Marshal(overview)
+	abuseLock.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	w.Write(append(b, '\n'))
+}
+
+func ReviewHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var req struct {
+		Action string
+	}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(&req); err != nil || (req.Action != "dismiss" && req.Action != "remove") {
+		Error(w, r, "action must be dismiss or remove", http.StatusBadRequest)
+		return
+	}
+	if !Suspended(id) {
+		Error(w, r, "transfer is not suspended", http.StatusNotFound)
+		return
+	}
+	if req.Action == "remove" {
+		if err := removeReported(id); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		Audit(r, "reported transfer removed", id, "")
+		if tl, ok := FindTimeline(id); ok {
+			tl.Record("removed after review", 0, Principal(r))
+		}
+	} else {
+		dismiss(id)
+		Audit(r, "abuse report dismissed", id, "")
+		if tl, ok := FindTimeline(id); ok {
+			tl.Record("report dismissed", 0, Principal(r))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UnblockHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ip := net.ParseIP(vars["ip"])
+	if ip == nil {
+		Error(w, r, "invalid address", http.StatusBadRequest)
+		return
+	}
+	abuseLock.Lock()
+	_, ok := blocked[ip.String()]
+	delete(blocked, ip.String())
+	delete(offenses, ip.String())
+	abuseLock.Unlock()
+	if !ok {
+		Error(w, r, "address is not blocked", http.StatusNotFound)
+		return
+	}
+	Audit(r, "uploads unblocked", ip.String(), "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Usage struct {
+	BytesIn         int64
+	BytesOut        int64
+	CompressSeconds float64
+	WallSeconds     float64
+	Started         time.Time
+	Finished        time.Time
+}
+
+type QuotaConfig struct {
+	MonthlyBytes     int64
+	MonthlyTransfers int
+}
+
+type MonthlyUsage struct {
+	Month     string
+	Bytes     int64
+	Transfers int
+}
+
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+type TimingWriter struct {
+	W io.Writer
+	D time.Duration
+}
+
+func (t *TimingWriter) Write(p []byte) (int, error) {
+	start := clock.Now()
+	n, err := t.W.Write(p)
+	t.D += clock.Since(start)
+	return n, err
+}
+
+var (
+	monthly     = map[string]*MonthlyUsage{}
+	totals      Usage
+	totalsCount int64
+	usageLock   sync.Mutex
+)
+
+func thisMonth() string {
+	return clock.Now().Format("2006-01")
+}
+
+func CheckQuota(token string) (int, string) {
+	quota, ok := conf.Quotas[token]
+	if !ok {
+		return 0, ""
+	}
+
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	u, ok := monthly[token]
+	if !ok || u.Month != thisMonth() {
+		return 0, ""
+	}
+	if quota.MonthlyTransfers > 0 && u.Transfers >= quota.MonthlyTransfers {
+		return http.StatusTooManyRequests, "monthly transfer quota exceeded"
+	}
+	if quota.MonthlyBytes > 0 && u.Bytes >= quota.MonthlyBytes {
+		return http.StatusPaymentRequired, "monthly data quota exceeded"
+	}
+	return 0, ""
+}
+
+func QuotaUsage(token string) (QuotaConfig, MonthlyUsage, bool) {
+	quota, ok := conf.Quotas[token]
+	if !ok {
+		return quota, MonthlyUsage{}, false
+	}
+
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	used := MonthlyUsage{Month: thisMonth()}
+	if u, ok := monthly[token]; ok && u.Month == used.Month {
+		used = *u
+	}
+	return quota, used, true
+}
+
+func Account(token string, u Usage) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	totals.BytesIn += u.BytesIn
+	totals.BytesOut += u.BytesOut
+	totals.CompressSeconds += u.CompressSeconds
+	totals.WallSeconds += u.WallSeconds
+	totalsCount++
+
+	if token == "" {
+		return
+	}
+	m, ok := monthly[token]
+	if !ok || m.Month != thisMonth() {
+		m = &MonthlyUsage{Month: thisMonth()}
+		monthly[token] = m
+	}
+	m.Bytes += u.BytesIn
+	m.Transfers++
+}
+
+func (t *Transfer) CurrentUsage() Usage {
+	t.Lock()
+	defer t.Unlock()
+	return t.Usage
+}
+
+func AdminTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	type view struct {
+		Status    Status
+		Priority  string
+		Created   time.Time
+		RequestID string
+		Usage     Usage
+		Events    []Event
+	}
+	list := map[string]view{}
+	transfersLock.Lock()
+	for id, transfer := range transfers {
+		list[id] = view{
+			transfer.CurrentStatus(),
+			transfer.Priority,
+			transfer.Created,
+			transfer.RequestID,
+			transfer.CurrentUsage(),
+			transfer.timeline.Events(),
+		}
+	}
+	transfersLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(list)
+}
+
+func AdminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(monthly)
+}
+
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	usageLock.Lock()
+	t, count := totals, totalsCount
+	usageLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "nethermes_transfers_total %d\n", count)
+	fmt.Fprintf(w, "nethermes_bytes_in_total %d\n", t.BytesIn)
+	fmt.Fprintf(w, "nethermes_bytes_out_total %d\n", t.BytesOut)
+	fmt.Fprintf(w, "nethermes_compress_seconds_total %f\n", t.CompressSeconds)
+	fmt.Fprintf(w, "nethermes_transfer_seconds_total %f\n", t.WallSeconds)
+
+	ks := keyspace.Report()
+	fmt.Fprintf(w, "nethermes_keys_issued_total %d\n", ks.Issued)
+	fmt.Fprintf(w, "nethermes_key_collisions_total %d\n", ks.Collisions)
+	fmt.Fprintf(w, "nethermes_key_exhausted_total %d\n", ks.Exhausted)
+	fmt.Fprintf(w, "nethermes_keys_expired_total %d\n", ks.Expired)
+	fmt.Fprintf(w, "nethermes_keys_active %d\n", ks.ActiveKeys)
+	fmt.Fprintf(w, "nethermes_key_collision_rate %f\n", ks.CollisionRate)
+	fmt.Fprintf(w, "nethermes_key_occupancy %g\n", ks.Occupancy)
+
+	ac := archives.Report()
+	fmt.Fprintf(w, "nethermes_archive_cache_entries %d\n", ac.Entries)
+	fmt.Fprintf(w, "nethermes_archive_cache_bytes %d\n", ac.Bytes)
+	fmt.Fprintf(w, "nethermes_archive_cache_hits_total %d\n", ac.Hits)
+	fmt.Fprintf(w, "nethermes_archive_cache_misses_total %d\n", ac.Misses)
+	fmt.Fprintf(w, "nethermes_archive_cache_evictions_total %d\n", ac.Evictions)
+
+	waitStats.WriteMetrics(w)
+	WritePriorityMetrics(w)
+	WriteWAFMetrics(w)
+}
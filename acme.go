@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	ACME_DIRECTORY    = "https://acme-v02.api.letsencrypt.org/directory"
+	ACME_CHECK_HOURS  = 12
+	ACME_RETRY_HOURS  = 1
+	ACME_POLL_TIMEOUT = 5 * time.Minute
+)
+
+var (
+	acmeHTTP      = &http.Client{Timeout: 30 * time.Second}
+	acmePoll      = 2 * time.Second
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+	dnsProviders = map[string]DNSProvider{
+		"exec":       {[]string{"Command"}, execDNS("present"), execDNS("cleanup")},
+		"httpreq":    {[]string{"URL"}, httpreqDNS("present"), httpreqDNS("cleanup")},
+		"cloudflare": {[]string{"APIToken", "ZoneID"}, cloudflarePresent, cloudflareCleanUp},
+	}
+)
+
+// ACMEConfig obtains and renews the certificate in TLS.CertFile and
+// TLS.KeyFile for Domains with DNS-01 challenges, so relays that are not
+// reachable from the internet can get certificates for internal hostnames.
+// Provider names one of dnsProviders and Credentials holds its settings.
+type ACMEConfig struct {
+	Domains            []string
+	Directory          string
+	Email              string
+	AccountKeyFile     string
+	Provider           string
+	Credentials        map[string]string
+	PropagationSeconds int
+	RenewDays          int
+}
+
+// DNSProvider publishes and removes the TXT record value at fqdn, which
+// has no trailing dot.
+type DNSProvider struct {
+	Credentials []string
+	Present     func(creds map[string]string, fqdn, value string) error
+	CleanUp     func(creds map[string]string, fqdn, value string) error
+}
+
+func (c ACMEConfig) Enabled() bool {
+	return len(c.Domains) > 0
+}
+
+func CheckACMEConfig() error {
+	c := conf.ACME
+	if !c.Enabled() {
+		return nil
+	}
+	if !conf.TLS.Enabled() {
+		return errors.New("ACME needs TLS.CertFile and TLS.KeyFile to store the certificate")
+	}
+	p, ok := dnsProviders[c.Provider]
+	if !ok {
+		return fmt.Errorf("unknown DNS provider %q", c.Provider)
+	}
+	for _, k := range p.Credentials {
+		if c.Credentials[k] == "" {
+			return fmt.Errorf("DNS provider %s needs Credentials.%s", c.Provider, k)
+		}
+	}
+	if u, err := url.Parse(c.Directory); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid ACME directory %q", c.Directory)
+	}
+	if c.AccountKeyFile == "" {
+		return errors.New("AccountKeyFile is not set")
+	}
+	if c.RenewDays <= 0 || c.PropagationSeconds < 0 {
+		return errors.New("RenewDays must be positive and PropagationSeconds not negative")
+	}
+	return nil
+}
+
+type acmeProblem struct {
+	Type   string
+	Detail string
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%s (%s)", p.Detail, p.Type)
+}
+
+type acmeOrder struct {
+	Status         string
+	Authorizations []string
+	Finalize       string
+	Certificate    string
+	Error          *acmeProblem
+}
+
+type acmeChallenge struct {
+	Type   string
+	URL    string
+	Token  string
+	Status string
+	Error  *acmeProblem
+}
+
+type acmeAuthz struct {
+	Status     string
+	Identifier struct {
+		Type  string
+		Value string
+	}
+	Challenges []acmeChallenge
+}
+
+type acmeClient struct {
+	key *ecdsa.PrivateKey
+	dir struct {
+		NewNonce   string
+		NewAccount string
+		NewOrder   string
+	}
+	kid   string
+	nonce string
+}
+
+func loadAccountKey(file string) (*ecdsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", file)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func (c *acmeClient) jwk() map[string]string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"crv": c.key.Curve.Params().Name,
+		"kty": "EC",
+		"x":   b64.EncodeToString(c.key.X.FillBytes(make([]byte, size))),
+		"y":   b64.EncodeToString(c.key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint of the account key, whose members
+// json.Marshal already writes in the required lexical order.
+func (c *acmeClient) thumbprint() string {
+	b, _ := json.Marshal(c.jwk())
+	sum := sha256.Sum256(b)
+	return b64.EncodeToString(sum[:])
+}
+
+func (c *acmeClient) newNonce() (string, error) {
+	if n := c.nonce; n != "" {
+		c.nonce = ""
+		return n, nil
+	}
+	resp, err := acmeHTTP.Head(c.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		return n, nil
+	}
+	return "", errors.New("ACME server sent no nonce")
+}
+
+// post sends payload as a JWS signed with the account key. A nil payload
+// makes a POST-as-GET request.
+func (c *acmeClient) post(u string, payload interface{}) ([]byte, http.Header, error) {
+	for retry := 0; ; retry++ {
+		nonce, err := c.newNonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": u}
+		if c.kid == "" {
+			protected["jwk"] = c.jwk()
+		} else {
+			protected["kid"] = c.kid
+		}
+		ph, _ := json.Marshal(protected)
+		body := ""
+		if payload != nil {
+			b, err := json.Marshal(payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			body = b64.EncodeToString(b)
+		}
+		signed := b64.EncodeToString(ph) + "." + body
+		hash := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, c.key, hash[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		jws, _ := json.Marshal(map[string]string{"protected": b64.EncodeToString(ph), "payload": body, "signature": b64.EncodeToString(sig)})
+
+		resp, err := acmeHTTP.Post(u, "application/jose+json", bytes.NewReader(jws))
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.nonce = resp.Header.Get("Replay-Nonce")
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode < 400 {
+			return b, resp.Header, nil
+		}
+		problem := &acmeProblem{}
+		if json.Unmarshal(b, problem) != nil || problem.Type == "" {
+			return nil, nil, fmt.Errorf("ACME server: %s", resp.Status)
+		}
+		if retry == 0 && strings.HasSuffix(problem.Type, ":badNonce") {
+			continue
+		}
+		return nil, nil, problem
+	}
+}
+
+func (c *acmeClient) get(u string, v interface{}) error {
+	b, _, err := c.post(u, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func newACMEClient() (*acmeClient, error) {
+	key, err := loadAccountKey(conf.ACME.AccountKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("account key: %s", err)
+	}
+	c := &acmeClient{key: key}
+	resp, err := acmeHTTP.Get(conf.ACME.Directory)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACME directory: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.dir); err != nil {
+		return nil, fmt.Errorf("ACME directory: %s", err)
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if conf.ACME.Email != "" {
+		account["contact"] = []string{"mailto:" + conf.ACME.Email}
+	}
+	_, h, err := c.post(c.dir.NewAccount, account)
+	if err != nil {
+		return nil, fmt.Errorf("ACME account: %s", err)
+	}
+	if c.kid = h.Get("Location"); c.kid == "" {
+		return nil, errors.New("ACME account: no account URL")
+	}
+	return c, nil
+}
+
+func (c *acmeClient) authorize(u string) error {
+	var authz acmeAuthz
+	if err := c.get(u, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var ch *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "dns-01" {
+			ch = &authz.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	sum := sha256.Sum256([]byte(ch.Token + "." + c.thumbprint()))
+	fqdn, value := "_acme-challenge."+authz.Identifier.Value, b64.EncodeToString(sum[:])
+	provider := dnsProviders[conf.ACME.Provider]
+	if err := provider.Present(conf.ACME.Credentials, fqdn, value); err != nil {
+		return fmt.Errorf("publish %s: %s", fqdn, err)
+	}
+	defer func() {
+		if err := provider.CleanUp(conf.ACME.Credentials, fqdn, value); err != nil {
+			logger.Warn("Remove ACME record %s: %s", fqdn, err)
+		}
+	}()
+	Sleep(time.Duration(conf.ACME.PropagationSeconds) * time.Second)
+	if _, _, err := c.post(ch.URL, struct{}{}); err != nil {
+		return err
+	}
+	deadline := clock.Now().Add(ACME_POLL_TIMEOUT)
+	for authz.Status == "pending" || authz.Status == "" {
+		if clock.Now().After(deadline) {
+			return fmt.Errorf("validation of %s timed out", authz.Identifier.Value)
+		}
+		Sleep(acmePoll)
+		if err := c.get(u, &authz); err != nil {
+			return err
+		}
+	}
+	if authz.Status != "valid" {
+		for _, ch := range authz.Challenges {
+			if ch.Type == "dns-01" && ch.Error != nil {
+				return fmt.Errorf("validation of %s failed: %s", authz.Identifier.Value, ch.Error)
+			}
+		}
+		return fmt.Errorf("validation of %s failed: %s", authz.Identifier.Value, authz.Status)
+	}
+	return nil
+}
+
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// ObtainCertificate orders a certificate for conf.ACME.Domains and stores
+// it in TLS.KeyFile and TLS.CertFile, where the certificate reloader picks
+// it up.
+func ObtainCertificate() error {
+	c, err := newACMEClient()
+	if err != nil {
+		return err
+	}
+	ids := []map[string]string{}
+	for _, d := range conf.ACME.Domains {
+		ids = append(ids, map[string]string{"type": "dns", "value": d})
+	}
+	b, h, err := c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": ids})
+	if err != nil {
+		return fmt.Errorf("new order: %s", err)
+	}
+	orderURL := h.Get("Location")
+	var order acmeOrder
+	if err := json.Unmarshal(b, &order); err != nil {
+		return err
+	}
+	for _, u := range order.Authorizations {
+		if err := c.authorize(u); err != nil {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: conf.ACME.Domains[0]},
+		DNSNames: conf.ACME.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	if b, _, err = c.post(order.Finalize, map[string]string{"csr": b64.EncodeToString(csr)}); err != nil {
+		return fmt.Errorf("finalize: %s", err)
+	}
+	if err := json.Unmarshal(b, &order); err != nil {
+		return err
+	}
+	deadline := clock.Now().Add(ACME_POLL_TIMEOUT)
+	for order.Status != "valid" {
+		if order.Status == "invalid" {
+			if order.Error != nil {
+				return fmt.Errorf("order failed: %s", order.Error)
+			}
+			return errors.New("order failed")
+		}
+		if clock.Now().After(deadline) {
+			return errors.New("order timed out")
+		}
+		Sleep(acmePoll)
+		if err := c.get(orderURL, &order); err != nil {
+			return err
+		}
+	}
+	chain, _, err := c.post(order.Certificate, nil)
+	if err != nil {
+		return fmt.Errorf("download certificate: %s", err)
+	}
+	if block, _ := pem.Decode(chain); block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("ACME server sent no certificate")
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(conf.TLS.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(conf.TLS.CertFile, chain, 0644)
+}
+
+func renewalDue() (bool, string) {
+	b, err := ioutil.ReadFile(conf.TLS.CertFile)
+	if err != nil {
+		return true, "no certificate yet"
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return true, "unreadable certificate"
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true, "unreadable certificate"
+	}
+	names := map[string]bool{}
+	for _, n := range cert.DNSNames {
+		names[n] = true
+	}
+	for _, d := range conf.ACME.Domains {
+		if !names[d] {
+			return true, d + " is not covered"
+		}
+	}
+	if left := Until(cert.NotAfter); left < time.Duration(conf.ACME.RenewDays)*24*time.Hour {
+		return true, fmt.Sprintf("expires %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return false, ""
+}
+
+func RenewCertificates() {
+	for {
+		wait := ACME_CHECK_HOURS * time.Hour
+		if due, why := renewalDue(); due {
+			logger.Info("Requesting certificate for %s: %s", strings.Join(conf.ACME.Domains, ", "), why)
+			if err := ObtainCertificate(); err != nil {
+				logger.Error("ACME: %s", err)
+				wait = ACME_RETRY_HOURS * time.Hour
+			} else {
+				logger.Info("Stored new certificate in %s", conf.TLS.CertFile)
+			}
+		}
+		Sleep(wait)
+	}
+}
+
+func execDNS(action string) func(map[string]string, string, string) error {
+	return func(creds map[string]string, fqdn, value string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, creds["Command"], action, fqdn, value).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
+
+// httpreqDNS posts {"fqdn", "value"} to URL/present and URL/cleanup, the
+// interface lego's httpreq provider uses.
+func httpreqDNS(action string) func(map[string]string, string, string) error {
+	return func(creds map[string]string, fqdn, value string) error {
+		body, _ := json.Marshal(map[string]string{"fqdn": fqdn + ".", "value": value})
+		req, err := http.NewRequest("POST", strings.TrimRight(creds["URL"], "/")+"/"+action, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if creds["Username"] != "" {
+			req.SetBasicAuth(creds["Username"], creds["Password"])
+		}
+		resp, err := acmeHTTP.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s %s", action, resp.Status)
+		}
+		return nil
+	}
+}
+
+func cloudflare(creds map[string]string, method, path string, body interface{}, result interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, cloudflareAPI+"/zones/"+url.PathEscape(creds["ZoneID"])+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+creds["APIToken"])
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := acmeHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r struct {
+		Success bool
+		Errors  []struct{ Message string }
+		Result  json.RawMessage
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("cloudflare: %s", resp.Status)
+	}
+	if !r.Success {
+		msgs := []string{}
+		for _, e := range r.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("cloudflare: %s", strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+func cloudflarePresent(creds map[string]string, fqdn, value string) error {
+	return cloudflare(creds, "POST", "/dns_records", map[string]interface{}{
+		"type": "TXT", "name": fqdn, "content": value, "ttl": 120,
+	}, nil)
+}
+
+func cloudflareCleanUp(creds map[string]string, fqdn, value string) error {
+	q := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	var records []struct{ ID string }
+	if err := cloudflare(creds, "GET", "/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := cloudflare(creds, "DELETE", "/dns_records/"+url.PathEscape(r.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
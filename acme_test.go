@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is a minimal RFC 8555 server that checks request signatures and
+// nonces and validates dns-01 challenges against the records the "test"
+// provider published.
+type fakeACME struct {
+	sync.Mutex
+	t        *testing.T
+	srv      *httptest.Server
+	caKey    *ecdsa.PrivateKey
+	ca       *x509.Certificate
+	key      *ecdsa.PublicKey
+	thumb    string
+	nonces   map[string]bool
+	next     int
+	badNonce bool
+	records  map[string]string
+	authz    []map[string]interface{}
+	order    map[string]interface{}
+	chain    []byte
+}
+
+func (f *fakeACME) nonce(w http.ResponseWriter) {
+	f.next++
+	n := fmt.Sprintf("nonce%d", f.next)
+	f.nonces[n] = true
+	w.Header().Set("Replay-Nonce", n)
+}
+
+func (f *fakeACME) problem(w http.ResponseWriter, kind string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + kind, "detail": kind})
+}
+
+func (f *fakeACME) verify(r *http.Request) ([]byte, bool) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, false
+	}
+	ph, _ := b64.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	json.Unmarshal(ph, &protected)
+	if protected.Alg != "ES256" || protected.URL != f.srv.URL+r.URL.Path || !f.nonces[protected.Nonce] {
+		f.t.Errorf("%s: bad protected header %s", r.URL.Path, ph)
+		return nil, false
+	}
+	delete(f.nonces, protected.Nonce)
+	if r.URL.Path == "/account" {
+		x, _ := b64.DecodeString(protected.JWK["x"])
+		y, _ := b64.DecodeString(protected.JWK["y"])
+		f.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		b, _ := json.Marshal(protected.JWK)
+		sum := sha256.Sum256(b)
+		f.thumb = b64.EncodeToString(sum[:])
+	} else if protected.Kid != f.srv.URL+"/acct/1" {
+		f.t.Errorf("%s: kid %q", r.URL.Path, protected.Kid)
+		return nil, false
+	}
+	sig, _ := b64.DecodeString(jws.Signature)
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(f.key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		f.t.Errorf("%s: bad signature", r.URL.Path)
+		return nil, false
+	}
+	payload, _ := b64.DecodeString(jws.Payload)
+	return payload, true
+}
+
+func (f *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	base := f.srv.URL
+	f.nonce(w)
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{"newNonce": base + "/nonce", "newAccount": base + "/account", "newOrder": base + "/order"})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	if f.badNonce {
+		f.badNonce = false
+		f.problem(w, "badNonce")
+		return
+	}
+	payload, ok := f.verify(r)
+	if !ok {
+		f.problem(w, "malformed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch path := r.URL.Path; {
+	case path == "/account":
+		w.Header().Set("Location", base+"/acct/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case path == "/order":
+		var req struct {
+			Identifiers []struct{ Type, Value string }
+		}
+		json.Unmarshal(payload, &req)
+		urls := []string{}
+		for i, id := range req.Identifiers {
+			value := strings.TrimPrefix(id.Value, "*.")
+			f.authz = append(f.authz, map[string]interface{}{
+				"status":     "pending",
+				"identifier": map[string]string{"type": "dns", "value": value},
+				"challenges": []map[string]string{
+					{"type": "http-01", "url": fmt.Sprintf("%s/http/%d", base, i), "token": "unused", "status": "pending"},
+					{"type": "dns-01", "url": fmt.Sprintf("%s/chall/%d", base, i), "token": fmt.Sprintf("token%d", i), "status": "pending"},
+				},
+			})
+			urls = append(urls, fmt.Sprintf("%s/authz/%d", base, i))
+		}
+		f.order = map[string]interface{}{"status": "pending", "authorizations": urls, "finalize": base + "/finalize"}
+		w.Header().Set("Location", base+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f.order)
+	case strings.HasPrefix(path, "/authz/"):
+		var i int
+		fmt.Sscanf(path, "/authz/%d", &i)
+		json.NewEncoder(w).Encode(f.authz[i])
+	case strings.HasPrefix(path, "/chall/"):
+		var i int
+		fmt.Sscanf(path, "/chall/%d", &i)
+		a := f.authz[i]
+		sum := sha256.Sum256([]byte(fmt.Sprintf("token%d.%s", i, f.thumb)))
+		fqdn := "_acme-challenge." + a["identifier"].(map[string]string)["value"]
+		if f.records[fqdn] == b64.EncodeToString(sum[:]) {
+			a["status"] = "valid"
+		} else {
+			a["status"] = "invalid"
+		}
+		w.Write([]byte(`{"type":"dns-01","status":"processing"}`))
+	case path == "/finalize":
+		for _, a := range f.authz {
+			if a["status"] != "valid" {
+				f.problem(w, "orderNotReady")
+				return
+			}
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := b64.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			f.problem(w, "badCSR")
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		cert, _ := x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.caKey)
+		f.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+		f.order["status"] = "processing"
+		json.NewEncoder(w).Encode(f.order)
+	case path == "/order/1":
+		if f.chain != nil {
+			f.order["status"] = "valid"
+			f.order["certificate"] = base + "/cert"
+		}
+		json.NewEncoder(w).Encode(f.order)
+	case path == "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.chain)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestObtainCertificate(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caDER, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+	f := &fakeACME{t: t, caKey: caKey, ca: ca, nonces: map[string]bool{}, badNonce: true, records: map[string]string{}}
+	f.srv = httptest.NewTLSServer(f)
+	defer f.srv.Close()
+
+	dnsProviders["test"] = DNSProvider{
+		Present: func(_ map[string]string, fqdn, value string) error {
+			f.Lock()
+			f.records[fqdn] = value
+			f.Unlock()
+			return nil
+		},
+		CleanUp: func(_ map[string]string, fqdn, value string) error {
+			f.Lock()
+			delete(f.records, fqdn)
+			f.Unlock()
+			return nil
+		},
+	}
+	defer delete(dnsProviders, "test")
+	defer func(c ACMEConfig, tc TLSConfig, client *http.Client, poll time.Duration) {
+		conf.ACME, conf.TLS, acmeHTTP, acmePoll = c, tc, client, poll
+	}(conf.ACME, conf.TLS, acmeHTTP, acmePoll)
+	dir := t.TempDir()
+	conf.TLS.CertFile, conf.TLS.KeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	conf.ACME = ACMEConfig{
+		Domains:        []string{"relay.internal.example", "*.internal.example"},
+		Directory:      f.srv.URL + "/dir",
+		AccountKeyFile: filepath.Join(dir, "account.pem"),
+		Provider:       "test",
+		RenewDays:      30,
+	}
+	acmeHTTP, acmePoll = f.srv.Client(), time.Millisecond
+	if err := CheckACMEConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if due, _ := renewalDue(); !due {
+		t.Error("renewal not due without a certificate")
+	}
+	if err := ObtainCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(conf.TLS.CertFile, conf.TLS.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+	if strings.Join(leaf.DNSNames, ",") != "relay.internal.example,*.internal.example" {
+		t.Errorf("certificate for %v", leaf.DNSNames)
+	}
+	if len(f.records) != 0 {
+		t.Errorf("records left behind: %v", f.records)
+	}
+	if due, why := renewalDue(); due {
+		t.Errorf("renewal due after issuance: %s", why)
+	}
+	conf.ACME.RenewDays = 100
+	if due, _ := renewalDue(); !due {
+		t.Error("renewal not due within RenewDays")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"math/bits"
+	"strings"
+)
+
+const (
+	AGE_VERSION = "age-encryption.org/v1"
+	AGE_X25519  = "age-encryption.org/v1/X25519"
+	AGE_CHUNK   = 64 * 1024
+	AGE_BEGIN   = "-----BEGIN AGE ENCRYPTED FILE-----"
+	AGE_END     = "-----END AGE ENCRYPTED FILE-----"
+
+	BECH32_CHARSET = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+var errAgeRecipient = errors.New("invalid age recipient")
+
+// ParseAgeRecipient decodes an age X25519 recipient ("age1...").
+func ParseAgeRecipient(s string) (*ecdh.PublicKey, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil || hrp != "age" {
+		return nil, errAgeRecipient
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, errAgeRecipient
+	}
+	return key, nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32Decode decodes a lowercase BIP 173 string without its length
+// limit, which age recipients exceed.
+func bech32Decode(s string) (string, []byte, error) {
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) || strings.ToLower(s) != s {
+		return "", nil, errAgeRecipient
+	}
+	hrp := s[:sep]
+	values := []byte{}
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]>>5)
+	}
+	values = append(values, 0)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]&31)
+	}
+	data := []byte{}
+	for i := sep + 1; i < len(s); i++ {
+		v := strings.IndexByte(BECH32_CHARSET, s[i])
+		if v < 0 {
+			return "", nil, errAgeRecipient
+		}
+		data = append(data, byte(v))
+	}
+	if bech32Polymod(append(values, data...)) != 1 {
+		return "", nil, errAgeRecipient
+	}
+	data = data[:len(data)-6]
+
+	out := []byte{}
+	acc, n := uint(0), uint(0)
+	for _, v := range data {
+		acc = acc<<5 | uint(v)
+		n += 5
+		if n >= 8 {
+			n -= 8
+			out = append(out, byte(acc>>n))
+		}
+	}
+	if n >= 5 || acc&(1<<n-1) != 0 {
+		return "", nil, errAgeRecipient
+	}
+	return hrp, out, nil
+}
+
+func chachaQuarter(s *[16]uint32, a, b, c, d int) {
+	s[a] += s[b]
+	s[d] = bits.RotateLeft32(s[d]^s[a], 16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], 12)
+	s[a] += s[b]
+	s[d] = bits.RotateLeft32(s[d]^s[a], 8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], 7)
+}
+
+// chachaBlock returns the ChaCha20 block for counter (RFC 8439 2.3).
+func chachaBlock(key, nonce []byte, counter uint32) []byte {
+	in := [16]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+	for i := 0; i < 8; i++ {
+		in[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	in[12] = counter
+	for i := 0; i < 3; i++ {
+		in[13+i] = binary.LittleEndian.Uint32(nonce[4*i:])
+	}
+	s := in
+	for i := 0; i < 10; i++ {
+		chachaQuarter(&s, 0, 4, 8, 12)
+		chachaQuarter(&s, 1, 5, 9, 13)
+		chachaQuarter(&s, 2, 6, 10, 14)
+		chachaQuarter(&s, 3, 7, 11, 15)
+		chachaQuarter(&s, 0, 5, 10, 15)
+		chachaQuarter(&s, 1, 6, 11, 12)
+		chachaQuarter(&s, 2, 7, 8, 13)
+		chachaQuarter(&s, 3, 4, 9, 14)
+	}
+	out := make([]byte, 64)
+	for i := range s {
+		binary.LittleEndian.PutUint32(out[4*i:], s[i]+in[i])
+	}
+	return out
+}
+
+func leInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// poly1305 is the one-time authenticator of RFC 8439 2.5. It uses
+// big.Int, which is fine for the few bytes sealed here.
+func poly1305(key, msg []byte) []byte {
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 130), big.NewInt(5))
+	clamp := leInt([]byte{0xff, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f})
+	r := new(big.Int).And(leInt(key[:16]), clamp)
+	acc := new(big.Int)
+	for len(msg) > 0 {
+		n := 16
+		if len(msg) < n {
+			n = len(msg)
+		}
+		acc.Add(acc, leInt(append(append([]byte{}, msg[:n]...), 1)))
+		acc.Mul(acc, r)
+		acc.Mod(acc, p)
+		msg = msg[n:]
+	}
+	acc.Add(acc, leInt(key[16:32]))
+	be := acc.Bytes()
+	tag := make([]byte, 16)
+	for i := 0; i < 16 && i < len(be); i++ {
+		tag[i] = be[len(be)-1-i]
+	}
+	return tag
+}
+
+func chachaXOR(key, nonce, data []byte, counter uint32) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += 64 {
+		block := chachaBlock(key, nonce, counter)
+		counter++
+		subtle.XORBytes(out[i:], data[i:], block)
+	}
+	return out
+}
+
+func chachaTag(key, nonce, ciphertext []byte) []byte {
+	polyKey := chachaBlock(key, nonce, 0)[:32]
+	mac := append([]byte{}, ciphertext...)
+	if pad := len(mac) % 16; pad != 0 {
+		mac = append(mac, make([]byte, 16-pad)...)
+	}
+	lengths := make([]byte, 16)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+	return poly1305(polyKey, append(mac, lengths...))
+}
+
+// chachaSeal is ChaCha20-Poly1305 without additional data (RFC 8439 2.8).
+func chachaSeal(key, nonce, plaintext []byte) []byte {
+	ciphertext := chachaXOR(key, nonce, plaintext, 1)
+	return append(ciphertext, chachaTag(key, nonce, ciphertext)...)
+}
+
+// SealAge encrypts plaintext to recipient in the age v1 format and
+// returns it ASCII armored, so "age -d -i key.txt" decrypts it.
+func SealAge(recipient *ecdh.PublicKey, plaintext []byte) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	fileKey := make([]byte, 16)
+	nonce := make([]byte, 16)
+	rand.Read(fileKey)
+	rand.Read(nonce)
+	return sealAge(recipient, plaintext, ephemeral, fileKey, nonce)
+}
+
+func sealAge(recipient *ecdh.PublicKey, plaintext []byte, ephemeral *ecdh.PrivateKey, fileKey, nonce []byte) (string, error) {
+	if len(plaintext) > AGE_CHUNK {
+		return "", errors.New("age payload is too large")
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+	share := ephemeral.PublicKey().Bytes()
+	wrapKey, err := hkdf.Key(sha256.New, shared, append(append([]byte{}, share...), recipient.Bytes()...), AGE_X25519, 32)
+	if err != nil {
+		return "", err
+	}
+	raw := base64.RawStdEncoding
+	header := AGE_VERSION + "\n-> X25519 " + raw.EncodeToString(share) + "\n" +
+		raw.EncodeToString(chachaSeal(wrapKey, make([]byte, 12), fileKey)) + "\n---"
+	macKey, err := hkdf.Key(sha256.New, fileKey, nil, "header", 32)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(header))
+	header += " " + raw.EncodeToString(mac.Sum(nil)) + "\n"
+
+	payloadKey, err := hkdf.Key(sha256.New, fileKey, nonce, "payload", 32)
+	if err != nil {
+		return "", err
+	}
+	chunkNonce := make([]byte, 12)
+	chunkNonce[11] = 1
+	file := append([]byte(header), nonce...)
+	file = append(file, chachaSeal(payloadKey, chunkNonce, plaintext)...)
+
+	armored := base64.StdEncoding.EncodeToString(file)
+	var out strings.Builder
+	out.WriteString(AGE_BEGIN + "\n")
+	for len(armored) > 64 {
+		out.WriteString(armored[:64] + "\n")
+		armored = armored[64:]
+	}
+	out.WriteString(armored + "\n" + AGE_END + "\n")
+	return out.String(), nil
+}
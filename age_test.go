@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+)
+
+func seq(from, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(from + i)
+	}
+	return b
+}
+
+func TestChaChaSeal(t *testing.T) {
+	want := "89fa0a032d12a347bf8a35f89410006cd961a0f44561bbaefe8e35de69ddb823cca10ed0c23b97bf1f1b5cf349b9a10c4eb59b47c91d8eac2a81e33cac72a0e93939fe8ea1516aae8c5f07f7543192be8a8f15613b3fa669560eaa5584205ce02dbf0e9093bc4193d93299dccefcd9ef991e244bfd28368f37144ea40542c13921e7413e2db659ebc19af5f1a0b1e5b524e015e19ffa5ac9aa783daa38863ea69f18234b19e1324126d7ccbbcb1c41af6ee514f9a3eecca260a6542adb8b2aaf19869d4ca738c9d801a2a950a2c2f8af5ebfa84a8b4d66ea"
+	if got := hex.EncodeToString(chachaSeal(seq(0, 32), seq(0, 12), seq(0, 200))); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+// The expected file was produced by an independent implementation of the
+// age v1 spec. The identity is
+// AGE-SECRET-KEY-1QYPQXPQ9QCRSSZG2PVXQ6RS0ZQG3YYC5Z5TPWXQERGD3C8G7RUSQGPQYEE.
+func TestSealAgeVector(t *testing.T) {
+	recipient, err := ParseAgeRecipient("age1q73he0q5yzfu3d64msd3p6rvksnrwjk3d2598mgtmlqt9wrdr37q2vrn72")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, _ := ecdh.X25519().NewPrivateKey(seq(1, 32))
+	if !bytes.Equal(recipient.Bytes(), identity.PublicKey().Bytes()) {
+		t.Fatal("recipient does not match the identity")
+	}
+	ephemeral, _ := ecdh.X25519().NewPrivateKey(seq(101, 32))
+	got, err := sealAge(recipient, []byte("content key 0123456789abcdef"), ephemeral, seq(201, 16), seq(17, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `-----BEGIN AGE ENCRYPTED FILE-----
+YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBWeFIyblJGcjkyUTJyblM4
+ZVQwc01LMFpBOFdheFNjNEJjZmlhWXRCRERZCk5OWEs4eGt4aHI1YXh0MTdaaUdl
+YndUQkMzYWl0b1RQaGI0RVpvK1RTbkkKLS0tIFJnOTgzMm9zdlZWYnhMOVJOK3Fo
+MFhDTE1xK1JRYkJJbnB1NnVJNDhLWlEKERITFBUWFxgZGhscHR4fILbLs1BBI/mf
+nqfd4b9deid7+JE1x/0T8SDWm1ZI3qzgLtTGJ9BuU/twnPNj
+-----END AGE ENCRYPTED FILE-----
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseAgeRecipientRejects(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"age1q73he0q5yzfu3d64msd3p6rvksnrwjk3d2598mgtmlqt9wrdr37q2vrn73",
+		"AGE1Q73HE0Q5YZFU3D64MSD3P6RVKSNRWJK3D2598MGTMLQT9WRDR37Q2VRN72",
+		"age1qqqsyqcyq5rqwzqfpg9scrgwpunevqvv",
+		"agx1qypqxpq9qcrsszg2pvxq6rs0zqg3yyc5z5tpwxqergd3c8g7rusq37xvsa",
+		"8bIVU2Hj7nPjhgJDrtIO0+0yuvjDrIoNBm5pFS6jgmM=",
+	} {
+		if _, err := ParseAgeRecipient(s); err == nil {
+			t.Errorf("accepted %q", s)
+		}
+	}
+}
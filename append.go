@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+)
+
+var (
+	ErrAppendClaimed  = errors.New("transfer was already claimed by a receiver")
+	ErrTooManyAppends = errors.New("too many appended files")
+)
+
+type AppendedFile struct {
+	Name string
+	Size int64
+	path string
+}
+
+func (t *Transfer) spool(name string, src io.Reader, limit int64) (AppendedFile, error) {
+	t.Lock()
+	dir := t.appendDir
+	t.Unlock()
+	if dir == "" {
+		d, err := NewTempDir("append")
+		if err != nil {
+			return AppendedFile{}, err
+		}
+		t.Lock()
+		if t.appendDir == "" {
+			t.appendDir = d
+		} else {
+			os.Remove(d)
+		}
+		dir = t.appendDir
+		t.Unlock()
+	}
+	fd, err := ioutil.TempFile(dir, "part-")
+	if err != nil {
+		return AppendedFile{}, err
+	}
+	if limit >= 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+	n, err := io.Copy(fd, src)
+	fd.Close()
+	if err == nil && limit >= 0 && n > limit {
+		err = ErrTooLarge
+	}
+	if err != nil {
+		WipeFile(fd.Name())
+		return AppendedFile{}, err
+	}
+	return AppendedFile{name, n, fd.Name()}, nil
+}
+
+func (t *Transfer) appendLimits() (int, int64) {
+	t.Lock()
+	defer t.Unlock()
+	size := int64(0)
+	for _, f := range t.appended {
+		size += f.Size
+	}
+	limit := int64(-1)
+	if conf.AppendMaxMB > 0 {
+		limit = int64(conf.AppendMaxMB)*1024*1024 - size
+	}
+	return conf.AppendMaxFiles - len(t.appended), limit
+}
+
+func (t *Transfer) Appended() []AppendedFile {
+	t.Lock()
+	defer t.Unlock()
+	return append([]AppendedFile{}, t.appended...)
+}
+
+func (t *Transfer) RemoveAppended(id, reason string) {
+	t.Lock()
+	dir := t.appendDir
+	t.appendDir = ""
+	t.appended = nil
+	t.Unlock()
+	BurnSpool(id, reason, dir)
+}
+
+func AppendHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !CheckUploader(w, r) {
+		return
+	}
+	if !CheckSecret(id, r.Header.Get("X-Sender-Secret")) {
+		RequestLog(r).Info("Rejected append to %s: wrong sender secret", id)
+		Error(w, r, "wrong sender secret", http.StatusForbidden)
+		return
+	}
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+	if transfer.CurrentStatus() != WAITING_RECEIVER {
+		Error(w, r, ErrAppendClaimed.Error(), http.StatusConflict)
+		return
+	}
+	mediatype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/form-data" || params["boundary"] == "" {
+		Error(w, r, "multipart body required", http.StatusBadRequest)
+		return
+	}
+	checksum, err := CheckBody(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		Error(w, r, "multipart body required", http.StatusBadRequest)
+		return
+	}
+
+	files := []AppendedFile{}
+	remove := func() {
+		for _, f := range files {
+			WipeFile(f.path)
+		}
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			remove()
+			Error(w, r, "upload failed", http.StatusBadRequest)
+			return
+		}
+		dir, isFile := FileField(p.FormName())
+		if !isFile {
+			RequestLog(r).Info("Ignoring form field %q in append to %s", p.FormName(), id)
+			p.Close()
+			continue
+		}
+		left, limit := transfer.appendLimits()
+		if left <= len(files) {
+			p.Close()
+			remove()
+			Error(w, r, ErrTooManyAppends.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		for _, f := range files {
+			if limit >= 0 {
+				limit -= f.Size
+			}
+		}
+		name := FieldPath(dir, PartPath(p))
+		part, err := CheckPart(p, p.Header)
+		if err != nil {
+			p.Close()
+			remove()
+			Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		src, err := CheckFilePolicy(name, part)
+		if err != nil {
+			p.Close()
+			remove()
+			RequestLog(r).Info("Rejected append to %s: %s", id, err)
+			WriteError(w, r, err)
+			return
+		}
+		f, err := transfer.spool(name, src, limit)
+		if err == nil {
+			files = append(files, f)
+			err = part.Finish()
+		}
+		p.Close()
+		if err != nil {
+			remove()
+			RequestLog(r).Info("Rejected append to %s: %s", id, err)
+			WriteError(w, r, err)
+			return
+		}
+	}
+	if err := checksum.Finish(); err != nil {
+		remove()
+		RequestLog(r).Info("Rejected append to %s: %s", id, err)
+		WriteError(w, r, err)
+		return
+	}
+	if len(files) == 0 {
+		Error(w, r, "no files in request", http.StatusBadRequest)
+		return
+	}
+
+	transfer.Lock()
+	if transfer.Status != WAITING_RECEIVER {
+		transfer.Unlock()
+		remove()
+		Error(w, r, ErrAppendClaimed.Error(), http.StatusConflict)
+		return
+	}
+	if len(transfer.appended)+len(files) > conf.AppendMaxFiles {
+		transfer.Unlock()
+		remove()
+		Error(w, r, ErrTooManyAppends.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	transfer.appended = append(transfer.appended, files...)
+	total := len(transfer.appended)
+	transfer.Unlock()
+
+	size := int64(0)
+	names := []string{}
+	for _, f := range files {
+		size += f.Size
+		names = append(names, f.Name)
+	}
+	transfer.timeline.Record("appended", size, "")
+	RequestLog(r).Info("Appended %d files to %s", len(files), id)
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(struct {
+		Files    []string
+		Appended int
+	}{names, total})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ArchiveCacheConfig struct {
+	MaxMB int
+}
+
+type cachedArchive struct {
+	path   string
+	size   int64
+	used   time.Time
+	pinned bool
+}
+
+type ArchiveCache struct {
+	sync.Mutex
+	entries   map[string]*cachedArchive
+	total     int64
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type ArchiveCacheReport struct {
+	Entries   int
+	Bytes     int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+var archives = &ArchiveCache{entries: map[string]*cachedArchive{}}
+
+func (c *ArchiveCache) Open(key string) (*os.File, int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, 0, false
+	}
+	fd, err := os.Open(e.path)
+	if err != nil {
+		c.remove(key)
+		c.misses++
+		return nil, 0, false
+	}
+	e.used = clock.Now()
+	c.hits++
+	return fd, e.size, true
+}
+
+func (c *ArchiveCache) Add(key, path string, size int64) {
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.entries[key]; ok && old.path != path {
+		c.remove(key)
+	}
+	c.entries[key] = &cachedArchive{path, size, clock.Now(), false}
+	c.total += size
+	c.evict(key)
+}
+
+func (c *ArchiveCache) Pin(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.pinned = true
+	}
+}
+
+func (c *ArchiveCache) Drop(id string) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, id+".") {
+			c.remove(key)
+		}
+	}
+}
+
+func (c *ArchiveCache) Report() ArchiveCacheReport {
+	c.Lock()
+	defer c.Unlock()
+	return ArchiveCacheReport{len(c.entries), c.total, c.hits, c.misses, c.evictions}
+}
+
+func (c *ArchiveCache) remove(key string) {
+	e := c.entries[key]
+	os.Remove(e.path)
+	c.total -= e.size
+	delete(c.entries, key)
+}
+
+func (c *ArchiveCache) evict(keep string) {
+	max := int64(conf.ArchiveCache.MaxMB) * 1024 * 1024
+	for c.total > max {
+		victim := ""
+		var oldest time.Time
+		for key, e := range c.entries {
+			if key == keep || e.pinned {
+				continue
+			}
+			if victim == "" || e.used.Before(oldest) {
+				victim, oldest = key, e.used
+			}
+		}
+		if victim == "" {
+			return
+		}
+		c.remove(victim)
+		c.evictions++
+	}
+}
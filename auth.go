@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+type AuthError struct {
+	Status    int
+	Challenge string
+}
+
+func (e *AuthError) Error() string {
+	return strings.ToLower(http.StatusText(e.Status))
+}
+
+var ErrAuthUnavailable = errors.New("authentication unavailable")
+
+// LoginRequired sends browsers to an interactive login instead of
+// answering 401.
+type LoginRequired struct {
+	URL string
+}
+
+func (e *LoginRequired) Error() string {
+	return "login required"
+}
+
+type OIDCConfig struct {
+	Issuer   string
+	Audience string
+}
+
+type principalKey struct{}
+
+func Principal(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey{}).(string)
+	return p
+}
+
+func Authenticate(a Authenticator) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := a.Authenticate(r)
+			if err != nil {
+				WriteAuthError(w, r, err)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+func WriteAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	var lr *LoginRequired
+	if errors.As(err, &lr) {
+		if r.Method == "GET" && WantsHTML(r) {
+			http.Redirect(w, r, lr.URL, http.StatusFound)
+			return
+		}
+		Error(w, r, strings.ToLower(http.StatusText(http.StatusUnauthorized)), http.StatusUnauthorized)
+		return
+	}
+	var ae *AuthError
+	if errors.As(err, &ae) {
+		if ae.Challenge != "" {
+			w.Header().Set("WWW-Authenticate", ae.Challenge)
+		}
+		Error(w, r, ae.Error(), ae.Status)
+		return
+	}
+	RequestLog(r).Error("Authenticate: %s", err)
+	Error(w, r, ErrAuthUnavailable.Error(), http.StatusBadGateway)
+}
+
+func NewAuthenticator(kind, scope string) (Authenticator, error) {
+	switch kind {
+	case "none":
+		return NoAuth{}, nil
+	case "", "tokens":
+		return TokenAuth{conf.AuthTokens, scope}, nil
+	case "basicfile":
+		if conf.BasicAuthFile == "" {
+			return nil, errors.New("basicfile needs BasicAuthFile")
+		}
+		return &BasicFileAuth{Path: conf.BasicAuthFile}, nil
+	case "oidc":
+		if conf.OIDC.Issuer == "" || conf.OIDC.Audience == "" {
+			return nil, errors.New("oidc needs OIDC.Issuer and OIDC.Audience")
+		}
+		return &OIDCAuth{Issuer: conf.OIDC.Issuer, Audience: conf.OIDC.Audience}, nil
+	case "saml":
+		if !conf.SAML.Enabled {
+			return nil, errors.New("saml needs SAML.Enabled")
+		}
+		return SAMLAuth{scope}, nil
+	case "forward":
+		if conf.ExternalAuthURL == "" {
+			return nil, errors.New("forward needs ExternalAuthURL")
+		}
+		return ForwardAuth{conf.ExternalAuthURL}, nil
+	}
+	return nil, fmt.Errorf("unknown authenticator %q", kind)
+}
+
+type NoAuth struct{}
+
+func (NoAuth) Authenticate(r *http.Request) (string, error) {
+	return "", nil
+}
+
+type TokenAuth struct {
+	Tokens []string
+	Scope  string
+}
+
+func (a TokenAuth) Authenticate(r *http.Request) (string, error) {
+	token := BearerToken(r)
+	for i, t := range a.Tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return fmt.Sprintf("token-%d", i), nil
+		}
+	}
+	if t, ok := LookupToken(token); ok && t.Valid() {
+		if !t.Allows(a.Scope) {
+			return "", &AuthError{http.StatusForbidden, `Bearer error="insufficient_scope"`}
+		}
+		return "token:" + t.ID, nil
+	}
+	return "", &AuthError{http.StatusUnauthorized, "Bearer"}
+}
+
+type BasicFileAuth struct {
+	Path    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+func (a *BasicFileAuth) load() (map[string]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	if a.users != nil && info.ModTime().Equal(a.modTime) {
+		return a.users, nil
+	}
+	fd, err := os.Open(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	users := map[string]string{}
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		if strings.HasPrefix(line[i+1:], "{SHA}") {
+			logger.Warn("Ignoring the unsalted SHA-1 password of %s in %s, rehash it with htpasswd -B", line[:i], a.Path)
+			continue
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	a.users, a.modTime = users, info.ModTime()
+	return users, nil
+}
+
+func checkPassword(hash, password string) bool {
+	var sum string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return checkBcrypt(hash, password)
+	case strings.HasPrefix(hash, "{SHA256}"):
+		h := sha256.Sum256([]byte(password))
+		hash, sum = hash[8:], hex.EncodeToString(h[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(sum)) == 1
+}
+
+func (a *BasicFileAuth) Authenticate(r *http.Request) (string, error) {
+	users, err := a.load()
+	if err != nil {
+		return "", err
+	}
+	user, password, ok := r.BasicAuth()
+	if ok {
+		if hash, exists := users[user]; exists && checkPassword(hash, password) {
+			return user, nil
+		}
+	}
+	return "", &AuthError{http.StatusUnauthorized, `Basic realm="nethermes"`}
+}
+
+type ForwardAuth struct {
+	URL string
+}
+
+var externalAuthClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               ProxyFor("auth"),
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (a ForwardAuth) Authenticate(r *http.Request) (string, error) {
+	req, err := http.NewRequest("GET", a.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, h := range []string{"Authorization", "Cookie"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Forwarded-For", ClientIP(r).String())
+	req.Header.Set("X-Request-ID", RequestID(r))
+
+	resp, err := externalAuthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.Header.Get("X-Auth-User"), nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return "", &AuthError{resp.StatusCode, resp.Header.Get("WWW-Authenticate")}
+	}
+	return "", fmt.Errorf("external auth responded %d", resp.StatusCode)
+}
+
+type jwk struct {
+	Kty string
+	Kid string
+	N   string
+	E   string
+	Crv string
+	X   string
+	Y   string
+}
+
+type OIDCAuth struct {
+	Issuer   string
+	Audience string
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+}
+
+func (a *OIDCAuth) fetchKeys() error {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JwksURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(strings.TrimSuffix(a.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return err
+	}
+	if discovery.Issuer != a.Issuer {
+		return fmt.Errorf("discovery document names issuer %q, not %q", discovery.Issuer, a.Issuer)
+	}
+	var set struct {
+		Keys []jwk
+	}
+	if err := getJSON(discovery.JwksURI, &set); err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	a.keys, a.fetched = keys, clock.Now()
+	return nil
+}
+
+func (a *OIDCAuth) key(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if k, ok := a.keys[kid]; ok && clock.Now().Sub(a.fetched) < time.Hour {
+		return k, nil
+	}
+	if clock.Now().Sub(a.fetched) > time.Minute {
+		if err := a.fetchKeys(); err != nil {
+			return nil, err
+		}
+	}
+	if k, ok := a.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := externalAuthClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func b64int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, err := b64int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := b64int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a *OIDCAuth) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string
+		Kid string
+	}
+	var claims struct {
+		Iss string
+		Sub string
+		Aud audience
+		Exp float64
+		Nbf float64
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return "", errors.New("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token signature")
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return "", errors.New("bad token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return "", errors.New("bad token signature")
+		}
+	default:
+		return "", errors.New("unsupported key")
+	}
+
+	raw, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return "", errors.New("malformed token claims")
+	}
+	now := float64(clock.Now().Unix())
+	if claims.Iss != a.Issuer {
+		return "", errors.New("wrong issuer")
+	}
+	if claims.Exp == 0 || now > claims.Exp || (claims.Nbf != 0 && now < claims.Nbf) {
+		return "", errors.New("token expired")
+	}
+	for _, aud := range claims.Aud {
+		if aud == a.Audience {
+			return claims.Sub, nil
+		}
+	}
+	return "", errors.New("wrong audience")
+}
+
+func (a *OIDCAuth) Authenticate(r *http.Request) (string, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return "", &AuthError{http.StatusUnauthorized, "Bearer"}
+	}
+	sub, err := a.verify(token)
+	if err != nil {
+		RequestLog(r).Info("Rejected OIDC token: %s", err)
+		return "", &AuthError{http.StatusUnauthorized, `Bearer error="invalid_token"`}
+	}
+	return sub, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeIssuer struct {
+	sync.Mutex
+	srv     *httptest.Server
+	keys    map[string]*ecdsa.PrivateKey
+	fetches int
+}
+
+func (f *fakeIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{"issuer": f.srv.URL, "jwks_uri": f.srv.URL + "/jwks"})
+	case "/jwks":
+		f.fetches++
+		keys := []jwk{}
+		for kid, k := range f.keys {
+			keys = append(keys, jwk{
+				Kid: kid,
+				Kty: "EC",
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+				Y:   base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	if key == nil {
+		return input + "."
+	}
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	sim := simulate(t)
+	k1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f := &fakeIssuer{keys: map[string]*ecdsa.PrivateKey{"k1": k1}}
+	f.srv = httptest.NewServer(f)
+	defer f.srv.Close()
+	a := &OIDCAuth{Issuer: f.srv.URL, Audience: "nethermes"}
+
+	now := sim.Now().Unix()
+	claims := func(iss, aud string, exp int64) map[string]interface{} {
+		return map[string]interface{}{"iss": iss, "sub": "alice", "aud": aud, "exp": exp}
+	}
+	es256 := map[string]interface{}{"alg": "ES256", "kid": "k1"}
+	valid := claims(f.srv.URL, "nethermes", now+3600)
+
+	if sub, err := a.verify(signJWT(t, k1, es256, valid)); err != nil || sub != "alice" {
+		t.Fatalf("valid token: %q, %v", sub, err)
+	}
+	for name, token := range map[string]string{
+		"alg none":       signJWT(t, nil, map[string]interface{}{"alg": "none", "kid": "k1"}, valid),
+		"alg mismatch":   signJWT(t, k1, map[string]interface{}{"alg": "RS256", "kid": "k1"}, valid),
+		"wrong audience": signJWT(t, k1, es256, claims(f.srv.URL, "other", now+60)),
+		"wrong issuer":   signJWT(t, k1, es256, claims("https://evil.example", "nethermes", now+60)),
+		"expired":        signJWT(t, k1, es256, claims(f.srv.URL, "nethermes", now-1)),
+		"no expiry":      signJWT(t, k1, es256, claims(f.srv.URL, "nethermes", 0)),
+	} {
+		if sub, err := a.verify(token); err == nil {
+			t.Errorf("%s: accepted as %q", name, sub)
+		}
+	}
+
+	k2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.Lock()
+	f.keys = map[string]*ecdsa.PrivateKey{"k2": k2}
+	f.Unlock()
+	rotated := signJWT(t, k2, map[string]interface{}{"alg": "ES256", "kid": "k2"}, valid)
+	if _, err := a.verify(rotated); err == nil {
+		t.Error("refetched the key set within a minute of the last fetch")
+	}
+	sim.Advance(2 * time.Minute)
+	if sub, err := a.verify(rotated); err != nil || sub != "alice" {
+		t.Fatalf("token signed with the rotated key: %q, %v", sub, err)
+	}
+	if _, err := a.verify(signJWT(t, k1, es256, valid)); err == nil {
+		t.Error("accepted a token signed with the retired key")
+	}
+	if f.fetches != 2 {
+		t.Errorf("fetched the key set %d times, want 2", f.fetches)
+	}
+
+	slash := &OIDCAuth{Issuer: f.srv.URL + "/", Audience: "nethermes"}
+	if _, err := slash.verify(rotated); err == nil {
+		t.Error("accepted a token from an issuer that differs by a trailing slash")
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	for _, c := range []struct {
+		hash, password string
+		ok             bool
+	}{
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U", true},
+		{"$2b$04$abcdefghijklmnopqrstuubyCG3zY1GIXMyxfivm.ClDiInHzxjiq", "", true},
+		{"$2y$06$nethermesnethermesnetedkhCB9I8S6mso1qLFefUx2LtJdHrjfi", "correct horse battery staple", true},
+		{"$2y$06$nethermesnethermesnetedkhCB9I8S6mso1qLFefUx2LtJdHrjfi", "correct horse battery stapler", false},
+		{"$2y$04$0123456789ABCDEFGHIJKuLYxWbTZrA9pRJwWQhpUTe0V4dxPp6gW", strings.Repeat("x", 80), true},
+		{"$2y$04$0123456789ABCDEFGHIJKu.ah4GHrPvgflmq1NRizY/UWwQoXamBq", "été", true},
+		{"$2x$04$0123456789ABCDEFGHIJKu.ah4GHrPvgflmq1NRizY/UWwQoXamBq", "été", false},
+		{"{SHA256}5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", "password", true},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", false},
+	} {
+		if checkPassword(c.hash, c.password) != c.ok {
+			t.Errorf("checkPassword(%q, %q) = %v", c.hash, c.password, !c.ok)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"strconv"
+	"sync"
+)
+
+const (
+	BCRYPT_ALPHABET = "./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	BCRYPT_MAGIC    = "OrpheanBeholderScryDoubt"
+)
+
+var (
+	bcryptEncoding = base64.NewEncoding(BCRYPT_ALPHABET).WithPadding(base64.NoPadding)
+	blowfishPiOnce sync.Once
+	blowfishPi     blowfish
+)
+
+type blowfish struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+// arctanInv returns atan(1/x) scaled by 2^bits.
+func arctanInv(x int64, bits uint) *big.Int {
+	term := new(big.Int).Lsh(big.NewInt(1), bits)
+	term.Quo(term, big.NewInt(x))
+	sum := new(big.Int).Set(term)
+	x2 := big.NewInt(x * x)
+	t := new(big.Int)
+	for k := int64(1); term.Sign() != 0; k++ {
+		term.Quo(term, x2)
+		t.Quo(term, big.NewInt(2*k+1))
+		if k%2 == 1 {
+			sum.Sub(sum, t)
+		} else {
+			sum.Add(sum, t)
+		}
+	}
+	return sum
+}
+
+// initBlowfishPi fills the initial Blowfish state, which is the
+// fractional part of pi, from Machin's formula instead of a table.
+func initBlowfishPi() {
+	words := len(blowfishPi.p) + 4*256
+	bits := uint(32*words + 64)
+	pi := new(big.Int).Mul(arctanInv(5, bits), big.NewInt(16))
+	pi.Sub(pi, new(big.Int).Mul(arctanInv(239, bits), big.NewInt(4)))
+	pi.Sub(pi, new(big.Int).Lsh(big.NewInt(3), bits))
+	frac := pi.Rsh(pi, 64).FillBytes(make([]byte, 4*words))
+	for i := range blowfishPi.p {
+		blowfishPi.p[i] = binary.BigEndian.Uint32(frac[4*i:])
+	}
+	frac = frac[4*len(blowfishPi.p):]
+	for i := range blowfishPi.s {
+		for j := range blowfishPi.s[i] {
+			blowfishPi.s[i][j] = binary.BigEndian.Uint32(frac[4*(256*i+j):])
+		}
+	}
+}
+
+func (b *blowfish) f(x uint32) uint32 {
+	return ((b.s[0][x>>24] + b.s[1][x>>16&0xff]) ^ b.s[2][x>>8&0xff]) + b.s[3][x&0xff]
+}
+
+func (b *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= b.p[0]
+	for i := 1; i < 16; i += 2 {
+		r ^= b.f(l) ^ b.p[i]
+		l ^= b.f(r) ^ b.p[i+1]
+	}
+	r ^= b.p[17]
+	return r, l
+}
+
+func cyclicWord(b []byte, j *int) uint32 {
+	var w uint32
+	for k := 0; k < 4; k++ {
+		w = w<<8 | uint32(b[*j])
+		*j = (*j + 1) % len(b)
+	}
+	return w
+}
+
+// expandKey is the Blowfish key schedule, mixing in salt as in eksblowfish
+// when it is not nil.
+func (b *blowfish) expandKey(key, salt []byte) {
+	j := 0
+	for i := range b.p {
+		b.p[i] ^= cyclicWord(key, &j)
+	}
+	j = 0
+	var l, r uint32
+	next := func() (uint32, uint32) {
+		if salt != nil {
+			l ^= cyclicWord(salt, &j)
+			r ^= cyclicWord(salt, &j)
+		}
+		l, r = b.encrypt(l, r)
+		return l, r
+	}
+	for i := 0; i < len(b.p); i += 2 {
+		b.p[i], b.p[i+1] = next()
+	}
+	for i := range b.s {
+		for k := 0; k < 256; k += 2 {
+			b.s[i][k], b.s[i][k+1] = next()
+		}
+	}
+}
+
+// bcryptSum returns the 31 character bcrypt hash of password.
+func bcryptSum(password, salt []byte, cost uint) string {
+	blowfishPiOnce.Do(initBlowfishPi)
+	key := append(append([]byte{}, password...), 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+	b := blowfishPi
+	b.expandKey(key, salt)
+	for i := 0; i < 1<<cost; i++ {
+		b.expandKey(key, nil)
+		b.expandKey(salt, nil)
+	}
+	data := []byte(BCRYPT_MAGIC)
+	for i := 0; i < len(data); i += 8 {
+		l, r := binary.BigEndian.Uint32(data[i:]), binary.BigEndian.Uint32(data[i+4:])
+		for k := 0; k < 64; k++ {
+			l, r = b.encrypt(l, r)
+		}
+		binary.BigEndian.PutUint32(data[i:], l)
+		binary.BigEndian.PutUint32(data[i+4:], r)
+	}
+	return bcryptEncoding.EncodeToString(data[:23])
+}
+
+// checkBcrypt verifies password against a "$2a$", "$2b$" or "$2y$" hash,
+// as written by "htpasswd -B".
+func checkBcrypt(hash, password string) bool {
+	if len(hash) != 60 || hash[0] != '$' || hash[1] != '2' || hash[3] != '$' || hash[6] != '$' {
+		return false
+	}
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return false
+	}
+	cost, err := strconv.Atoi(hash[4:6])
+	if err != nil || cost < 4 || cost > 31 {
+		return false
+	}
+	salt, err := bcryptEncoding.DecodeString(hash[7:29])
+	if err != nil {
+		return false
+	}
+	sum := bcryptSum([]byte(password), salt, uint(cost))
+	return subtle.ConstantTimeCompare([]byte(hash[29:]), []byte(sum)) == 1
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const CANCEL_COOKIE = "nethermes-cancel"
+
+var ErrCancelled = errors.New("transfer was cancelled")
+
+type CancelNotice struct {
+	Key string
+	By  string
+}
+
+type cancelReader struct {
+	R         io.Reader
+	cancelled <-chan struct{}
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-c.cancelled:
+		return 0, ErrCancelled
+	default:
+	}
+	return c.R.Read(p)
+}
+
+func (t *Transfer) Cancel(by string) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.Hold != nil {
+		return ErrOnHold
+	}
+	if err := t.Status.Set(ABORTED); err != nil {
+		return err
+	}
+	t.cancelledBy = by
+	close(t.cancelled)
+	return nil
+}
+
+func (t *Transfer) CancelledBy() string {
+	t.Lock()
+	defer t.Unlock()
+	return t.cancelledBy
+}
+
+func IssueCancelToken(w http.ResponseWriter, id string, transfer *Transfer) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	transfer.Lock()
+	transfer.cancelToken = token
+	transfer.Unlock()
+	w.Header().Set("X-Cancel-Token", token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CANCEL_COOKIE,
+		Value:    token,
+		Path:     "/cancel/" + id,
+		MaxAge:   60 * conf.MaxTransferMinutes,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (t *Transfer) receiverToken(r *http.Request) bool {
+	token := r.Header.Get("X-Cancel-Token")
+	if c, err := r.Cookie(CANCEL_COOKIE); token == "" && err == nil {
+		token = c.Value
+	}
+	t.Lock()
+	defer t.Unlock()
+	return token != "" && t.cancelToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(t.cancelToken)) == 1
+}
+
+func CancelHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+	secret := SenderSecret(r, id)
+	if secret == "" {
+		secret = r.PostFormValue("secret")
+	}
+	by := ""
+	switch {
+	case CheckSecret(id, secret):
+		by = "sender"
+	case transfer.receiverToken(r):
+		by = "receiver"
+	default:
+		RequestLog(r).Info("Rejected cancellation of %s: not sender or receiver", id)
+		Error(w, r, "only the sender or the connected receiver can cancel", http.StatusForbidden)
+		return
+	}
+
+	if err := transfer.Cancel(by); err != nil {
+		if errors.Is(err, ErrOnHold) {
+			WriteError(w, r, err)
+			return
+		}
+		Error(w, r, "transfer is already "+strings.ToLower(transfer.CurrentStatus().String()), http.StatusConflict)
+		return
+	}
+	transfer.timeline.Record("cancelled", 0, by)
+	RequestLog(r).Info("Transfer %s cancelled by the %s", id, by)
+	if WantsHTML(r) && by == "sender" {
+		http.Redirect(w, r, "/progress/"+id, http.StatusSeeOther)
+		return
+	}
+	if WantsHTML(r) {
+		http.Redirect(w, r, "/receive?code="+id, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
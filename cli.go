@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/henkman/nethermes/client"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	EXIT_OK        = 0
+	EXIT_FAILURE   = 1
+	EXIT_EXPIRED   = 2
+	EXIT_AUTH      = 3
+	EXIT_TOO_LARGE = 4
+	EXIT_NETWORK   = 5
+)
+
+type CLIResult struct {
+	Event     string
+	Key       string     `json:",omitempty"`
+	URL       string     `json:",omitempty"`
+	Files     []string   `json:",omitempty"`
+	Status    string     `json:",omitempty"`
+	Expires   *time.Time `json:",omitempty"`
+	Error     string     `json:",omitempty"`
+	Reason    string     `json:",omitempty"`
+	RequestID string     `json:",omitempty"`
+	ExitCode  int
+}
+
+func ExitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+	if errors.Is(err, client.ErrPassphrase) {
+		return EXIT_AUTH
+	}
+	if errors.Is(err, client.ErrTooLarge) {
+		return EXIT_TOO_LARGE
+	}
+	var se *client.StatusError
+	if errors.As(err, &se) {
+		switch {
+		case errors.Is(err, client.ErrExpired), errors.Is(err, client.ErrTransferNotFound):
+			return EXIT_EXPIRED
+		case errors.Is(err, client.ErrTooLarge), se.Code == http.StatusRequestEntityTooLarge:
+			return EXIT_TOO_LARGE
+		case errors.Is(err, client.ErrForbidden), se.Code == http.StatusUnauthorized, se.Code == http.StatusForbidden:
+			return EXIT_AUTH
+		case errors.Is(err, client.ErrCorrupted), se.Code == http.StatusBadGateway, se.Code == http.StatusGatewayTimeout:
+			return EXIT_NETWORK
+		}
+		return EXIT_FAILURE
+	}
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, client.ErrIncomplete) {
+		return EXIT_NETWORK
+	}
+	return EXIT_FAILURE
+}
+
+type cli struct {
+	json bool
+	out  io.Writer
+}
+
+func (c *cli) emit(res CLIResult, text string) {
+	if c.json {
+		json.NewEncoder(c.out).Encode(res)
+		return
+	}
+	if text != "" {
+		fmt.Fprintln(c.out, text)
+	}
+}
+
+func (c *cli) fail(err error) int {
+	res := CLIResult{Event: "error", Error: err.Error(), ExitCode: ExitCode(err)}
+	var se *client.StatusError
+	if errors.As(err, &se) {
+		res.Reason = se.Reason
+		res.RequestID = se.RequestID
+	}
+	if c.json {
+		c.emit(res, "")
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+	return res.ExitCode
+}
+
+func cliFlags(name string) (*flag.FlagSet, *string, *bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	server := os.Getenv("NETHERMES_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	url := fs.String("server", server, "server URL, defaults to $NETHERMES_SERVER")
+	asJSON := fs.Bool("json", false, "print one JSON object per line")
+	return fs, url, asJSON
+}
+
+func cliClient() (client.Client, error) {
+	c := *client.DefaultClient
+	for _, s := range strings.Split(os.Getenv("NETHERMES_SERVER_KEY"), ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		key, err := client.ParseServerKey(s)
+		if err != nil {
+			return c, err
+		}
+		c.ServerKeys = append(c.ServerKeys, key)
+	}
+	return c, nil
+}
+
+func RunSend(args []string) int {
+	fs, server, asJSON := cliFlags("send")
+	checksums := fs.Bool("checksum", false, "send a SHA-256 of every file so the server detects corruption in transit")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_FAILURE
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: nethermes send [-server URL] [-checksum] [-json] FILE...")
+		return EXIT_FAILURE
+	}
+	c := &cli{*asJSON, os.Stdout}
+	base := strings.TrimRight(*server, "/")
+	sender, err := cliClient()
+	if err != nil {
+		return c.fail(err)
+	}
+	sender.Passphrase = os.Getenv("NETHERMES_PASSPHRASE")
+	sender.Checksums = *checksums
+	sender.OnKey = func(key string) {
+		url := base + "/download/" + key
+		c.emit(CLIResult{Event: "key", Key: key, URL: url}, fmt.Sprintf("Key: %s\nDownload: %s", key, url))
+	}
+	key, err := sender.Send(context.Background(), base, fs.Args()...)
+	if err != nil {
+		return c.fail(err)
+	}
+	c.emit(CLIResult{Event: "sent", Key: key, Files: fs.Args()}, "Sent")
+	return EXIT_OK
+}
+
+func RunReceive(args []string) int {
+	fs, server, asJSON := cliFlags("receive")
+	dir := fs.String("dir", ".", "directory to extract the files to")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_FAILURE
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: nethermes receive [-server URL] [-dir DIR] [-json] KEY")
+		return EXIT_FAILURE
+	}
+	c := &cli{*asJSON, os.Stdout}
+	key := NormalizeCode(fs.Arg(0))
+	receiver, err := cliClient()
+	if err != nil {
+		return c.fail(err)
+	}
+	receiver.Passphrase = os.Getenv("NETHERMES_PASSPHRASE")
+	files, err := receiver.Receive(context.Background(), *server, key, *dir)
+	if err != nil {
+		if len(files) == 1 && strings.HasSuffix(files[0], client.ENCRYPTED_SUFFIX) {
+			fmt.Fprintf(os.Stderr, "Kept encrypted download %s\n", files[0])
+		}
+		return c.fail(err)
+	}
+	text := strings.Join(files, "\n")
+	if receiver.Passphrase == "" && len(files) == 1 && strings.HasSuffix(files[0], client.ENCRYPTED_SUFFIX) {
+		text += "\nEncrypted, run: nethermes decrypt " + files[0]
+	}
+	c.emit(CLIResult{Event: "received", Key: key, Files: files}, text)
+	return EXIT_OK
+}
+
+func RunStatus(args []string) int {
+	fs, server, asJSON := cliFlags("status")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_FAILURE
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: nethermes status [-server URL] [-json] KEY")
+		return EXIT_FAILURE
+	}
+	c := &cli{*asJSON, os.Stdout}
+	key := NormalizeCode(fs.Arg(0))
+	checker, err := cliClient()
+	if err != nil {
+		return c.fail(err)
+	}
+	status, expires, err := checker.Status(context.Background(), *server, key)
+	if err != nil {
+		return c.fail(err)
+	}
+	res := CLIResult{Event: "status", Key: key, Status: status}
+	text := status
+	if !expires.IsZero() {
+		res.Expires = &expires
+		text += " until " + expires.Format(time.RFC3339)
+	}
+	c.emit(res, text)
+	if status == "EXPIRED" {
+		return EXIT_EXPIRED
+	}
+	return EXIT_OK
+}
+
+func readPassphrase() (string, error) {
+	if pass := os.Getenv("NETHERMES_PASSPHRASE"); pass != "" {
+		return pass, nil
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		if err == nil {
+			err = errors.New("empty passphrase")
+		}
+		return "", err
+	}
+	return line, nil
+}
+
+func RunDecrypt(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	output := fs.String("out", "", "output file, defaults to FILE without "+client.ENCRYPTED_SUFFIX)
+	asJSON := fs.Bool("json", false, "print one JSON object per line")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_FAILURE
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: nethermes decrypt [-out FILE] [-json] FILE"+client.ENCRYPTED_SUFFIX)
+		return EXIT_FAILURE
+	}
+	c := &cli{*asJSON, os.Stdout}
+	in := fs.Arg(0)
+	out := *output
+	if out == "" {
+		out = strings.TrimSuffix(in, client.ENCRYPTED_SUFFIX)
+		if out == in {
+			out += ".zip"
+		}
+	}
+	pass, err := readPassphrase()
+	if err != nil {
+		return c.fail(err)
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return c.fail(err)
+	}
+	_, err = client.DecryptTo(dst, src, pass)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return c.fail(err)
+	}
+	c.emit(CLIResult{Event: "decrypted", Files: []string{out}}, out)
+	return EXIT_OK
+}
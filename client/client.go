@@ -0,0 +1,598 @@
+// Package client sends and receives nethermes transfers from Go programs.
+//
+// Requests are retried on network errors and 5xx responses. A failed
+// upload is sent again to the same key with the sender secret from /key,
+// which lets the server replace an upload that broke off while waiting. A
+// download that breaks off resumes from the last byte received with
+// ?offset=N and the receiver's X-Cancel-Token; it fails with ErrInterrupted
+// when the server does not offer or refuses resumption.
+package client
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ProgressFunc func(name string, done, total int64)
+
+type Client struct {
+	HTTPClient *http.Client
+	Retries    int
+	RetryDelay time.Duration
+	OnKey      func(key string)
+	Progress   ProgressFunc
+	Passphrase string
+	ServerKeys []ed25519.PublicKey
+	Checksums  bool
+}
+
+var DefaultClient = &Client{
+	HTTPClient: &http.Client{Transport: waitingTransport()},
+	Retries:    3,
+	RetryDelay: time.Second,
+}
+
+func waitingTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ExpectContinueTimeout = time.Hour
+	return t
+}
+
+var (
+	ErrTransferNotFound  = errors.New("transfer does not exist")
+	ErrExpired           = errors.New("transfer has expired")
+	ErrKeySpaceExhausted = errors.New("no unique key found")
+	ErrTooLarge          = errors.New("transfer is too large")
+	ErrGeoBlocked        = errors.New("downloads are not allowed from your country")
+	ErrIncomplete        = errors.New("transfer did not complete")
+	ErrChecksum          = errors.New("archive checksum mismatch")
+	ErrOnHold            = errors.New("transfer is on legal hold")
+	ErrSuspended         = errors.New("transfer is suspended pending review")
+	ErrUploadsBlocked    = errors.New("uploads from your address are blocked")
+	ErrForbidden         = errors.New("receiver not allowed")
+	ErrAborted           = errors.New("transfer aborted")
+	ErrFilePolicy        = errors.New("file type policy violation")
+	ErrCorrupted         = errors.New("upload was corrupted in transit")
+	ErrInterrupted       = errors.New("download interrupted")
+)
+
+var reasons = map[string]error{
+	"transfer-not-found":  ErrTransferNotFound,
+	"expired":             ErrExpired,
+	"key-space-exhausted": ErrKeySpaceExhausted,
+	"too-large":           ErrTooLarge,
+	"geo-blocked":         ErrGeoBlocked,
+	"legal-hold":          ErrOnHold,
+	"suspended":           ErrSuspended,
+	"uploads-blocked":     ErrUploadsBlocked,
+	"receiver-forbidden":  ErrForbidden,
+	"aborted":             ErrAborted,
+	"file-policy":         ErrFilePolicy,
+	"checksum-mismatch":   ErrCorrupted,
+}
+
+type StatusError struct {
+	Code      int
+	Message   string
+	RequestID string
+	Reason    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server responded %d: %s", e.Code, e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	err, ok := reasons[e.Reason]
+	return ok && err == target
+}
+
+type permanentError struct {
+	error
+}
+
+func Send(ctx context.Context, serverURL string, files ...string) (string, error) {
+	return DefaultClient.Send(ctx, serverURL, files...)
+}
+
+func Receive(ctx context.Context, serverURL, key, destDir string) ([]string, error) {
+	return DefaultClient.Receive(ctx, serverURL, key, destDir)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if se, ok := err.(*StatusError); ok {
+		return se.Code >= 500
+	}
+	if _, ok := err.(permanentError); ok {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func (c *Client) retry(ctx context.Context, f func() error) error {
+	delay := c.RetryDelay
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= c.Retries || !transient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, &StatusError{
+			resp.StatusCode,
+			strings.TrimSpace(string(msg)),
+			resp.Header.Get("X-Request-ID"),
+			resp.Header.Get("X-Error-Code"),
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) Key(ctx context.Context, serverURL string) (string, error) {
+	key, _, err := c.key(ctx, serverURL)
+	return key, err
+}
+
+func (c *Client) key(ctx context.Context, serverURL string) (string, string, error) {
+	var key, secret string
+	err := c.retry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", serverURL+"/key", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.doSigned(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		secret = resp.Header.Get("X-Sender-Secret")
+		return json.NewDecoder(resp.Body).Decode(&key)
+	})
+	if pe, ok := err.(permanentError); ok {
+		err = pe.error
+	}
+	return key, secret, err
+}
+
+func (c *Client) Status(ctx context.Context, serverURL, key string) (string, time.Time, error) {
+	var status string
+	var expires time.Time
+	serverURL = strings.TrimRight(serverURL, "/")
+	err := c.retry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", serverURL+"/status/"+key, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.doSigned(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		expires, _ = time.Parse(time.RFC3339, resp.Header.Get("X-Expires"))
+		if left, err := strconv.Atoi(resp.Header.Get("X-Expires-In")); err == nil {
+			expires = time.Now().Add(time.Duration(left) * time.Second).Truncate(time.Second)
+		}
+		return json.NewDecoder(resp.Body).Decode(&status)
+	})
+	if pe, ok := err.(permanentError); ok {
+		err = pe.error
+	}
+	return status, expires, err
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+type progressReader struct {
+	io.Reader
+	name     string
+	done     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.done += int64(n)
+	if r.progress != nil && n > 0 {
+		r.progress(r.name, r.done, r.total)
+	}
+	return n, err
+}
+
+func (c *Client) writeFile(mw *multipart.Writer, file, name string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(name)))
+	h.Set("Content-Type", "application/octet-stream")
+	if c.Checksums {
+		sum := sha256.New()
+		if _, err := io.Copy(sum, fd); err != nil {
+			return err
+		}
+		if _, err := fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h.Set("X-Content-SHA256", hex.EncodeToString(sum.Sum(nil)))
+	}
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, &progressReader{fd, name, 0, info.Size(), c.Progress})
+	return err
+}
+
+func (c *Client) writeTree(mw *multipart.Writer, root string) error {
+	base := filepath.Dir(root)
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		switch {
+		case info.IsDir():
+			return mw.WriteField("dir", name)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			part, err := mw.CreateFormFile("symlink", name)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(part, filepath.ToSlash(target))
+			return err
+		case info.Mode().IsRegular():
+			return c.writeFile(mw, file, name)
+		}
+		return nil
+	})
+}
+
+func (c *Client) writeFiles(mw *multipart.Writer, files []string) error {
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = c.writeTree(mw, filepath.Clean(file))
+		} else {
+			err = c.writeFile(mw, file, filepath.Base(file))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (c *Client) upload(ctx context.Context, serverURL, key, secret string, files []string) error {
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(c.writeFiles(mw, files))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", serverURL+"/upload/"+key, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Expect", "100-continue")
+	if secret != "" {
+		req.Header.Set("X-Sender-Secret", secret)
+	}
+	if c.Passphrase != "" {
+		req.Header.Set("X-Passphrase", c.Passphrase)
+	}
+	resp, err := c.do(req)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) Send(ctx context.Context, serverURL string, files ...string) (string, error) {
+	serverURL = strings.TrimRight(serverURL, "/")
+	limits, err := c.Limits(ctx, serverURL)
+	if errors.Is(err, ErrUnsigned) || errors.Is(err, ErrBadSignature) {
+		return "", err
+	}
+	if err == nil {
+		if err := limits.Check(files); err != nil {
+			return "", err
+		}
+	}
+	key, secret, err := c.key(ctx, serverURL)
+	if err != nil {
+		return "", err
+	}
+	if c.OnKey != nil {
+		c.OnKey(key)
+	}
+
+	err = c.retry(ctx, func() error {
+		return c.upload(ctx, serverURL, key, secret, files)
+	})
+	return key, err
+}
+
+func (c *Client) Receive(ctx context.Context, serverURL, key, destDir string) ([]string, error) {
+	serverURL = strings.TrimRight(serverURL, "/")
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+
+	archive, err := ioutil.TempFile(destDir, ".nethermes-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	h := sha256.New()
+	var token string
+	var received, total int64
+	err = c.retry(ctx, func() error {
+		u := serverURL + "/download/" + key
+		if token != "" {
+			u += "?offset=" + strconv.FormatInt(received, 10)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			req.Header.Set("X-Cancel-Token", token)
+		}
+		resp, err := c.do(req)
+		if token != "" && err != nil && !transient(err) {
+			return permanentError{fmt.Errorf("%w: %s", ErrInterrupted, err)}
+		}
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if token == "" {
+			total = resp.ContentLength
+			if resp.Header.Get("X-Resumable") == "offset" {
+				token = resp.Header.Get("X-Cancel-Token")
+			}
+		} else if resp.Header.Get("X-Resume-Offset") != strconv.FormatInt(received, 10) {
+			return permanentError{fmt.Errorf("%w: server resumed at the wrong offset", ErrInterrupted)}
+		}
+		n, err := io.Copy(io.MultiWriter(archive, h), &progressReader{resp.Body, key + ".zip", received, total, c.Progress})
+		received += n
+		if err != nil && token == "" {
+			return permanentError{fmt.Errorf("%w: %s", ErrInterrupted, err)}
+		}
+		if err != nil {
+			return err
+		}
+		return checkTrailers(resp, h.Sum(nil))
+	})
+	if pe, ok := err.(permanentError); ok {
+		return nil, pe.error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if Encrypted(archive) {
+		return c.decrypt(archive, key, destDir)
+	}
+	size, err := archive.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return extract(archive, size, destDir)
+}
+
+func (c *Client) decrypt(archive *os.File, key, destDir string) ([]string, error) {
+	encPath := filepath.Join(destDir, key+".zip"+ENCRYPTED_SUFFIX)
+	keep := func() error {
+		archive.Close()
+		return os.Rename(archive.Name(), encPath)
+	}
+	if c.Passphrase == "" {
+		if err := keep(); err != nil {
+			return nil, err
+		}
+		return []string{encPath}, nil
+	}
+
+	plain, err := ioutil.TempFile(destDir, ".nethermes-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(plain.Name())
+	defer plain.Close()
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	size, err := DecryptTo(plain, archive, c.Passphrase)
+	if err == ErrPassphrase {
+		if kerr := keep(); kerr != nil {
+			return nil, kerr
+		}
+		return []string{encPath}, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return extract(plain, size, destDir)
+}
+
+func checkTrailers(resp *http.Response, sum []byte) error {
+	status := resp.Trailer.Get("X-Transfer-Status")
+	if status != "" && status != "complete" {
+		return permanentError{fmt.Errorf("%w: %s", ErrIncomplete, status)}
+	}
+	if want := resp.Trailer.Get("X-Content-SHA256"); want != "" && want != hex.EncodeToString(sum) {
+		return permanentError{ErrChecksum}
+	}
+	return nil
+}
+
+func extractSymlink(f *zip.File, root, target string) error {
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	link, err := ioutil.ReadAll(io.LimitReader(in, 4096))
+	in.Close()
+	if err != nil {
+		return err
+	}
+	dest := filepath.FromSlash(string(link))
+	resolved := filepath.Join(filepath.Dir(target), dest)
+	if filepath.IsAbs(dest) || !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return fmt.Errorf("symlink %q points outside the archive", f.Name)
+	}
+	return os.Symlink(dest, target)
+}
+
+// noSymlinks refuses paths below root that pass through a symlink extracted
+// earlier, which would let a chain of links write outside root.
+func noSymlinks(root, target string) error {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return err
+	}
+	p := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive writes through symlink %q", rel)
+		}
+	}
+	return nil
+}
+
+func extract(archive io.ReaderAt, size int64, destDir string) ([]string, error) {
+	zr, err := zip.NewReader(archive, size)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.Abs(destDir)
+	if err != nil {
+		return nil, err
+	}
+	written := []string{}
+	for _, f := range zr.File {
+		target := filepath.Join(root, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return written, fmt.Errorf("invalid file name in archive: %q", f.Name)
+		}
+		if err := noSymlinks(root, target); err != nil {
+			return written, err
+		}
+		if strings.HasSuffix(f.Name, "/") {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return written, err
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			if err := extractSymlink(f, root, target); err != nil {
+				return written, err
+			}
+			written = append(written, target)
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			return written, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			in.Close()
+			return written, err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return written, err
+		}
+		written = append(written, target)
+	}
+	return written, nil
+}
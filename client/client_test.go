@@ -0,0 +1,150 @@
+package client
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestExtractChainedSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name, content string, mode os.FileMode) {
+		h := &zip.FileHeader{Name: name, Method: zip.Store}
+		h.SetMode(mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	add("x/", "", os.ModeDir|0755)
+	add("c/d/e", "../../x", os.ModeSymlink|0777)
+	add("c/d/e/f", "../../../a", os.ModeSymlink|0777)
+	add("c/d/e/f/evil", "pwned", 0644)
+	zw.Close()
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "a", "b")
+	if _, err := extract(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dest); err == nil {
+		t.Error("extracted an archive that writes through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "a", "evil")); err == nil {
+		t.Error("archive escaped the destination directory")
+	}
+}
+
+func TestReceiveInterrupted(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("PK\x03\x04"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+
+	c := &Client{Retries: 3}
+	_, err := c.Receive(context.Background(), srv.URL, "key", t.TempDir())
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("got %v, want ErrInterrupted", err)
+	}
+	if requests != 1 {
+		t.Errorf("retried an interrupted download %d times", requests-1)
+	}
+}
+
+func TestReceiveResumes(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "hello.txt", Method: zip.Store})
+	content := bytes.Repeat([]byte("hello "), 10000)
+	w.Write(content)
+	zw.Close()
+	archive := buf.Bytes()
+	sum := sha256.Sum256(archive)
+	cut := len(archive) / 2
+
+	offsets := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset := r.URL.Query().Get("offset")
+		offsets = append(offsets, offset)
+		w.Header().Set("Trailer", "X-Content-SHA256, X-Transfer-Status")
+		if offset == "" {
+			w.Header().Set("X-Resumable", "offset")
+			w.Header().Set("X-Cancel-Token", "token")
+			w.Write(archive[:cut])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if r.Header.Get("X-Cancel-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		n, _ := strconv.Atoi(offset)
+		w.Header().Set("X-Resume-Offset", offset)
+		w.Write(archive[n:])
+		w.Header().Set("X-Content-SHA256", hex.EncodeToString(sum[:]))
+		w.Header().Set("X-Transfer-Status", "complete")
+	}))
+	defer srv.Close()
+
+	c := &Client{Retries: 3}
+	dir := t.TempDir()
+	files, err := c.Receive(context.Background(), srv.URL, "key", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 2 || offsets[1] != strconv.Itoa(cut) {
+		t.Errorf("requested offsets %q, want resumption at %d", offsets, cut)
+	}
+	got, _ := ioutil.ReadFile(filepath.Join(dir, "hello.txt"))
+	if len(files) != 1 || !bytes.Equal(got, content) {
+		t.Errorf("resumed download extracted %v", files)
+	}
+}
+
+func TestSendRetriesWithSecret(t *testing.T) {
+	secrets := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/key":
+			w.Header().Set("X-Sender-Secret", "secret")
+			w.Write([]byte(`"abc"`))
+		case "/upload/abc":
+			io.Copy(ioutil.Discard, r.Body)
+			secrets = append(secrets, r.Header.Get("X-Sender-Secret"))
+			if len(secrets) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte("ok"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(file, []byte("a"), 0644)
+	c := &Client{Retries: 3}
+	key, err := c.Send(context.Background(), srv.URL, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "abc" || len(secrets) != 2 || secrets[0] != "secret" || secrets[1] != "secret" {
+		t.Errorf("sent %s with secrets %q, want two uploads to abc with the sender secret", key, secrets)
+	}
+}
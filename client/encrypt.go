@@ -0,0 +1,278 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	ENCRYPTED_SUFFIX = ".enc"
+	encryptMagic     = "NHENC1"
+	encryptChunk     = 64 * 1024
+	encryptHeader    = len(encryptMagic) + 3 + 16 + 7
+	scryptR          = 8
+	scryptP          = 1
+	maxScryptLogN    = 22
+)
+
+var (
+	ErrEncrypted    = errors.New("transfer is encrypted, a passphrase is needed")
+	ErrPassphrase   = errors.New("wrong passphrase or damaged file")
+	ErrNotEncrypted = errors.New("not an encrypted nethermes file")
+)
+
+func salsaXOR(tmp *[16]uint32, in, out []uint32) {
+	var w [16]uint32
+	for i := range w {
+		w[i] = tmp[i] ^ in[i]
+	}
+	x := w
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range x {
+		x[i] += w[i]
+		out[i] = x[i]
+		tmp[i] = x[i]
+	}
+}
+
+func blockMix(tmp *[16]uint32, in, out []uint32, r int) {
+	copy(tmp[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i += 2 {
+		salsaXOR(tmp, in[i*16:], out[i*8:])
+		salsaXOR(tmp, in[i*16+16:], out[i*8+r*16:])
+	}
+}
+
+func smix(b []byte, r, n int, v, xy []uint32) {
+	var tmp [16]uint32
+	size := 32 * r
+	x, y := xy[:size], xy[size:]
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	for i := 0; i < n; i += 2 {
+		copy(v[i*size:], x)
+		blockMix(&tmp, x, y, r)
+		copy(v[(i+1)*size:], y)
+		blockMix(&tmp, y, x, r)
+	}
+	for i := 0; i < n; i += 2 {
+		j := int(x[(2*r-1)*16] & uint32(n-1))
+		for k := range x {
+			x[k] ^= v[j*size+k]
+		}
+		blockMix(&tmp, x, y, r)
+		j = int(y[(2*r-1)*16] & uint32(n-1))
+		for k := range y {
+			y[k] ^= v[j*size+k]
+		}
+		blockMix(&tmp, y, x, r)
+	}
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+}
+
+func scrypt(passphrase string, salt []byte, n, r, p, keyLen int) ([]byte, error) {
+	b, err := pbkdf2.Key(sha256.New, passphrase, salt, 1, p*128*r)
+	if err != nil {
+		return nil, err
+	}
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*n*r)
+	for i := 0; i < p; i++ {
+		smix(b[i*128*r:], r, n, v, xy)
+	}
+	return pbkdf2.Key(sha256.New, passphrase, b, 1, keyLen)
+}
+
+func streamCipher(passphrase string, header []byte) (cipher.AEAD, error) {
+	logN := int(header[len(encryptMagic)])
+	r := int(header[len(encryptMagic)+1])
+	p := int(header[len(encryptMagic)+2])
+	if logN < 1 || logN > maxScryptLogN || r < 1 || r > 32 || p < 1 || p > 16 {
+		return nil, ErrNotEncrypted
+	}
+	salt := header[len(encryptMagic)+3 : len(encryptMagic)+19]
+	key, err := scrypt(passphrase, salt, 1<<uint(logN), r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(header []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[encryptHeader-7:])
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint32
+}
+
+func NewEncryptWriter(w io.Writer, passphrase string, logN int) (io.WriteCloser, error) {
+	header := make([]byte, encryptHeader)
+	copy(header, encryptMagic)
+	header[len(encryptMagic)] = byte(logN)
+	header[len(encryptMagic)+1] = scryptR
+	header[len(encryptMagic)+2] = scryptP
+	if _, err := rand.Read(header[len(encryptMagic)+3:]); err != nil {
+		return nil, err
+	}
+	gcm, err := streamCipher(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w, gcm, header, make([]byte, 0, encryptChunk), 0}, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	out := e.gcm.Seal(nil, chunkNonce(e.header, e.counter, last), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(e.buf) == encryptChunk {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):encryptChunk], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	gcm     cipher.AEAD
+	header  []byte
+	counter uint32
+	plain   []byte
+	done    bool
+}
+
+func NewDecryptReader(r io.Reader, passphrase string) (io.Reader, error) {
+	header := make([]byte, encryptHeader)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, []byte(encryptMagic)) {
+		return nil, ErrNotEncrypted
+	}
+	gcm, err := streamCipher(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: bufio.NewReaderSize(r, encryptChunk+64), gcm: gcm, header: header}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, encryptChunk+d.gcm.Overhead())
+		n, err := io.ReadFull(d.r, chunk)
+		last := err == io.ErrUnexpectedEOF || err == io.EOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			if _, err := d.r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		plain, err := d.gcm.Open(nil, chunkNonce(d.header, d.counter, last), chunk[:n], d.header)
+		if err != nil {
+			return 0, ErrPassphrase
+		}
+		d.counter++
+		d.plain = plain
+		d.done = last
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func Encrypted(r io.ReaderAt) bool {
+	magic := make([]byte, len(encryptMagic))
+	_, err := r.ReadAt(magic, 0)
+	return err == nil && string(magic) == encryptMagic
+}
+
+func DecryptTo(w io.Writer, r io.Reader, passphrase string) (int64, error) {
+	dr, err := NewDecryptReader(r, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, dr)
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Limits struct {
+	MaxBytes         int64
+	MaxMessageLength int
+	AllowExtensions  []string
+	DenyExtensions   []string
+	AllowTypes       []string
+	DenyTypes        []string
+	Expiry           struct {
+		TimeoutMinutes     int
+		ExtendMinutes      int
+		MaxTransferMinutes int
+	}
+	Append struct {
+		MaxFiles int
+		MaxBytes int64
+	}
+	Quota *struct {
+		Month              string
+		MonthlyBytes       int64
+		MonthlyTransfers   int
+		UsedBytes          int64
+		UsedTransfers      int
+		RemainingBytes     int64
+		RemainingTransfers int
+	}
+}
+
+func (c *Client) Limits(ctx context.Context, serverURL string) (*Limits, error) {
+	var l Limits
+	serverURL = strings.TrimRight(serverURL, "/")
+	err := c.retry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", serverURL+"/api/v1/limits", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.doSigned(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return json.NewDecoder(resp.Body).Decode(&l)
+	})
+	if pe, ok := err.(permanentError); ok {
+		err = pe.error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func hasExtension(name string, list []string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range list {
+		if strings.HasSuffix(name, "."+strings.ToLower(strings.TrimPrefix(ext, "."))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Limits) Check(files []string) error {
+	var total int64
+	for _, file := range files {
+		err := filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			total += info.Size()
+			name := filepath.Base(path)
+			if hasExtension(name, l.DenyExtensions) || (len(l.AllowExtensions) > 0 && !hasExtension(name, l.AllowExtensions)) {
+				return fmt.Errorf("%s: %w", name, ErrFilePolicy)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if l.MaxBytes > 0 && total > l.MaxBytes {
+		return fmt.Errorf("%d bytes selected, %d allowed: %w", total, l.MaxBytes, ErrTooLarge)
+	}
+	return nil
+}
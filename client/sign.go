@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SIGNATURE_HEADER  = "X-Signature"
+	SIGNATURE_VERSION = "nethermes-v1"
+	SIGNATURE_MAX_AGE = 5 * time.Minute
+)
+
+var (
+	ErrUnsigned     = errors.New("response is not signed")
+	ErrBadSignature = errors.New("response signature does not verify")
+)
+
+func ParseServerKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key %q", s)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func signatureFields(header string) map[string]string {
+	fields := map[string]string{}
+	for _, part := range strings.Split(header, ";") {
+		if i := strings.Index(part, "="); i > 0 {
+			fields[strings.TrimSpace(part[:i])] = strings.TrimSpace(part[i+1:])
+		}
+	}
+	return fields
+}
+
+func (c *Client) verify(req *http.Request, resp *http.Response, body []byte) error {
+	header := resp.Header.Get(SIGNATURE_HEADER)
+	if header == "" {
+		return ErrUnsigned
+	}
+	fields := signatureFields(header)
+	var pub ed25519.PublicKey
+	for _, k := range c.ServerKeys {
+		if keyID(k) == fields["keyid"] {
+			pub = k
+		}
+	}
+	if pub == nil {
+		return fmt.Errorf("%w: unknown key %q", ErrBadSignature, fields["keyid"])
+	}
+	ts, err := strconv.ParseInt(fields["ts"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad timestamp", ErrBadSignature)
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > SIGNATURE_MAX_AGE || age < -SIGNATURE_MAX_AGE {
+		return fmt.Errorf("%w: signed %s ago", ErrBadSignature, age.Round(time.Second))
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields["sig"])
+	if err != nil {
+		return ErrBadSignature
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "%s\n%s\n%s\n%d\n%d\n", SIGNATURE_VERSION, req.Method, req.URL.RequestURI(), resp.StatusCode, ts)
+	msg.Write(body)
+	if !ed25519.Verify(pub, msg.Bytes(), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func (c *Client) doSigned(req *http.Request) (*http.Response, error) {
+	resp, err := c.do(req)
+	if err != nil || len(c.ServerKeys) == 0 {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.verify(req, resp, body); err != nil {
+		return nil, permanentError{err}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
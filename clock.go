@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var clock = &SwitchClock{}
+
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// SwitchClock forwards to a Clock that can be replaced while other
+// goroutines use it. The zero value forwards to RealClock.
+type SwitchClock struct {
+	v atomic.Value
+}
+
+type clockBox struct {
+	Clock
+}
+
+func (c *SwitchClock) Get() Clock {
+	if b, ok := c.v.Load().(clockBox); ok {
+		return b.Clock
+	}
+	return RealClock{}
+}
+
+func (c *SwitchClock) Set(next Clock) Clock {
+	prev := c.Get()
+	c.v.Store(clockBox{next})
+	return prev
+}
+
+func (c *SwitchClock) Now() time.Time {
+	return c.Get().Now()
+}
+
+func (c *SwitchClock) NewTimer(d time.Duration) Timer {
+	return c.Get().NewTimer(d)
+}
+
+func (c *SwitchClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *SwitchClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func Until(t time.Time) time.Duration {
+	return t.Sub(clock.Now())
+}
+
+func Sleep(d time.Duration) {
+	<-clock.NewTimer(d).C()
+}
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type SimClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*simTimer
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *SimClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &simTimer{clock: c, ch: make(chan time.Time, 1), when: c.now.Add(d)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	t.active, t.listed = true, true
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	due := []*simTimer{}
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case !t.active:
+			t.listed = false
+		case !t.when.After(now):
+			t.active, t.listed = false, false
+			due = append(due, t)
+		default:
+			active = append(active, t)
+		}
+	}
+	c.timers = active
+	c.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	for _, t := range due {
+		select {
+		case t.ch <- now:
+		default:
+		}
+	}
+}
+
+func (c *SimClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+type simTimer struct {
+	clock  *SimClock
+	ch     chan time.Time
+	when   time.Time
+	active bool
+	listed bool
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *simTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	if !t.listed {
+		t.listed = true
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	return was
+}
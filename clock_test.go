@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func simulate(t *testing.T) *SimClock {
+	sim := NewSimClock(time.Now())
+	saved := clock.Set(sim)
+	t.Cleanup(func() { clock.Set(saved) })
+	return sim
+}
+
+func waitForTimers(t *testing.T, sim *SimClock, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if sim.Pending() >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("only %d of %d timers were started", sim.Pending(), n)
+}
+
+func fired(timer Timer) bool {
+	select {
+	case <-timer.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSimClockTimers(t *testing.T) {
+	sim := NewSimClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	a := sim.NewTimer(time.Minute)
+	b := sim.NewTimer(time.Hour)
+	sim.Advance(59 * time.Second)
+	if fired(a) || fired(b) {
+		t.Fatal("timer fired early")
+	}
+	sim.Advance(time.Second)
+	if !fired(a) || fired(b) {
+		t.Fatal("only the one minute timer should have fired")
+	}
+	if b.Stop() != true || b.Stop() != false {
+		t.Fatal("Stop should report whether the timer was active")
+	}
+	sim.Advance(2 * time.Hour)
+	if fired(b) {
+		t.Fatal("stopped timer fired")
+	}
+	b.Reset(time.Minute)
+	b.Reset(2 * time.Minute)
+	sim.Advance(time.Minute)
+	if fired(b) {
+		t.Fatal("reset timer fired at its old deadline")
+	}
+	sim.Advance(time.Minute)
+	if !fired(b) || sim.Pending() != 0 {
+		t.Fatal("reset timer did not fire exactly once")
+	}
+	if got := sim.Now(); !got.Equal(time.Date(2020, 1, 1, 2, 3, 0, 0, time.UTC)) {
+		t.Fatalf("clock reads %s", got)
+	}
+}
+
+func startWaitingUpload(t *testing.T, srv string, key string) chan string {
+	contentType, body := multipartBody(t, []testFile{{"a.txt", []byte("hello")}})
+	done := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(srv+"/upload/"+key, contentType, bytes.NewReader(body))
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		done <- string(msg)
+	}()
+	return done
+}
+
+func TestSimulatedUploadExpiry(t *testing.T) {
+	sim := simulate(t)
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+	done := startWaitingUpload(t, srv.URL, key)
+	waitForTransfer(t, key)
+	waitForTimers(t, sim, 2)
+
+	sim.Advance(time.Minute*time.Duration(conf.TimeoutMinutes) - time.Second)
+	select {
+	case msg := <-done:
+		t.Fatalf("upload ended before its deadline: %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sim.Advance(2 * time.Second)
+	select {
+	case msg := <-done:
+		if !strings.Contains(msg, "no receiver found") {
+			t.Fatalf("upload answered %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload did not expire")
+	}
+	transfer, _ := GetTransfer(key)
+	if status := transfer.CurrentStatus(); status != EXPIRED {
+		t.Fatalf("transfer is %s", status)
+	}
+	CleanTransfers()
+	if _, exists := GetTransfer(key); exists {
+		t.Fatal("expired transfer was not cleaned up")
+	}
+}
+
+func TestSimulatedExtension(t *testing.T) {
+	sim := simulate(t)
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+	done := startWaitingUpload(t, srv.URL, key)
+	waitForTransfer(t, key)
+	waitForTimers(t, sim, 2)
+
+	transfer, _ := GetTransfer(key)
+	transfer.Extend(time.Minute * time.Duration(conf.ExtendMinutes))
+	sim.Advance(time.Minute*time.Duration(conf.TimeoutMinutes) + time.Second)
+	select {
+	case msg := <-done:
+		t.Fatalf("extended upload ended at its original deadline: %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if status := transfer.CurrentStatus(); status != WAITING_RECEIVER {
+		t.Fatalf("transfer is %s", status)
+	}
+	for _, k := range PendingKeys() {
+		if k.Key == key && !k.Expires.Equal(transfer.Deadline()) {
+			t.Errorf("replicated %s until %s, not its extended deadline", key, k.Expires)
+		}
+	}
+
+	sim.Advance(time.Minute * time.Duration(conf.ExtendMinutes))
+	select {
+	case msg := <-done:
+		if !strings.Contains(msg, "no receiver found") {
+			t.Fatalf("upload answered %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("extended upload did not expire")
+	}
+}
+
+func TestSimulatedGroupExpiry(t *testing.T) {
+	sim := simulate(t)
+	key := GenerateKey()
+	group, err := CreateGroup(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !group.Open() {
+		t.Fatal("new group is closed")
+	}
+	sim.Advance(time.Minute * time.Duration(conf.GroupWindowMinutes))
+	if group.Open() {
+		t.Fatal("group is still open after its window")
+	}
+	CleanGroups()
+	groupsLock.Lock()
+	_, exists := groups[key]
+	groupsLock.Unlock()
+	if !exists {
+		t.Fatal("group was removed before the grace period")
+	}
+	sim.Advance(time.Minute*time.Duration(conf.TimeoutMinutes) + time.Second)
+	CleanGroups()
+	groupsLock.Lock()
+	_, exists = groups[key]
+	groupsLock.Unlock()
+	if exists {
+		t.Fatal("expired group was not cleaned up")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"text/template"
+)
+
+var commandFormats = []string{"manifest", "files", "compression"}
+
+type CommandVars struct {
+	URL      string
+	Key      string
+	Filename string
+}
+
+func DefaultReceiverCommands() map[string]string {
+	return map[string]string{
+		"curl":       "curl -fOJ '{{.URL}}'",
+		"wget":       "wget --content-disposition '{{.URL}}'",
+		"powershell": "Invoke-WebRequest -Uri '{{.URL}}' -OutFile '{{.Filename}}'",
+	}
+}
+
+func DownloadURL(r *http.Request, key string, group bool) string {
+	path := "/download/" + key
+	if group {
+		path = "/group/" + key + "/download"
+	}
+	q := url.Values{}
+	for _, name := range commandFormats {
+		if v := r.URL.Query().Get(name); v != "" {
+			q.Set(name, v)
+		}
+	}
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return RequestBaseURL(r) + path
+}
+
+func ReceiverCommands(r *http.Request, key string, group bool) map[string]string {
+	vars := CommandVars{DownloadURL(r, key, group), key, key + ".zip"}
+	commands := map[string]string{}
+	for name, text := range conf.ReceiverCommands {
+		t, err := template.New(name).Parse(text)
+		if err != nil {
+			logger.Error("Receiver command %s: %s", name, err)
+			continue
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, vars); err != nil {
+			logger.Error("Receiver command %s: %s", name, err)
+			continue
+		}
+		commands[name] = out.String()
+	}
+	return commands
+}
+
+func CommandsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	groupsLock.Lock()
+	_, grouped := groups[id]
+	groupsLock.Unlock()
+	grouped = grouped || r.URL.Query().Get("group") != ""
+
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(ReceiverCommands(r, id, grouped))
+}
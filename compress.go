@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type CompressionConfig struct {
+	Level    int
+	MinBytes int
+}
+
+var compressibleTypes = map[string]bool{
+	"application/json":          true,
+	"application/javascript":    true,
+	"application/manifest+json": true,
+	"application/xml":           true,
+	"image/svg+xml":             true,
+}
+
+func Compressible(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediatype == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediatype, "text/") || compressibleTypes[mediatype]
+}
+
+func AcceptedEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			accepted[name] = true
+		}
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	enc      io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.decided {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	c.status = status
+}
+
+func (c *compressWriter) decide(compress bool) error {
+	c.decided = true
+	h := c.Header()
+	if h.Get("Content-Type") == "" && len(c.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	if compress && h.Get("Content-Encoding") == "" && Compressible(h.Get("Content-Type")) &&
+		(c.status == 0 || c.status == http.StatusOK) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		var err error
+		if c.encoding == "gzip" {
+			c.enc, err = gzip.NewWriterLevel(c.ResponseWriter, conf.Compression.Level)
+		} else {
+			c.enc, err = zlib.NewWriterLevel(c.ResponseWriter, conf.Compression.Level)
+		}
+		if err != nil {
+			h.Del("Content-Encoding")
+			c.enc = nil
+		}
+	}
+	if c.status != 0 {
+		c.ResponseWriter.WriteHeader(c.status)
+	}
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := c.write(buf)
+	return err
+}
+
+func (c *compressWriter) write(p []byte) (int, error) {
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.decided {
+		return c.write(p)
+	}
+	c.buf = append(c.buf, p...)
+	if len(c.buf) < conf.Compression.MinBytes {
+		return len(p), nil
+	}
+	if err := c.decide(true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+	}
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Close() error {
+	if !c.decided {
+		if c.status == 0 && len(c.buf) == 0 {
+			return nil
+		}
+		return c.decide(false)
+	}
+	if c.enc != nil {
+		return c.enc.Close()
+	}
+	return nil
+}
+
+func Compress(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := AcceptedEncoding(r)
+		if encoding == "" || r.Method == "HEAD" || r.Header.Get("Range") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		handler.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	CONFIG_FILE = "./nethermes.json"
+	REDACTED    = "********"
+)
+
+var (
+	confFile      = map[string]interface{}{}
+	secretConfigs = map[string]bool{
+		"authtokens":    true,
+		"secret":        true,
+		"secretkey":     true,
+		"password":      true,
+		"authorization": true,
+		"credentials":   true,
+	}
+)
+
+// configChecks run in this order at startup and by "nethermes config
+// validate".
+var configChecks = []struct {
+	Name  string
+	Check func() error
+}{
+	{"Escrow configuration", func() error { return CheckEscrowConfig(conf.Escrow) }},
+	{"Geo database", LoadGeoDB},
+	{"Key configuration", CheckKeyConfig},
+	{"TLS configuration", CheckTLSConfig},
+	{"ACME", CheckACMEConfig},
+	{"Encryption configuration", CheckEncryptionConfig},
+	{"Public base URL", CheckPublicBaseURL},
+	{"Cloud drive configuration", CheckDriveConfig},
+	{"File policy", CheckFilePolicyConfig},
+	{"Spool wipe", CheckWipeConfig},
+	{"CORS", CheckCorsConfig},
+	{"Priority classes", CheckPriorityConfig},
+	{"Gallery", CheckGalleryConfig},
+	{"SAML", CheckSAMLConfig},
+	{"Firewall", CheckWAFConfig},
+	{"Tunnel configuration", CheckTunnelConfig},
+	{"Regions configuration", CheckRegionsConfig},
+	{"Middleware configuration", BuildChains},
+}
+
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// configPosition returns the line and column of the last byte the decoder
+// read before it failed.
+func configPosition(data []byte, offset int64) (int, int) {
+	if offset--; offset < 0 {
+		offset = 0
+	} else if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	return bytes.Count(before, []byte("\n")) + 1, len(before) - bytes.LastIndexByte(before, '\n')
+}
+
+// ParseConfig decodes data over the defaults. Syntax and type errors are
+// returned as a *ConfigError pointing at the offending line and column.
+func ParseConfig(file string, data []byte) (Config, error) {
+	c := DefaultConfig()
+	err := json.Unmarshal(data, &c)
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		line, col := configPosition(data, e.Offset)
+		return c, &ConfigError{file, line, col, strings.TrimPrefix(e.Error(), "json: ")}
+	case *json.UnmarshalTypeError:
+		line, col := configPosition(data, e.Offset)
+		return c, &ConfigError{file, line, col, fmt.Sprintf("%s must be %s, not %s", e.Field, schemaType(e.Type), e.Value)}
+	}
+	return c, err
+}
+
+// ValidateConfig parses file and runs the startup checks against it. Keys
+// the server would ignore are returned as warnings.
+func ValidateConfig(file string) ([]string, []error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, []error{err}
+	}
+	c, err := ParseConfig(file, b)
+	if err != nil {
+		return nil, []error{err}
+	}
+	conf = c
+	json.Unmarshal(b, &confFile)
+	var warnings []string
+	for _, key := range BuildConfigReport().Ignored {
+		warnings = append(warnings, fmt.Sprintf("%s: unknown key %s is ignored", file, key))
+	}
+	var errs []error
+	for _, c := range configChecks {
+		if err := c.Check(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %s", file, c.Name, err))
+		}
+	}
+	return warnings, errs
+}
+
+func schemaType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Ptr:
+		return schemaType(t.Elem())
+	}
+	return ""
+}
+
+func schemaProperties(t reflect.Type, def reflect.Value, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		var v reflect.Value
+		if def.IsValid() {
+			v = def.Field(i)
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && name == "" {
+			schemaProperties(f.Type, v, props)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaFor(f.Type, v)
+	}
+}
+
+// schemaFor describes t as JSON Schema, taking defaults from def where the
+// default configuration sets one.
+func schemaFor(t reflect.Type, def reflect.Value) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		if def.IsValid() && !def.IsNil() {
+			def = def.Elem()
+		} else {
+			def = reflect.Value{}
+		}
+		t = t.Elem()
+	}
+	s := map[string]interface{}{}
+	if typ := schemaType(t); typ != "" {
+		s["type"] = typ
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		schemaProperties(t, def, props)
+		s["properties"] = props
+		return s
+	case reflect.Slice, reflect.Array:
+		s["items"] = schemaFor(t.Elem(), reflect.Value{})
+	case reflect.Map:
+		s["additionalProperties"] = schemaFor(t.Elem(), reflect.Value{})
+	}
+	if def.IsValid() && !((def.Kind() == reflect.Slice || def.Kind() == reflect.Map) && def.IsNil()) {
+		s["default"] = def.Interface()
+	}
+	return s
+}
+
+func ConfigSchema() map[string]interface{} {
+	s := schemaFor(reflect.TypeOf(Config{}), reflect.ValueOf(DefaultConfig()))
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "nethermes configuration"
+	return s
+}
+
+func RunConfig(args []string) int {
+	usage := "usage: nethermes config validate [FILE] | nethermes config schema"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_FAILURE
+	}
+	switch {
+	case args[0] == "schema" && len(args) == 1:
+		jenc := json.NewEncoder(os.Stdout)
+		jenc.SetIndent("", "  ")
+		jenc.Encode(ConfigSchema())
+		return EXIT_OK
+	case args[0] == "validate" && len(args) <= 2:
+		file := CONFIG_FILE
+		if len(args) == 2 {
+			file = args[1]
+		}
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		if err := ChangeHome(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return EXIT_FAILURE
+		}
+		warnings, errs := ValidateConfig(file)
+		for _, w := range warnings {
+			fmt.Fprintln(os.Stderr, "warning: "+w)
+		}
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			return EXIT_FAILURE
+		}
+		fmt.Printf("%s is valid\n", file)
+		return EXIT_OK
+	}
+	fmt.Fprintln(os.Stderr, usage)
+	return EXIT_FAILURE
+}
+
+type ConfigReport struct {
+	File    string
+	Config  map[string]interface{}
+	Sources map[string]string
+	Ignored []string
+}
+
+func ReadConfigValues(file string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return values, err
+	}
+	err = json.Unmarshal(b, &values)
+	return values, err
+}
+
+func lookupConfigKey(values map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := values[key]; ok {
+		return v, true
+	}
+	for k, v := range values {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func redactConfigValue(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		return strings.Replace(s, u.User.String()+"@", REDACTED+"@", 1)
+	}
+	return s
+}
+
+func walkConfig(prefix string, effective, file map[string]interface{}, r *ConfigReport) {
+	for key, v := range effective {
+		path := prefix + key
+		fv, inFile := lookupConfigKey(file, key)
+		if secretConfigs[strings.ToLower(key)] {
+			switch s := v.(type) {
+			case nil:
+			case string:
+				if s != "" {
+					effective[key] = REDACTED
+				}
+			case []interface{}:
+				if len(s) > 0 {
+					effective[key] = REDACTED
+				}
+			default:
+				effective[key] = REDACTED
+			}
+		} else if sub, ok := v.(map[string]interface{}); ok {
+			fsub, _ := fv.(map[string]interface{})
+			walkConfig(path+".", sub, fsub, r)
+			continue
+		} else {
+			effective[key] = redactConfigValue(v)
+		}
+		r.Sources[path] = "default"
+		if inFile {
+			r.Sources[path] = "file"
+		}
+	}
+	for key := range file {
+		if _, ok := lookupConfigKey(effective, key); !ok {
+			r.Ignored = append(r.Ignored, prefix+key)
+		}
+	}
+}
+
+func BuildConfigReport() ConfigReport {
+	r := ConfigReport{
+		File:    CONFIG_FILE,
+		Config:  map[string]interface{}{},
+		Sources: map[string]string{},
+		Ignored: []string{},
+	}
+	b, _ := json.Marshal(conf)
+	json.Unmarshal(b, &r.Config)
+	walkConfig("", r.Config, confFile, &r)
+	sort.Strings(r.Ignored)
+	return r
+}
+
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(BuildConfigReport())
+}
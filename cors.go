@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type CorsConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAgeSeconds    int
+}
+
+func (c CorsConfig) AllowsOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCorsConfig rejects a wildcard origin with credentials, which would
+// let every site make credentialed requests.
+func CheckCorsConfig() error {
+	if !conf.Cors.AllowCredentials {
+		return nil
+	}
+	for _, o := range conf.Cors.AllowedOrigins {
+		if o == "*" {
+			return errors.New(`AllowCredentials needs explicit AllowedOrigins, not "*"`)
+		}
+	}
+	return nil
+}
+
+func CORS(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !conf.Cors.AllowsOrigin(origin) {
+			if r.Method == "OPTIONS" {
+				Error(w, r, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if conf.Cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+		} else if len(conf.Cors.AllowedOrigins) == 1 && conf.Cors.AllowedOrigins[0] == "*" {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method != "OPTIONS" {
+			h.Set("Access-Control-Expose-Headers", "X-Request-ID, X-Error-Code, X-Sender-Secret, X-Expires, X-Expires-In, X-Signature")
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", strings.Join(conf.Cors.AllowedMethods, ", "))
+		if len(conf.Cors.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(conf.Cors.AllowedHeaders, ", "))
+		} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+			h.Set("Access-Control-Allow-Headers", req)
+		}
+		if conf.Cors.MaxAgeSeconds > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(conf.Cors.MaxAgeSeconds))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const HOME_ENV = "NETHERMES_HOME"
+
+func ChangeHome() error {
+	home := os.Getenv(HOME_ENV)
+	if home == "" {
+		return nil
+	}
+	return os.Chdir(home)
+}
+
+func AbsHome(dir string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(dir, CONFIG_FILE)); err != nil {
+		return "", fmt.Errorf("no %s in %s (run \"nethermes init\" there first)", filepath.Base(CONFIG_FILE), dir)
+	}
+	return dir, nil
+}
+
+func parseUmask(s string) (int, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid umask %q, use an octal value like 027", s)
+	}
+	return int(mask), nil
+}
+
+func readPidFile() (int, error) {
+	data, err := ioutil.ReadFile(conf.PidFile)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func WritePidFile() error {
+	if conf.PidFile == "" {
+		return nil
+	}
+	if pid, err := readPidFile(); err == nil && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("nethermes is already running as pid %d (%s)", pid, conf.PidFile)
+	}
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+	return ioutil.WriteFile(conf.PidFile, []byte(pid), 0644)
+}
+
+func RemovePidFile() {
+	if conf.PidFile == "" {
+		return
+	}
+	if pid, err := readPidFile(); err != nil || pid != os.Getpid() {
+		return
+	}
+	if err := os.Remove(conf.PidFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Remove pid file: %s", err)
+	}
+}
+
+func Shutdown() {
+	if conf.Failover.Peer != "" {
+		Drain()
+	}
+	RemovePidFile()
+	logger.Info("Shutting down")
+	logger.Close()
+}
@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const DAEMON_START_SECONDS = 2
+
+func ApplyUmask() error {
+	if conf.Umask == "" {
+		return nil
+	}
+	mask, err := parseUmask(conf.Umask)
+	if err != nil {
+		return err
+	}
+	syscall.Umask(mask)
+	return nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func RunDaemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	dir := fs.String("home", "", "directory with nethermes.json, defaults to the current directory")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_FAILURE
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: nethermes daemon [-home DIR]")
+		return EXIT_FAILURE
+	}
+	home, err := AbsHome(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	logDir := filepath.Join(home, filepath.Dir(LOG_FILE))
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	console, err := os.OpenFile(filepath.Join(logDir, "console.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	defer console.Close()
+
+	cmd := exec.Command(exe)
+	cmd.Dir = "/"
+	cmd.Env = append(os.Environ(), HOME_ENV+"="+home)
+	cmd.Stdout = console
+	cmd.Stderr = console
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		fmt.Fprintf(os.Stderr, "Error: nethermes stopped right after starting (%v), see %s\n", err, console.Name())
+		return EXIT_FAILURE
+	case <-clock.After(DAEMON_START_SECONDS * time.Second):
+	}
+	fmt.Printf("nethermes is running in the background as pid %d, output goes to %s\n", cmd.Process.Pid, console.Name())
+	return EXIT_OK
+}
+
+func RunService(args []string) int {
+	fmt.Fprintln(os.Stderr, "Windows services are only available on Windows, use \"nethermes daemon\" or your init system")
+	return EXIT_FAILURE
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func ApplyUmask() error {
+	if conf.Umask == "" {
+		return nil
+	}
+	_, err := parseUmask(conf.Umask)
+	return err
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+func RunDaemon(args []string) int {
+	fmt.Fprintln(os.Stderr, "Use \"nethermes service install\" to run in the background on Windows")
+	return EXIT_FAILURE
+}
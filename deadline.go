@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const CLOCK_JUMP_TOLERANCE = 2 * time.Second
+
+var lastClockCheck = time.Now()
+
+func Remaining(deadline time.Time) time.Duration {
+	if left := Until(deadline); left > 0 {
+		return left
+	}
+	return 0
+}
+
+func SecondsLeft(deadline time.Time) int {
+	return int(Remaining(deadline).Seconds())
+}
+
+func Rebase(wall time.Time) time.Time {
+	if wall.IsZero() {
+		return wall
+	}
+	return clock.Now().Add(Until(wall))
+}
+
+func RebaseTTL(sent, expires time.Time) time.Time {
+	if sent.IsZero() {
+		return Rebase(expires)
+	}
+	return clock.Now().Add(expires.Sub(sent))
+}
+
+func SetExpiryHeaders(w http.ResponseWriter, deadline time.Time) {
+	w.Header().Set("X-Expires", deadline.Format(time.RFC3339))
+	w.Header().Set("X-Expires-In", strconv.Itoa(SecondsLeft(deadline)))
+}
+
+// CheckClock compares the monotonic and wall readings of the real clock,
+// so it deliberately bypasses clock.
+func CheckClock() {
+	now := time.Now()
+	elapsed := now.Sub(lastClockCheck)
+	wall := now.Round(0).Sub(lastClockCheck.Round(0))
+	lastClockCheck = now
+	if jump := wall - elapsed; jump > CLOCK_JUMP_TOLERANCE || jump < -CLOCK_JUMP_TOLERANCE {
+		logger.Warn("Wall clock jumped by %s, transfer deadlines are kept on the monotonic clock", jump.Round(time.Second))
+	}
+}
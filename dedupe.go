@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	MAX_DEDUPE_FILES = 1000
+)
+
+var (
+	blobs     = map[string]GroupFile{}
+	blobsLock sync.Mutex
+)
+
+type DedupeFile struct {
+	Name    string
+	SHA256  string
+	Present bool
+}
+
+func RegisterBlob(owner string, f GroupFile) {
+	blobsLock.Lock()
+	defer blobsLock.Unlock()
+	blobs[owner+"/"+f.SHA256] = f
+}
+
+func FindBlob(owner, sum string) (GroupFile, bool) {
+	blobsLock.Lock()
+	defer blobsLock.Unlock()
+	key := owner + "/" + sum
+	f, ok := blobs[key]
+	if !ok {
+		return f, false
+	}
+	if _, err := os.Stat(f.path); err != nil {
+		delete(blobs, key)
+		return f, false
+	}
+	return f, true
+}
+
+func CleanBlobs() {
+	blobsLock.Lock()
+	defer blobsLock.Unlock()
+	for key, f := range blobs {
+		if _, err := os.Stat(f.path); err != nil {
+			delete(blobs, key)
+		}
+	}
+}
+
+func LinkBlob(src GroupFile, dir string) (string, error) {
+	fd, err := ioutil.TempFile(dir, "part-")
+	if err != nil {
+		return "", err
+	}
+	target := fd.Name()
+	fd.Close()
+	os.Remove(target)
+	if err := os.Link(src.path, target); err == nil {
+		return target, nil
+	}
+
+	in, err := os.Open(src.path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return "", err
+	}
+	return target, out.Close()
+}
+
+func GroupDedupeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if _, exists := GetTransfer(id); exists || Reserved(id) {
+		Error(w, r, "key is in use by a transfer", http.StatusBadRequest)
+		return
+	}
+
+	files := []DedupeFile{}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 1024*1024))
+	if err := jdec.Decode(&files); err != nil || len(files) > MAX_DEDUPE_FILES {
+		Error(w, r, "invalid file list", http.StatusBadRequest)
+		return
+	}
+
+	group, err := CreateGroup(id)
+	if err != nil {
+		RequestLog(r).Error("Create group: %s", err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !group.Open() {
+		Error(w, r, ErrGroupClosed.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := Contribution{
+		RequestID: RequestID(r),
+		Time:      clock.Now(),
+	}
+	if s := strings.TrimSpace(r.URL.Query().Get("sender")); s != "" && len(s) <= 64 {
+		c.Sender = s
+	}
+	message, err := MessageParam(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Message = message
+	owner := ClientIP(r).String()
+	for i, f := range files {
+		blob, ok := FindBlob(owner, strings.ToLower(f.SHA256))
+		if !ok {
+			continue
+		}
+		path, err := LinkBlob(blob, group.dir)
+		if err != nil {
+			RequestLog(r).Error("Link blob %s: %s", blob.SHA256, err)
+			continue
+		}
+		c.Files = append(c.Files, GroupFile{
+			SanitizeName(f.Name),
+			blob.Size,
+			blob.SHA256,
+			path,
+		})
+		files[i].Present = true
+	}
+
+	if len(c.Files) > 0 {
+		if err := group.add(c); err != nil {
+			for _, f := range c.Files {
+				os.Remove(f.path)
+			}
+			Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		RequestLog(r).Info("Reused %d buffered files for %s", len(c.Files), id)
+	}
+
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(files)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	DRIVE_COOKIE      = "nethermes-drive"
+	DRIVE_AUTH_WINDOW = 10 * time.Minute
+	DRIVE_CHUNK       = 20 * 1024 * 1024
+)
+
+var (
+	driveAuths     = map[string]*driveAuth{}
+	driveAuthsLock sync.Mutex
+
+	ErrDriveAuth = errors.New("cloud drive authorization failed")
+)
+
+type DriveConfig struct {
+	TimeoutSeconds int
+	Providers      map[string]DriveClient
+}
+
+type DriveClient struct {
+	ClientID     string
+	ClientSecret string
+}
+
+type DriveProvider struct {
+	Name     string
+	AuthURL  string
+	TokenURL string
+	Scope    string
+	Upload   func(ctx context.Context, client *http.Client, token, name string, f *os.File, size int64) error
+}
+
+type DriveLink struct {
+	Provider string
+	Name     string
+}
+
+type driveAuth struct {
+	ID          string
+	Provider    string
+	Query       string
+	Verifier    string
+	RedirectURI string
+	Token       string
+	Expires     time.Time
+}
+
+var driveProviders = map[string]DriveProvider{
+	"google": {
+		Name:     "Google Drive",
+		AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL: "https://oauth2.googleapis.com/token",
+		Scope:    "https://www.googleapis.com/auth/drive.file",
+		Upload:   uploadGoogleDrive,
+	},
+	"onedrive": {
+		Name:     "OneDrive",
+		AuthURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		Scope:    "Files.ReadWrite",
+		Upload:   uploadOneDrive,
+	},
+	"dropbox": {
+		Name:     "Dropbox",
+		AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+		TokenURL: "https://api.dropboxapi.com/oauth2/token",
+		Scope:    "files.content.write",
+		Upload:   uploadDropbox,
+	},
+}
+
+func CheckDriveConfig() error {
+	for name, c := range conf.Drive.Providers {
+		if _, ok := driveProviders[name]; !ok {
+			return fmt.Errorf("unknown cloud drive provider %q", name)
+		}
+		if c.ClientID == "" || c.ClientSecret == "" {
+			return fmt.Errorf("cloud drive provider %q needs ClientID and ClientSecret", name)
+		}
+	}
+	if len(conf.Drive.Providers) > 0 && conf.Drive.TimeoutSeconds <= 0 {
+		return errors.New("Drive.TimeoutSeconds must be positive")
+	}
+	return nil
+}
+
+func DriveLinks() []DriveLink {
+	links := []DriveLink{}
+	for name := range conf.Drive.Providers {
+		links = append(links, DriveLink{name, driveProviders[name].Name})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Name < links[j].Name })
+	return links
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func CleanDriveAuths() {
+	driveAuthsLock.Lock()
+	defer driveAuthsLock.Unlock()
+	for state, a := range driveAuths {
+		if clock.Now().After(a.Expires) {
+			delete(driveAuths, state)
+		}
+	}
+}
+
+func takeDriveAuth(r *http.Request, state string) (*driveAuth, bool) {
+	c, err := r.Cookie(DRIVE_COOKIE)
+	if err != nil || state == "" || c.Value != state {
+		return nil, false
+	}
+	driveAuthsLock.Lock()
+	defer driveAuthsLock.Unlock()
+	a, ok := driveAuths[state]
+	if !ok || clock.Now().After(a.Expires) {
+		return nil, false
+	}
+	return a, true
+}
+
+func DriveStartHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	name := r.URL.Query().Get("provider")
+	client, ok := conf.Drive.Providers[name]
+	if !ok {
+		Error(w, r, "unknown cloud drive", http.StatusNotFound)
+		return
+	}
+	if page, ok := LookupCode(id); !ok || !page.Found {
+		ReceiverError(w, r, "notfound", http.StatusNotFound)
+		return
+	}
+	if _, err := ZipMode(r); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	query.Del("provider")
+
+	provider := driveProviders[name]
+	state := randomToken()
+	auth := &driveAuth{
+		ID:          id,
+		Provider:    name,
+		Query:       query.Encode(),
+		Verifier:    randomToken(),
+		RedirectURI: RequestBaseURL(r) + "/drive/callback",
+		Expires:     clock.Now().Add(DRIVE_AUTH_WINDOW),
+	}
+	driveAuthsLock.Lock()
+	driveAuths[state] = auth
+	driveAuthsLock.Unlock()
+
+	challenge := sha256.Sum256([]byte(auth.Verifier))
+	params := url.Values{
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {auth.RedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {provider.Scope},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     DRIVE_COOKIE,
+		Value:    state,
+		Path:     "/drive",
+		MaxAge:   int(DRIVE_AUTH_WINDOW.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	RequestLog(r).Info("Authorizing %s export of %s", name, id)
+	http.Redirect(w, r, provider.AuthURL+"?"+params.Encode(), http.StatusSeeOther)
+}
+
+func DriveCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	state := query.Get("state")
+	auth, ok := takeDriveAuth(r, state)
+	if !ok {
+		Error(w, r, "cloud drive authorization expired, please start again", http.StatusBadRequest)
+		return
+	}
+	provider := driveProviders[auth.Provider]
+	if e := query.Get("error"); e != "" || query.Get("code") == "" {
+		RequestLog(r).Info("%s authorization for %s denied: %s", auth.Provider, auth.ID, e)
+		driveResult(w, r, auth.ID, "Saving to "+provider.Name+" was not authorized.", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	client := conf.Drive.Providers[auth.Provider]
+	token, err := exchangeDriveCode(ctx, provider, client, query.Get("code"), auth)
+	if err != nil {
+		RequestLog(r).Info("%s token exchange for %s: %s", auth.Provider, auth.ID, err)
+		driveResult(w, r, auth.ID, "Saving to "+provider.Name+" was not authorized.", http.StatusBadGateway)
+		return
+	}
+	driveAuthsLock.Lock()
+	auth.Token = token
+	driveAuthsLock.Unlock()
+	http.Redirect(w, r, "/drive/"+url.PathEscape(auth.ID)+"/save?state="+url.QueryEscape(state), http.StatusSeeOther)
+}
+
+func DriveSaveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	state := r.URL.Query().Get("state")
+	auth, ok := takeDriveAuth(r, state)
+	if ok {
+		driveAuthsLock.Lock()
+		if auth.Token == "" || auth.ID != id {
+			ok = false
+		} else {
+			delete(driveAuths, state)
+		}
+		driveAuthsLock.Unlock()
+	}
+	if !ok {
+		Error(w, r, "cloud drive authorization expired, please start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: DRIVE_COOKIE, Path: "/drive", MaxAge: -1})
+
+	archive := r.Clone(r.Context())
+	archive.URL.RawQuery = auth.Query
+	fd, size, name, ok := SpoolArchive(w, archive, id, "drive")
+	if !ok {
+		return
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	provider := driveProviders[auth.Provider]
+	timeout := time.Second * time.Duration(conf.Drive.TimeoutSeconds)
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	err := provider.Upload(ctx, OutboundClient("drive", timeout), auth.Token, name, fd, size)
+	if err != nil {
+		RequestLog(r).Info("Save %s to %s: %s", id, auth.Provider, err)
+		driveResult(w, r, id, "Saving to "+provider.Name+" failed. The transfer was already received, ask the sender to send it again.", http.StatusBadGateway)
+		return
+	}
+	RequestLog(r).Info("Saved %s (%d bytes) to %s", id, size, auth.Provider)
+	driveResult(w, r, id, "Saved "+name+" to "+provider.Name+".", http.StatusOK)
+}
+
+func driveResult(w http.ResponseWriter, r *http.Request, id, message string, status int) {
+	if !WantsHTML(r) {
+		if status != http.StatusOK {
+			Error(w, r, message, status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/javascript")
+		jenc := json.NewEncoder(w)
+		jenc.Encode(struct {
+			Key     string
+			Message string
+		}{id, message})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	receivetemplate.Execute(w, ReceivePage{Code: id, Error: message})
+}
+
+func exchangeDriveCode(ctx context.Context, provider DriveProvider, client DriveClient, code string, auth *driveAuth) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {auth.RedirectURI},
+		"client_id":     {client.ClientID},
+		"client_secret": {client.ClientSecret},
+		"code_verifier": {auth.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", provider.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := driveDo(OutboundClient("drive", time.Minute), req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", ErrDriveAuth
+	}
+	return token.AccessToken, nil
+}
+
+func driveDo(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(out)
+}
+
+func uploadGoogleDrive(ctx context.Context, client *http.Client, token, name string, f *os.File, size int64) error {
+	meta, _ := json.Marshal(map[string]string{"name": name})
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable", bytes.NewReader(meta))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/zip")
+	req.Header.Set("X-Upload-Content-Length", fmt.Sprint(size))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusOK || session == "" {
+		return fmt.Errorf("upload session responded %d", resp.StatusCode)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "PUT", session, ioutil.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/zip")
+	return driveDo(client, req, nil)
+}
+
+func uploadOneDrive(ctx context.Context, client *http.Client, token, name string, f *os.File, size int64) error {
+	body := strings.NewReader(`{"item":{"@microsoft.graph.conflictBehavior":"rename"}}`)
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://graph.microsoft.com/v1.0/me/drive/root:/"+url.PathEscape(name)+":/createUploadSession", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	if err := driveDo(client, req, &session); err != nil {
+		return err
+	}
+
+	for off := int64(0); off < size; off += DRIVE_CHUNK {
+		n := size - off
+		if n > DRIVE_CHUNK {
+			n = DRIVE_CHUNK
+		}
+		req, err := http.NewRequestWithContext(ctx, "PUT", session.UploadURL, io.NewSectionReader(f, off, n))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, size))
+		if err := driveDo(client, req, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropboxArg(v interface{}) string {
+	b, _ := json.Marshal(v)
+	var sb strings.Builder
+	for _, c := range string(b) {
+		if c < 0x80 {
+			sb.WriteRune(c)
+			continue
+		}
+		for _, u := range utf16.Encode([]rune{c}) {
+			fmt.Fprintf(&sb, "\\u%04x", u)
+		}
+	}
+	return sb.String()
+}
+
+func dropboxCall(ctx context.Context, client *http.Client, token, endpoint string, arg interface{}, body io.Reader, n int64, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://content.dropboxapi.com/2/files/"+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", dropboxArg(arg))
+	return driveDo(client, req, out)
+}
+
+func uploadDropbox(ctx context.Context, client *http.Client, token, name string, f *os.File, size int64) error {
+	type cursor struct {
+		SessionID string `json:"session_id"`
+		Offset    int64  `json:"offset"`
+	}
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	err := dropboxCall(ctx, client, token, "upload_session/start", map[string]bool{"close": false}, bytes.NewReader(nil), 0, &session)
+	if err != nil {
+		return err
+	}
+	for off := int64(0); off < size; off += DRIVE_CHUNK {
+		n := size - off
+		if n > DRIVE_CHUNK {
+			n = DRIVE_CHUNK
+		}
+		arg := map[string]interface{}{"cursor": cursor{session.SessionID, off}, "close": off+n == size}
+		if err := dropboxCall(ctx, client, token, "upload_session/append_v2", arg, io.NewSectionReader(f, off, n), n, nil); err != nil {
+			return err
+		}
+	}
+	arg := map[string]interface{}{
+		"cursor": cursor{session.SessionID, size},
+		"commit": map[string]interface{}{"path": "/" + name, "mode": "add", "autorename": true},
+	}
+	return dropboxCall(ctx, client, token, "upload_session/finish", arg, bytes.NewReader(nil), 0, nil)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+type EchoPart struct {
+	Field       string
+	FileName    string `json:",omitempty"`
+	Path        string `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+	Size        int64
+	SHA256      string `json:",omitempty"`
+}
+
+type EchoReport struct {
+	ContentType   string
+	ContentLength int64
+	Received      int64
+	Files         int
+	FileBytes     int64
+	Parts         []EchoPart
+	Violations    []string
+}
+
+func DryRun(r *http.Request) bool {
+	v := r.URL.Query().Get("dryrun")
+	return v == "1" || v == "true"
+}
+
+func (e *EchoReport) violation(format string, args ...interface{}) {
+	e.Violations = append(e.Violations, fmt.Sprintf(format, args...))
+}
+
+func Echo(r *http.Request) (report EchoReport) {
+	report = EchoReport{
+		ContentType:   r.Header.Get("Content-Type"),
+		ContentLength: r.ContentLength,
+		Parts:         []EchoPart{},
+		Violations:    []string{},
+	}
+	body := &CountingReader{R: r.Body}
+	defer func() {
+		io.Copy(ioutil.Discard, body)
+		report.Received = body.N
+		if r.ContentLength >= 0 && body.N != r.ContentLength {
+			report.violation("received %d bytes but Content-Length is %d", body.N, r.ContentLength)
+		}
+	}()
+
+	if code, msg := CheckQuota(BearerToken(r)); code != 0 {
+		report.violation("quota: %s", msg)
+	}
+	mediatype, params, err := mime.ParseMediaType(report.ContentType)
+	if err != nil || mediatype != "multipart/form-data" {
+		report.violation("Content-Type must be multipart/form-data")
+		return report
+	}
+	if params["boundary"] == "" {
+		report.violation("Content-Type has no boundary parameter")
+		return report
+	}
+	r.Body = ioutil.NopCloser(body)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		report.violation("multipart: %s", err)
+		return report
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.violation("multipart: %s", err)
+			return report
+		}
+		_, disposition, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		part := EchoPart{
+			Field:       p.FormName(),
+			FileName:    disposition["filename"],
+			ContentType: p.Header.Get("Content-Type"),
+		}
+		h := sha256.New()
+		part.Size, err = io.Copy(h, p)
+		p.Close()
+		if err != nil {
+			report.violation("part %d: %s", len(report.Parts)+1, err)
+			report.Parts = append(report.Parts, part)
+			return report
+		}
+
+		dir, isFile := FileField(part.Field)
+		switch {
+		case isFile:
+			part.Path = FieldPath(dir, PartPath(p))
+			part.SHA256 = hex.EncodeToString(h.Sum(nil))
+			report.Files++
+			report.FileBytes += part.Size
+			if part.FileName == "" {
+				report.violation("file part %d has no filename", report.Files)
+			} else if len(part.FileName) > MAX_PATH_LENGTH {
+				report.violation("file %d: name longer than %d bytes", report.Files, MAX_PATH_LENGTH)
+			} else if dir == "" && part.FileName != part.Path {
+				report.violation("file name %q would be stored as %q", part.FileName, part.Path)
+			}
+		case part.Field == "dir":
+			if part.Size > MAX_PATH_LENGTH {
+				report.violation("dir part longer than %d bytes", MAX_PATH_LENGTH)
+			}
+		case part.Field == "symlink":
+			part.Path = PartPath(p)
+			if !conf.AllowSymlinks {
+				report.violation("symlink %s would be dropped, symlinks are disabled", part.Path)
+			}
+		case part.Field == "note":
+			if part.Size > MAX_NOTE_LENGTH {
+				report.violation("note is %d bytes and would be cut to %d", part.Size, MAX_NOTE_LENGTH)
+			}
+		case part.Field == "sender":
+		default:
+			report.violation("unknown field %q would be ignored", part.Field)
+		}
+		report.Parts = append(report.Parts, part)
+	}
+	if report.Files == 0 {
+		report.violation("no file parts")
+	}
+	return report
+}
+
+func EchoHandler(w http.ResponseWriter, r *http.Request) {
+	report := Echo(r)
+	RequestLog(r).Info("Dry run: %d files, %d bytes, %d violations", report.Files, report.FileBytes, len(report.Violations))
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(report)
+}
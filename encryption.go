@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"unicode/utf8"
+)
+
+var (
+	ErrEncryptionDisabled = errors.New("passphrase encryption is disabled")
+	ErrPassphraseTooShort = errors.New("passphrase is too short")
+	ErrPassphraseGroup    = errors.New("passphrase encryption is only available for direct transfers")
+)
+
+type EncryptionConfig struct {
+	Enabled    bool
+	MinLength  int
+	ScryptLogN int
+}
+
+func PassphraseParam(r *http.Request) (string, error) {
+	pass := r.Header.Get("X-Passphrase")
+	switch {
+	case pass == "":
+		return "", nil
+	case !conf.Encryption.Enabled:
+		return "", ErrEncryptionDisabled
+	case utf8.RuneCountInString(pass) < conf.Encryption.MinLength:
+		return "", ErrPassphraseTooShort
+	}
+	return pass, nil
+}
+
+func CheckEncryptionConfig() error {
+	if !conf.Encryption.Enabled {
+		return nil
+	}
+	if conf.Encryption.ScryptLogN < 10 || conf.Encryption.ScryptLogN > 22 {
+		return errors.New("ScryptLogN must be between 10 and 22")
+	}
+	return nil
+}
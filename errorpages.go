@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ErrorText struct {
+	Title   string
+	Message string
+	Action  string
+}
+
+var (
+	errortemplate *template.Template
+
+	receiverErrorCodes = map[string]string{
+		"notfound":  "transfer-not-found",
+		"forbidden": "receiver-forbidden",
+		"aborted":   "aborted",
+	}
+
+	plainErrors = map[string]string{
+		"notfound":  "transfer does not exist",
+		"forbidden": "receiver not allowed",
+		"aborted":   "transfer aborted",
+	}
+
+	errorTexts = map[string]map[string]ErrorText{
+		"en": {
+			"notfound":  {"Link expired", "This transfer does not exist anymore. It was already downloaded, or the sender stopped waiting.", "Ask the sender to send the files again."},
+			"forbidden": {"Not allowed", "The sender restricted this transfer to another receiver.", "Ask the sender to send the files to your address."},
+			"aborted":   {"Transfer aborted", "The transfer was aborted before it could be completed.", "Ask the sender to try again."},
+		},
+		"de": {
+			"notfound":  {"Link abgelaufen", "Diese Übertragung existiert nicht mehr. Sie wurde bereits heruntergeladen oder der Absender wartet nicht mehr.", "Bitte den Absender, die Dateien erneut zu senden."},
+			"forbidden": {"Nicht erlaubt", "Der Absender hat diese Übertragung auf einen anderen Empfänger beschränkt.", "Bitte den Absender, die Dateien an deine Adresse zu senden."},
+			"aborted":   {"Übertragung abgebrochen", "Die Übertragung wurde abgebrochen, bevor sie abgeschlossen werden konnte.", "Bitte den Absender, es erneut zu versuchen."},
+		},
+		"fr": {
+			"notfound":  {"Lien expiré", "Ce transfert n'existe plus. Il a déjà été téléchargé ou l'expéditeur a cessé d'attendre.", "Demandez à l'expéditeur de renvoyer les fichiers."},
+			"forbidden": {"Non autorisé", "L'expéditeur a réservé ce transfert à un autre destinataire.", "Demandez à l'expéditeur d'envoyer les fichiers à votre adresse."},
+			"aborted":   {"Transfert interrompu", "Le transfert a été interrompu avant la fin.", "Demandez à l'expéditeur de réessayer."},
+		},
+		"es": {
+			"notfound":  {"Enlace caducado", "Esta transferencia ya no existe. Ya se descargó o el remitente dejó de esperar.", "Pide al remitente que vuelva a enviar los archivos."},
+			"forbidden": {"No permitido", "El remitente restringió esta transferencia a otro destinatario.", "Pide al remitente que envíe los archivos a tu dirección."},
+			"aborted":   {"Transferencia cancelada", "La transferencia se canceló antes de completarse.", "Pide al remitente que lo intente de nuevo."},
+		},
+	}
+)
+
+type langQ struct {
+	lang string
+	q    float64
+}
+
+func Language(r *http.Request) string {
+	prefs := []langQ{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		prefs = append(prefs, langQ{lang, q})
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	for _, p := range prefs {
+		base := strings.SplitN(p.lang, "-", 2)[0]
+		if _, ok := errorTexts[base]; ok && p.q > 0 {
+			return base
+		}
+	}
+	return "en"
+}
+
+func WantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func WantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func ReceiverError(w http.ResponseWriter, r *http.Request, kind string, code int) {
+	text := errorTexts["en"][kind]
+	w.Header().Set("X-Error-Code", receiverErrorCodes[kind])
+	switch {
+	case WantsJSON(r):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		jenc := json.NewEncoder(w)
+		jenc.Encode(struct {
+			Error     string
+			Message   string
+			RequestID string
+		}{
+			kind,
+			text.Message,
+			RequestID(r),
+		})
+	case WantsHTML(r) && errortemplate != nil:
+		lang := Language(r)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Language", lang)
+		w.WriteHeader(code)
+		errortemplate.Execute(w, struct {
+			Lang      string
+			Text      ErrorText
+			RequestID string
+		}{
+			lang,
+			errorTexts[lang][kind],
+			RequestID(r),
+		})
+	default:
+		Error(w, r, plainErrors[kind], code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrTransferNotFound  = errors.New("transfer does not exist")
+	ErrExpired           = errors.New("transfer has expired")
+	ErrKeySpaceExhausted = errors.New("no unique key found")
+	ErrTooLarge          = errors.New("transfer is too large")
+)
+
+type errorMapping struct {
+	err    error
+	code   string
+	status int
+}
+
+var errorMappings = []errorMapping{
+	{ErrTransferNotFound, "transfer-not-found", http.StatusNotFound},
+	{ErrExpired, "expired", http.StatusGone},
+	{ErrKeySpaceExhausted, "key-space-exhausted", http.StatusServiceUnavailable},
+	{ErrTooLarge, "too-large", http.StatusRequestEntityTooLarge},
+	{ErrInvalidKey, "invalid-key", http.StatusNotFound},
+	{ErrGeoBlocked, "geo-blocked", http.StatusUnavailableForLegalReasons},
+	{ErrOnHold, "legal-hold", http.StatusLocked},
+	{ErrSuspended, "suspended", http.StatusForbidden},
+	{ErrUploadsBlocked, "uploads-blocked", http.StatusForbidden},
+	{ErrMaintenance, "maintenance", http.StatusServiceUnavailable},
+	{ErrFilePolicy, "file-policy", http.StatusUnsupportedMediaType},
+	{ErrChecksumMismatch, "checksum-mismatch", http.StatusUnprocessableEntity},
+	{ErrGroupClosed, "group-closed", http.StatusBadRequest},
+	{ErrMessageTooLong, "message-too-long", http.StatusBadRequest},
+	{ErrMessageDisabled, "messages-disabled", http.StatusBadRequest},
+	{ErrPresignedKey, "presigned-key", http.StatusForbidden},
+	{ErrServerBusy, "busy", http.StatusServiceUnavailable},
+}
+
+func ErrorStatus(err error) (string, int) {
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return m.code, m.status
+		}
+	}
+	return "internal", http.StatusInternalServerError
+}
+
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	code, status := ErrorStatus(err)
+	w.Header().Set("X-Error-Code", code)
+	if status == http.StatusInternalServerError {
+		RequestLog(r).Error("%s", err)
+		Error(w, r, "internal error", status)
+		return
+	}
+	Error(w, r, err.Error(), status)
+}
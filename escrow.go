@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var escrowLock sync.Mutex
+
+// EscrowConfig.PublicKey is the compliance team's age X25519 recipient
+// ("age1...").
+type EscrowConfig struct {
+	Enabled   bool
+	PublicKey string
+	File      string
+}
+
+// EscrowRecord.Sealed holds the content key as an ASCII armored age
+// file, so it can be decrypted with the age tool and the admin identity.
+type EscrowRecord struct {
+	Id     string
+	Time   time.Time
+	Sender string
+	Sealed string
+}
+
+func WriteEscrow(rec EscrowRecord) error {
+	escrowLock.Lock()
+	defer escrowLock.Unlock()
+	fd, err := os.OpenFile(conf.Escrow.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(fd).Encode(rec); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func EscrowHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !conf.Escrow.Enabled {
+		Error(w, r, "escrow is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if !CheckSecret(id, SenderSecret(r, id)) {
+		RequestLog(r).Info("Rejected escrow for %s: wrong sender secret", id)
+		Error(w, r, "wrong sender secret", http.StatusForbidden)
+		return
+	}
+
+	groupsLock.Lock()
+	_, grouped := groups[id]
+	groupsLock.Unlock()
+	if _, exists := GetTransfer(id); !exists && !grouped {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+
+	var req struct {
+		Key []byte
+	}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 4096))
+	if err := jdec.Decode(&req); err != nil || len(req.Key) == 0 {
+		Error(w, r, "invalid escrow request", http.StatusBadRequest)
+		return
+	}
+
+	var sealed string
+	recipient, err := ParseAgeRecipient(conf.Escrow.PublicKey)
+	if err == nil {
+		sealed, err = SealAge(recipient, req.Key)
+	}
+	if err != nil {
+		RequestLog(r).Error("Seal escrow for %s: %s", id, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	err = WriteEscrow(EscrowRecord{
+		Id:     id,
+		Time:   clock.Now(),
+		Sender: r.RemoteAddr,
+		Sealed: sealed,
+	})
+	if err != nil {
+		RequestLog(r).Error("Write escrow for %s: %s", id, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	RequestLog(r).Info("Escrowed content key for %s", id)
+	w.Write([]byte("ok"))
+}
+
+func CheckEscrowConfig(c EscrowConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, err := ParseAgeRecipient(c.PublicKey); err != nil {
+		return err
+	}
+	if c.File == "" {
+		return errors.New("escrow file is not set")
+	}
+	return nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_SHIP_BATCH   = 500
+	EVENT_SHIP_BACKLOG = 10000
+)
+
+type EventLogConfig struct {
+	File     string
+	Follower string
+}
+
+type RegistryEvent struct {
+	Seq     int64
+	Time    time.Time
+	Op      string
+	Key     string
+	Expires time.Time
+	Group   *GroupRecord `json:",omitempty"`
+	File    *FileRecord  `json:",omitempty"`
+}
+
+type GroupRecord struct {
+	Dir           string
+	Created       time.Time
+	Expires       time.Time
+	Contributions []ContributionRecord
+	Hold          *LegalHold       `json:",omitempty"`
+	Incomplete    []IncompleteFile `json:",omitempty"`
+	Pin           *Pin             `json:",omitempty"`
+}
+
+type FileRecord struct {
+	GroupFile
+	RequestID string
+	Path      string
+}
+
+type IncompleteFile struct {
+	Name      string
+	RequestID string
+	Reason    string
+}
+
+type ContributionRecord struct {
+	Contribution
+	Paths    []string
+	Uploader string `json:",omitempty"`
+}
+
+type EventLog struct {
+	sync.Mutex
+	fd      *os.File
+	seq     int64
+	pending [][]byte
+	behind  bool
+	wake    chan struct{}
+}
+
+var eventLog = &EventLog{wake: make(chan struct{}, 1)}
+
+func (g *Group) record() *GroupRecord {
+	rec := &GroupRecord{g.dir, g.Created, g.Expires, []ContributionRecord{}, g.Hold, g.Incomplete, g.Pin}
+	for _, c := range g.Contributions {
+		cr := ContributionRecord{Contribution: c}
+		for _, f := range c.Files {
+			cr.Paths = append(cr.Paths, f.path)
+		}
+		if c.uploader != nil {
+			cr.Uploader = c.uploader.String()
+		}
+		rec.Contributions = append(rec.Contributions, cr)
+	}
+	return rec
+}
+
+func (l *EventLog) Append(ev RegistryEvent) {
+	l.Lock()
+	defer l.Unlock()
+	if l.fd == nil {
+		return
+	}
+	l.seq++
+	ev.Seq = l.seq
+	ev.Time = clock.Now()
+	b, err := json.Marshal(ev)
+	if err != nil {
+		logger.Error("Encode registry event: %s", err)
+		return
+	}
+	l.write(append(b, '\n'))
+}
+
+func (l *EventLog) write(line []byte) {
+	if _, err := l.fd.Write(line); err != nil {
+		logger.Error("Write event log: %s", err)
+		return
+	}
+	if err := l.fd.Sync(); err != nil {
+		logger.Error("Sync event log: %s", err)
+	}
+	if conf.EventLog.Follower == "" {
+		return
+	}
+	if len(l.pending) >= EVENT_SHIP_BACKLOG {
+		if !l.behind {
+			logger.Error("Event log follower is %d events behind, not shipping newer events", EVENT_SHIP_BACKLOG)
+			l.behind = true
+		}
+		return
+	}
+	l.behind = false
+	l.pending = append(l.pending, line)
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func JournalKey(key string, expires time.Time) {
+	eventLog.Append(RegistryEvent{Op: "key", Key: key, Expires: expires})
+}
+
+func (g *Group) journal() {
+	eventLog.Append(RegistryEvent{Op: "group", Key: g.key, Group: g.record()})
+}
+
+func JournalFile(key, requestID string, f GroupFile) {
+	eventLog.Append(RegistryEvent{Op: "file", Key: key, File: &FileRecord{f, requestID, f.path}})
+}
+
+func Journaling() bool {
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	return eventLog.fd != nil
+}
+
+func SyncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+func JournalDiscard(key, requestID string) {
+	eventLog.Append(RegistryEvent{Op: "discard", Key: key, File: &FileRecord{RequestID: requestID}})
+}
+
+func JournalClose(key string) {
+	eventLog.Append(RegistryEvent{Op: "close", Key: key})
+}
+
+func JournalDelete(key string) {
+	eventLog.Append(RegistryEvent{Op: "delete", Key: key})
+}
+
+func readEvents(r io.Reader, apply func(RegistryEvent)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var ev RegistryEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			logger.Error("Skip damaged registry event: %s", err)
+			continue
+		}
+		apply(ev)
+	}
+	return sc.Err()
+}
+
+func spooledDamage(path string, size int64) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing after restart"
+	}
+	if info.Size() != size {
+		return fmt.Sprintf("truncated after restart, %d of %d bytes on disk", info.Size(), size)
+	}
+	return ""
+}
+
+func restoreGroup(key string, rec *GroupRecord, interrupted []FileRecord) (*Group, bool) {
+	if _, err := os.Stat(rec.Dir); err != nil {
+		return nil, false
+	}
+	g := &Group{
+		key:        key,
+		dir:        rec.Dir,
+		Created:    Rebase(rec.Created),
+		Expires:    Rebase(rec.Expires),
+		Status:     WAITING_RECEIVER,
+		Hold:       rec.Hold,
+		Incomplete: append([]IncompleteFile{}, rec.Incomplete...),
+		Pin:        rec.Pin,
+	}
+	keep := map[string]bool{}
+	for _, cr := range rec.Contributions {
+		c := cr.Contribution
+		if len(cr.Paths) != len(c.Files) {
+			return nil, false
+		}
+		c.Files = []GroupFile{}
+		for i, f := range cr.Contribution.Files {
+			if reason := spooledDamage(cr.Paths[i], f.Size); reason != "" {
+				g.Incomplete = append(g.Incomplete, IncompleteFile{f.Name, c.RequestID, reason})
+				continue
+			}
+			f.path = cr.Paths[i]
+			keep[f.path] = true
+			c.Files = append(c.Files, f)
+		}
+		if len(c.Files) == 0 {
+			continue
+		}
+		c.uploader = net.ParseIP(cr.Uploader)
+		g.Contributions = append(g.Contributions, c)
+	}
+	for _, fr := range interrupted {
+		reason := "upload interrupted by restart, file was complete"
+		if damage := spooledDamage(fr.Path, fr.Size); damage != "" {
+			reason = "upload interrupted by restart, file " + damage
+		}
+		g.Incomplete = append(g.Incomplete, IncompleteFile{fr.Name, fr.RequestID, reason})
+	}
+	names, _ := filepath.Glob(filepath.Join(rec.Dir, "*"))
+	for _, name := range names {
+		if !keep[name] {
+			WipeFile(name)
+		}
+	}
+	g.timeline.Record("restored", 0, "replayed from event log")
+	for _, f := range g.Incomplete[len(rec.Incomplete):] {
+		logger.Error("Group %s: %s from request %s is not offered: %s", key, f.Name, f.RequestID, f.Reason)
+		g.timeline.Record("incomplete", 0, f.Name+": "+f.Reason)
+	}
+	return g, true
+}
+
+func dropPending(pending []FileRecord, requests map[string]bool) []FileRecord {
+	kept := []FileRecord{}
+	for _, fr := range pending {
+		if !requests[fr.RequestID] {
+			kept = append(kept, fr)
+		}
+	}
+	return kept
+}
+
+func ReplayEventLog() error {
+	if conf.EventLog.File == "" {
+		return nil
+	}
+	keys := map[string]time.Time{}
+	records := map[string]*GroupRecord{}
+	pending := map[string][]FileRecord{}
+	seq := int64(0)
+	fd, err := os.Open(conf.EventLog.File)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = readEvents(fd, func(ev RegistryEvent) {
+			if ev.Seq > seq {
+				seq = ev.Seq
+			}
+			switch ev.Op {
+			case "key":
+				keys[ev.Key] = ev.Expires
+			case "file":
+				if ev.File != nil {
+					pending[ev.Key] = append(pending[ev.Key], *ev.File)
+				}
+			case "group":
+				records[ev.Key] = ev.Group
+				keys[ev.Key] = ev.Group.Expires
+				committed := map[string]bool{}
+				for _, cr := range ev.Group.Contributions {
+					committed[cr.RequestID] = true
+				}
+				pending[ev.Key] = dropPending(pending[ev.Key], committed)
+			case "discard":
+				if ev.File != nil {
+					pending[ev.Key] = dropPending(pending[ev.Key], map[string]bool{ev.File.RequestID: true})
+				}
+			case "close", "delete":
+				delete(records, ev.Key)
+				delete(pending, ev.Key)
+			}
+		})
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	now := clock.Now()
+	grace := time.Minute * time.Duration(conf.TimeoutMinutes)
+	restored := 0
+	groupsLock.Lock()
+	for key, rec := range records {
+		if rec.Hold == nil && now.After(rec.Expires.Add(grace)) {
+			continue
+		}
+		if g, ok := restoreGroup(key, rec, pending[key]); ok {
+			groups[key] = g
+			restored++
+		} else {
+			logger.Error("Cannot restore group %s, its files are gone", key)
+		}
+	}
+	groupsLock.Unlock()
+	importedLock.Lock()
+	for key, expires := range keys {
+		if now.Before(expires) {
+			imported[key] = Rebase(expires)
+		}
+	}
+	importedLock.Unlock()
+
+	if err := compactEventLog(seq); err != nil {
+		return err
+	}
+	logger.Info("Replayed event log %s: restored %d groups, %d keys in use", conf.EventLog.File, restored, len(keys))
+	go ShipEvents()
+	return nil
+}
+
+func compactEventLog(seq int64) error {
+	tmp := conf.EventLog.File + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	jenc := json.NewEncoder(fd)
+	now := clock.Now()
+	importedLock.Lock()
+	for key, expires := range imported {
+		seq++
+		jenc.Encode(RegistryEvent{Seq: seq, Time: now, Op: "key", Key: key, Expires: expires})
+	}
+	importedLock.Unlock()
+	groupsLock.Lock()
+	for key, g := range groups {
+		seq++
+		jenc.Encode(RegistryEvent{Seq: seq, Time: now, Op: "group", Key: key, Group: g.record()})
+	}
+	groupsLock.Unlock()
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	fd.Close()
+	if err := os.Rename(tmp, conf.EventLog.File); err != nil {
+		return err
+	}
+	fd, err = os.OpenFile(conf.EventLog.File, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	eventLog.Lock()
+	eventLog.fd = fd
+	eventLog.seq = seq
+	eventLog.Unlock()
+	return nil
+}
+
+func shipBatch(batch [][]byte) error {
+	req, err := http.NewRequest("POST", strings.TrimRight(conf.EventLog.Follower, "/")+"/replicate/events", bytes.NewReader(bytes.Join(batch, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-Failover-Secret", conf.Failover.Secret)
+	resp, err := replicateClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("follower responded " + resp.Status)
+	}
+	return nil
+}
+
+func ShipEvents() {
+	if conf.EventLog.Follower == "" {
+		return
+	}
+	backoff := time.Second
+	for range eventLog.wake {
+		for {
+			eventLog.Lock()
+			batch := eventLog.pending
+			if len(batch) > EVENT_SHIP_BATCH {
+				batch = batch[:EVENT_SHIP_BATCH]
+			}
+			eventLog.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+			if err := shipBatch(batch); err != nil {
+				logger.Error("Ship %d events to follower: %s", len(batch), err)
+				Sleep(backoff)
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+				continue
+			}
+			backoff = time.Second
+			eventLog.Lock()
+			if len(eventLog.pending) >= len(batch) {
+				eventLog.pending = eventLog.pending[len(batch):]
+			}
+			eventLog.Unlock()
+		}
+	}
+}
+
+func ReplicateEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !FailoverAuthorized(r) {
+		Error(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	lines := [][]byte{}
+	events := []RegistryEvent{}
+	err := readEvents(io.LimitReader(r.Body, 64*1024*1024), func(ev RegistryEvent) {
+		b, _ := json.Marshal(ev)
+		lines = append(lines, append(b, '\n'))
+		events = append(events, ev)
+	})
+	if err != nil {
+		Error(w, r, "invalid event data", http.StatusBadRequest)
+		return
+	}
+
+	eventLog.Lock()
+	if eventLog.fd != nil {
+		for _, line := range lines {
+			if _, err := eventLog.fd.Write(line); err != nil {
+				logger.Error("Write event log: %s", err)
+				break
+			}
+		}
+		eventLog.fd.Sync()
+	}
+	eventLog.Unlock()
+
+	importedLock.Lock()
+	for _, ev := range events {
+		switch {
+		case ev.Op == "key":
+			imported[ev.Key] = RebaseTTL(ev.Time, ev.Expires)
+		case ev.Op == "group" && ev.Group != nil:
+			imported[ev.Key] = RebaseTTL(ev.Time, ev.Group.Expires)
+		}
+	}
+	importedLock.Unlock()
+	RequestLog(r).Info("Stored %d registry events from leader", len(events))
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Event struct {
+	Time   time.Time
+	Kind   string
+	Bytes  int64  `json:",omitempty"`
+	Detail string `json:",omitempty"`
+}
+
+type Timeline struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (tl *Timeline) Record(kind string, bytes int64, detail string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.events = append(tl.events, Event{clock.Now(), kind, bytes, detail})
+}
+
+func (tl *Timeline) Events() []Event {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return append([]Event{}, tl.events...)
+}
+
+type archivedTimeline struct {
+	timeline *Timeline
+	expires  time.Time
+}
+
+var (
+	archivedTimelines     = map[string]archivedTimeline{}
+	archivedTimelinesLock sync.Mutex
+)
+
+func ArchiveTimeline(id string, tl *Timeline) {
+	archivedTimelinesLock.Lock()
+	defer archivedTimelinesLock.Unlock()
+	archivedTimelines[id] = archivedTimeline{
+		tl,
+		clock.Now().Add(time.Minute * time.Duration(conf.EventKeepMinutes)),
+	}
+}
+
+func CleanTimelines() {
+	archivedTimelinesLock.Lock()
+	defer archivedTimelinesLock.Unlock()
+	for id, a := range archivedTimelines {
+		if clock.Now().After(a.expires) {
+			delete(archivedTimelines, id)
+		}
+	}
+}
+
+func FindTimeline(id string) (*Timeline, bool) {
+	if transfer, exists := GetTransfer(id); exists {
+		return &transfer.timeline, true
+	}
+	groupsLock.Lock()
+	group, grouped := groups[id]
+	groupsLock.Unlock()
+	if grouped {
+		return &group.timeline, true
+	}
+	archivedTimelinesLock.Lock()
+	defer archivedTimelinesLock.Unlock()
+	a, ok := archivedTimelines[id]
+	return a.timeline, ok
+}
+
+type ProgressReader struct {
+	R        io.Reader
+	Timeline *Timeline
+	Every    int64
+	n        int64
+	next     int64
+}
+
+func (p *ProgressReader) Read(b []byte) (int, error) {
+	n, err := p.R.Read(b)
+	p.n += int64(n)
+	if p.Every > 0 && p.n >= p.next+p.Every {
+		p.next = p.n - p.n%p.Every
+		p.Timeline.Record("progress", p.n, "")
+	}
+	return n, err
+}
+
+func TransferEventsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	tl, exists := FindTimeline(id)
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(tl.Events())
+}
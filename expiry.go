@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+type ExpiryNotice struct {
+	Key     string
+	Status  Status
+	Expires time.Time
+	Left    int
+	Extend  string
+}
+
+func ExpiryWindow() time.Duration {
+	return time.Second * time.Duration(conf.ExpiryWarnSeconds)
+}
+
+func NewExpiryNotice(id string, transfer *Transfer) ExpiryNotice {
+	deadline := transfer.Deadline()
+	return ExpiryNotice{id, transfer.CurrentStatus(), deadline, SecondsLeft(deadline), "/extend/" + id}
+}
+
+func FireExpiryWebhook(n ExpiryNotice) {
+	if conf.ExpiryWebhook == "" {
+		return
+	}
+	b, _ := json.Marshal(n)
+	client := OutboundClient("webhook", 30*time.Second)
+	resp, err := client.Post(conf.ExpiryWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		logger.Error("Expiry webhook for %s: %s", n.Key, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Error("Expiry webhook for %s: responded %d", n.Key, resp.StatusCode)
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, v interface{}) {
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func StatusEventsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+
+	defer PauseSlowLog(r)()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	first, last := true, WAITING_RECEIVER
+	var warned time.Time
+	tick := clock.NewTimer(time.Second)
+	defer tick.Stop()
+	for {
+		n := NewExpiryNotice(id, transfer)
+		if first || n.Status != last {
+			if !first && last == WAITING_RECEIVER && (n.Status.Active() || n.Status == COMPLETED) {
+				writeEvent(w, "receiver", n)
+			}
+			if by := transfer.CancelledBy(); n.Status == ABORTED && by != "" {
+				writeEvent(w, "cancelled", CancelNotice{id, by})
+			}
+			first, last = false, n.Status
+			writeEvent(w, "status", n)
+		}
+		if n.Status.Terminal() {
+			return
+		}
+		if n.Status == WAITING_RECEIVER && Until(n.Expires) <= ExpiryWindow() && !warned.Equal(n.Expires) {
+			warned = n.Expires
+			writeEvent(w, "expiring", n)
+		}
+		select {
+		case <-tick.C():
+			tick.Reset(time.Second)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
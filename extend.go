@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type senderSecret struct {
+	Secret  string
+	Expires time.Time
+}
+
+var (
+	secrets     = map[string]senderSecret{}
+	secretsLock sync.Mutex
+)
+
+func SecretCookie(key string) string {
+	return "secret-" + key
+}
+
+func IssueSecret(w http.ResponseWriter, key string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	s := senderSecret{
+		hex.EncodeToString(b),
+		clock.Now().Add(time.Minute * time.Duration(conf.MaxTransferMinutes)),
+	}
+	secretsLock.Lock()
+	secrets[key] = s
+	secretsLock.Unlock()
+	w.Header().Set("X-Sender-Secret", s.Secret)
+	http.SetCookie(w, &http.Cookie{
+		Name:     SecretCookie(key),
+		Value:    s.Secret,
+		Path:     "/",
+		MaxAge:   60 * conf.MaxTransferMinutes,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return s.Secret
+}
+
+// SenderSecret takes the secret from the X-Sender-Secret header, or from
+// the cookie set for pages that work without JavaScript.
+func SenderSecret(r *http.Request, key string) string {
+	if secret := r.Header.Get("X-Sender-Secret"); secret != "" {
+		return secret
+	}
+	if c, err := r.Cookie(SecretCookie(key)); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func CheckSecret(key, secret string) bool {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	s, ok := secrets[key]
+	return ok && secret != "" && clock.Now().Before(s.Expires) &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(s.Secret)) == 1
+}
+
+func CleanSecrets() {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for key, s := range secrets {
+		if clock.Now().After(s.Expires) {
+			delete(secrets, key)
+		}
+	}
+}
+
+func (t *Transfer) Deadline() time.Time {
+	t.Lock()
+	defer t.Unlock()
+	return t.Expires
+}
+
+func (t *Transfer) Extend(d time.Duration) time.Time {
+	t.Lock()
+	defer t.Unlock()
+	limit := t.Created.Add(time.Minute * time.Duration(conf.MaxTransferMinutes))
+	t.Expires = t.Expires.Add(d)
+	if t.Expires.After(limit) {
+		t.Expires = limit
+	}
+	return t.Expires
+}
+
+func ExtendHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !CheckSecret(id, SenderSecret(r, id)) {
+		RequestLog(r).Info("Rejected extension of %s: wrong sender secret", id)
+		Error(w, r, "wrong sender secret", http.StatusForbidden)
+		return
+	}
+
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+	status := transfer.CurrentStatus()
+	if status == EXPIRED {
+		WriteError(w, r, ErrExpired)
+		return
+	}
+	if status != WAITING_RECEIVER {
+		Error(w, r, "transfer is not waiting", http.StatusBadRequest)
+		return
+	}
+
+	expires := transfer.Extend(time.Minute * time.Duration(conf.ExtendMinutes))
+	transfer.timeline.Record("extended", 0, expires.Format(time.RFC3339))
+	RequestLog(r).Info("Extended %s until %s", id, expires.Format(time.RFC3339))
+	if WantsHTML(r) {
+		http.Redirect(w, r, "/progress/"+id, http.StatusSeeOther)
+		return
+	}
+	SetExpiryHeaders(w, expires)
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(expires)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type FailoverConfig struct {
+	Peer         string
+	Secret       string
+	DrainSeconds int
+}
+
+type ReplicatedKey struct {
+	Key       string
+	Expires   time.Time
+	TTLMillis int64 `json:",omitempty"`
+}
+
+var (
+	draining     = make(chan struct{})
+	drainOnce    sync.Once
+	imported     = map[string]time.Time{}
+	importedLock sync.Mutex
+
+	replicateClient = OutboundClient("failover", 10*time.Second)
+)
+
+func Draining() bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func Imported(key string) bool {
+	importedLock.Lock()
+	defer importedLock.Unlock()
+	expires, ok := imported[key]
+	return ok && clock.Now().Before(expires)
+}
+
+func CleanImported() {
+	importedLock.Lock()
+	defer importedLock.Unlock()
+	for key, expires := range imported {
+		if clock.Now().After(expires) {
+			delete(imported, key)
+		}
+	}
+}
+
+func PendingKeys() []ReplicatedKey {
+	keys := []ReplicatedKey{}
+	transfersLock.Lock()
+	for id, transfer := range transfers {
+		if transfer.CurrentStatus() == WAITING_RECEIVER {
+			expires := transfer.Deadline()
+			keys = append(keys, ReplicatedKey{id, expires, Remaining(expires).Milliseconds()})
+		}
+	}
+	transfersLock.Unlock()
+	reservationsLock.Lock()
+	for id, res := range reservations {
+		keys = append(keys, ReplicatedKey{id, res.Expires, Remaining(res.Expires).Milliseconds()})
+	}
+	reservationsLock.Unlock()
+	return keys
+}
+
+func Replicate() error {
+	if conf.Failover.Peer == "" {
+		return nil
+	}
+	data, err := json.Marshal(PendingKeys())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(conf.Failover.Peer, "/")+"/replicate", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Failover-Secret", conf.Failover.Secret)
+	resp, err := replicateClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("peer responded " + resp.Status)
+	}
+	return nil
+}
+
+func FailoverAuthorized(r *http.Request) bool {
+	secret := r.Header.Get("X-Failover-Secret")
+	return conf.Failover.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(conf.Failover.Secret)) == 1
+}
+
+func ReplicateHandler(w http.ResponseWriter, r *http.Request) {
+	if !FailoverAuthorized(r) {
+		Error(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keys := []ReplicatedKey{}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 16*1024*1024))
+	if err := jdec.Decode(&keys); err != nil {
+		Error(w, r, "invalid replication data", http.StatusBadRequest)
+		return
+	}
+
+	importedLock.Lock()
+	for _, k := range keys {
+		if k.TTLMillis > 0 {
+			imported[k.Key] = clock.Now().Add(time.Duration(k.TTLMillis) * time.Millisecond)
+		} else {
+			imported[k.Key] = Rebase(k.Expires)
+		}
+	}
+	importedLock.Unlock()
+	RequestLog(r).Info("Imported %d pending keys from peer", len(keys))
+	w.Write([]byte("ok"))
+}
+
+func RedirectToPeer(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, strings.TrimRight(conf.Failover.Peer, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+func Failover(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf.Failover.Peer != "" && Draining() && !strings.HasPrefix(r.URL.Path, "/replicate") {
+			RedirectToPeer(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func Drain() {
+	drainOnce.Do(func() {
+		logger.Info("Draining: redirecting new requests to %s", conf.Failover.Peer)
+		if err := Replicate(); err != nil {
+			logger.Error("Replicate to peer: %s", err)
+		}
+		close(draining)
+	})
+
+	deadline := clock.Now().Add(time.Second * time.Duration(conf.Failover.DrainSeconds))
+	for clock.Now().Before(deadline) {
+		busy := false
+		transfersLock.Lock()
+		for _, transfer := range transfers {
+			if transfer.CurrentStatus().Active() {
+				busy = true
+			}
+		}
+		transfersLock.Unlock()
+		if !busy {
+			break
+		}
+		Sleep(time.Second)
+	}
+}
+
+func HandleShutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	Shutdown()
+	os.Exit(0)
+}
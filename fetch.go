@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrForbiddenAddress = errors.New("address is not allowed")
+
+	fetchClients     = map[string]*http.Client{}
+	fetchClientsLock sync.Mutex
+
+	reservedNetworks = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "64:ff9b::/96")
+)
+
+type FetchConfig struct {
+	MaxMB           int
+	TimeoutSeconds  int
+	AllowPrivate    bool
+	AllowedNetworks []string
+}
+
+type FetchRequest struct {
+	URL           string
+	Authorization string
+	Name          string
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+func PrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func FetchAllowed(ip net.IP) bool {
+	for _, n := range conf.Fetch.AllowedNetworks {
+		if _, network, err := net.ParseCIDR(n); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return conf.Fetch.AllowPrivate || !PrivateIP(ip)
+}
+
+func checkFetchHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !FetchAllowed(ip) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !FetchAllowed(addr.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// fetchClient returns the shared client for feature, so keep-alive
+// connections are reused and idle ones get closed.
+func fetchClient(feature string) *http.Client {
+	fetchClientsLock.Lock()
+	defer fetchClientsLock.Unlock()
+	c, ok := fetchClients[feature]
+	if !ok {
+		c = newFetchClient(feature)
+		fetchClients[feature] = c
+	}
+	return c
+}
+
+// fetchDialer refuses connections to addresses FetchAllowed rejects,
+// after name resolution.
+func fetchDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !FetchAllowed(ip) {
+				return ErrForbiddenAddress
+			}
+			return nil
+		},
+	}
+}
+
+func newFetchClient(feature string) *http.Client {
+	var proxies sync.Map
+	direct := &net.Dialer{Timeout: 10 * time.Second}
+	dialer := fetchDialer()
+	proxy := ProxyFor(feature)
+	transport := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			u, err := proxy(req)
+			if u == nil || err != nil {
+				return u, err
+			}
+			if err := checkFetchHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			proxies.Store(proxyAddr(u), true)
+			return u, nil
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if _, ok := proxies.Load(address); ok {
+				return direct.DialContext(ctx, network, address)
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   2,
+	}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("unsupported redirect scheme")
+			}
+			return nil
+		},
+	}
+}
+
+func FetchName(resp *http.Response, fr FetchRequest) string {
+	if fr.Name != "" {
+		return fr.Name
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return "download"
+}
+
+func FetchHandler(w http.ResponseWriter, r *http.Request) {
+	if conf.Fetch.MaxMB <= 0 {
+		Error(w, r, "fetching is disabled", http.StatusNotFound)
+		return
+	}
+	if !CheckUploader(w, r) {
+		return
+	}
+
+	var fr FetchRequest
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(&fr); err != nil {
+		Error(w, r, "invalid fetch request", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(fr.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		Error(w, r, "invalid url", http.StatusBadRequest)
+		return
+	}
+
+	key, err := GenerateUniqueKey()
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*time.Duration(conf.Fetch.TimeoutSeconds))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		Error(w, r, "invalid url", http.StatusBadRequest)
+		return
+	}
+	if fr.Authorization != "" {
+		req.Header.Set("Authorization", fr.Authorization)
+	}
+	resp, err := fetchClient("fetch").Do(req)
+	if err != nil {
+		RequestLog(r).Info("Fetch %s: %s", u.Host, err)
+		if errors.Is(err, ErrForbiddenAddress) {
+			Error(w, r, "url points to a forbidden address", http.StatusForbidden)
+			return
+		}
+		Error(w, r, "fetch failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		Error(w, r, fmt.Sprintf("remote server responded %d", resp.StatusCode), http.StatusBadGateway)
+		return
+	}
+	limit := int64(conf.Fetch.MaxMB) * 1024 * 1024
+	if resp.ContentLength > limit {
+		WriteError(w, r, ErrTooLarge)
+		return
+	}
+
+	group, err := CreateGroup(key)
+	if err != nil {
+		RequestLog(r).Error("Create group: %s", err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	body := &CountingReader{R: io.LimitReader(resp.Body, limit+1)}
+	f, err := group.AddFile(RequestID(r), u.Host, FetchName(resp, fr), body)
+	if err == nil && body.N > limit {
+		err = ErrTooLarge
+	}
+	if err != nil {
+		RequestLog(r).Info("Fetch %s: %s", u.Host, err)
+		group.Lock()
+		group.Status.Set(ABORTED)
+		group.Unlock()
+		JournalClose(key)
+		if err == ErrTooLarge {
+			WriteError(w, r, err)
+			return
+		}
+		Error(w, r, "fetch failed", http.StatusBadGateway)
+		return
+	}
+	RequestLog(r).Info("Fetched %d bytes from %s into %s", f.Size, u.Host, key)
+
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(struct {
+		Key      string
+		Name     string
+		Size     int64
+		Download string
+	}{
+		key,
+		f.Name,
+		f.Size,
+		"/group/" + key + "/download",
+	})
+}
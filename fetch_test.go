@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPrivateIP(t *testing.T) {
+	for _, c := range []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"192.0.0.8", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"100.128.0.1", false},
+		{"192.0.2.1", false},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	} {
+		if got := PrivateIP(net.ParseIP(c.ip)); got != c.private {
+			t.Errorf("PrivateIP(%s) = %t", c.ip, got)
+		}
+	}
+}
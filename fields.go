@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+)
+
+func FileField(name string) (string, bool) {
+	if dir, ok := conf.FileFields[name]; ok {
+		return dir, true
+	}
+	for pattern, dir := range conf.FileFields {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+func FieldPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return EntryPath(dir + "/" + name)
+}
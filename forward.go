@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var ErrNothingSelected = errors.New("no files selected")
+
+type ForwardedTransfer struct {
+	Key      string
+	Expires  time.Time
+	Files    []GroupFile
+	Download string
+}
+
+func (g *Group) Forwardable(ip net.IP) bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.Status == COMPLETED && g.receiver.Equal(ip) && clock.Now().Before(g.forwardUntil)
+}
+
+func (g *Group) Forward(target *Group, requestID, message string, selected map[int]bool) ([]GroupFile, error) {
+	g.Lock()
+	contributions := g.Contributions
+	g.Unlock()
+
+	files := []GroupFile{}
+	index := 0
+	for _, c := range contributions {
+		fc := Contribution{
+			Sender:    c.Sender,
+			RequestID: requestID,
+			Time:      clock.Now(),
+			Message:   message,
+		}
+		for _, f := range c.Files {
+			index++
+			if selected != nil && !selected[index] {
+				continue
+			}
+			path, err := LinkBlob(f, target.dir)
+			if err != nil {
+				for _, f := range fc.Files {
+					os.Remove(f.path)
+				}
+				return files, err
+			}
+			fc.Files = append(fc.Files, GroupFile{f.Name, f.Size, f.SHA256, path})
+		}
+		if len(fc.Files) == 0 {
+			continue
+		}
+		if err := target.add(fc); err != nil {
+			for _, f := range fc.Files {
+				os.Remove(f.path)
+			}
+			return files, err
+		}
+		files = append(files, fc.Files...)
+		message = ""
+	}
+	return files, nil
+}
+
+func GroupForwardHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	groupsLock.Lock()
+	group, exists := groups[id]
+	groupsLock.Unlock()
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+	if group.Held() {
+		WriteError(w, r, ErrOnHold)
+		return
+	}
+	if Suspended(id) {
+		WriteError(w, r, ErrSuspended)
+		return
+	}
+	if !group.Forwardable(ClientIP(r)) {
+		RequestLog(r).Info("Rejected forward of %s from %s", id, ClientIP(r))
+		Error(w, r, "only the receiver of a completed transfer can forward it", http.StatusForbidden)
+		return
+	}
+	selected, err := SelectedFiles(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	message, err := MessageParam(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if code, msg := CheckQuota(BearerToken(r)); code != 0 {
+		Error(w, r, msg, code)
+		return
+	}
+
+	key, err := GenerateUniqueKey()
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	target, err := CreateGroup(key)
+	if err != nil {
+		RequestLog(r).Error("Create group: %s", err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	files, err := group.Forward(target, RequestID(r), message, selected)
+	if err == nil && len(files) == 0 {
+		err = ErrNothingSelected
+	}
+	if err != nil {
+		target.Lock()
+		target.Status.Set(ABORTED)
+		target.Unlock()
+		JournalClose(key)
+		if err == ErrNothingSelected {
+			Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		RequestLog(r).Error("Forward %s: %s", id, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	size := int64(0)
+	for _, f := range files {
+		size += f.Size
+	}
+	group.timeline.Record("forwarded", size, RequestID(r))
+	target.timeline.Record("forwarded", size, RequestID(r))
+	RequestLog(r).Info("Forwarded %d files of %s as %s", len(files), id, key)
+
+	target.Lock()
+	expires := target.Expires
+	target.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	w.WriteHeader(http.StatusCreated)
+	jenc := json.NewEncoder(w)
+	jenc.Encode(ForwardedTransfer{
+		key,
+		expires,
+		files,
+		"/group/" + key + "/download",
+	})
+}
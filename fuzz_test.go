@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func FuzzSanitizeName(f *testing.F) {
+	for _, seed := range []string{"", ".", "..", "/", "a.txt", "../../etc/passwd", "C:\\Windows\\win.ini", "dir/", "\x00"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		s := SanitizeName(name)
+		if s == "" || s == "." || s == ".." {
+			t.Fatalf("SanitizeName(%q) = %q", name, s)
+		}
+		if strings.ContainsAny(s, "/\\") {
+			t.Fatalf("SanitizeName(%q) = %q contains a separator", name, s)
+		}
+	})
+}
+
+func FuzzNormalizeCode(f *testing.F) {
+	for _, seed := range []string{"", "abcde fghij", " ABCDEFGHIJ ", "abc\tdef\nghij", "abcdefghij\u00a0"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, code string) {
+		n := NormalizeCode(code)
+		if strings.ContainsAny(n, " \t\r\n") {
+			t.Fatalf("NormalizeCode(%q) = %q keeps whitespace", code, n)
+		}
+		if NormalizeCode(n) != n {
+			t.Fatalf("NormalizeCode is not idempotent for %q", code)
+		}
+		if ValidKey(n) && utf8.RuneCountInString(n) != conf.KeyLength {
+			t.Fatalf("ValidKey accepted %q of length %d", n, utf8.RuneCountInString(n))
+		}
+	})
+}
+
+func FuzzGeoDB(f *testing.F) {
+	f.Add(geoFixture(countryRecord("AU"), 8))
+	f.Add(geoFixture([]byte{0x20, 0x00}, 8))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		db, err := ParseGeoDB(buf)
+		if err != nil {
+			return
+		}
+		for _, ip := range []string{"1.2.3.4", "255.255.255.255", "::1", "2001:db8::1"} {
+			db.Lookup(net.ParseIP(ip))
+		}
+	})
+}
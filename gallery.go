@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	gallerytemplate *template.Template
+
+	galleryTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+)
+
+type GalleryConfig struct {
+	Enabled       bool
+	ThumbnailSize int
+	MaxImages     int
+}
+
+type GalleryImage struct {
+	Index     int
+	Name      string
+	Size      int64
+	Type      string
+	Thumbnail string
+	URL       string
+	data      []byte
+	thumb     []byte
+	thumbType string
+}
+
+type Gallery struct {
+	sync.Mutex
+	Images []*GalleryImage
+}
+
+type GalleryPage struct {
+	Key      string
+	Download string
+	Expires  time.Time
+	Messages []string
+	Images   []*GalleryImage
+}
+
+func CheckGalleryConfig() error {
+	if !conf.Gallery.Enabled {
+		return nil
+	}
+	if conf.Gallery.ThumbnailSize < 16 || conf.Gallery.ThumbnailSize > 1024 {
+		return errors.New("ThumbnailSize must be between 16 and 1024 pixels")
+	}
+	if conf.Gallery.MaxImages <= 0 {
+		return errors.New("MaxImages must be positive")
+	}
+	return nil
+}
+
+// buildGallery splits a buffered upload into its files. Only uploads made
+// up entirely of images that pass the file policy and their declared
+// checksums get a gallery.
+func buildGallery(id string, t *Transfer) *Gallery {
+	_, params, err := mime.ParseMediaType(t.upload.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	mr := multipart.NewReader(bytes.NewReader(t.buffer), params["boundary"])
+	g := &Gallery{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		dir, isFile := FileField(p.FormName())
+		if !isFile {
+			continue
+		}
+		name := FieldPath(dir, PartPath(p))
+		part, err := CheckPart(p, p.Header)
+		if err != nil {
+			return nil
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil
+		}
+		if _, err := CheckFilePolicy(name, bytes.NewReader(data)); err != nil {
+			return nil
+		}
+		mediatype := SniffType(data)
+		if !galleryTypes[mediatype] || len(g.Images) >= conf.Gallery.MaxImages {
+			return nil
+		}
+		n := len(g.Images) + 1
+		g.Images = append(g.Images, &GalleryImage{
+			Index:     n,
+			Name:      name,
+			Size:      int64(len(data)),
+			Type:      mediatype,
+			Thumbnail: fmt.Sprintf("/gallery/%s/thumb/%d", id, n),
+			URL:       fmt.Sprintf("/gallery/%s/image/%d", id, n),
+			data:      data,
+		})
+	}
+	if len(g.Images) == 0 {
+		return nil
+	}
+	return g
+}
+
+func (t *Transfer) Gallery(id string) (*Gallery, bool) {
+	if !conf.Gallery.Enabled || !t.buffered || t.passphrase != "" {
+		return nil, false
+	}
+	t.Lock()
+	defer t.Unlock()
+	if !t.galleryDone {
+		t.gallery = buildGallery(id, t)
+		t.galleryDone = true
+	}
+	return t.gallery, t.gallery != nil
+}
+
+func (g *Gallery) Image(n int) (*GalleryImage, bool) {
+	if n < 1 || n > len(g.Images) {
+		return nil, false
+	}
+	return g.Images[n-1], true
+}
+
+func (g *Gallery) Thumbnail(img *GalleryImage) ([]byte, string, error) {
+	g.Lock()
+	defer g.Unlock()
+	if img.thumb != nil {
+		return img.thumb, img.thumbType, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img.data))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > conf.Images.MaxMegapixels*1000*1000 {
+		return nil, "", errors.New("image is too large for a thumbnail")
+	}
+	src, _, err := image.Decode(bytes.NewReader(img.data))
+	if err != nil {
+		return nil, "", err
+	}
+	scaled := Downscale(src, conf.Gallery.ThumbnailSize)
+	var out bytes.Buffer
+	img.thumbType = "image/png"
+	if img.Type == "image/jpeg" {
+		img.thumbType = "image/jpeg"
+		err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: 75})
+	} else {
+		err = png.Encode(&out, scaled)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	img.thumb = out.Bytes()
+	return img.thumb, img.thumbType, nil
+}
+
+func galleryAccess(w http.ResponseWriter, r *http.Request) (string, *Transfer, *Gallery, bool) {
+	id := mux.Vars(r)["id"]
+	transfer, exists := GetTransfer(id)
+	if !exists || transfer.CurrentStatus() != WAITING_RECEIVER {
+		ReceiverError(w, r, "notfound", http.StatusNotFound)
+		return id, nil, nil, false
+	}
+	if transfer.Held() {
+		WriteError(w, r, ErrOnHold)
+		return id, nil, nil, false
+	}
+	if Suspended(id) {
+		WriteError(w, r, ErrSuspended)
+		return id, nil, nil, false
+	}
+	if !transfer.Pin.Allows(ClientIP(r)) {
+		transfer.Pin.Audit(r, id, "", false)
+		ReceiverError(w, r, "forbidden", http.StatusForbidden)
+		return id, nil, nil, false
+	}
+	principal, err := transfer.Pin.Authorize(r)
+	if err != nil {
+		transfer.Pin.Audit(r, id, principal, false)
+		WriteAuthError(w, r, err)
+		return id, nil, nil, false
+	}
+	if !transfer.Pin.Claim(ClientIP(r)) {
+		transfer.Pin.Audit(r, id, principal, false)
+		ReceiverError(w, r, "forbidden", http.StatusForbidden)
+		return id, nil, nil, false
+	}
+	gallery, ok := transfer.Gallery(id)
+	if !ok {
+		ReceiverError(w, r, "notfound", http.StatusNotFound)
+		return id, nil, nil, false
+	}
+	return id, transfer, gallery, true
+}
+
+func galleryImage(w http.ResponseWriter, r *http.Request, g *Gallery) (*GalleryImage, bool) {
+	n, _ := strconv.Atoi(mux.Vars(r)["n"])
+	img, ok := g.Image(n)
+	if !ok {
+		ReceiverError(w, r, "notfound", http.StatusNotFound)
+	}
+	return img, ok
+}
+
+func GalleryHandler(w http.ResponseWriter, r *http.Request) {
+	id, transfer, gallery, ok := galleryAccess(w, r)
+	if !ok {
+		return
+	}
+	page := GalleryPage{
+		Key:      id,
+		Download: "/download/" + id,
+		Expires:  transfer.Deadline(),
+		Images:   gallery.Images,
+	}
+	if transfer.Message != "" {
+		page.Messages = []string{transfer.Message}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if conf.Headless || WantsJSON(r) {
+		w.Header().Set("Content-Type", "text/javascript")
+		jenc := json.NewEncoder(w)
+		jenc.Encode(page)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	gallerytemplate.Execute(w, page)
+}
+
+func GalleryThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, gallery, ok := galleryAccess(w, r)
+	if !ok {
+		return
+	}
+	img, ok := galleryImage(w, r, gallery)
+	if !ok {
+		return
+	}
+	thumb, mediatype, err := gallery.Thumbnail(img)
+	if err != nil {
+		RequestLog(r).Info("No thumbnail for %s: %s", img.Name, err)
+		Error(w, r, "no thumbnail for this image", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", mediatype)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(thumb)
+}
+
+func GalleryImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, transfer, gallery, ok := galleryAccess(w, r)
+	if !ok {
+		return
+	}
+	img, ok := galleryImage(w, r, gallery)
+	if !ok {
+		return
+	}
+	transfer.timeline.Record("image downloaded", img.Size, img.Name)
+	RequestLog(r).Info("Served image %d of %s", img.Index, id)
+	w.Header().Set("Content-Type", img.Type)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(img.Name)}))
+	w.Header().Set("Cache-Control", "no-store")
+	io.Copy(w, transfer.Images.Process(bytes.NewReader(img.data)))
+}
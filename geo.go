@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var ErrGeoBlocked = errors.New("downloads are not allowed from your country")
+
+type GeoConfig struct {
+	Database     string
+	Allow        []string
+	Deny         []string
+	AllowUnknown bool
+}
+
+var mmdbMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const GEO_MAX_DEPTH = 32
+
+type GeoDB struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint
+	ipVersion  uint
+}
+
+var geodb *GeoDB
+
+func OpenGeoDB(file string) (*GeoDB, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseGeoDB(buf)
+}
+
+func ParseGeoDB(buf []byte) (*GeoDB, error) {
+	i := bytes.LastIndex(buf, mmdbMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind database")
+	}
+	d := &decoder{buf: buf[i+len(mmdbMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %s", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata: not a map")
+	}
+	num := func(key string) uint {
+		n, _ := meta[key].(uint64)
+		return uint(n)
+	}
+	db := &GeoDB{
+		buf:        buf,
+		nodeCount:  num("node_count"),
+		recordSize: num("record_size"),
+		ipVersion:  num("ip_version"),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if uint(i) < 16 || db.nodeCount > (uint(i)-16)/(db.recordSize/4) {
+		return nil, errors.New("search tree exceeds file")
+	}
+	treeSize := db.recordSize / 4 * db.nodeCount
+	db.data = buf[treeSize+16 : i]
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for b := 0; b < 96 && node < db.nodeCount; b++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func (db *GeoDB) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(db.buf[node*8+bit*4:]))
+}
+
+func (db *GeoDB) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 || len(ip) != net.IPv6len {
+		return nil, nil
+	}
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount+16 {
+		return nil, errCorrupt
+	}
+	d := &decoder{buf: db.data}
+	v, _, err := d.decode(node - db.nodeCount - 16)
+	return v, err
+}
+
+func (db *GeoDB) Country(ip net.IP) string {
+	v, err := db.Lookup(ip)
+	if err != nil {
+		logger.Error("Geo lookup %s: %s", ip, err)
+		return ""
+	}
+	record, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+type decoder struct {
+	buf   []byte
+	depth int
+}
+
+var errCorrupt = errors.New("corrupt database")
+
+func (d *decoder) take(offset, n uint) ([]byte, error) {
+	if offset > uint(len(d.buf)) || n > uint(len(d.buf))-offset {
+		return nil, errCorrupt
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	if d.depth >= GEO_MAX_DEPTH {
+		return nil, 0, errCorrupt
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	b, err := d.take(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	typ := uint(b[0] >> 5)
+	if typ == 1 {
+		return d.pointer(b[0], offset)
+	}
+	if typ == 0 {
+		ext, err := d.take(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(ext[0])
+		offset++
+	}
+	size := uint(b[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		ext, err := d.take(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		size = 0
+		for _, c := range ext {
+			size = size<<8 | uint(c)
+		}
+		size += [...]uint{29, 285, 65821}[n-1]
+	}
+	if (typ == 7 || typ == 11) && size > uint(len(d.buf))-offset {
+		return nil, 0, errCorrupt
+	}
+
+	switch typ {
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	raw, err := d.take(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case 2:
+		return string(raw), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case 5, 6, 8, 9:
+		var n uint64
+		for _, c := range raw {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 4, 10:
+		return raw, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+func (d *decoder) pointer(ctrl byte, offset uint) (interface{}, uint, error) {
+	n := uint(ctrl>>3&3) + 1
+	b, err := d.take(offset, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 7)
+	}
+	for _, c := range b {
+		p = p<<8 | uint(c)
+	}
+	p += [...]uint{0, 2048, 526336, 0}[n-1]
+	v, _, err := d.decode(p)
+	return v, offset + n, err
+}
+
+func GeoAllowed(country string) bool {
+	if country == "" {
+		return conf.Geo.AllowUnknown
+	}
+	for _, c := range conf.Geo.Deny {
+		if strings.EqualFold(c, country) {
+			return false
+		}
+	}
+	if len(conf.Geo.Allow) == 0 {
+		return true
+	}
+	for _, c := range conf.Geo.Allow {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadGeoDB() error {
+	if conf.Geo.Database == "" {
+		return nil
+	}
+	db, err := OpenGeoDB(conf.Geo.Database)
+	if err != nil {
+		return err
+	}
+	geodb = db
+	return nil
+}
+
+func GeoBlock(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if geodb == nil || r.Method == "OPTIONS" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ip := ClientIP(r)
+		country := ""
+		if ip != nil {
+			country = geodb.Country(ip)
+		}
+		if !GeoAllowed(country) {
+			if country == "" {
+				country = "unknown"
+			}
+			RequestLog(r).Info("Geo-blocked %s from %s (%s)", r.URL.Path, ip, country)
+			WriteError(w, r, ErrGeoBlocked)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func mmdbString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+// geoFixture builds an IPv4 database with 24-bit records that maps
+// 1.0.0.0/8 to data and everything else to nothing. nodeCount is written
+// to the metadata as a uint64.
+func geoFixture(data []byte, nodeCount uint64) []byte {
+	const nodes = 8
+	var buf bytes.Buffer
+	for i := uint(0); i < nodes; i++ {
+		next := i + 1
+		if i == nodes-1 {
+			next = nodes + 16
+		}
+		left, right := uint(nodes), uint(nodes)
+		if 1>>(7-i)&1 == 1 {
+			right = next
+		} else {
+			left = next
+		}
+		buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.Write(mmdbMarker)
+	buf.WriteByte(0xe3)
+	buf.Write(mmdbString("node_count"))
+	buf.Write([]byte{0x08, 0x02})
+	for i := 7; i >= 0; i-- {
+		buf.WriteByte(byte(nodeCount >> (8 * uint(i))))
+	}
+	buf.Write(mmdbString("record_size"))
+	buf.Write([]byte{0xc1, 24})
+	buf.Write(mmdbString("ip_version"))
+	buf.Write([]byte{0xa1, 4})
+	return buf.Bytes()
+}
+
+func countryRecord(code string) []byte {
+	data := []byte{0xe1}
+	data = append(data, mmdbString("country")...)
+	data = append(data, 0xe1)
+	data = append(data, mmdbString("iso_code")...)
+	return append(data, mmdbString(code)...)
+}
+
+func TestGeoDBLookup(t *testing.T) {
+	db, err := ParseGeoDB(geoFixture(countryRecord("AU"), 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := db.Country(net.ParseIP("1.2.3.4")); c != "AU" {
+		t.Errorf("1.2.3.4 is in %q", c)
+	}
+	if c := db.Country(net.ParseIP("2.2.3.4")); c != "" {
+		t.Errorf("2.2.3.4 is in %q", c)
+	}
+}
+
+func TestGeoDBTruncated(t *testing.T) {
+	full := geoFixture(countryRecord("AU"), 8)
+	for n := 0; n < len(full); n++ {
+		db, err := ParseGeoDB(full[:n])
+		if err == nil {
+			db.Lookup(net.ParseIP("1.2.3.4"))
+		}
+	}
+}
+
+func TestGeoDBHostile(t *testing.T) {
+	for name, buf := range map[string][]byte{
+		"self pointer":   geoFixture([]byte{0x20, 0x00}, 8),
+		"huge map":       geoFixture([]byte{0xff, 0xff, 0xff, 0xff}, 8),
+		"huge array":     geoFixture([]byte{0x1f, 0x04, 0xff, 0xff, 0xff}, 8),
+		"node overflow":  geoFixture(countryRecord("AU"), 3074457345618258603),
+		"data too short": geoFixture([]byte{0xe1}, 8),
+	} {
+		db, err := ParseGeoDB(buf)
+		if err != nil {
+			continue
+		}
+		if _, err := db.Lookup(net.ParseIP("1.2.3.4")); err == nil {
+			t.Errorf("%s: lookup succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	groups     = map[string]*Group{}
+	groupsLock sync.Mutex
+
+	ErrGroupClosed = errors.New("group is closed")
+)
+
+type GroupFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+	path   string
+}
+
+type Contribution struct {
+	Sender    string `json:",omitempty"`
+	RequestID string
+	Time      time.Time
+	Message   string `json:",omitempty"`
+	Files     []GroupFile
+	uploader  net.IP
+}
+
+type Group struct {
+	sync.Mutex
+	key           string
+	dir           string
+	Created       time.Time
+	Expires       time.Time
+	Status        Status
+	Contributions []Contribution
+	timeline      Timeline
+	split         *SplitArchive
+	Hold          *LegalHold       `json:"-"`
+	Incomplete    []IncompleteFile `json:",omitempty"`
+	receiver      net.IP
+	forwardUntil  time.Time
+	Pin           *Pin `json:"-"`
+}
+
+// GroupView is what GroupStatusHandler reveals about a group. It leaves
+// out the names contributors gave themselves.
+type GroupView struct {
+	Created       time.Time
+	Expires       time.Time
+	Status        Status
+	Contributions []ContributionView
+	Incomplete    []IncompleteFile `json:",omitempty"`
+}
+
+type ContributionView struct {
+	RequestID string
+	Time      time.Time
+	Message   string `json:",omitempty"`
+	Files     []GroupFile
+}
+
+func (g *Group) View() GroupView {
+	v := GroupView{g.Created, g.Expires, g.Status, []ContributionView{}, g.Incomplete}
+	for _, c := range g.Contributions {
+		v.Contributions = append(v.Contributions, ContributionView{c.RequestID, c.Time, c.Message, c.Files})
+	}
+	return v
+}
+
+func (g *Group) Open() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.Status == WAITING_RECEIVER && g.split == nil && clock.Now().Before(g.Expires)
+}
+
+func (g *Group) Remove() {
+	g.Lock()
+	reason := g.Status.String()
+	g.Unlock()
+	BurnSpool(g.key, reason, g.dir)
+}
+
+func (g *Group) SetPin(pin *Pin) error {
+	if pin == nil {
+		return nil
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.Pin != nil || len(g.Contributions) > 0 {
+		return ErrGroupPinned
+	}
+	g.Pin = pin
+	return nil
+}
+
+// DiscardGroup removes a group that a failed upload created, unless a
+// contribution arrived in the meantime.
+func DiscardGroup(id string) {
+	groupsLock.Lock()
+	group, exists := groups[id]
+	if !exists {
+		groupsLock.Unlock()
+		return
+	}
+	group.Lock()
+	empty := len(group.Contributions) == 0 && group.Hold == nil && group.Status.Set(ABORTED) == nil
+	group.Unlock()
+	if empty {
+		delete(groups, id)
+	}
+	groupsLock.Unlock()
+	if empty {
+		JournalDelete(id)
+		group.Remove()
+	}
+}
+
+// ReceiveError reports why Group.Receive failed. Errors without a mapping
+// come from reading the request.
+func ReceiveError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, status := ErrorStatus(err); status != http.StatusInternalServerError {
+		RequestLog(r).Info("Rejected contribution: %s", err)
+		WriteError(w, r, err)
+		return
+	}
+	RequestLog(r).Info("Upload failed: %s", err)
+	Error(w, r, "upload failed", http.StatusBadRequest)
+}
+
+func SanitizeName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || name == ".." {
+		return "unnamed"
+	}
+	return name
+}
+
+func CreateGroup(id string) (*Group, error) {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	if group, exists := groups[id]; exists {
+		return group, nil
+	}
+
+	dir, err := NewTempDir("group")
+	if err != nil {
+		return nil, err
+	}
+	now := clock.Now()
+	group := &Group{
+		key:     id,
+		dir:     dir,
+		Created: now,
+		Expires: now.Add(time.Minute * time.Duration(conf.GroupWindowMinutes)),
+		Status:  WAITING_RECEIVER,
+	}
+	groups[id] = group
+	group.timeline.Record("created", 0, "")
+	group.journal()
+	return group, nil
+}
+
+func (g *Group) Receive(r *http.Request, mr *multipart.Reader, checksum *ChecksumReader, sender string) error {
+	if !g.Open() {
+		return ErrGroupClosed
+	}
+
+	c := Contribution{
+		Sender:    sender,
+		RequestID: RequestID(r),
+		Time:      clock.Now(),
+		uploader:  ClientIP(r),
+	}
+	c.Message, _ = MessageParam(r)
+	images, _ := ParseImageOptions(r)
+	owner := ClientIP(r).String()
+	remove := func() {
+		for _, f := range c.Files {
+			WipeFile(f.path)
+		}
+		if len(c.Files) > 0 {
+			JournalDiscard(g.key, c.RequestID)
+		}
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			remove()
+			panic(e)
+		}
+	}()
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			remove()
+			return err
+		}
+
+		field := p.FormName()
+		dir, isFile := FileField(field)
+		switch {
+		case field == "sender":
+			name, _ := ioutil.ReadAll(io.LimitReader(p, 64))
+			if s := strings.TrimSpace(string(name)); s != "" {
+				c.Sender = s
+			}
+		case field == "message":
+			text, _ := ioutil.ReadAll(io.LimitReader(p, int64(conf.MaxMessageLength)*4+1))
+			message, err := SenderMessage(string(text))
+			if err != nil {
+				p.Close()
+				remove()
+				return err
+			}
+			c.Message = message
+		case isFile:
+			part, err := CheckPart(p, p.Header)
+			if err != nil {
+				p.Close()
+				remove()
+				return err
+			}
+			src, err := CheckFilePolicy(FieldPath(dir, PartPath(p)), part)
+			if err != nil {
+				p.Close()
+				remove()
+				return err
+			}
+			f, err := g.store(p.FileName(), images.Process(src))
+			if err != nil {
+				p.Close()
+				remove()
+				return err
+			}
+			if err := part.Finish(); err != nil {
+				WipeFile(f.path)
+				p.Close()
+				remove()
+				return err
+			}
+			f.Name = FieldPath(dir, f.Name)
+			c.Files = append(c.Files, f)
+			JournalFile(g.key, c.RequestID, f)
+			RegisterBlob(owner, f)
+		default:
+			RequestLog(r).Info("Ignoring form field %q", field)
+		}
+		p.Close()
+	}
+
+	if err := checksum.Finish(); err != nil {
+		remove()
+		return err
+	}
+	if err := g.add(c); err != nil {
+		remove()
+		return err
+	}
+	return nil
+}
+
+func (g *Group) store(name string, src io.Reader) (GroupFile, error) {
+	fd, err := ioutil.TempFile(g.dir, "part-")
+	if err != nil {
+		return GroupFile{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fd, h), src)
+	if err == nil && Journaling() {
+		err = fd.Sync()
+		if err == nil {
+			err = SyncDir(g.dir)
+		}
+	}
+	fd.Close()
+	if err != nil {
+		WipeFile(fd.Name())
+		return GroupFile{}, err
+	}
+	return GroupFile{
+		SanitizeName(name),
+		n,
+		hex.EncodeToString(h.Sum(nil)),
+		fd.Name(),
+	}, nil
+}
+
+func (g *Group) AddFile(requestID, sender, name string, src io.Reader) (GroupFile, error) {
+	if !g.Open() {
+		return GroupFile{}, ErrGroupClosed
+	}
+	f, err := g.store(name, src)
+	if err != nil {
+		return f, err
+	}
+	c := Contribution{
+		Sender:    sender,
+		RequestID: requestID,
+		Time:      clock.Now(),
+		Files:     []GroupFile{f},
+	}
+	if err := g.add(c); err != nil {
+		WipeFile(f.path)
+		return f, err
+	}
+	return f, nil
+}
+
+func (g *Group) add(c Contribution) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.Status != WAITING_RECEIVER {
+		return ErrGroupClosed
+	}
+	g.Contributions = append(g.Contributions, c)
+	size := int64(0)
+	for _, f := range c.Files {
+		size += f.Size
+	}
+	g.timeline.Record("contribution", size, c.RequestID)
+	g.journal()
+	return nil
+}
+
+func SelectedFiles(r *http.Request) (map[int]bool, error) {
+	values := r.URL.Query()["files"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	selected := map[int]bool{}
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 1 {
+				return nil, fmt.Errorf("invalid file index %q", s)
+			}
+			selected[i] = true
+		}
+	}
+	return selected, nil
+}
+
+func GroupUploadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if DryRun(r) {
+		EchoHandler(w, r)
+		return
+	}
+	if !CheckUploader(w, r) {
+		return
+	}
+
+	if _, exists := GetTransfer(id); exists || Reserved(id) || Presigned(id) {
+		Error(w, r, "key is in use by a transfer", http.StatusBadRequest)
+		return
+	}
+	if _, err := MessageParam(r); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := ParseImageOptions(r); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("X-Passphrase") != "" {
+		Error(w, r, ErrPassphraseGroup.Error(), http.StatusBadRequest)
+		return
+	}
+	pin, err := ParsePin(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pin != nil && pin.First {
+		Error(w, r, ErrPinFirst.Error(), http.StatusBadRequest)
+		return
+	}
+
+	checksum, err := CheckBody(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		Error(w, r, "internal error", http.StatusBadRequest)
+		return
+	}
+
+	groupsLock.Lock()
+	_, existed := groups[id]
+	groupsLock.Unlock()
+	group, err := CreateGroup(id)
+	if err != nil {
+		RequestLog(r).Error("Create group: %s", err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := group.SetPin(pin); err != nil {
+		Error(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := group.Receive(r, mr, checksum, ""); err != nil {
+		if !existed {
+			DiscardGroup(id)
+		}
+		ReceiveError(w, r, err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func GroupStatusHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	groupsLock.Lock()
+	group, exists := groups[id]
+	groupsLock.Unlock()
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+
+	group.Lock()
+	view := group.View()
+	group.Unlock()
+	SetExpiryHeaders(w, view.Expires)
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(view)
+}
+
+func GroupDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	groupsLock.Lock()
+	group, exists := groups[id]
+	groupsLock.Unlock()
+	if !exists {
+		ReceiverError(w, r, "notfound", http.StatusBadRequest)
+		return
+	}
+	if group.Held() {
+		WriteError(w, r, ErrOnHold)
+		return
+	}
+	if Suspended(id) {
+		WriteError(w, r, ErrSuspended)
+		return
+	}
+	group.Lock()
+	pin := group.Pin
+	group.Unlock()
+	if !pin.Allows(ClientIP(r)) {
+		RequestLog(r).Info("Rejected receiver %s for group %s", ClientIP(r), id)
+		pin.Audit(r, id, "", false)
+		ReceiverError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	principal, err := pin.Authorize(r)
+	if err != nil {
+		RequestLog(r).Info("Rejected receiver %q for group %s pinned to %q: %s", principal, id, pin.Receiver, err)
+		pin.Audit(r, id, principal, false)
+		WriteAuthError(w, r, err)
+		return
+	}
+	pin.Audit(r, id, principal, true)
+	selected, err := SelectedFiles(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode, err := ZipMode(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group.Lock()
+	if group.Status.Set(RECEIVER_CONNECTED) != nil {
+		group.Unlock()
+		ReceiverError(w, r, "notfound", http.StatusBadRequest)
+		return
+	}
+	JournalClose(id)
+	group.Status.Set(STREAMING)
+	group.receiver = ClientIP(r)
+	contributions := group.Contributions
+	group.Unlock()
+	group.timeline.Record("receiver connected", 0, ClientIP(r).String())
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+id+".zip")
+	trailers := NewTrailerWriter(w)
+	cw := &CountingWriter{W: trailers}
+	defer func() {
+		stats.Completed(cw.N)
+	}()
+	zout := NewZipWriter(cw)
+	zout.SetMode(mode)
+	err = WriteGroupArchive(zout, contributions, selected)
+	if cerr := zout.Close(); err == nil {
+		err = cerr
+	}
+	trailers.Finish(err)
+	group.Lock()
+	if err != nil {
+		group.Status.Set(FAILED)
+	} else {
+		group.Status.Set(COMPLETED)
+		group.forwardUntil = clock.Now().Add(time.Minute * time.Duration(conf.ForwardMinutes))
+	}
+	group.Unlock()
+	if err != nil {
+		RequestLog(r).Error("Write group archive %s: %s", id, err)
+		group.timeline.Record("failed", cw.N, err.Error())
+		return
+	}
+	group.timeline.Record("completed", cw.N, "")
+	go NotifyWebPush(id, WebPushMessage{conf.Branding.SiteName, id + " was downloaded.", id, "downloaded"})
+}
+
+func WriteGroupArchive(zout *ZipWriter, contributions []Contribution, selected map[int]bool) error {
+	entries := []ZipEntry{}
+	included := []Contribution{}
+	index := 0
+	for i, c := range contributions {
+		dir := fmt.Sprintf("%02d/", i+1)
+		if c.Sender != "" {
+			dir = fmt.Sprintf("%02d-%s/", i+1, SanitizeName(c.Sender))
+		}
+		files := []GroupFile{}
+		for _, f := range c.Files {
+			index++
+			if selected != nil && !selected[index] {
+				continue
+			}
+			entries = append(entries, ZipEntry{dir + f.Name, f.path})
+			files = append(files, f)
+		}
+		if len(files) > 0 {
+			c.Files = files
+			included = append(included, c)
+		}
+	}
+	if err := WriteEntries(zout, entries); err != nil {
+		return err
+	}
+	out, err := zout.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	jenc := json.NewEncoder(out)
+	return jenc.Encode(included)
+}
+
+func CleanGroups() {
+	expired := []*Group{}
+	groupsLock.Lock()
+	grace := time.Minute * time.Duration(conf.TimeoutMinutes)
+	for id, group := range groups {
+		group.Lock()
+		if group.Hold != nil || (group.Status == COMPLETED && clock.Now().Before(group.forwardUntil)) {
+			group.Unlock()
+			continue
+		}
+		if group.Status.Terminal() || clock.Now().After(group.Expires.Add(grace)) {
+			group.Status.Set(EXPIRED)
+			if !group.Status.Active() {
+				if group.Status == EXPIRED {
+					keyspace.KeyExpired()
+				}
+				ArchiveTimeline(id, &group.timeline)
+				waitStats.Observe(&group.timeline)
+				DropWebPush(id)
+				archives.Drop(id)
+				JournalDelete(id)
+				expired = append(expired, group)
+				delete(groups, id)
+			}
+		}
+		group.Unlock()
+	}
+	groupsLock.Unlock()
+	for _, group := range expired {
+		group.Remove()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGroupUploadFailureDiscardsGroup(t *testing.T) {
+	srv := newTestServer(t)
+	key := GenerateKey()
+	body := strings.NewReader("--x\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a\"\r\n\r\ntruncated")
+	resp, err := http.Post(srv.URL+"/group/"+key+"/upload", "multipart/form-data; boundary=x", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("truncated upload responded %d", resp.StatusCode)
+	}
+	groupsLock.Lock()
+	_, exists := groups[key]
+	groupsLock.Unlock()
+	if exists {
+		t.Fatal("failed upload left its group behind")
+	}
+}
+
+func TestGroupDownloadHeldAndAnonymous(t *testing.T) {
+	srv := newTestServer(t)
+	key := GenerateKey()
+	contentType, body := multipartBody(t, []testFile{{"a.txt", []byte("a")}})
+	resp, err := http.Post(srv.URL+"/group/"+key+"/upload", contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	groupsLock.Lock()
+	group := groups[key]
+	groupsLock.Unlock()
+	group.Lock()
+	group.Hold = &LegalHold{"legal", "case 1", clock.Now()}
+	group.Unlock()
+
+	resp, err = http.Get(srv.URL + "/group/" + key + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLocked {
+		t.Fatalf("held group download responded %d", resp.StatusCode)
+	}
+
+	group.Lock()
+	group.Hold = nil
+	group.Unlock()
+	resp, err = http.Get(srv.URL + "/group/" + key + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	files := unzip(t, archive)
+	if string(files["01/a.txt"]) != "a" {
+		t.Errorf("archive holds %d files, want 01/a.txt", len(files))
+	}
+	if manifest := string(files["manifest.json"]); strings.Contains(manifest, "127.0.0.1") || strings.Contains(manifest, "Sender") {
+		t.Errorf("manifest names the contributor's address: %s", manifest)
+	}
+}
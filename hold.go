@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	auditLock sync.Mutex
+
+	ErrOnHold      = errors.New("transfer is on legal hold")
+	ErrNotHoldable = errors.New("only buffered transfers and groups can be held")
+)
+
+type LegalHold struct {
+	By     string
+	Reason string
+	Since  time.Time
+}
+
+type AuditRecord struct {
+	Time      time.Time
+	Action    string
+	Key       string
+	Principal string
+	RequestID string
+	Detail    string `json:",omitempty"`
+}
+
+func Audit(r *http.Request, action, key, detail string) {
+	rec := AuditRecord{clock.Now(), action, key, Principal(r), RequestID(r), detail}
+	RequestLog(r).Info("Audit: %s %s by %q %s", action, key, rec.Principal, detail)
+	writeAudit(rec)
+}
+
+func AuditSystem(action, key, detail string) {
+	rec := AuditRecord{clock.Now(), action, key, "system", "", detail}
+	logger.Info("Audit: %s %s %s", action, key, detail)
+	writeAudit(rec)
+}
+
+func writeAudit(rec AuditRecord) {
+	if conf.AuditFile == "" {
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	fd, err := os.OpenFile(conf.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Error("Write audit log: %s", err)
+		return
+	}
+	defer fd.Close()
+	if err := json.NewEncoder(fd).Encode(rec); err != nil {
+		logger.Error("Write audit log: %s", err)
+	}
+}
+
+func (t *Transfer) Held() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.Hold != nil
+}
+
+func (g *Group) Held() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.Hold != nil
+}
+
+type heldItem struct {
+	Key   string
+	Group bool
+	Hold  *LegalHold
+}
+
+func findHoldable(id string) (*Transfer, *Group) {
+	if transfer, ok := GetTransfer(id); ok {
+		return transfer, nil
+	}
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	return nil, groups[id]
+}
+
+func setHold(id string, hold *LegalHold) (bool, error) {
+	transfer, group := findHoldable(id)
+	switch {
+	case transfer != nil:
+		transfer.Lock()
+		defer transfer.Unlock()
+		if !transfer.buffered {
+			return false, ErrNotHoldable
+		}
+		changed := (transfer.Hold == nil) != (hold == nil)
+		transfer.Hold = hold
+		return changed, nil
+	case group != nil:
+		group.Lock()
+		defer group.Unlock()
+		changed := (group.Hold == nil) != (hold == nil)
+		group.Hold = hold
+		group.journal()
+		return changed, nil
+	}
+	return false, ErrTransferNotFound
+}
+
+func HoldsHandler(w http.ResponseWriter, r *http.Request) {
+	list := []heldItem{}
+	transfersLock.Lock()
+	for id, transfer := range transfers {
+		transfer.Lock()
+		if transfer.Hold != nil {
+			list = append(list, heldItem{id, false, transfer.Hold})
+		}
+		transfer.Unlock()
+	}
+	transfersLock.Unlock()
+	groupsLock.Lock()
+	for id, group := range groups {
+		group.Lock()
+		if group.Hold != nil {
+			list = append(list, heldItem{id, true, group.Hold})
+		}
+		group.Unlock()
+	}
+	groupsLock.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(list)
+}
+
+func PlaceHoldHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var req struct {
+		Reason string
+	}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(&req); err != nil || req.Reason == "" {
+		Error(w, r, "a reason is required", http.StatusBadRequest)
+		return
+	}
+	hold := &LegalHold{Principal(r), req.Reason, clock.Now()}
+	changed, err := setHold(id, hold)
+	if err == ErrNotHoldable {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	if changed {
+		Audit(r, "hold placed", id, req.Reason)
+		if tl, ok := FindTimeline(id); ok {
+			tl.Record("legal hold placed", 0, hold.By)
+		}
+	} else {
+		Audit(r, "hold updated", id, req.Reason)
+	}
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(hold)
+}
+
+func LiftHoldHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	changed, err := setHold(id, nil)
+	if err == ErrNotHoldable {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	if !changed {
+		Error(w, r, "transfer is not on hold", http.StatusNotFound)
+		return
+	}
+	Audit(r, "hold lifted", id, "")
+	if tl, ok := FindTimeline(id); ok {
+		tl.Record("legal hold lifted", 0, Principal(r))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
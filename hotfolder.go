@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type HotFolderConfig struct {
+	Dir         string
+	PollSeconds int
+	BaseURL     string
+	Webhook     string
+}
+
+type HotFile struct {
+	Key      string
+	Name     string
+	Size     int64
+	Download string
+}
+
+type hotEntry struct {
+	size    int64
+	modTime time.Time
+	stable  bool
+}
+
+func HotFolderBaseURL() string {
+	if conf.HotFolder.BaseURL != "" {
+		return strings.TrimRight(conf.HotFolder.BaseURL, "/")
+	}
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
+	return fmt.Sprintf("http://localhost:%d", conf.Port)
+}
+
+func SendHotFile(path string) (HotFile, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return HotFile{}, err
+	}
+	defer fd.Close()
+
+	key, err := GenerateUniqueKey()
+	if err != nil {
+		return HotFile{}, err
+	}
+	group, err := CreateGroup(key)
+	if err != nil {
+		return HotFile{}, err
+	}
+	f, err := group.AddFile(NewRequestID(), "hotfolder", filepath.Base(path), fd)
+	if err != nil {
+		return HotFile{}, err
+	}
+	return HotFile{
+		key,
+		f.Name,
+		f.Size,
+		HotFolderBaseURL() + "/group/" + key + "/download",
+	}, nil
+}
+
+func NotifyHotFile(hf HotFile) {
+	fmt.Printf("%s: %s\n", hf.Name, hf.Download)
+	if conf.HotFolder.Webhook == "" {
+		return
+	}
+	b, _ := json.Marshal(hf)
+	client := OutboundClient("webhook", 30*time.Second)
+	resp, err := client.Post(conf.HotFolder.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		logger.Error("Hot folder webhook for %s: %s", hf.Key, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Error("Hot folder webhook for %s: responded %d", hf.Key, resp.StatusCode)
+	}
+}
+
+func scanHotFolder(seen map[string]*hotEntry) ([]string, error) {
+	infos, err := ioutil.ReadDir(conf.HotFolder.Dir)
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]bool{}
+	ready := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		present[name] = true
+		e, ok := seen[name]
+		if !ok {
+			seen[name] = &hotEntry{size: info.Size(), modTime: info.ModTime()}
+			continue
+		}
+		if e.size != info.Size() || !e.modTime.Equal(info.ModTime()) {
+			e.size, e.modTime, e.stable = info.Size(), info.ModTime(), false
+			continue
+		}
+		if !e.stable {
+			e.stable = true
+			ready = append(ready, name)
+		}
+	}
+	for name := range seen {
+		if !present[name] {
+			delete(seen, name)
+		}
+	}
+	return ready, nil
+}
+
+func WatchHotFolder() {
+	seen := map[string]*hotEntry{}
+	if _, err := scanHotFolder(seen); err != nil {
+		logger.Error("Scan hot folder %s: %s", conf.HotFolder.Dir, err)
+	}
+	for _, e := range seen {
+		e.stable = true
+	}
+	logger.Info("Watching hot folder %s", conf.HotFolder.Dir)
+
+	interval := time.Second * time.Duration(conf.HotFolder.PollSeconds)
+	t := clock.NewTimer(interval)
+	for range t.C() {
+		t.Reset(interval)
+		ready, err := scanHotFolder(seen)
+		if err != nil {
+			logger.Error("Scan hot folder %s: %s", conf.HotFolder.Dir, err)
+			continue
+		}
+		for _, name := range ready {
+			hf, err := SendHotFile(filepath.Join(conf.HotFolder.Dir, name))
+			if err != nil {
+				logger.Error("Send hot folder file %s: %s", name, err)
+				continue
+			}
+			logger.Info("Hot folder file %s is available as %s", name, hf.Key)
+			NotifyHotFile(hf)
+		}
+	}
+}
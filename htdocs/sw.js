@@ -0,0 +1,25 @@
+self.addEventListener("install", function(event) {
+	self.skipWaiting();
+});
+
+self.addEventListener("activate", function(event) {
+	event.waitUntil(self.clients.claim());
+});
+
+self.addEventListener("push", function(event) {
+	var msg = event.data ? event.data.json() : {};
+	event.waitUntil(self.registration.showNotification(msg.Title || "Net.Hermes", {
+		body: msg.Body || "",
+		icon: "/favicon.ico",
+		tag: msg.Key
+	}));
+});
+
+self.addEventListener("notificationclick", function(event) {
+	event.notification.close();
+	event.waitUntil(self.clients.openWindow("/"));
+});
+
+self.addEventListener("fetch", function(event) {
+	event.respondWith(fetch(event.request));
+});
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+type ImageConfig struct {
+	Enabled       bool
+	MaxInputMB    int
+	MaxMegapixels int
+}
+
+type ImageOptions struct {
+	MaxSize int
+	Quality int
+}
+
+func ParseImageOptions(r *http.Request) (*ImageOptions, error) {
+	q := r.URL.Query()
+	if q.Get("downscale") == "" && q.Get("quality") == "" {
+		return nil, nil
+	}
+	if !conf.Images.Enabled {
+		return nil, errors.New("image processing is disabled")
+	}
+	opts := &ImageOptions{Quality: jpeg.DefaultQuality}
+	if s := q.Get("downscale"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 16 {
+			return nil, errors.New("invalid downscale size")
+		}
+		opts.MaxSize = n
+	}
+	if s := q.Get("quality"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			return nil, errors.New("invalid image quality")
+		}
+		opts.Quality = n
+	}
+	return opts, nil
+}
+
+func Downscale(src image.Image, max int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if max <= 0 || (w <= max && h <= max) {
+		return src
+	}
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+func (o *ImageOptions) reencode(data []byte) ([]byte, bool) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return nil, false
+	}
+	if cfg.Width*cfg.Height > conf.Images.MaxMegapixels*1000*1000 {
+		return nil, false
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	scaled := Downscale(img, o.MaxSize)
+	if format == "png" && scaled == img {
+		return nil, false
+	}
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: o.Quality})
+	} else {
+		err = png.Encode(&out, scaled)
+	}
+	if err != nil || out.Len() >= len(data) {
+		return nil, false
+	}
+	return out.Bytes(), true
+}
+
+func (o *ImageOptions) Process(src io.Reader) io.Reader {
+	if o == nil {
+		return src
+	}
+	br := bufio.NewReaderSize(src, 512)
+	head, _ := br.Peek(512)
+	switch http.DetectContentType(head) {
+	case "image/jpeg", "image/png":
+	default:
+		return br
+	}
+	limit := int64(conf.Images.MaxInputMB) * 1024 * 1024
+	data, err := ioutil.ReadAll(io.LimitReader(br, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		return io.MultiReader(bytes.NewReader(data), br)
+	}
+	if out, ok := o.reencode(data); ok {
+		return bytes.NewReader(out)
+	}
+	return bytes.NewReader(data)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+)
+
+const (
+	CHECKSUM_MD5    = "Content-MD5"
+	CHECKSUM_SHA256 = "X-Content-SHA256"
+)
+
+var ErrChecksumMismatch = errors.New("upload was corrupted in transit")
+
+type Checksum struct {
+	Header string
+	Want   []byte
+}
+
+type Checksums []Checksum
+
+// ParseChecksums reads the digests a sender declared for a request or a
+// multipart part: Content-MD5 as base64 (RFC 1864) and X-Content-SHA256 as
+// hex, like the trailer of the download, or base64.
+func ParseChecksums(h textproto.MIMEHeader) (Checksums, error) {
+	sums := Checksums{}
+	if v := h.Get(CHECKSUM_MD5); v != "" {
+		want, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(want) != md5.Size {
+			return nil, fmt.Errorf("invalid %s header", CHECKSUM_MD5)
+		}
+		sums = append(sums, Checksum{CHECKSUM_MD5, want})
+	}
+	if v := h.Get(CHECKSUM_SHA256); v != "" {
+		want, err := hex.DecodeString(v)
+		if err != nil {
+			want, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil || len(want) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s header", CHECKSUM_SHA256)
+		}
+		sums = append(sums, Checksum{CHECKSUM_SHA256, want})
+	}
+	return sums, nil
+}
+
+func (sums Checksums) Reader(r io.Reader) *ChecksumReader {
+	cr := &ChecksumReader{R: r}
+	for _, sum := range sums {
+		var h hash.Hash
+		switch sum.Header {
+		case CHECKSUM_MD5:
+			h = md5.New()
+		case CHECKSUM_SHA256:
+			h = sha256.New()
+		}
+		cr.sums = append(cr.sums, sum)
+		cr.hashes = append(cr.hashes, h)
+	}
+	return cr
+}
+
+// ChecksumReader hashes everything read through it and replaces the final
+// io.EOF with ErrChecksumMismatch when a declared digest does not match.
+type ChecksumReader struct {
+	R      io.Reader
+	sums   Checksums
+	hashes []hash.Hash
+}
+
+func (cr *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := cr.R.Read(p)
+	for _, h := range cr.hashes {
+		h.Write(p[:n])
+	}
+	if err == io.EOF {
+		if verr := cr.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+func (cr *ChecksumReader) verify() error {
+	for i, sum := range cr.sums {
+		if got := cr.hashes[i].Sum(nil); !bytes.Equal(got, sum.Want) {
+			return fmt.Errorf("%w: %s is %s, received data hashes to %s", ErrChecksumMismatch, sum.Header, hex.EncodeToString(sum.Want), hex.EncodeToString(got))
+		}
+	}
+	return nil
+}
+
+// Finish reads whatever the consumer left unread and reports whether the
+// data matched the declared digests.
+func (cr *ChecksumReader) Finish() error {
+	if cr == nil {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, cr)
+	return err
+}
+
+// CheckBody makes the request body verify the digests declared in the
+// request headers, which cover the whole multipart body.
+func CheckBody(r *http.Request) (*ChecksumReader, error) {
+	sums, err := ParseChecksums(textproto.MIMEHeader(r.Header))
+	if err != nil {
+		return nil, err
+	}
+	cr := sums.Reader(r.Body)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{cr, r.Body}
+	return cr, nil
+}
+
+func CheckPart(p io.Reader, h textproto.MIMEHeader) (*ChecksumReader, error) {
+	sums, err := ParseChecksums(h)
+	if err != nil {
+		return nil, err
+	}
+	return sums.Reader(p), nil
+}
+
+func FailureStatus(err error) Status {
+	if errors.Is(err, ErrChecksumMismatch) {
+		return CORRUPTED
+	}
+	return FAILED
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"math/rand"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const KEY_RESERVED = "/?#%"
+
+var (
+	keys *KeyParser
+
+	ErrInvalidKey = errors.New("invalid transfer key")
+)
+
+type KeyParser struct {
+	runes  []rune
+	set    map[rune]bool
+	length int
+}
+
+func NewKeyParser(charset string, length int) (*KeyParser, error) {
+	if length < 1 {
+		return nil, errors.New("KeyLength must be at least 1")
+	}
+	if charset == "" {
+		return nil, errors.New("KeyCharset must not be empty")
+	}
+	if !utf8.ValidString(charset) {
+		return nil, errors.New("KeyCharset is not valid UTF-8")
+	}
+	p := &KeyParser{set: map[rune]bool{}, length: length}
+	for _, c := range charset {
+		switch {
+		case p.set[c]:
+			return nil, fmt.Errorf("KeyCharset contains %q twice", c)
+		case strings.ContainsRune(KEY_RESERVED, c):
+			return nil, fmt.Errorf("KeyCharset must not contain %q", c)
+		case unicode.IsSpace(c) || !unicode.IsGraphic(c):
+			return nil, fmt.Errorf("KeyCharset must not contain whitespace or control character %U", c)
+		}
+		p.set[c] = true
+		p.runes = append(p.runes, c)
+	}
+	return p, nil
+}
+
+func (p *KeyParser) Valid(key string) bool {
+	n := 0
+	for _, c := range key {
+		if n == p.length || !p.set[c] {
+			return false
+		}
+		n++
+	}
+	return n == p.length && utf8.ValidString(key)
+}
+
+func (p *KeyParser) Generate() string {
+	key := make([]rune, p.length)
+	for i := range key {
+		key[i] = p.runes[rand.Intn(len(p.runes))]
+	}
+	return string(key)
+}
+
+func (p *KeyParser) Charset() int {
+	return len(p.runes)
+}
+
+func CheckKeyConfig() error {
+	p, err := NewKeyParser(conf.KeyCharset, conf.KeyLength)
+	if err != nil {
+		return err
+	}
+	keys = p
+	return nil
+}
+
+func KeyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := mux.Vars(r)["id"]; ok && !keys.Valid(id) {
+			Anomaly(ClientIP(r).String(), ANOMALY_KEY)
+			WriteError(w, r, ErrInvalidKey)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var adversarialCharsets = []string{
+	"abc]",
+	"]^-\\",
+	"a-z",
+	".*+",
+	"(a|b)",
+	"{}[]",
+	"^$",
+	"ab\\d",
+	"äöüß",
+	"日本語",
+	"🙂🙃x",
+	"(:a+)+$",
+}
+
+func TestKeyParserAdversarialCharsets(t *testing.T) {
+	for _, charset := range adversarialCharsets {
+		p, err := NewKeyParser(dedupe(charset), 6)
+		if err != nil {
+			t.Errorf("%q rejected: %s", charset, err)
+			continue
+		}
+		for i := 0; i < 50; i++ {
+			key := p.Generate()
+			if utf8.RuneCountInString(key) != 6 || !p.Valid(key) {
+				t.Fatalf("%q: generated key %q is not valid", charset, key)
+			}
+		}
+		for _, key := range []string{"", "!!!!!!", strings.Repeat(string([]rune(dedupe(charset))[0]), 7), "\xff\xff\xff\xff\xff\xff"} {
+			if p.Valid(key) {
+				t.Errorf("%q: accepted %q", charset, key)
+			}
+		}
+	}
+}
+
+func TestKeyParserRejectsUnsafeCharsets(t *testing.T) {
+	for _, charset := range []string{"", "ab/", "ab?", "ab#", "ab%", "ab c", "ab\t", "ab\x00", "aba", "ab\xff"} {
+		if _, err := NewKeyParser(charset, 6); err == nil {
+			t.Errorf("%q accepted", charset)
+		}
+	}
+	if _, err := NewKeyParser("abc", 0); err == nil {
+		t.Error("key length 0 accepted")
+	}
+}
+
+func TestKeyParserLinearTime(t *testing.T) {
+	p, err := NewKeyParser(dedupe("(:a+)+$"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.Repeat("a", 1<<20) + "!"
+	start := time.Now()
+	if p.Valid(key) {
+		t.Fatal("long key accepted")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("rejecting a long key took %s", d)
+	}
+}
+
+func TestKeyGuardRouting(t *testing.T) {
+	saved := keys
+	t.Cleanup(func() { keys = saved })
+	for _, charset := range adversarialCharsets {
+		p, err := NewKeyParser(dedupe(charset), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = p
+		r := mux.NewRouter()
+		r.Handle("/download/{id}", KeyGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(mux.Vars(r)["id"]))
+		})))
+		key := p.Generate()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/download/"+url.PathEscape(key), nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != key {
+			t.Errorf("%q: key %q routed to %d %q", charset, key, rec.Code, rec.Body.String())
+		}
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/download/"+url.PathEscape(key+key), nil))
+		if rec.Code != http.StatusNotFound || rec.Header().Get("X-Error-Code") != "invalid-key" {
+			t.Errorf("%q: overlong key answered %d", charset, rec.Code)
+		}
+	}
+}
+
+func dedupe(charset string) string {
+	seen := map[rune]bool{}
+	out := []rune{}
+	for _, c := range charset {
+		if !seen[c] {
+			seen[c] = true
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
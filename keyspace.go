@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	KEYSPACE_WINDOW = 1000
+)
+
+type KeySpaceConfig struct {
+	CollisionRate float64
+	Occupancy     float64
+	Webhook       string
+}
+
+type KeySpace struct {
+	sync.Mutex
+	Issued     int64
+	Collisions int64
+	Exhausted  int64
+	Expired    int64
+	window     [KEYSPACE_WINDOW]bool
+	next       int
+	filled     int
+	alerting   bool
+}
+
+type KeySpaceReport struct {
+	Issued        int64
+	Collisions    int64
+	Exhausted     int64
+	Expired       int64
+	CollisionRate float64
+	ActiveKeys    int
+	Size          float64
+	Occupancy     float64
+	Alert         string `json:",omitempty"`
+}
+
+var keyspace = &KeySpace{}
+
+func KeySpaceSize() float64 {
+	return math.Pow(float64(keys.Charset()), float64(conf.KeyLength))
+}
+
+func ActiveKeys() int {
+	transfersLock.Lock()
+	n := len(transfers)
+	transfersLock.Unlock()
+	groupsLock.Lock()
+	n += len(groups)
+	groupsLock.Unlock()
+	reservationsLock.Lock()
+	n += len(reservations)
+	reservationsLock.Unlock()
+	importedLock.Lock()
+	n += len(imported)
+	importedLock.Unlock()
+	return n
+}
+
+func (k *KeySpace) attempt(collision bool) {
+	k.window[k.next] = collision
+	k.next = (k.next + 1) % KEYSPACE_WINDOW
+	if k.filled < KEYSPACE_WINDOW {
+		k.filled++
+	}
+	if collision {
+		k.Collisions++
+	}
+}
+
+func (k *KeySpace) Record(collisions int, issued bool) {
+	k.Lock()
+	for i := 0; i < collisions; i++ {
+		k.attempt(true)
+	}
+	if issued {
+		k.attempt(false)
+		k.Issued++
+	} else {
+		k.Exhausted++
+	}
+	k.Unlock()
+	k.Check()
+}
+
+func (k *KeySpace) KeyExpired() {
+	k.Lock()
+	defer k.Unlock()
+	k.Expired++
+}
+
+func (k *KeySpace) Report() KeySpaceReport {
+	active := ActiveKeys()
+	size := KeySpaceSize()
+	k.Lock()
+	defer k.Unlock()
+	rep := KeySpaceReport{
+		Issued:     k.Issued,
+		Collisions: k.Collisions,
+		Exhausted:  k.Exhausted,
+		Expired:    k.Expired,
+		ActiveKeys: active,
+		Size:       size,
+	}
+	if k.filled > 0 {
+		n := 0
+		for _, c := range k.window[:k.filled] {
+			if c {
+				n++
+			}
+		}
+		rep.CollisionRate = float64(n) / float64(k.filled)
+	}
+	if size > 0 {
+		rep.Occupancy = float64(active) / size
+	}
+	return rep
+}
+
+func (r KeySpaceReport) alert() string {
+	switch {
+	case conf.KeySpace.CollisionRate > 0 && r.CollisionRate >= conf.KeySpace.CollisionRate:
+		return fmt.Sprintf("key collision rate %.4f reached threshold %.4f", r.CollisionRate, conf.KeySpace.CollisionRate)
+	case conf.KeySpace.Occupancy > 0 && r.Occupancy >= conf.KeySpace.Occupancy:
+		return fmt.Sprintf("key space occupancy %.6f reached threshold %.6f", r.Occupancy, conf.KeySpace.Occupancy)
+	}
+	return ""
+}
+
+func (k *KeySpace) Check() KeySpaceReport {
+	rep := k.Report()
+	rep.Alert = rep.alert()
+	k.Lock()
+	changed := k.alerting != (rep.Alert != "")
+	k.alerting = rep.Alert != ""
+	k.Unlock()
+	if !changed {
+		return rep
+	}
+	if rep.Alert != "" {
+		logger.Warn("Key space: %s (%d active keys, %d collisions)", rep.Alert, rep.ActiveKeys, rep.Collisions)
+	} else {
+		logger.Info("Key space back below thresholds")
+	}
+	if conf.KeySpace.Webhook != "" {
+		go FireKeySpaceWebhook(rep)
+	}
+	return rep
+}
+
+func FireKeySpaceWebhook(rep KeySpaceReport) {
+	b, _ := json.Marshal(rep)
+	client := OutboundClient("webhook", 30*time.Second)
+	resp, err := client.Post(conf.KeySpace.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		logger.Error("Key space webhook: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Error("Key space webhook responded %d", resp.StatusCode)
+	}
+}
+
+type Health struct {
+	Status      string
+	Draining    bool
+	Maintenance bool
+	KeySpace    KeySpaceReport
+	Regions     []RegionStatus `json:",omitempty"`
+}
+
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	h := Health{
+		Status:      "ok",
+		Draining:    Draining(),
+		Maintenance: CurrentMaintenance() != nil,
+		KeySpace:    keyspace.Check(),
+	}
+	if len(conf.Regions.Nodes) > 0 {
+		h.Regions = RegionStatuses()
+	}
+	if h.KeySpace.Alert != "" {
+		h.Status = "warning"
+	}
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(h)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type Limits struct {
+	MaxBytes         int64
+	MaxMessageLength int
+	AllowExtensions  []string
+	DenyExtensions   []string
+	AllowTypes       []string
+	DenyTypes        []string
+	Expiry           ExpiryLimits
+	Append           AppendLimits
+	Quota            *QuotaLimits `json:",omitempty"`
+}
+
+type ExpiryLimits struct {
+	TimeoutMinutes     int
+	ExtendMinutes      int
+	MaxTransferMinutes int
+}
+
+type AppendLimits struct {
+	MaxFiles int
+	MaxBytes int64
+}
+
+type QuotaLimits struct {
+	Month              string
+	MonthlyBytes       int64
+	MonthlyTransfers   int
+	UsedBytes          int64
+	UsedTransfers      int
+	RemainingBytes     int64
+	RemainingTransfers int
+}
+
+func remaining(limit, used int64) int64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+func ClientLimits(token string) Limits {
+	p := conf.FilePolicy
+	l := Limits{
+		MaxMessageLength: conf.MaxMessageLength,
+		AllowExtensions:  p.AllowExtensions,
+		DenyExtensions:   p.DenyExtensions,
+		AllowTypes:       p.AllowTypes,
+		DenyTypes:        p.DenyTypes,
+		Expiry: ExpiryLimits{
+			TimeoutMinutes:     conf.TimeoutMinutes,
+			ExtendMinutes:      conf.ExtendMinutes,
+			MaxTransferMinutes: conf.MaxTransferMinutes,
+		},
+		Append: AppendLimits{MaxFiles: conf.AppendMaxFiles},
+	}
+	if conf.AppendMaxMB > 0 {
+		l.Append.MaxBytes = int64(conf.AppendMaxMB) * 1024 * 1024
+	}
+
+	quota, used, ok := QuotaUsage(token)
+	if !ok {
+		return l
+	}
+	q := &QuotaLimits{
+		Month:            used.Month,
+		MonthlyBytes:     quota.MonthlyBytes,
+		MonthlyTransfers: quota.MonthlyTransfers,
+		UsedBytes:        used.Bytes,
+		UsedTransfers:    used.Transfers,
+	}
+	if quota.MonthlyBytes > 0 {
+		q.RemainingBytes = remaining(quota.MonthlyBytes, used.Bytes)
+		l.MaxBytes = q.RemainingBytes
+	}
+	if quota.MonthlyTransfers > 0 {
+		q.RemainingTransfers = int(remaining(int64(quota.MonthlyTransfers), int64(used.Transfers)))
+	}
+	l.Quota = q
+	return l
+}
+
+func LimitsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(ClientLimits(BearerToken(r)))
+}
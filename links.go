@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	PUNY_BASE    = 36
+	PUNY_TMIN    = 1
+	PUNY_TMAX    = 26
+	PUNY_SKEW    = 38
+	PUNY_DAMP    = 700
+	PUNY_BIAS    = 72
+	PUNY_INITIAL = 128
+	ACE_PREFIX   = "xn--"
+)
+
+var (
+	publicBaseURL string
+
+	ErrInvalidHost = errors.New("invalid host name")
+)
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= PUNY_DAMP
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((PUNY_BASE-PUNY_TMIN)*PUNY_TMAX)/2 {
+		delta /= PUNY_BASE - PUNY_TMIN
+		k += PUNY_BASE
+	}
+	return k + (PUNY_BASE-PUNY_TMIN+1)*delta/(delta+PUNY_SKEW)
+}
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return PUNY_TMIN
+	case k >= bias+PUNY_TMAX:
+		return PUNY_TMAX
+	}
+	return k - bias
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyValue(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
+
+func PunyEncode(label string) string {
+	runes := []rune(label)
+	out := []byte{}
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := PUNY_INITIAL, 0, PUNY_BIAS
+	for handled < len(runes) {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := PUNY_BASE; ; k += PUNY_BASE {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(PUNY_BASE-t)))
+				q = (q - t) / (PUNY_BASE - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func PunyDecode(label string) (string, error) {
+	out := []rune{}
+	pos := 0
+	if b := strings.LastIndexByte(label, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if label[i] >= utf8.RuneSelf {
+				return "", ErrInvalidHost
+			}
+			out = append(out, rune(label[i]))
+		}
+		pos = b + 1
+	}
+	n, i, bias := PUNY_INITIAL, 0, PUNY_BIAS
+	for pos < len(label) {
+		old, w := i, 1
+		for k := PUNY_BASE; ; k += PUNY_BASE {
+			if pos >= len(label) {
+				return "", ErrInvalidHost
+			}
+			d, ok := punyValue(label[pos])
+			pos++
+			if !ok {
+				return "", ErrInvalidHost
+			}
+			i += d * w
+			t := punyThreshold(k, bias)
+			if d < t {
+				break
+			}
+			w *= PUNY_BASE - t
+			if i > utf8.MaxRune*64 || w > utf8.MaxRune*64 {
+				return "", ErrInvalidHost
+			}
+		}
+		bias = punyAdapt(i-old, len(out)+1, old == 0)
+		n += i / (len(out) + 1)
+		i %= len(out) + 1
+		if n > utf8.MaxRune {
+			return "", ErrInvalidHost
+		}
+		out = append(out[:i], append([]rune{rune(n)}, out[i:]...)...)
+		i++
+	}
+	return string(out), nil
+}
+
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func HostToASCII(host string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(host), "."), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			ace := ACE_PREFIX + PunyEncode(label)
+			if back, err := PunyDecode(ace[len(ACE_PREFIX):]); err != nil || back != label {
+				return "", ErrInvalidHost
+			}
+			label = ace
+		}
+		if !validLabel(label) {
+			return "", ErrInvalidHost
+		}
+		labels[i] = label
+	}
+	if len(strings.Join(labels, ".")) > 253 {
+		return "", ErrInvalidHost
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func HostToUnicode(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(label, ACE_PREFIX) {
+			continue
+		}
+		if u, err := PunyDecode(label[len(ACE_PREFIX):]); err == nil {
+			labels[i] = u
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func splitHostPort(hostport string) (string, string, bool) {
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return "", "", false
+		}
+		rest := hostport[end+1:]
+		if rest != "" && !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		return hostport[1:end], strings.TrimPrefix(rest, ":"), true
+	}
+	if strings.Count(hostport, ":") > 1 {
+		return hostport, "", true
+	}
+	host, port, _ := strings.Cut(hostport, ":")
+	return host, port, true
+}
+
+func LinkHost(hostport, scheme string) (string, error) {
+	host, port, ok := splitHostPort(hostport)
+	if !ok || host == "" {
+		return "", ErrInvalidHost
+	}
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return "", ErrInvalidHost
+		}
+		port = strconv.Itoa(p)
+		if (scheme == "http" && p == 80) || (scheme == "https" && p == 443) {
+			port = ""
+		}
+	}
+
+	addr, zone, zoned := strings.Cut(host, "%")
+	zone = strings.TrimPrefix(zone, "25")
+	if ip := net.ParseIP(addr); ip != nil {
+		switch {
+		case !strings.Contains(addr, ":") && !zoned:
+			host = ip.String()
+		case strings.Contains(addr, ":") && (!zoned || zone != ""):
+			host = "[" + strings.ToLower(addr)
+			if zoned {
+				host += "%25" + url.PathEscape(zone)
+			}
+			host += "]"
+		default:
+			return "", ErrInvalidHost
+		}
+	} else {
+		ascii, err := HostToASCII(host)
+		if err != nil {
+			return "", err
+		}
+		host = ascii
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return host, nil
+}
+
+func CheckPublicBaseURL() error {
+	publicBaseURL = ""
+	if conf.PublicBaseURL == "" {
+		return nil
+	}
+	u, err := url.Parse(strings.TrimRight(conf.PublicBaseURL, "/"))
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("PublicBaseURL must be an http or https URL without query")
+	}
+	host, err := LinkHost(u.Host, u.Scheme)
+	if err != nil {
+		return err
+	}
+	publicBaseURL = u.Scheme + "://" + host + u.EscapedPath()
+	return nil
+}
+
+func RequestBaseURL(r *http.Request) string {
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, err := LinkHost(r.Host, scheme)
+	if err != nil {
+		return HotFolderBaseURL()
+	}
+	return scheme + "://" + host
+}
+
+func DisplayURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	host, port, ok := splitHostPort(u.Host)
+	if !ok || strings.HasPrefix(u.Host, "[") {
+		return link
+	}
+	host = HostToUnicode(host)
+	if port != "" {
+		host += ":" + port
+	}
+	return u.Scheme + "://" + host + u.EscapedPath()
+}
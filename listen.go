@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type AdminListenerConfig struct {
+	Address   string
+	Exclusive bool
+}
+
+func AddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+func ListenWithFallback() (net.Listener, error) {
+	ports := append([]int{conf.Port}, conf.FallbackPorts...)
+	if conf.EphemeralFallback {
+		ports = append(ports, 0)
+	}
+
+	var lastErr error
+	for _, port := range ports {
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return l, nil
+		}
+		if !AddrInUse(err) {
+			return nil, err
+		}
+		logger.Warn("Port %d is busy", port)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func Announce(addr net.Addr) {
+	port := addr.(*net.TCPAddr).Port
+	scheme := "http"
+	if conf.TLS.Enabled() {
+		scheme = "https"
+	}
+	endpoint := fmt.Sprintf("%s://localhost:%d/", scheme, port)
+	logger.Info("Listening on %s (%s)", addr, endpoint)
+	fmt.Printf("%s is listening on %s\n", Build(), endpoint)
+
+	if conf.EndpointFile != "" {
+		if err := ioutil.WriteFile(conf.EndpointFile, []byte(endpoint+"\n"), 0644); err != nil {
+			logger.Error("Write endpoint file: %s", err)
+		}
+	}
+}
+
+func ListenAdmin(address string) (net.Listener, error) {
+	path := strings.TrimPrefix(address, "unix:")
+	if path == address {
+		return net.Listen("tcp", address)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func ServeAdmin() {
+	l, err := ListenAdmin(conf.AdminListener.Address)
+	if err != nil {
+		logger.Critical("Admin listener: %s", err)
+		os.Exit(1)
+	}
+	logger.Info("Admin API listening on %s (exclusive: %t)", conf.AdminListener.Address, conf.AdminListener.Exclusive)
+	logger.Critical("Admin listener: %s", http.Serve(l, IdentifyAdmin(AdminRoutes())))
+	os.Exit(1)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"code.google.com/p/log4go"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_FILE   = "./log/http.log"
+	LOG_FORMAT = "[%D %T] [%L] %M"
+)
+
+var (
+	fileLogging    bool
+	loggerInjected bool
+)
+
+type StreamLogWriter struct {
+	sync.Mutex
+	W io.Writer
+}
+
+func (s *StreamLogWriter) LogWrite(rec *log4go.LogRecord) {
+	s.Lock()
+	defer s.Unlock()
+	fmt.Fprint(s.W, log4go.FormatLogRecord(LOG_FORMAT, rec))
+}
+
+func (s *StreamLogWriter) Close() {}
+
+// SetLogger makes Startup use l instead of building a logger from
+// LogOutputs, for programs that embed the server.
+func SetLogger(l log4go.Logger) {
+	logger = l
+	loggerInjected = true
+}
+
+// SetupLogging builds the logger from LogOutputs. A log file that cannot
+// be written is not fatal: the server warns and logs to stderr instead,
+// so it still starts in read-only containers.
+func SetupLogging() {
+	if loggerInjected {
+		return
+	}
+	l := make(log4go.Logger)
+	warnings := []string{}
+	fallback := false
+	fileLogging = false
+	for _, out := range conf.LogOutputs {
+		switch out {
+		case "file":
+			if err := os.MkdirAll(filepath.Dir(LOG_FILE), 0755); err != nil {
+				warnings = append(warnings, fmt.Sprintf("Cannot create log directory: %s, logging to stderr", err))
+				fallback = true
+				continue
+			}
+			flw := log4go.NewFileLogWriter(LOG_FILE, true)
+			if flw == nil {
+				warnings = append(warnings, fmt.Sprintf("Cannot write %s, logging to stderr", LOG_FILE))
+				fallback = true
+				continue
+			}
+			flw.SetFormat(LOG_FORMAT)
+			flw.SetRotateSize(conf.LogMaxSizeMB * 1024 * 1024)
+			l.AddFilter("file", log4go.INFO, flw)
+			fileLogging = true
+		case "stderr":
+			l.AddFilter("stderr", log4go.INFO, &StreamLogWriter{W: os.Stderr})
+		case "stdout":
+			l.AddFilter("stdout", log4go.INFO, &StreamLogWriter{W: os.Stdout})
+		default:
+			warnings = append(warnings, fmt.Sprintf("Unknown log output %q", out))
+		}
+	}
+	if _, ok := l["stderr"]; !ok && (fallback || len(l) == 0) {
+		l.AddFilter("stderr", log4go.INFO, &StreamLogWriter{W: os.Stderr})
+	}
+	logger = l
+	for _, w := range warnings {
+		logger.Warn(w)
+	}
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().After(s[j].ModTime()) }
+
+func CompressLog(file, target string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(file)
+}
+
+func RotatedLogs() ([]os.FileInfo, error) {
+	dir := filepath.Dir(LOG_FILE)
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	infos, err := fd.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(LOG_FILE) + "."
+	rotated := []os.FileInfo{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), prefix) {
+			rotated = append(rotated, info)
+		}
+	}
+	sort.Sort(byModTime(rotated))
+	return rotated, nil
+}
+
+func PruneLogs() {
+	if !fileLogging {
+		return
+	}
+	dir := filepath.Dir(LOG_FILE)
+	if conf.LogCompress {
+		rotated, err := RotatedLogs()
+		if err != nil {
+			logger.Error("List logs: %s", err)
+			return
+		}
+		for _, info := range rotated {
+			if strings.HasSuffix(info.Name(), ".gz") {
+				continue
+			}
+			target := filepath.Join(dir, fmt.Sprintf("%s.%s.gz",
+				filepath.Base(LOG_FILE), info.ModTime().Format("20060102-150405.000")))
+			if err := CompressLog(filepath.Join(dir, info.Name()), target); err != nil {
+				logger.Error("Compress log %s: %s", info.Name(), err)
+			}
+		}
+	}
+
+	rotated, err := RotatedLogs()
+	if err != nil {
+		logger.Error("List logs: %s", err)
+		return
+	}
+	maxAge := time.Hour * 24 * time.Duration(conf.LogMaxAgeDays)
+	for i, info := range rotated {
+		tooMany := conf.LogMaxFiles > 0 && i >= conf.LogMaxFiles
+		tooOld := conf.LogMaxAgeDays > 0 && clock.Since(info.ModTime()) > maxAge
+		if tooMany || tooOld {
+			if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				logger.Error("Remove log %s: %s", info.Name(), err)
+			}
+		}
+	}
+}
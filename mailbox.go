@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	mailboxes     = map[string]*Mailbox{}
+	mailboxesLock sync.Mutex
+	mailboxName   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+	ErrMailboxNotFound = errors.New("mailbox does not exist")
+	ErrMailboxFull     = errors.New("mailbox quota exceeded")
+	ErrMailboxToken    = errors.New("wrong mailbox token")
+)
+
+type MailboxConfig struct {
+	File                 string
+	Dir                  string
+	DefaultQuotaMB       int
+	DefaultRetentionDays int
+}
+
+type Mailbox struct {
+	Name          string
+	Label         string
+	QuotaMB       int
+	RetentionDays int
+	Created       time.Time
+	DropHash      string
+	CollectHash   string
+	Files         []MailboxFile
+}
+
+type MailboxFile struct {
+	ID       string
+	Name     string
+	Size     int64
+	SHA256   string
+	From     string
+	Received time.Time
+}
+
+type mailboxView struct {
+	Name          string
+	Label         string
+	QuotaMB       int
+	RetentionDays int
+	Created       time.Time
+	Files         []MailboxFile
+	Used          int64
+	DropToken     string `json:",omitempty"`
+	CollectToken  string `json:",omitempty"`
+}
+
+func (m *Mailbox) used() int64 {
+	n := int64(0)
+	for _, f := range m.Files {
+		n += f.Size
+	}
+	return n
+}
+
+func (m *Mailbox) view() mailboxView {
+	return mailboxView{m.Name, m.Label, m.QuotaMB, m.RetentionDays, m.Created, append([]MailboxFile{}, m.Files...), m.used(), "", ""}
+}
+
+func (m *Mailbox) dir() string {
+	return filepath.Join(conf.Mailboxes.Dir, m.Name)
+}
+
+func (m *Mailbox) path(f MailboxFile) string {
+	return filepath.Join(m.dir(), f.ID)
+}
+
+func LoadMailboxes() error {
+	if conf.Mailboxes.File == "" {
+		return nil
+	}
+	list := []*Mailbox{}
+	if err := LoadJSON(conf.Mailboxes.File, &list); err != nil {
+		return err
+	}
+	mailboxesLock.Lock()
+	defer mailboxesLock.Unlock()
+	for _, m := range list {
+		kept := []MailboxFile{}
+		for _, f := range m.Files {
+			if reason := spooledDamage(m.path(f), f.Size); reason != "" {
+				logger.Error("Mailbox %s: dropping %s, %s", m.Name, f.Name, reason)
+				os.Remove(m.path(f))
+				continue
+			}
+			kept = append(kept, f)
+		}
+		m.Files = kept
+		mailboxes[m.Name] = m
+	}
+	return nil
+}
+
+func saveMailboxes() {
+	if conf.Mailboxes.File == "" {
+		return
+	}
+	list := []*Mailbox{}
+	for _, m := range mailboxes {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	if err := SaveJSON(conf.Mailboxes.File, list); err != nil {
+		logger.Error("Save mailboxes: %s", err)
+	}
+}
+
+func CleanMailboxes() {
+	mailboxesLock.Lock()
+	defer mailboxesLock.Unlock()
+	changed := false
+	for _, m := range mailboxes {
+		if m.RetentionDays <= 0 {
+			continue
+		}
+		cutoff := clock.Now().AddDate(0, 0, -m.RetentionDays)
+		kept := m.Files[:0]
+		for _, f := range m.Files {
+			if f.Received.Before(cutoff) {
+				n, err := WipeFile(m.path(f))
+				AuditWipe("box/"+m.Name, "retention of "+f.Name, WipeResult{1, n}, err)
+				logger.Info("Mailbox %s: removed %s after %d days", m.Name, f.Name, m.RetentionDays)
+				changed = true
+				continue
+			}
+			kept = append(kept, f)
+		}
+		m.Files = kept
+	}
+	if changed {
+		saveMailboxes()
+	}
+}
+
+func mailboxToken(r *http.Request) string {
+	return r.Header.Get("X-Box-Token")
+}
+
+func checkMailboxToken(token, hash string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(hash)) == 1
+}
+
+func openMailbox(w http.ResponseWriter, r *http.Request, collect bool) (*Mailbox, bool) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	mailboxesLock.Lock()
+	m, ok := mailboxes[name]
+	hash := ""
+	if ok {
+		hash = m.DropHash
+		if collect {
+			hash = m.CollectHash
+		}
+	}
+	mailboxesLock.Unlock()
+	if !ok {
+		Error(w, r, ErrMailboxNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if !checkMailboxToken(mailboxToken(r), hash) {
+		RequestLog(r).Info("Rejected mailbox %s: wrong token", name)
+		Error(w, r, ErrMailboxToken.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	return m, true
+}
+
+func (m *Mailbox) spool(name, from string, src io.Reader, limit int64) (MailboxFile, error) {
+	if err := os.MkdirAll(m.dir(), 0700); err != nil {
+		return MailboxFile{}, err
+	}
+	f := MailboxFile{ID: randomHex(8), Name: name, From: from, Received: clock.Now()}
+	fd, err := os.OpenFile(m.path(f), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return MailboxFile{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fd, h), io.LimitReader(src, limit+1))
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err == nil {
+		err = SyncDir(m.dir())
+	}
+	fd.Close()
+	if err == nil && n > limit {
+		err = ErrMailboxFull
+	}
+	if err != nil {
+		os.Remove(m.path(f))
+		return MailboxFile{}, err
+	}
+	f.Size = n
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, nil
+}
+
+func (m *Mailbox) free() int64 {
+	mailboxesLock.Lock()
+	defer mailboxesLock.Unlock()
+	return int64(m.QuotaMB)*1024*1024 - m.used()
+}
+
+func MailboxDropHandler(w http.ResponseWriter, r *http.Request) {
+	if !CheckUploader(w, r) {
+		return
+	}
+	m, ok := openMailbox(w, r, false)
+	if !ok {
+		return
+	}
+	mediatype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/form-data" || params["boundary"] == "" {
+		Error(w, r, "multipart body required", http.StatusBadRequest)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		Error(w, r, "multipart body required", http.StatusBadRequest)
+		return
+	}
+
+	from := ClientIP(r).String()
+	files := []MailboxFile{}
+	size := int64(0)
+	remove := func() {
+		for _, f := range files {
+			os.Remove(m.path(f))
+		}
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			remove()
+			Error(w, r, "upload failed", http.StatusBadRequest)
+			return
+		}
+		dir, isFile := FileField(p.FormName())
+		if !isFile {
+			p.Close()
+			continue
+		}
+		name := FieldPath(dir, PartPath(p))
+		src, err := CheckFilePolicy(name, p)
+		if err == nil {
+			var f MailboxFile
+			f, err = m.spool(name, from, src, m.free()-size)
+			if err == nil {
+				files = append(files, f)
+				size += f.Size
+			}
+		}
+		p.Close()
+		if errors.Is(err, ErrMailboxFull) {
+			remove()
+			Error(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			remove()
+			RequestLog(r).Info("Rejected drop into mailbox %s: %s", m.Name, err)
+			WriteError(w, r, err)
+			return
+		}
+	}
+	if len(files) == 0 {
+		Error(w, r, "no files in request", http.StatusBadRequest)
+		return
+	}
+
+	mailboxesLock.Lock()
+	if mailboxes[m.Name] != m {
+		mailboxesLock.Unlock()
+		remove()
+		Error(w, r, ErrMailboxNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if m.used()+size > int64(m.QuotaMB)*1024*1024 {
+		mailboxesLock.Unlock()
+		remove()
+		Error(w, r, ErrMailboxFull.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	m.Files = append(m.Files, files...)
+	saveMailboxes()
+	mailboxesLock.Unlock()
+
+	RequestLog(r).Info("Dropped %d files (%d bytes) into mailbox %s", len(files), size, m.Name)
+	w.Header().Set("Content-Type", "text/javascript")
+	w.WriteHeader(http.StatusCreated)
+	jenc := json.NewEncoder(w)
+	jenc.Encode(files)
+}
+
+func MailboxHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := openMailbox(w, r, true)
+	if !ok {
+		return
+	}
+	mailboxesLock.Lock()
+	view := m.view()
+	mailboxesLock.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(view)
+}
+
+func findMailboxFile(m *Mailbox, id string) (MailboxFile, int) {
+	for i, f := range m.Files {
+		if f.ID == id {
+			return f, i
+		}
+	}
+	return MailboxFile{}, -1
+}
+
+func MailboxFileHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := openMailbox(w, r, true)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	mailboxesLock.Lock()
+	f, i := findMailboxFile(m, vars["fid"])
+	mailboxesLock.Unlock()
+	if i < 0 {
+		Error(w, r, "file not found", http.StatusNotFound)
+		return
+	}
+	fd, err := os.Open(m.path(f))
+	if err != nil {
+		RequestLog(r).Error("Open mailbox file %s/%s: %s", m.Name, f.ID, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(f.Name)}))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", f.Received, fd)
+}
+
+func MailboxDeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := openMailbox(w, r, true)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	mailboxesLock.Lock()
+	f, i := findMailboxFile(m, vars["fid"])
+	if i >= 0 {
+		m.Files = append(m.Files[:i], m.Files[i+1:]...)
+		saveMailboxes()
+	}
+	mailboxesLock.Unlock()
+	if i < 0 {
+		Error(w, r, "file not found", http.StatusNotFound)
+		return
+	}
+	os.Remove(m.path(f))
+	RequestLog(r).Info("Removed %s from mailbox %s", f.Name, m.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func MailboxCollectHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := openMailbox(w, r, true)
+	if !ok {
+		return
+	}
+	mailboxesLock.Lock()
+	files := append([]MailboxFile{}, m.Files...)
+	mailboxesLock.Unlock()
+	if len(files) == 0 {
+		Error(w, r, "mailbox is empty", http.StatusNotFound)
+		return
+	}
+	mode, err := ZipMode(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := []ZipEntry{}
+	seen := map[string]int{}
+	for _, f := range files {
+		name := f.Name
+		if n := seen[name]; n > 0 {
+			ext := filepath.Ext(name)
+			name = fmt.Sprintf("%s (%d)%s", name[:len(name)-len(ext)], n, ext)
+		}
+		seen[f.Name]++
+		entries = append(entries, ZipEntry{name, m.path(f)})
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename="+m.Name+".zip")
+	trailers := NewTrailerWriter(w)
+	zout := NewZipWriter(trailers)
+	zout.SetMode(mode)
+	failure := WriteEntries(zout, entries)
+	if err := zout.Close(); err != nil && failure == nil {
+		failure = err
+	}
+	trailers.Finish(failure)
+	if failure != nil {
+		RequestLog(r).Info("Collecting mailbox %s failed: %s", m.Name, failure)
+		return
+	}
+
+	collected := map[string]bool{}
+	for _, f := range files {
+		collected[f.ID] = true
+		os.Remove(m.path(f))
+	}
+	mailboxesLock.Lock()
+	kept := m.Files[:0]
+	for _, f := range m.Files {
+		if !collected[f.ID] {
+			kept = append(kept, f)
+		}
+	}
+	m.Files = kept
+	saveMailboxes()
+	mailboxesLock.Unlock()
+	RequestLog(r).Info("Collected %d files from mailbox %s", len(files), m.Name)
+}
+
+func MailboxesHandler(w http.ResponseWriter, r *http.Request) {
+	mailboxesLock.Lock()
+	list := []mailboxView{}
+	for _, m := range mailboxes {
+		list = append(list, m.view())
+	}
+	mailboxesLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(list)
+}
+
+func CreateMailboxHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string
+		Label         string
+		QuotaMB       int
+		RetentionDays int
+	}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(&req); err != nil {
+		Error(w, r, "invalid mailbox request", http.StatusBadRequest)
+		return
+	}
+	if !mailboxName.MatchString(req.Name) {
+		Error(w, r, "mailbox names are 1-63 lowercase letters, digits, - or _", http.StatusBadRequest)
+		return
+	}
+	if req.QuotaMB <= 0 {
+		req.QuotaMB = conf.Mailboxes.DefaultQuotaMB
+	}
+	if req.RetentionDays <= 0 {
+		req.RetentionDays = conf.Mailboxes.DefaultRetentionDays
+	}
+	drop := "box_" + randomHex(24)
+	collect := "box_" + randomHex(24)
+	m := &Mailbox{
+		Name:          req.Name,
+		Label:         req.Label,
+		QuotaMB:       req.QuotaMB,
+		RetentionDays: req.RetentionDays,
+		Created:       clock.Now(),
+		DropHash:      hashToken(drop),
+		CollectHash:   hashToken(collect),
+		Files:         []MailboxFile{},
+	}
+	mailboxesLock.Lock()
+	if _, exists := mailboxes[m.Name]; exists {
+		mailboxesLock.Unlock()
+		Error(w, r, "mailbox already exists", http.StatusConflict)
+		return
+	}
+	mailboxes[m.Name] = m
+	saveMailboxes()
+	view := m.view()
+	mailboxesLock.Unlock()
+
+	Audit(r, "mailbox created", m.Name, m.Label)
+	view.DropToken = drop
+	view.CollectToken = collect
+	w.Header().Set("Content-Type", "text/javascript")
+	w.WriteHeader(http.StatusCreated)
+	jenc := json.NewEncoder(w)
+	jenc.Encode(view)
+}
+
+func DeleteMailboxHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	mailboxesLock.Lock()
+	m, ok := mailboxes[name]
+	if ok {
+		delete(mailboxes, name)
+		saveMailboxes()
+	}
+	mailboxesLock.Unlock()
+	if !ok {
+		Error(w, r, ErrMailboxNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	os.RemoveAll(m.dir())
+	Audit(r, "mailbox deleted", name, "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,257 +1,1257 @@
 package main
 
 import (
-	"archive/zip"
+	"bytes"
 	"code.google.com/p/log4go"
+	"compress/flate"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/henkman/nethermes/client"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	KEY_TRIES = 3
+	KEY_TRIES       = 3
+	MAX_PATH_LENGTH = 4096
 )
 
 var (
 	transfers     = map[string]*Transfer{}
+	transfersLock sync.Mutex
 	indextemplate *template.Template
 	conf          Config
 	logger        log4go.Logger
 )
 
 type Config struct {
-	KeyCharset     string
-	KeyLength      int
-	Port           int
-	TimeoutMinutes int
-	CheckMinutes   int
+	KeyCharset           string
+	KeyLength            int
+	Port                 int
+	TimeoutMinutes       int
+	CheckMinutes         int
+	GroupWindowMinutes   int
+	LogMaxSizeMB         int
+	LogMaxFiles          int
+	LogMaxAgeDays        int
+	LogCompress          bool
+	Cors                 CorsConfig
+	Escrow               EscrowConfig
+	SpeedTestMaxMB       int
+	Listeners            []Listener
+	TempDir              string
+	Middleware           map[string][]string
+	SecurityHeaders      map[string]string
+	RateLimit            RateLimitConfig
+	AuthTokens           []string
+	ExternalAuthURL      string
+	ReservationMinutes   int
+	ResumeMinutes        int
+	Failover             FailoverConfig
+	Quotas               map[string]QuotaConfig
+	ReceiveMaxAttempts   int
+	ReceiveWindowMinutes int
+	ZipWorkers           int
+	FallbackPorts        []int
+	EphemeralFallback    bool
+	EndpointFile         string
+	PidFile              string
+	Fetch                FetchConfig
+	Push                 PushConfig
+	Drive                DriveConfig
+	FilePolicy           FilePolicyConfig
+	Mailboxes            MailboxConfig
+	Tunnel               TunnelConfig
+	Regions              RegionsConfig
+	SmallFileBufferBytes int64
+	ExtendMinutes        int
+	MaxTransferMinutes   int
+	HotFolder            HotFolderConfig
+	ZipLevel             int
+	ZipStore             []string
+	PreviewBots          []string
+	Branding             BrandingConfig
+	EventCheckpointMB    int
+	EventKeepMinutes     int
+	AllowSymlinks        bool
+	Headless             bool
+	TLS                  TLSConfig
+	SlowLog              SlowLogConfig
+	Authenticator        string
+	BasicAuthFile        string
+	OIDC                 OIDCConfig
+	ExpiryWarnSeconds    int
+	ExpiryWebhook        string
+	Schedules            ScheduleConfig
+	Geo                  GeoConfig
+	VersionHeader        bool
+	TokensFile           string
+	FileFields           map[string]string
+	KeySpace             KeySpaceConfig
+	Compression          CompressionConfig
+	ForwardMinutes       int
+	MaxMessageLength     int
+	Images               ImageConfig
+	WebPush              WebPushConfig
+	AdminListener        AdminListenerConfig
+	AuditFile            string
+	Proxy                ProxyConfig
+	Proxies              map[string]ProxyConfig
+	ReceiverCommands     map[string]string
+	Abuse                AbuseConfig
+	ArchiveCache         ArchiveCacheConfig
+	EventLog             EventLogConfig
+	Encryption           EncryptionConfig
+	PublicBaseURL        string
+	AppendMaxFiles       int
+	AppendMaxMB          int
+	SpoolWipe            string
+	Signing              SigningConfig
+	Umask                string
+	Presign              PresignConfig
+	Priority             PriorityConfig
+	Gallery              GalleryConfig
+	SAML                 SAMLConfig
+	LogOutputs           []string
+	WAF                  WAFConfig
+	ACME                 ACMEConfig
 }
 
-type Status uint8
+type Transfer struct {
+	sync.Mutex
+	Mr          *multipart.Reader
+	upload      *http.Request
+	Status      Status
+	Pin         *Pin
+	RequestID   string
+	Created     time.Time
+	Token       string
+	Priority    string
+	Usage       Usage
+	Expires     time.Time
+	Message     string
+	Images      *ImageOptions
+	Hold        *LegalHold `json:"-"`
+	buffered    bool
+	buffer      []byte
+	passphrase  string
+	cancelToken string
+	cancelledBy string
+	appendDir   string
+	appended    []AppendedFile
+	failure     error
+	checksum    *ChecksumReader
+	resume      *ResumeSpool
+	timeline    Timeline
+	started     chan struct{}
+	done        chan struct{}
+	cancelled   chan struct{}
+	gallery     *Gallery
+	galleryDone bool
+}
 
-const (
-	WAIT Status = iota
-	INPROGRESS
-	TIMEOUT
-	DONE
-)
+func (t *Transfer) fail(err error) Status {
+	status := FailureStatus(err)
+	t.Lock()
+	t.failure = err
+	t.Unlock()
+	t.SetStatus(status)
+	return status
+}
 
-type Transfer struct {
-	Mr     *multipart.Reader
-	Status Status
+func (t *Transfer) Failure() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.failure
+}
+
+func (t *Transfer) ArchiveName(id string) string {
+	if t.passphrase != "" {
+		return id + ".zip" + client.ENCRYPTED_SUFFIX
+	}
+	return id + ".zip"
+}
+
+func GetTransfer(id string) (*Transfer, bool) {
+	transfersLock.Lock()
+	defer transfersLock.Unlock()
+	transfer, exists := transfers[id]
+	return transfer, exists
+}
+
+func AddTransfer(id string, transfer *Transfer) bool {
+	transfersLock.Lock()
+	defer transfersLock.Unlock()
+	if _, exists := transfers[id]; exists {
+		return false
+	}
+	transfers[id] = transfer
+	JournalKey(id, transfer.Expires)
+	return true
 }
 
 func GenerateUniqueKey() (string, error) {
+	if CurrentMaintenance() != nil {
+		return "", ErrMaintenance
+	}
 	for i := 0; i < KEY_TRIES; i++ {
 		key := GenerateKey()
-		if _, ok := transfers[key]; !ok {
+		groupsLock.Lock()
+		_, grouped := groups[key]
+		groupsLock.Unlock()
+		if _, ok := GetTransfer(key); !ok && !grouped && !Reserved(key) && !Presigned(key) && !Imported(key) && !RegionTaken(key) {
+			keyspace.Record(i, true)
 			return key, nil
 		}
 	}
 
-	return "", errors.New("no unique key found")
+	keyspace.Record(KEY_TRIES, false)
+	logger.Error("No unique key found after %d tries", KEY_TRIES)
+	return "", ErrKeySpaceExhausted
 }
 
 func GenerateKey() string {
-	key := make([]byte, conf.KeyLength)
-	for i := 0; i < conf.KeyLength; i++ {
-		r := rand.Int31n(int32(len(conf.KeyCharset)))
-		key[i] = conf.KeyCharset[r : r+1][0]
-	}
-
-	return string(key)
+	return keys.Generate()
 }
 
 func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	transfer, exists := transfers[id]
+	transfer, exists := GetTransfer(id)
 	if !exists {
-		http.Error(w, "transfer does not exist", http.StatusBadRequest)
+		if Reserved(id) {
+			w.Header().Set("Content-Type", "text/javascript")
+			jenc := json.NewEncoder(w)
+			jenc.Encode(RESERVED)
+			return
+		}
+		WriteError(w, r, ErrTransferNotFound)
 		return
 	}
 
+	SetExpiryHeaders(w, transfer.Deadline())
+	if by := transfer.CancelledBy(); by != "" {
+		w.Header().Set("X-Cancelled-By", by)
+	}
 	w.Header().Set("Content-Type", "text/javascript")
 	jenc := json.NewEncoder(w)
-	jenc.Encode(transfer.Status)
+	jenc.Encode(transfer.CurrentStatus())
+}
+
+func KeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := GenerateUniqueKey()
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	IssueSecret(w, key)
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(key)
 }
 
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if _, exists := transfers[id]; exists {
-		http.Error(w, "internal error", http.StatusBadRequest)
+	if DryRun(r) {
+		EchoHandler(w, r)
+		return
+	}
+	if !CheckUploader(w, r) {
+		return
+	}
+
+	if old, exists := GetTransfer(id); exists && !old.Supersede(r, id) {
+		Error(w, r, "internal error", http.StatusBadRequest)
+		return
+	}
+	if Presigned(id) && !PresignedUpload(r) {
+		RequestLog(r).Info("Rejected upload to %s without its pre-signed link", id)
+		WriteError(w, r, ErrPresignedKey)
+		return
+	}
+
+	groupsLock.Lock()
+	_, grouped := groups[id]
+	groupsLock.Unlock()
+	if grouped {
+		Error(w, r, "key is in use by a group", http.StatusBadRequest)
+		return
+	}
+
+	token := BearerToken(r)
+	if code, msg := CheckQuota(token); code != 0 {
+		RequestLog(r).Info("Rejected upload to %s: %s", id, msg)
+		Error(w, r, msg, code)
+		return
+	}
+
+	if !ClaimReservation(r, id) {
+		RequestLog(r).Info("Rejected upload to %s reserved by another browser", id)
+		Error(w, r, "key is reserved by another sender", http.StatusForbidden)
+		return
+	}
+
+	pin, err := ParsePin(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	message, err := MessageParam(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	images, err := ParseImageOptions(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	passphrase, err := PassphraseParam(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pin != nil && pin.First && (!conf.Gallery.Enabled || passphrase != "") {
+		Error(w, r, ErrPinFirst.Error(), http.StatusBadRequest)
 		return
 	}
 
-	mr, err := r.MultipartReader()
+	mediatype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/form-data" || params["boundary"] == "" {
+		Error(w, r, "internal error", http.StatusBadRequest)
+		return
+	}
+	checksum, err := CheckBody(r)
 	if err != nil {
-		http.Error(w, "internal error", http.StatusBadRequest)
+		Error(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if r.Header.Get("Expect") == "100-continue" {
+		RequestLog(r).Info("Deferring 100 Continue for %s until a receiver connects", id)
+	}
 
+	now := clock.Now()
 	transfer := &Transfer{
-		mr,
-		WAIT,
+		upload:     r,
+		Status:     WAITING_RECEIVER,
+		Pin:        pin,
+		RequestID:  RequestID(r),
+		Created:    now,
+		Token:      token,
+		Priority:   Classify(r),
+		Expires:    now.Add(time.Minute * time.Duration(conf.TimeoutMinutes)),
+		Message:    message,
+		Images:     images,
+		passphrase: passphrase,
+		started:    make(chan struct{}),
+		done:       make(chan struct{}),
+		cancelled:  make(chan struct{}),
 	}
-	transfers[id] = transfer
 
-	timeout := time.After(time.Minute * time.Duration(conf.TimeoutMinutes))
-	for transfer.Status == WAIT {
+	if r.ContentLength > 0 && r.ContentLength <= conf.SmallFileBufferBytes {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+		if err == nil {
+			err = checksum.Finish()
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			RequestLog(r).Info("Rejected upload to %s: %s", id, err)
+			WriteError(w, r, err)
+			return
+		}
+		if err != nil || int64(len(body)) != r.ContentLength {
+			Error(w, r, "upload failed", http.StatusBadRequest)
+			return
+		}
+		upload := r.Clone(context.Background())
+		upload.Body = ioutil.NopCloser(bytes.NewReader(body))
+		transfer.upload = upload
+		transfer.buffered = true
+		transfer.buffer = body
+		if !AddTransfer(id, transfer) {
+			Error(w, r, "internal error", http.StatusBadRequest)
+			return
+		}
+		transfer.timeline.Record("created", int64(len(body)), "buffered in memory")
+		RequestLog(r).Info("Buffered %d bytes for %s in memory", len(body), id)
+		w.Write([]byte("ok"))
+		return
+	}
+	transfer.checksum = checksum
+	if err := MakeRoom(transfer.Priority); err != nil {
+		RequestLog(r).Info("Rejected %s upload to %s: %s", transfer.Priority, id, err)
+		WriteError(w, r, err)
+		return
+	}
+	if !AddTransfer(id, transfer) {
+		Error(w, r, "internal error", http.StatusBadRequest)
+		return
+	}
+	transfer.timeline.Record("created", r.ContentLength, "")
+
+	timeout := clock.NewTimer(transfer.Expires.Sub(now))
+	defer timeout.Stop()
+	warn := clock.NewTimer(transfer.Expires.Sub(now) - ExpiryWindow())
+	defer warn.Stop()
+	var warned time.Time
+	resume := PauseSlowLog(r)
+	finish := func() {
+		resume()
+		<-transfer.done
+		if status := transfer.CurrentStatus(); status != COMPLETED {
+			if err := transfer.Failure(); errors.Is(err, ErrFilePolicy) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrTooLarge) {
+				WriteError(w, r, err)
+				return
+			}
+			msg := "transfer " + strings.ToLower(status.String())
+			if by := transfer.CancelledBy(); by != "" {
+				msg = "transfer cancelled by the " + by
+			}
+			Error(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+	for {
 		select {
-		case <-timeout:
-			http.Error(w, "no receiver found", http.StatusBadRequest)
-			transfer.Status = TIMEOUT
+		case <-transfer.started:
+			finish()
+			return
+		case <-transfer.cancelled:
+			resume()
+			Error(w, r, "transfer cancelled by the "+transfer.CancelledBy(), http.StatusBadRequest)
+			return
+		case <-warn.C():
+			deadline := transfer.Deadline()
+			left := Until(deadline)
+			if left > ExpiryWindow() {
+				warn.Reset(left - ExpiryWindow())
+				continue
+			}
+			if !warned.Equal(deadline) {
+				warned = deadline
+				transfer.timeline.Record("expiring", 0, deadline.Format(time.RFC3339))
+				go FireExpiryWebhook(NewExpiryNotice(id, transfer))
+			}
+			if left > 0 {
+				warn.Reset(left)
+			}
+		case <-timeout.C():
+			if left := Until(transfer.Deadline()); left > 0 {
+				timeout.Reset(left)
+				continue
+			}
+			if transfer.SetStatus(EXPIRED) != nil {
+				finish()
+				return
+			}
+			transfer.timeline.Record("expired", 0, "no receiver connected")
+			Error(w, r, "no receiver found", http.StatusBadRequest)
+			return
+		case <-draining:
+			if transfer.SetStatus(ABORTED) != nil {
+				finish()
+				return
+			}
+			transfer.timeline.Record("moved", 0, "handed over to failover peer")
+			RequestLog(r).Info("Moving waiting upload %s to peer", id)
+			RedirectToPeer(w, r)
+			return
 		}
 	}
-	w.Write([]byte("ok"))
 }
 
 func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	transfer, exists := transfers[id]
-	if !exists || transfer.Status != WAIT {
-		http.Error(w, "transfer does not exist", http.StatusBadRequest)
+	transfer, exists := GetTransfer(id)
+	if exists && r.URL.Query().Has("offset") {
+		ResumeDownload(w, r, id, transfer)
+		return
+	}
+	if !exists || transfer.CurrentStatus() != WAITING_RECEIVER {
+		ReceiverError(w, r, "notfound", http.StatusBadRequest)
+		return
+	}
+	if transfer.Held() {
+		WriteError(w, r, ErrOnHold)
+		return
+	}
+	if Suspended(id) {
+		WriteError(w, r, ErrSuspended)
+		return
+	}
+	selected, err := SelectedFiles(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode, err := ZipMode(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+id+".zip")
-	transfer.Status = INPROGRESS
-	zout := zip.NewWriter(w)
-	defer zout.Close()
+	ip := ClientIP(r)
+	if !transfer.Pin.Allows(ip) {
+		RequestLog(r).Info("Rejected receiver %s for %s uploaded in request %s", ip, id, transfer.RequestID)
+		transfer.Pin.Audit(r, id, "", false)
+		ReceiverError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	principal, err := transfer.Pin.Authorize(r)
+	if err != nil {
+		RequestLog(r).Info("Rejected receiver %q for %s pinned to %q: %s", principal, id, transfer.Pin.Receiver, err)
+		transfer.timeline.Record("receiver rejected", 0, principal)
+		transfer.Pin.Audit(r, id, principal, false)
+		WriteAuthError(w, r, err)
+		return
+	}
+	if !transfer.Pin.Claim(ip) {
+		RequestLog(r).Info("Rejected receiver %s for %s pinned to another address", ip, id)
+		transfer.Pin.Audit(r, id, principal, false)
+		ReceiverError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	transfer.Pin.Audit(r, id, principal, true)
+	if transfer.SetStatus(RECEIVER_CONNECTED) != nil {
+		ReceiverError(w, r, "notfound", http.StatusBadRequest)
+		return
+	}
+	IssueCancelToken(w, id, transfer)
+	transfer.timeline.Record("receiver connected", 0, ip.String())
+	if principal != "" {
+		RequestLog(r).Info("Receiver %s authenticated for %s", principal, id)
+		transfer.timeline.Record("receiver authenticated", 0, principal)
+	}
+	ticket, position := relayQueue.Enqueue(transfer.Priority)
+	if position > 0 {
+		RequestLog(r).Info("Queued %s relay %s at position %d", transfer.Priority, id, position)
+		transfer.timeline.Record("queued", 0, fmt.Sprintf("%s, position %d", transfer.Priority, position))
+	}
+	if err := relayQueue.Wait(r.Context(), ticket, transfer.cancelled); err != nil {
+		transfer.fail(err)
+		close(transfer.started)
+		close(transfer.done)
+		transfer.timeline.Record("failed", 0, "left the relay queue: "+err.Error())
+		ReceiverError(w, r, "aborted", http.StatusBadRequest)
+		return
+	}
+	defer relayQueue.Release()
+
+	body := &CountingReader{R: &ProgressReader{
+		R:        &cancelReader{transfer.upload.Body, transfer.cancelled},
+		Timeline: &transfer.timeline,
+		Every:    int64(conf.EventCheckpointMB) * 1024 * 1024,
+	}}
+	transfer.upload.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, transfer.upload.Body}
+	mr, err := transfer.upload.MultipartReader()
+	if err != nil {
+		transfer.SetStatus(FAILED)
+		close(transfer.started)
+		close(transfer.done)
+		transfer.timeline.Record("failed", 0, err.Error())
+		ReceiverError(w, r, "aborted", http.StatusBadRequest)
+		return
+	}
+	transfer.Mr = mr
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+transfer.ArchiveName(id))
+	transfer.SetStatus(STREAMING)
+	close(transfer.started)
+	defer close(transfer.done)
+	var resume *ResumeSpool
+	if _, spooled := w.(*spoolWriter); !spooled && conf.ResumeMinutes > 0 {
+		resume, err = NewResumeSpool()
+		if err != nil {
+			RequestLog(r).Error("Create resume spool for %s: %s", id, err)
+		}
+	}
+	if resume != nil {
+		transfer.Lock()
+		transfer.resume = resume
+		transfer.Unlock()
+		defer resume.Finish(id, w.Header())
+		w.Header().Set("X-Resumable", "offset")
+		w = &resumeWriter{w, resume, func(err error) {
+			RequestLog(r).Info("Receiver of %s dropped, spooling the rest for resumption: %s", id, err)
+			transfer.timeline.Record("receiver dropped", resume.Size(), err.Error())
+		}}
+	}
+	trailers := NewTrailerWriter(w)
+	var out io.Writer = trailers
+	if conf.Priority.BandwidthKBps > 0 {
+		throttled := bandwidth.Writer(trailers, transfer.Priority)
+		defer bandwidth.Release(throttled)
+		out = throttled
+	}
+	var enc io.WriteCloser
+	if transfer.passphrase != "" {
+		enc, err = client.NewEncryptWriter(out, transfer.passphrase, conf.Encryption.ScryptLogN)
+		if err != nil {
+			transfer.SetStatus(FAILED)
+			transfer.timeline.Record("failed", 0, err.Error())
+			trailers.Finish(err)
+			return
+		}
+		out = enc
+		transfer.timeline.Record("encrypting", 0, "")
+	}
+	cw := &CountingWriter{W: out}
+	tw := &TimingWriter{}
+	transfer.Lock()
+	transfer.Usage.Started = clock.Now()
+	transfer.Unlock()
+	defer func() {
+		transfer.Lock()
+		u := &transfer.Usage
+		u.Finished = clock.Now()
+		u.BytesIn = body.N
+		u.BytesOut = cw.N
+		u.WallSeconds = u.Finished.Sub(u.Started).Seconds()
+		if compress := tw.D - cw.D; compress > 0 {
+			u.CompressSeconds = compress.Seconds()
+		}
+		usage := *u
+		transfer.Unlock()
+		stats.Completed(cw.N)
+		Account(transfer.Token, usage)
+	}()
+	var manifest *Manifest
+	if WantsManifest(r) {
+		manifest = &Manifest{
+			Key:     id,
+			Created: transfer.Created,
+		}
+	}
+	zout := NewZipWriter(cw)
+	zout.SetMode(mode)
+	writeFile := func(name string, src io.Reader) error {
+		entry, err := CreateEntry(zout, name)
+		if err != nil {
+			return err
+		}
+		tw.W = entry
+		src = transfer.Images.Process(src)
+		if manifest != nil {
+			_, err = manifest.Copy(name, tw, src)
+			return err
+		}
+		_, err = io.Copy(tw, src)
+		return err
+	}
+	var failure error
+	index := 0
 	for {
 		p, err := transfer.Mr.NextPart()
-		if err == io.EOF {
+		if err != nil {
+			if err != io.EOF {
+				failure = err
+			}
 			break
 		}
 
-		if p.FormName() == "file" {
-			out, _ := zout.Create(p.FileName())
-			io.Copy(out, p)
+		field := p.FormName()
+		dir, isFile := FileField(field)
+		switch {
+		case isFile:
+			index++
+			if selected != nil && !selected[index] {
+				io.Copy(ioutil.Discard, p)
+				break
+			}
+			name := FieldPath(dir, PartPath(p))
+			part, err := CheckPart(p, p.Header)
+			if err != nil {
+				failure = err
+				break
+			}
+			src, err := CheckFilePolicy(name, part)
+			if err != nil {
+				RequestLog(r).Info("Stopping %s: %s", id, err)
+				failure = err
+				break
+			}
+			err = writeFile(name, src)
+			if err == nil {
+				err = part.Finish()
+			}
+			if err != nil && failure == nil {
+				failure = err
+			}
+		case field == "dir":
+			name, _ := ioutil.ReadAll(io.LimitReader(p, MAX_PATH_LENGTH))
+			CreateDir(zout, string(name))
+		case field == "symlink":
+			if conf.AllowSymlinks {
+				target, _ := ioutil.ReadAll(io.LimitReader(p, MAX_PATH_LENGTH))
+				CreateSymlink(zout, PartPath(p), string(target))
+			}
+		case field == "note":
+			if manifest != nil {
+				manifest.Note = ReadNote(p)
+			}
+		default:
+			RequestLog(transfer.upload).Info("Ignoring form field %q in %s", field, id)
 		}
 		p.Close()
+		if errors.Is(failure, ErrFilePolicy) || errors.Is(failure, ErrChecksumMismatch) {
+			break
+		}
 	}
-	transfer.Status = DONE
+	if errors.Is(failure, ErrFilePolicy) && trailers.Written() == 0 {
+		transfer.RemoveAppended(id, FAILED.String())
+		transfer.fail(failure)
+		transfer.timeline.Record("failed", body.N, failure.Error())
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Trailer")
+		WriteError(w, r, failure)
+		return
+	}
+	for _, f := range transfer.Appended() {
+		if failure != nil {
+			break
+		}
+		index++
+		if selected != nil && !selected[index] {
+			continue
+		}
+		fd, err := os.Open(f.path)
+		if err != nil {
+			failure = err
+			break
+		}
+		failure = writeFile(f.Name, &cancelReader{fd, transfer.cancelled})
+		fd.Close()
+	}
+	if failure == nil {
+		failure = transfer.checksum.Finish()
+	}
+	if failure != nil {
+		transfer.RemoveAppended(id, FailureStatus(failure).String())
+	} else {
+		transfer.RemoveAppended(id, "delivered")
+	}
+	if errors.Is(failure, ErrChecksumMismatch) {
+		RequestLog(r).Warn("Leaving the archive of %s unterminated: %s", id, failure)
+	} else {
+		if manifest != nil {
+			manifest.WriteTo(zout.Writer)
+		}
+		if err := zout.Close(); err != nil && failure == nil {
+			failure = err
+		}
+		if enc != nil {
+			if err := enc.Close(); err != nil && failure == nil {
+				failure = err
+			}
+		}
+	}
+	trailers.Finish(failure)
+	if errors.Is(failure, ErrCancelled) {
+		transfer.timeline.Record("aborted", body.N, "cancelled by the "+transfer.CancelledBy())
+	} else if failure != nil {
+		status := transfer.fail(failure)
+		transfer.timeline.Record(strings.ToLower(status.String()), body.N, failure.Error())
+	} else {
+		transfer.SetStatus(COMPLETED)
+		transfer.timeline.Record("completed", body.N, "")
+		go NotifyWebPush(id, WebPushMessage{conf.Branding.SiteName, id + " was downloaded.", id, "downloaded"})
+	}
+}
+
+type IndexPage struct {
+	Key         string
+	BaseURL     string
+	DisplayURL  string
+	Secret      string
+	Commands    map[string]string
+	Maintenance string
+	SigningKey  *SigningKey
+	UploadURL   string
+	Partner     bool
+	MaxBytes    int64
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	base := RequestBaseURL(r)
+	if m := CurrentMaintenance(); m != nil {
+		w.Header().Set("Content-Type", "text/html")
+		indextemplate.Execute(w, IndexPage{BaseURL: base, DisplayURL: DisplayURL(base), Maintenance: m.Message})
+		return
+	}
 	key, err := GenerateUniqueKey()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		WriteError(w, r, err)
 		return
 	}
 
+	Reserve(w, key)
+	secret := IssueSecret(w, key)
 	w.Header().Set("Content-Type", "text/html")
-	indextemplate.Execute(w, struct {
-		Key  string
-		Host string
-	}{
-		key,
-		r.Host,
+	indextemplate.Execute(w, IndexPage{
+		Key:        key,
+		BaseURL:    base,
+		DisplayURL: DisplayURL(base),
+		Secret:     secret,
+		Commands:   ReceiverCommands(r, key, false),
+		SigningKey: AdvertisedSigningKey(),
+		UploadURL:  "/upload/" + key,
 	})
 }
 
+func DefaultConfig() Config {
+	return Config{
+		Port:               8080,
+		TimeoutMinutes:     3,
+		KeyCharset:         "abcdefghijklmnopqrstuvwxyz0123456789",
+		KeyLength:          10,
+		CheckMinutes:       3,
+		GroupWindowMinutes: 60,
+		LogMaxSizeMB:       1024,
+		LogMaxFiles:        10,
+		LogMaxAgeDays:      30,
+		LogCompress:        true,
+		Cors: CorsConfig{
+			AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+			MaxAgeSeconds:  600,
+		},
+		Escrow: EscrowConfig{
+			File: "./log/escrow.log",
+		},
+		SpeedTestMaxMB: 100,
+		TempDir:        filepath.Join(os.TempDir(), "nethermes"),
+		Middleware: map[string][]string{
+			"ui":          {"log", "headers", "region", "compress"},
+			"sender":      {"log", "slowlog", "cors", "sign"},
+			"receiver":    {"log", "slowlog", "cors", "geo", "region", "sign"},
+			"diagnostics": {"log", "cors"},
+			"stats":       {"log", "headers", "compress"},
+			"failover":    {"log"},
+			"tunnel":      {"log"},
+			"admin":       {"log", "auth", "compress"},
+			"presign":     {"log", "auth", "cors", "sign"},
+			"partner":     {"log", "headers", "slowlog", "cors", "sign"},
+			"sso":         {"log", "headers"},
+		},
+		SecurityHeaders: map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+			"Referrer-Policy":        "no-referrer",
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerMinute: 0,
+			Burst:             10,
+		},
+		ReservationMinutes: 15,
+		ResumeMinutes:      10,
+		Failover: FailoverConfig{
+			DrainSeconds: 300,
+		},
+		ReceiveMaxAttempts:   10,
+		ReceiveWindowMinutes: 10,
+		Fetch: FetchConfig{
+			MaxMB:          0,
+			TimeoutSeconds: 600,
+		},
+		Push: PushConfig{
+			TimeoutSeconds: 3600,
+		},
+		Drive: DriveConfig{
+			TimeoutSeconds: 3600,
+			Providers:      map[string]DriveClient{},
+		},
+		FilePolicy: FilePolicyConfig{
+			AllowExtensions: []string{},
+			DenyExtensions:  []string{},
+			AllowTypes:      []string{},
+			DenyTypes:       []string{},
+		},
+		Mailboxes: MailboxConfig{
+			File:                 "mailboxes.json",
+			Dir:                  "./mailboxes",
+			DefaultQuotaMB:       1024,
+			DefaultRetentionDays: 30,
+		},
+		Tunnel: TunnelConfig{
+			IdleConnections: 4,
+			Endpoints:       []TunnelEndpoint{},
+		},
+		Regions: RegionsConfig{
+			Countries:     []string{},
+			GossipSeconds: 10,
+			Nodes:         []RegionNode{},
+		},
+		SmallFileBufferBytes: 0,
+		AppendMaxFiles:       1000,
+		ExtendMinutes:        10,
+		MaxTransferMinutes:   120,
+		SpoolWipe:            WIPE_DELETE,
+		Signing: SigningConfig{
+			KeyFile:  "signing.json",
+			MaxBytes: 1024 * 1024,
+		},
+		Presign: PresignConfig{
+			File:           "presign.json",
+			DefaultMinutes: 24 * 60,
+			MaxMinutes:     7 * 24 * 60,
+		},
+		Priority: PriorityConfig{
+			Classes: []PriorityClass{
+				{Name: "high", Principals: []string{"*"}, Share: 4},
+				{Name: "normal", Share: 1},
+			},
+			Default: "normal",
+		},
+		Gallery: GalleryConfig{
+			ThumbnailSize: 200,
+			MaxImages:     100,
+		},
+		SAML: SAMLConfig{
+			IdPMetadata:    "idp-metadata.xml",
+			Roles:          map[string][]string{},
+			DefaultScopes:  []string{SCOPE_UPLOAD, SCOPE_DOWNLOAD},
+			SessionMinutes: 8 * 60,
+		},
+		LogOutputs: []string{"file"},
+		WAF: WAFConfig{
+			MaxHeaderBytes: 32 * 1024,
+			Threshold:      20,
+			WindowMinutes:  10,
+			BanMinutes:     60,
+		},
+		ACME: ACMEConfig{
+			Directory:          ACME_DIRECTORY,
+			AccountKeyFile:     "acme-account.pem",
+			Credentials:        map[string]string{},
+			PropagationSeconds: 60,
+			RenewDays:          30,
+		},
+		HotFolder: HotFolderConfig{
+			PollSeconds: 2,
+		},
+		ZipLevel: flate.DefaultCompression,
+		ZipStore: []string{"mp4", "mkv", "mov", "jpg", "jpeg", "png", "zip", "gz", "7z"},
+		PreviewBots: []string{
+			"Slackbot", "facebookexternalhit", "Facebot", "WhatsApp", "Twitterbot",
+			"TelegramBot", "Discordbot", "LinkedInBot", "SkypeUriPreview",
+			"Applebot", "redditbot", "Mattermost", "Iframely", "Embedly",
+		},
+		Branding: BrandingConfig{
+			SiteName: "Net.Hermes",
+		},
+		EventCheckpointMB: 10,
+		EventKeepMinutes:  60,
+		Authenticator:     "tokens",
+		ExpiryWarnSeconds: 60,
+		Schedules: ScheduleConfig{
+			File: "schedules.json",
+		},
+		Geo: GeoConfig{
+			AllowUnknown: true,
+		},
+		TokensFile: "tokens.json",
+		FileFields: map[string]string{"file": ""},
+		Proxies:    map[string]ProxyConfig{},
+		TLS: TLSConfig{
+			MinVersion: "1.2",
+		},
+		KeySpace: KeySpaceConfig{
+			CollisionRate: 0.05,
+			Occupancy:     0.01,
+		},
+		ReceiverCommands: DefaultReceiverCommands(),
+		ForwardMinutes:   10,
+		ArchiveCache: ArchiveCacheConfig{
+			MaxMB: 1024,
+		},
+		Abuse: AbuseConfig{
+			BlockAfter:  3,
+			BlockHours:  24,
+			OffenseDays: 30,
+		},
+		MaxMessageLength: 1000,
+		AuditFile:        "./log/audit.log",
+		WebPush: WebPushConfig{
+			KeyFile: "vapid.json",
+		},
+		Images: ImageConfig{
+			Enabled:       true,
+			MaxInputMB:    64,
+			MaxMegapixels: 50,
+		},
+		Compression: CompressionConfig{
+			Level:    flate.DefaultCompression,
+			MinBytes: 1024,
+		},
+		SlowLog: SlowLogConfig{
+			FirstByteSeconds: 10,
+			StallSeconds:     30,
+		},
+		Encryption: EncryptionConfig{
+			Enabled:    true,
+			MinLength:  8,
+			ScryptLogN: 15,
+		},
+	}
+}
+
 func ReadConfig(file string) (Config, error) {
-	conf := Config{
-		Port:           8080,
-		TimeoutMinutes: 3,
-		KeyCharset:     "abcdefghijklmnopqrstuvwxyz0123456789",
-		KeyLength:      10,
-		CheckMinutes:   3,
-	}
-	fd, err := os.Open(file)
+	b, err := ioutil.ReadFile(file)
 	if err != nil {
-		return conf, err
+		return DefaultConfig(), err
 	}
-	defer fd.Close()
-
-	jdec := json.NewDecoder(fd)
-	err = jdec.Decode(&conf)
-	return conf, err
+	return ParseConfig(file, b)
 }
 
-func CleanOld() {
-	clean := func() {
-		for id, transfer := range transfers {
-			if transfer.Status == TIMEOUT || transfer.Status == DONE {
-				delete(transfers, id)
+func CleanTransfers() {
+	transfersLock.Lock()
+	defer transfersLock.Unlock()
+	for id, transfer := range transfers {
+		if transfer.Held() || transfer.Resume().Open() {
+			continue
+		}
+		if transfer.buffered && clock.Now().After(transfer.Deadline()) {
+			transfer.SetStatus(EXPIRED)
+		}
+		if status := transfer.CurrentStatus(); status.Terminal() {
+			if status == EXPIRED {
+				keyspace.KeyExpired()
 			}
+			ArchiveTimeline(id, &transfer.timeline)
+			waitStats.Observe(&transfer.timeline)
+			DropWebPush(id)
+			transfer.RemoveAppended(id, status.String())
+			BurnBuffer(id, status.String(), transfer.buffer)
+			transfer.Resume().Wipe(id, status.String())
+			delete(transfers, id)
 		}
 	}
+}
 
-	t := time.NewTicker(time.Minute * time.Duration(conf.CheckMinutes))
+// CleanOld runs the periodic cleanups on t. Startup creates t before
+// starting it, so the timer comes from the clock in place at startup.
+func CleanOld(t Timer) {
+	interval := time.Minute * time.Duration(conf.CheckMinutes)
 	for {
 		select {
-		case <-t.C:
-			clean()
+		case <-t.C():
+			t.Reset(interval)
+			CheckClock()
+			CleanTransfers()
+			CleanGroups()
+			CleanBlobs()
+			PruneLogs()
+			CleanBuckets()
+			CleanReservations()
+			CleanImported()
+			CleanAttempts()
+			CleanDriveAuths()
+			CleanMailboxes()
+			CleanAbuse()
+			CleanSecrets()
+			CleanPresigned()
+			CleanSAML()
+			CleanWAF()
+			CleanTimelines()
+			LogWaitSummary()
+			if err := Replicate(); err != nil {
+				logger.Error("Replicate to peer: %s", err)
+			}
 		}
 	}
 }
 
+func Identify(handler http.Handler) http.Handler {
+	return identify(Firewall(Failover(handler)))
+}
+
+// IdentifyAdmin is Identify without the firewall, for the admin listener.
+func IdentifyAdmin(handler http.Handler) http.Handler {
+	return identify(Failover(handler))
+}
+
+func identify(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = WithRequestID(r)
+		w.Header().Set("X-Request-ID", RequestID(r))
+		if conf.VersionHeader {
+			w.Header().Set("X-Nethermes-Version", Version)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func Log(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.Info("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+		RequestLog(r).Info("%s %s %s", r.RemoteAddr, r.Method, r.URL)
 		handler.ServeHTTP(w, r)
 	})
 }
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+}
 
-	logger = make(log4go.Logger)
-	flw := log4go.NewFileLogWriter("./log/http.log", true)
-	flw.SetFormat("[%D %T] [%L] %M")
-	flw.SetRotateSize(1024 * 1024 * 1024)
-	logger.AddFilter("file", log4go.INFO, flw)
+func Startup() {
+	if err := ChangeHome(); err != nil {
+		fmt.Fprintf(os.Stderr, "Change to home directory: %s\n", err)
+		os.Exit(1)
+	}
 
 	var err error
 
-	conf, err = ReadConfig("./nethermes.json")
+	conf, err = ReadConfig(CONFIG_FILE)
+	confFile, _ = ReadConfigValues(CONFIG_FILE)
+	if err := ApplyUmask(); err != nil {
+		fmt.Fprintf(os.Stderr, "Umask: %s\n", err)
+		os.Exit(1)
+	}
+
+	SetupLogging()
+
 	if err != nil {
-		logger.Info("Could not read nethermes.json")
+		logger.Info("Could not read nethermes.json: %s", err)
 	}
+	PruneLogs()
+	logger.Info("Starting %s", Build())
 	logger.Info("Using following configuration: %+v", conf)
+	if err := ReplayEventLog(); err != nil {
+		logger.Critical("Event log: %s", err)
+		os.Exit(1)
+	}
+	SweepTemp()
+
+	for _, c := range configChecks {
+		if err := c.Check(); err != nil {
+			logger.Critical("%s: %s", c.Name, err)
+			os.Exit(1)
+		}
+	}
 
-	idRegex := fmt.Sprintf("[%s]{%d}", conf.KeyCharset, conf.KeyLength)
+	mime.AddExtensionType(".webmanifest", "application/manifest+json")
 
-	rand.Seed(time.Now().Unix() + 3301)
-	r := mux.NewRouter()
-	s := r.Methods("GET").Subrouter()
-	s.HandleFunc("/", IndexHandler)
-	s.HandleFunc("/status/{id:"+idRegex+"}", StatusHandler)
-	s.HandleFunc("/download/{id:"+idRegex+"}", DownloadHandler)
-	s.Handle("/{_:(.*)}", http.FileServer(http.Dir("./htdocs")))
-	s = r.Methods("POST").Subrouter()
-	s.HandleFunc("/upload/{id:"+idRegex+"}", UploadHandler)
-	http.Handle("/", r)
+	rand.Seed(clock.Now().Unix() + 3301)
+	http.Handle("/", Routes(true, true))
 
-	indextemplate, err = template.ParseFiles("./index.html")
-	if err != nil {
-		logger.Critical("Parse template: ", err)
-		os.Exit(1)
+	if !conf.Headless {
+		for _, name := range templateFiles {
+			t, err := template.ParseFiles("./" + name)
+			if err != nil {
+				logger.Critical("Parse template: %s (run \"nethermes init\" to check the installation)", err)
+				os.Exit(1)
+			}
+			*templates[name] = t
+		}
 	}
-	go CleanOld()
+	go CleanOld(clock.NewTimer(time.Minute * time.Duration(conf.CheckMinutes)))
 }
 
 func main() {
-	port := strconv.Itoa(conf.Port)
-	err := http.ListenAndServe(":"+port, Log(http.DefaultServeMux))
-	if err != nil {
-		logger.Critical(err)
+	if cmd := Subcommand(); cmd != "" {
+		os.Exit(subcommands[cmd](os.Args[2:]))
+	}
+	Startup()
+	RunServer()
+}
+
+func RunServer() {
+	if err := WritePidFile(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		logger.Critical("Pid file: %s", err)
+		os.Exit(1)
+	}
+	go HandleShutdown()
+	if conf.HotFolder.Dir != "" {
+		go WatchHotFolder()
+	}
+	if conf.ACME.Enabled() {
+		go RenewCertificates()
+	}
+	if err := LoadTokens(); err != nil {
+		logger.Critical("Load tokens: %s", err)
+		os.Exit(1)
+	}
+	if err := LoadMailboxes(); err != nil {
+		logger.Critical("Load mailboxes: %s", err)
+		os.Exit(1)
+	}
+	if err := LoadVAPIDKeys(); err != nil {
+		logger.Critical("Load VAPID keys: %s", err)
+		os.Exit(1)
+	}
+	if err := LoadSigningKeys(); err != nil {
+		logger.Critical("Load signing keys: %s", err)
+		os.Exit(1)
+	}
+	if err := LoadPresigned(); err != nil {
+		logger.Critical("Load pre-signed keys: %s", err)
 		os.Exit(1)
 	}
+	if err := LoadSAML(); err != nil {
+		logger.Critical("Load SAML identity provider: %s", err)
+		os.Exit(1)
+	}
+	if err := LoadSchedules(); err != nil {
+		logger.Critical("Load schedules: %s", err)
+		os.Exit(1)
+	}
+	go RunSchedules()
+	if conf.Tunnel.Relay != "" {
+		go ServeTunnel()
+	}
+	if len(conf.Regions.Nodes) > 0 {
+		go GossipRegions()
+	}
+	if conf.AdminListener.Address != "" {
+		go ServeAdmin()
+	} else if conf.AdminListener.Exclusive {
+		logger.Warn("AdminListener.Exclusive has no effect without an address")
+	}
+
+	if len(conf.Listeners) == 0 {
+		l, err := ListenWithFallback()
+		if err != nil {
+			logger.Critical(err)
+			os.Exit(1)
+		}
+		Announce(l.Addr())
+		err = Serve(l, Identify(Tunnels(http.DefaultServeMux)))
+		if err != nil {
+			logger.Critical(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	errs := make(chan error)
+	for _, l := range conf.Listeners {
+		logger.Info("Listening on %s (upload: %t, download: %t)", l.Address, l.Upload, l.Download)
+		go func(l Listener) {
+			errs <- ListenAndServe(l.Address, Identify(Tunnels(Routes(l.Upload, l.Download))))
+		}(l)
+	}
+	logger.Critical(<-errs)
+	os.Exit(1)
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const MAINTENANCE_MESSAGE = "The relay is in maintenance. New transfers are paused, pending downloads still work."
+
+var (
+	maintenance     *Maintenance
+	maintenanceLock sync.Mutex
+
+	ErrMaintenance = errors.New("the relay is in maintenance mode and accepts no new transfers")
+)
+
+type Maintenance struct {
+	By      string
+	Message string
+	Since   time.Time
+}
+
+func CurrentMaintenance() *Maintenance {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+	if maintenance == nil {
+		return nil
+	}
+	m := *maintenance
+	return &m
+}
+
+func MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	m := CurrentMaintenance()
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(struct {
+		Enabled bool
+		*Maintenance
+	}{
+		m != nil,
+		m,
+	})
+}
+
+func StartMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message string
+	}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(&req); err != nil && err != io.EOF {
+		Error(w, r, "invalid maintenance request", http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		req.Message = MAINTENANCE_MESSAGE
+	}
+	m := &Maintenance{Principal(r), req.Message, clock.Now()}
+	maintenanceLock.Lock()
+	changed := maintenance == nil
+	maintenance = m
+	maintenanceLock.Unlock()
+	if changed {
+		Audit(r, "maintenance started", "", req.Message)
+		logger.Info("Maintenance mode on: no new keys or uploads, pending downloads continue")
+	} else {
+		Audit(r, "maintenance updated", "", req.Message)
+	}
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(m)
+}
+
+func EndMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	maintenanceLock.Lock()
+	changed := maintenance != nil
+	maintenance = nil
+	maintenanceLock.Unlock()
+	if !changed {
+		Error(w, r, "maintenance mode is not on", http.StatusNotFound)
+		return
+	}
+	Audit(r, "maintenance ended", "", "")
+	logger.Info("Maintenance mode off")
+	w.WriteHeader(http.StatusNoContent)
+}
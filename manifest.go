@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_NOTE_LENGTH = 1024
+)
+
+type ManifestFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+	Time   time.Time
+}
+
+type Manifest struct {
+	Key       string
+	Note      string
+	Created   time.Time
+	Completed time.Time
+	Files     []ManifestFile
+}
+
+func WantsManifest(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("manifest")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+func ReadNote(r io.Reader) string {
+	note, _ := ioutil.ReadAll(io.LimitReader(r, MAX_NOTE_LENGTH))
+	return strings.TrimSpace(string(note))
+}
+
+func (m *Manifest) Copy(name string, dst io.Writer, src io.Reader) (int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), src)
+	m.Files = append(m.Files, ManifestFile{
+		Name:   name,
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Time:   clock.Now(),
+	})
+	return n, err
+}
+
+func (m *Manifest) WriteTo(zout *zip.Writer) error {
+	m.Completed = clock.Now()
+	out, err := zout.Create("MANIFEST.json")
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrMessageTooLong  = errors.New("message is too long")
+	ErrMessageDisabled = errors.New("messages are disabled")
+)
+
+func SenderMessage(s string) (string, error) {
+	s = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, strings.ToValidUTF8(s, "")))
+	switch {
+	case s == "":
+		return "", nil
+	case conf.MaxMessageLength <= 0:
+		return "", ErrMessageDisabled
+	case utf8.RuneCountInString(s) > conf.MaxMessageLength:
+		return "", ErrMessageTooLong
+	}
+	return s, nil
+}
+
+func MessageParam(r *http.Request) (string, error) {
+	return SenderMessage(r.URL.Query().Get("message"))
+}
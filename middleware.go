@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+var Middlewares = map[string]Middleware{
+	"log":       Log,
+	"cors":      CORS,
+	"headers":   SecurityHeaders,
+	"ratelimit": RateLimit,
+	"slowlog":   SlowLog,
+	"geo":       GeoBlock,
+	"compress":  Compress,
+	"region":    RegionRedirect,
+	"sign":      Sign,
+}
+
+var (
+	chains         = map[string][]Middleware{}
+	authenticators = map[string]Authenticator{}
+)
+
+// ScopedAuthenticator returns the authenticator BuildChains created for
+// scope so that its caches are shared with the middleware.
+func ScopedAuthenticator(scope string) (Authenticator, error) {
+	if a, ok := authenticators[scope]; ok {
+		return a, nil
+	}
+	return NewAuthenticator(conf.Authenticator, scope)
+}
+
+func BuildChains() error {
+	Middlewares["externalauth"] = Authenticate(ForwardAuth{conf.ExternalAuthURL})
+	Middlewares["clientcert"] = Authenticate(ClientCertAuth{})
+
+	chains = map[string][]Middleware{}
+	authenticators = map[string]Authenticator{}
+	for _, scope := range []string{SCOPE_ADMIN, SCOPE_DOWNLOAD} {
+		a, err := NewAuthenticator(conf.Authenticator, scope)
+		if err != nil {
+			return err
+		}
+		authenticators[scope] = a
+	}
+	for group, names := range conf.Middleware {
+		chain := make([]Middleware, 0, len(names))
+		for _, name := range names {
+			m, ok := Middlewares[name]
+			if name == "auth" {
+				scope := GroupScope(group)
+				if _, exists := authenticators[scope]; !exists {
+					a, err := NewAuthenticator(conf.Authenticator, scope)
+					if err != nil {
+						return err
+					}
+					authenticators[scope] = a
+				}
+				m, ok = Authenticate(authenticators[scope]), true
+			}
+			if !ok {
+				return fmt.Errorf("unknown middleware %q for %s", name, group)
+			}
+			chain = append(chain, m)
+		}
+		chains[group] = chain
+	}
+	return nil
+}
+
+func Chain(group string, handler http.Handler) http.Handler {
+	chain := chains[group]
+	handler = KeyGuard(handler)
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
+
+func ChainFunc(group string, f func(http.ResponseWriter, *http.Request)) http.Handler {
+	return Chain(group, http.HandlerFunc(f))
+}
+
+func SecurityHeaders(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range conf.SecurityHeaders {
+			w.Header().Set(k, v)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func BearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
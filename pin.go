@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrPinFirst    = errors.New("pin=first needs the gallery, a download is already limited to its first receiver")
+	ErrGroupPinned = errors.New("only the first contribution can pin a group")
+)
+
+// Pin restricts who may receive a transfer. With First, the address of
+// the first receiver that opens the gallery or starts the download is the
+// only one allowed afterwards.
+type Pin struct {
+	sync.Mutex
+	Network  *net.IPNet
+	First    bool
+	PinnedIP net.IP
+	Receiver string
+}
+
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func ParsePin(r *http.Request) (*Pin, error) {
+	q := r.URL.Query()
+	cidr := strings.TrimSpace(q.Get("cidr"))
+	first := q.Get("pin") == "first"
+	receiver := strings.TrimSpace(q.Get("receiver"))
+	if cidr == "" && !first && receiver == "" {
+		return nil, nil
+	}
+	if receiver != "" && conf.Authenticator == "none" {
+		return nil, errors.New("receiver pinning needs an authenticator")
+	}
+
+	pin := &Pin{First: first, Receiver: receiver}
+	if cidr != "" {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("invalid receiver address")
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("invalid receiver network")
+		}
+		pin.Network = network
+	}
+	return pin, nil
+}
+
+func (p *Pin) Allows(ip net.IP) bool {
+	if p == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if p.Network != nil && !p.Network.Contains(ip) {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.First && p.PinnedIP != nil && !p.PinnedIP.Equal(ip) {
+		return false
+	}
+	return true
+}
+
+// Claim pins ip if nobody has claimed the pin yet and reports whether ip
+// holds it.
+func (p *Pin) Claim(ip net.IP) bool {
+	if p == nil || !p.First {
+		return true
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.PinnedIP == nil {
+		p.PinnedIP = ip
+	}
+	return p.PinnedIP.Equal(ip)
+}
+
+// Audit records a receiver being admitted to or turned away from a
+// pinned transfer. Transfers without a pin are not audited.
+func (p *Pin) Audit(r *http.Request, id, principal string, admitted bool) {
+	if p == nil {
+		return
+	}
+	action := "pinned download rejected"
+	if admitted {
+		action = "pinned download"
+	}
+	detail := ClientIP(r).String()
+	if principal != "" {
+		detail = principal + " from " + detail
+	}
+	Audit(r, action, id, detail)
+}
+
+func (p *Pin) Authorize(r *http.Request) (string, error) {
+	if p == nil || p.Receiver == "" {
+		return "", nil
+	}
+	principal, authenticated := r.Context().Value(principalKey{}).(string)
+	if !authenticated {
+		a, err := ScopedAuthenticator(SCOPE_DOWNLOAD)
+		if err != nil {
+			return "", err
+		}
+		principal, err = a.Authenticate(r)
+		if err != nil {
+			return principal, err
+		}
+	}
+	if principal != p.Receiver {
+		return principal, &AuthError{http.StatusForbidden, ""}
+	}
+	return principal, nil
+}
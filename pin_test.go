@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPinFirstDirectTransfer(t *testing.T) {
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+	contentType, body := multipartBody(t, []testFile{{"a.txt", []byte("a")}})
+	resp, err := http.Post(srv.URL+"/upload/"+key+"?pin=first", contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("pin=first without gallery: %d %s", resp.StatusCode, msg)
+	}
+}
+
+func auditActions(t *testing.T, key string) []string {
+	data, _ := ioutil.ReadFile(conf.AuditFile)
+	actions := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec AuditRecord
+		if json.Unmarshal([]byte(line), &rec) == nil && rec.Key == key {
+			actions = append(actions, rec.Action)
+		}
+	}
+	return actions
+}
+
+func TestPinGroupDownload(t *testing.T) {
+	srv := newTestServer(t)
+	saved := conf.AuditFile
+	conf.AuditFile = filepath.Join(t.TempDir(), "audit.log")
+	defer func() { conf.AuditFile = saved }()
+	files := []testFile{{"a.txt", []byte("pinned")}}
+	for _, c := range []struct {
+		cidr   string
+		status int
+		audit  string
+	}{
+		{"10.0.0.0/8", http.StatusForbidden, "pinned download rejected"},
+		{"127.0.0.1", http.StatusOK, "pinned download"},
+	} {
+		key := GenerateKey()
+		contentType, body := multipartBody(t, files)
+		resp, err := http.Post(srv.URL+"/group/"+key+"/upload?cidr="+c.cidr, contentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: upload responded %d: %s", c.cidr, resp.StatusCode, msg)
+		}
+
+		contentType, body = multipartBody(t, files)
+		resp, err = http.Post(srv.URL+"/group/"+key+"/upload?cidr=0.0.0.0/0", contentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("%s: repinning responded %d", c.cidr, resp.StatusCode)
+		}
+
+		resp, err = http.Get(srv.URL + "/group/" + key + "/download")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("%s: download responded %d, want %d", c.cidr, resp.StatusCode, c.status)
+		}
+		if c.status == http.StatusOK && len(unzip(t, data)) != 2 {
+			t.Errorf("%s: archive should hold the file and the manifest", c.cidr)
+		}
+		if got := auditActions(t, key); len(got) != 1 || got[0] != c.audit {
+			t.Errorf("%s: audited %q, want %q", c.cidr, got, c.audit)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const SNIFF_BYTES = 512
+
+var ErrFilePolicy = errors.New("file type policy violation")
+
+type FilePolicyConfig struct {
+	AllowExtensions []string
+	DenyExtensions  []string
+	AllowTypes      []string
+	DenyTypes       []string
+}
+
+type PolicyError struct {
+	Name   string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s is not allowed: %s", e.Name, e.Reason)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrFilePolicy
+}
+
+var executableSignatures = []struct {
+	magic string
+	mime  string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xca\xfe\xba\xbe", "application/x-mach-binary"},
+	{"#!", "text/x-shellscript"},
+}
+
+func SniffType(head []byte) string {
+	for _, s := range executableSignatures {
+		if bytes.HasPrefix(head, []byte(s.magic)) {
+			return s.mime
+		}
+	}
+	mediatype, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediatype
+}
+
+func FilePolicyEnabled() bool {
+	p := conf.FilePolicy
+	return len(p.AllowExtensions)+len(p.DenyExtensions)+len(p.AllowTypes)+len(p.DenyTypes) > 0
+}
+
+func matchExtension(name string, list []string) (string, bool) {
+	name = strings.ToLower(path.Base(name))
+	for _, ext := range list {
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		if strings.HasSuffix(name, "."+ext) {
+			return ext, true
+		}
+	}
+	return "", false
+}
+
+func matchType(mediatype string, list []string) (string, bool) {
+	for _, t := range list {
+		t = strings.ToLower(t)
+		if t == mediatype || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediatype, t[:len(t)-1])) {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+func CheckFileName(name string) error {
+	p := conf.FilePolicy
+	if ext, ok := matchExtension(name, p.DenyExtensions); ok {
+		return &PolicyError{name, "extension ." + ext + " is blocked"}
+	}
+	if _, ok := matchExtension(name, p.AllowExtensions); len(p.AllowExtensions) > 0 && !ok {
+		return &PolicyError{name, "extension is not on the allow list"}
+	}
+	return nil
+}
+
+func CheckFileType(name string, head []byte) error {
+	p := conf.FilePolicy
+	if len(p.AllowTypes) == 0 && len(p.DenyTypes) == 0 {
+		return nil
+	}
+	mediatype := SniffType(head)
+	if _, ok := matchType(mediatype, p.DenyTypes); ok {
+		return &PolicyError{name, "content type " + mediatype + " is blocked"}
+	}
+	if _, ok := matchType(mediatype, p.AllowTypes); len(p.AllowTypes) > 0 && !ok {
+		return &PolicyError{name, "content type " + mediatype + " is not on the allow list"}
+	}
+	return nil
+}
+
+func CheckFilePolicy(name string, src io.Reader) (io.Reader, error) {
+	if !FilePolicyEnabled() {
+		return src, nil
+	}
+	if err := CheckFileName(name); err != nil {
+		return nil, err
+	}
+	head := make([]byte, SNIFF_BYTES)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	if err := CheckFileType(name, head); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(head), src), nil
+}
+
+func CheckFilePolicyConfig() error {
+	p := conf.FilePolicy
+	for _, list := range [][]string{p.AllowTypes, p.DenyTypes} {
+		for _, t := range list {
+			if !strings.Contains(t, "/") || strings.Contains(t, ";") {
+				return fmt.Errorf("invalid media type %q", t)
+			}
+		}
+	}
+	for _, list := range [][]string{p.AllowExtensions, p.DenyExtensions} {
+		for _, ext := range list {
+			if strings.Trim(ext, ".") == "" || strings.ContainsAny(ext, "/\\") {
+				return fmt.Errorf("invalid extension %q", ext)
+			}
+		}
+	}
+	return nil
+}
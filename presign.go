@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const PRESIGN_VERSION = "nethermes-presign-v1"
+
+var (
+	presigned     presignFile
+	presignedLock sync.Mutex
+
+	ErrPresignDisabled = errors.New("pre-signed uploads are disabled")
+	ErrPresignAuth     = errors.New("pre-signing needs an authenticated user")
+	ErrPresignInvalid  = errors.New("invalid or expired upload link")
+	ErrPresignUsed     = errors.New("upload link was already used")
+	ErrPresignedKey    = errors.New("key is reserved for a pre-signed upload")
+)
+
+type PresignConfig struct {
+	Enabled        bool
+	File           string
+	DefaultMinutes int
+	MaxMinutes     int
+	DefaultMB      int64
+	MaxMB          int64
+}
+
+type PresignedKey struct {
+	Principal string
+	Label     string `json:",omitempty"`
+	Created   time.Time
+	Expires   time.Time
+	MaxBytes  int64
+	Used      time.Time `json:",omitempty"`
+}
+
+type presignFile struct {
+	Secret string
+	Keys   map[string]*PresignedKey
+}
+
+type PresignedURL struct {
+	Key      string
+	URL      string
+	Download string
+	Expires  time.Time
+	MaxBytes int64
+}
+
+type presignedUploadKey struct{}
+
+type sizeLimitReader struct {
+	R io.Reader
+	N int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+	if l.N < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+func LoadPresigned() error {
+	if !conf.Presign.Enabled {
+		return nil
+	}
+	state := presignFile{}
+	if err := LoadJSON(conf.Presign.File, &state); err != nil {
+		return err
+	}
+	if state.Secret == "" {
+		state.Secret = randomHex(32)
+		if err := SaveJSON(conf.Presign.File, state); err != nil {
+			return err
+		}
+		logger.Info("Generated pre-signing secret in %s", conf.Presign.File)
+	}
+	if state.Keys == nil {
+		state.Keys = map[string]*PresignedKey{}
+	}
+	presignedLock.Lock()
+	defer presignedLock.Unlock()
+	presigned = state
+	return nil
+}
+
+func savePresigned() {
+	if err := SaveJSON(conf.Presign.File, presigned); err != nil {
+		logger.Error("Save pre-signed keys: %s", err)
+	}
+}
+
+func CleanPresigned() {
+	presignedLock.Lock()
+	defer presignedLock.Unlock()
+	changed := false
+	for key, p := range presigned.Keys {
+		if clock.Now().After(p.Expires) {
+			delete(presigned.Keys, key)
+			changed = true
+		}
+	}
+	if changed {
+		savePresigned()
+	}
+}
+
+func presignMAC(key string, expires, max int64) string {
+	mac := hmac.New(sha256.New, []byte(presigned.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d", PRESIGN_VERSION, key, expires, max)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func Presign(principal, label string, maxBytes int64, lifetime time.Duration) (PresignedKey, string, string, error) {
+	key, err := GenerateUniqueKey()
+	if err != nil {
+		return PresignedKey{}, "", "", err
+	}
+	now := clock.Now()
+	p := &PresignedKey{
+		Principal: principal,
+		Label:     label,
+		Created:   now,
+		Expires:   now.Add(lifetime).Truncate(time.Second),
+		MaxBytes:  maxBytes,
+	}
+	presignedLock.Lock()
+	defer presignedLock.Unlock()
+	presigned.Keys[key] = p
+	savePresigned()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(p.Expires.Unix(), 10))
+	query.Set("max", strconv.FormatInt(p.MaxBytes, 10))
+	query.Set("sig", presignMAC(key, p.Expires.Unix(), p.MaxBytes))
+	return *p, key, query.Encode(), nil
+}
+
+func Presigned(key string) bool {
+	presignedLock.Lock()
+	defer presignedLock.Unlock()
+	p, ok := presigned.Keys[key]
+	return ok && clock.Now().Before(p.Expires)
+}
+
+func checkPresigned(key string, query url.Values, consume bool) (PresignedKey, error) {
+	expires, err1 := strconv.ParseInt(query.Get("expires"), 10, 64)
+	max, err2 := strconv.ParseInt(query.Get("max"), 10, 64)
+	if err1 != nil || err2 != nil || clock.Now().Unix() >= expires {
+		return PresignedKey{}, ErrPresignInvalid
+	}
+	presignedLock.Lock()
+	defer presignedLock.Unlock()
+	want := presignMAC(key, expires, max)
+	if subtle.ConstantTimeCompare([]byte(query.Get("sig")), []byte(want)) != 1 {
+		return PresignedKey{}, ErrPresignInvalid
+	}
+	p, ok := presigned.Keys[key]
+	if !ok || p.Expires.Unix() != expires || p.MaxBytes != max {
+		return PresignedKey{}, ErrPresignInvalid
+	}
+	if !p.Used.IsZero() {
+		return *p, ErrPresignUsed
+	}
+	if consume {
+		p.Used = clock.Now()
+		savePresigned()
+	}
+	return *p, nil
+}
+
+func PresignedUpload(r *http.Request) bool {
+	ok, _ := r.Context().Value(presignedUploadKey{}).(bool)
+	return ok
+}
+
+func presignError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ErrPresignDisabled:
+		Error(w, r, err.Error(), http.StatusNotFound)
+	case ErrPresignAuth:
+		Error(w, r, err.Error(), http.StatusUnauthorized)
+	case ErrPresignInvalid:
+		Error(w, r, err.Error(), http.StatusForbidden)
+	case ErrPresignUsed:
+		Error(w, r, err.Error(), http.StatusGone)
+	default:
+		WriteError(w, r, err)
+	}
+}
+
+func PresignHandler(w http.ResponseWriter, r *http.Request) {
+	if !conf.Presign.Enabled {
+		presignError(w, r, ErrPresignDisabled)
+		return
+	}
+	principal := Principal(r)
+	if principal == "" {
+		presignError(w, r, ErrPresignAuth)
+		return
+	}
+	req := struct {
+		Label          string
+		MaxMB          int64
+		ExpiresMinutes int
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+			Error(w, r, "invalid pre-sign request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.MaxMB <= 0 {
+		req.MaxMB = conf.Presign.DefaultMB
+	}
+	if conf.Presign.MaxMB > 0 && req.MaxMB > conf.Presign.MaxMB {
+		Error(w, r, fmt.Sprintf("the largest allowed upload is %d MB", conf.Presign.MaxMB), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresMinutes <= 0 {
+		req.ExpiresMinutes = conf.Presign.DefaultMinutes
+	}
+	if conf.Presign.MaxMinutes > 0 && req.ExpiresMinutes > conf.Presign.MaxMinutes {
+		Error(w, r, fmt.Sprintf("links expire after at most %d minutes", conf.Presign.MaxMinutes), http.StatusBadRequest)
+		return
+	}
+	if len(req.Label) > 200 {
+		Error(w, r, "label is too long", http.StatusBadRequest)
+		return
+	}
+
+	p, key, query, err := Presign(principal, req.Label, req.MaxMB*1024*1024, time.Minute*time.Duration(req.ExpiresMinutes))
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	Audit(r, "upload link created", key, fmt.Sprintf("max %d bytes until %s", p.MaxBytes, p.Expires.Format(time.RFC3339)))
+	base := RequestBaseURL(r)
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(PresignedURL{
+		Key:      key,
+		URL:      base + "/presigned/" + key + "?" + query,
+		Download: base + "/download/" + key,
+		Expires:  p.Expires,
+		MaxBytes: p.MaxBytes,
+	})
+}
+
+func PresignedPageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !conf.Presign.Enabled {
+		presignError(w, r, ErrPresignDisabled)
+		return
+	}
+	p, err := checkPresigned(id, r.URL.Query(), false)
+	if err != nil {
+		presignError(w, r, err)
+		return
+	}
+	base := RequestBaseURL(r)
+	secret := IssueSecret(w, id)
+	w.Header().Set("Content-Type", "text/html")
+	indextemplate.Execute(w, IndexPage{
+		Key:        id,
+		BaseURL:    base,
+		DisplayURL: DisplayURL(base),
+		Secret:     secret,
+		UploadURL:  "/presigned/" + id + "?" + r.URL.RawQuery,
+		Partner:    true,
+		MaxBytes:   p.MaxBytes,
+		SigningKey: AdvertisedSigningKey(),
+	})
+}
+
+func PresignedUploadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !conf.Presign.Enabled {
+		presignError(w, r, ErrPresignDisabled)
+		return
+	}
+	p, err := checkPresigned(id, r.URL.Query(), false)
+	if err != nil {
+		presignError(w, r, err)
+		return
+	}
+	if DryRun(r) {
+		EchoHandler(w, r)
+		return
+	}
+	if p.MaxBytes > 0 && r.ContentLength > p.MaxBytes {
+		RequestLog(r).Info("Rejected pre-signed upload to %s: %d bytes", id, r.ContentLength)
+		WriteError(w, r, ErrTooLarge)
+		return
+	}
+	if p, err = checkPresigned(id, r.URL.Query(), true); err != nil {
+		presignError(w, r, err)
+		return
+	}
+	RequestLog(r).Info("Pre-signed upload to %s for %s", id, p.Principal)
+	Audit(r, "upload link used", id, p.Principal)
+	if p.MaxBytes > 0 {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{&sizeLimitReader{r.Body, p.MaxBytes}, r.Body}
+	}
+	r = r.WithContext(context.WithValue(r.Context(), presignedUploadKey{}, true))
+	UploadHandler(w, r)
+}
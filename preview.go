@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var previewtemplate *template.Template
+
+type BrandingConfig struct {
+	SiteName string
+	ImageURL string
+}
+
+type Preview struct {
+	SiteName    string
+	Title       string
+	Description string
+	Image       string
+	URL         string
+	Messages    []string
+}
+
+func IsPreviewBot(r *http.Request) bool {
+	ua := strings.ToLower(r.UserAgent())
+	for _, bot := range conf.PreviewBots {
+		if bot != "" && strings.Contains(ua, strings.ToLower(bot)) {
+			return true
+		}
+	}
+	return false
+}
+
+func ExpiresIn(t time.Time) string {
+	d := Remaining(t)
+	switch {
+	case d < time.Minute:
+		return "expires in less than a minute"
+	case d < 2*time.Hour:
+		return fmt.Sprintf("expires in %d min", int(d.Minutes()))
+	default:
+		return fmt.Sprintf("expires in %d hours", int(d.Hours()))
+	}
+}
+
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func DescribeTransfer(id string) (Preview, bool) {
+	p := Preview{
+		SiteName: conf.Branding.SiteName,
+		Image:    conf.Branding.ImageURL,
+	}
+	groupsLock.Lock()
+	group, grouped := groups[id]
+	groupsLock.Unlock()
+	if grouped {
+		group.Lock()
+		defer group.Unlock()
+		files, size := 0, int64(0)
+		for _, c := range group.Contributions {
+			if c.Message != "" {
+				p.Messages = append(p.Messages, c.Message)
+			}
+			for _, f := range c.Files {
+				files++
+				size += f.Size
+			}
+		}
+		expires := group.Expires.Add(time.Minute * time.Duration(conf.TimeoutMinutes))
+		p.Title = "Someone wants to send you files - " + ExpiresIn(expires)
+		p.Description = fmt.Sprintf("%d files, %s. Open this link in a browser to download them.", files, FormatSize(size))
+		if files == 1 {
+			p.Description = fmt.Sprintf("1 file, %s. Open this link in a browser to download it.", FormatSize(size))
+		}
+		return p, group.Status == WAITING_RECEIVER
+	}
+	if transfer, exists := GetTransfer(id); exists {
+		p.Title = "Someone wants to send you files - " + ExpiresIn(transfer.Deadline())
+		p.Description = "Open this link in a browser to download them. The link works only once."
+		if transfer.Message != "" {
+			p.Messages = []string{transfer.Message}
+		}
+		return p, transfer.CurrentStatus() == WAITING_RECEIVER
+	}
+	return p, false
+}
+
+func PreviewGuard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" && !IsPreviewBot(r) {
+			handler(w, r)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		preview, ok := DescribeTransfer(id)
+		if !ok {
+			ReceiverError(w, r, "notfound", http.StatusNotFound)
+			return
+		}
+		preview.URL = RequestBaseURL(r) + r.URL.Path
+		RequestLog(r).Info("Served preview of %s to %q", id, r.UserAgent())
+		if conf.Headless {
+			w.Header().Set("Content-Type", "text/javascript")
+			w.Header().Set("Cache-Control", "no-store")
+			jenc := json.NewEncoder(w)
+			jenc.Encode(preview)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		previewtemplate.Execute(w, preview)
+	}
+}
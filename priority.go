@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const THROTTLE_CHUNK = 32 * 1024
+
+var (
+	ErrServerBusy = errors.New("server is busy, try again later")
+
+	relayQueue    = &RelayQueue{}
+	bandwidth     = &Bandwidth{}
+	evictions     = map[string]int64{}
+	evictionsLock sync.Mutex
+)
+
+type PriorityClass struct {
+	Name       string
+	Principals []string
+	Share      int
+}
+
+// PriorityConfig lists the classes from highest to lowest. A class matches
+// when the uploader's principal is listed in Principals, "*" matching any
+// authenticated uploader; everyone else gets Default.
+type PriorityConfig struct {
+	Classes       []PriorityClass
+	Default       string
+	BandwidthKBps int64
+	MaxActive     int
+	MaxWaiting    int
+}
+
+func CheckPriorityConfig() error {
+	if len(conf.Priority.Classes) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, c := range conf.Priority.Classes {
+		if c.Name == "" || seen[c.Name] {
+			return fmt.Errorf("priority class names must be unique and not empty")
+		}
+		if c.Share <= 0 {
+			return fmt.Errorf("priority class %s needs a positive Share", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	if !seen[conf.Priority.Default] {
+		return fmt.Errorf("default priority class %q is not defined", conf.Priority.Default)
+	}
+	return nil
+}
+
+func priorityRank(class string) int {
+	for i, c := range conf.Priority.Classes {
+		if c.Name == class {
+			return i
+		}
+	}
+	return len(conf.Priority.Classes)
+}
+
+func priorityShare(class string) int {
+	for _, c := range conf.Priority.Classes {
+		if c.Name == class {
+			return c.Share
+		}
+	}
+	return 1
+}
+
+func RequestPrincipal(r *http.Request) string {
+	if p := Principal(r); p != "" {
+		return p
+	}
+	p, err := TokenAuth{conf.AuthTokens, SCOPE_UPLOAD}.Authenticate(r)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+func Classify(r *http.Request) string {
+	principal := RequestPrincipal(r)
+	for _, c := range conf.Priority.Classes {
+		for _, p := range c.Principals {
+			if (p == "*" && principal != "") || p == principal {
+				return c.Name
+			}
+		}
+	}
+	return conf.Priority.Default
+}
+
+// MakeRoom enforces MaxWaiting before an upload of the given class starts
+// to wait. When the limit is reached, the newest waiting upload of the
+// lowest class below it is cancelled; if there is none, the new upload is
+// refused.
+func MakeRoom(class string) error {
+	if conf.Priority.MaxWaiting <= 0 {
+		return nil
+	}
+	rank := priorityRank(class)
+	waiting := 0
+	victimID := ""
+	var victim *Transfer
+	transfersLock.Lock()
+	for id, t := range transfers {
+		if t.CurrentStatus() != WAITING_RECEIVER {
+			continue
+		}
+		waiting++
+		r := priorityRank(t.Priority)
+		if r <= rank || t.Held() {
+			continue
+		}
+		if victim == nil || r > priorityRank(victim.Priority) || (r == priorityRank(victim.Priority) && t.Created.After(victim.Created)) {
+			victim, victimID = t, id
+		}
+	}
+	transfersLock.Unlock()
+	if waiting < conf.Priority.MaxWaiting {
+		return nil
+	}
+	if victim == nil || victim.Cancel("server") != nil {
+		return ErrServerBusy
+	}
+	victim.timeline.Record("evicted", 0, "making room for a "+class+" upload")
+	logger.Info("Evicted waiting %s upload %s for a %s upload", victim.Priority, victimID, class)
+	evictionsLock.Lock()
+	evictions[victim.Priority]++
+	evictionsLock.Unlock()
+	return nil
+}
+
+type queueTicket struct {
+	rank    int
+	class   string
+	granted bool
+	ready   chan struct{}
+}
+
+// RelayQueue limits the number of relays streaming at once to MaxActive.
+// Receivers beyond that wait in class order, first come first served
+// within a class.
+type RelayQueue struct {
+	sync.Mutex
+	active  int
+	waiting []*queueTicket
+}
+
+func (q *RelayQueue) Enqueue(class string) (*queueTicket, int) {
+	q.Lock()
+	defer q.Unlock()
+	t := &queueTicket{rank: priorityRank(class), class: class, ready: make(chan struct{})}
+	if conf.Priority.MaxActive <= 0 || (q.active < conf.Priority.MaxActive && len(q.waiting) == 0) {
+		q.active++
+		t.granted = true
+		close(t.ready)
+		return t, 0
+	}
+	i := sort.Search(len(q.waiting), func(i int) bool { return q.waiting[i].rank > t.rank })
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = t
+	return t, i + 1
+}
+
+func (q *RelayQueue) Wait(ctx context.Context, t *queueTicket, cancelled <-chan struct{}) error {
+	var err error
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-cancelled:
+		err = ErrCancelled
+	}
+	q.Lock()
+	defer q.Unlock()
+	if t.granted {
+		q.active--
+		q.grant()
+		return err
+	}
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	return err
+}
+
+func (q *RelayQueue) Release() {
+	q.Lock()
+	defer q.Unlock()
+	q.active--
+	q.grant()
+}
+
+func (q *RelayQueue) grant() {
+	for len(q.waiting) > 0 && (conf.Priority.MaxActive <= 0 || q.active < conf.Priority.MaxActive) {
+		t := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.active++
+		t.granted = true
+		close(t.ready)
+	}
+}
+
+func (q *RelayQueue) Waiting() map[string]int {
+	q.Lock()
+	defer q.Unlock()
+	n := map[string]int{}
+	for _, t := range q.waiting {
+		n[t.class]++
+	}
+	return n
+}
+
+// Bandwidth splits BandwidthKBps between the running relays in proportion
+// to the Share of their classes. A relay that cannot use its share does
+// not hand it to the others.
+type Bandwidth struct {
+	sync.Mutex
+	shares int
+}
+
+type ThrottledWriter struct {
+	W     io.Writer
+	share int
+	due   time.Time
+}
+
+func (b *Bandwidth) Writer(w io.Writer, class string) *ThrottledWriter {
+	t := &ThrottledWriter{W: w, share: priorityShare(class)}
+	b.Lock()
+	b.shares += t.share
+	b.Unlock()
+	return t
+}
+
+func (b *Bandwidth) Release(t *ThrottledWriter) {
+	b.Lock()
+	b.shares -= t.share
+	b.Unlock()
+}
+
+func (b *Bandwidth) rate(share int) float64 {
+	b.Lock()
+	defer b.Unlock()
+	return float64(conf.Priority.BandwidthKBps*1024) * float64(share) / float64(b.shares)
+}
+
+func (t *ThrottledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > THROTTLE_CHUNK {
+			chunk = chunk[:THROTTLE_CHUNK]
+		}
+		n, err := t.W.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if now := clock.Now(); t.due.Before(now) {
+			t.due = now
+		}
+		t.due = t.due.Add(time.Duration(float64(n) / bandwidth.rate(t.share) * float64(time.Second)))
+		Sleep(Until(t.due))
+	}
+	return written, nil
+}
+
+func (t *ThrottledWriter) Flush() {
+	if f, ok := t.W.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func WritePriorityMetrics(w io.Writer) {
+	waiting := relayQueue.Waiting()
+	evictionsLock.Lock()
+	defer evictionsLock.Unlock()
+	for _, c := range conf.Priority.Classes {
+		fmt.Fprintf(w, "nethermes_relay_queue_length{class=%q} %d\n", c.Name, waiting[c.Name])
+		fmt.Fprintf(w, "nethermes_evictions_total{class=%q} %d\n", c.Name, evictions[c.Name])
+	}
+}
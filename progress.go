@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+const PROGRESS_REFRESH_SECONDS = 3
+
+var progresstemplate *template.Template
+
+type ProgressPage struct {
+	Key         string
+	Sender      bool
+	Status      string
+	CancelledBy string
+	Expires     time.Time
+	Sent        int64
+	Total       int64
+	Percent     int64
+	Refresh     int
+}
+
+func timelineProgress(tl *Timeline) (int64, int64, Status) {
+	sent, total, outcome := int64(0), int64(0), FAILED
+	for _, ev := range tl.Events() {
+		switch ev.Kind {
+		case "created":
+			total = ev.Bytes
+		case "cancelled", "evicted":
+			outcome = ABORTED
+		case "expired":
+			outcome = EXPIRED
+		case "completed":
+			outcome = COMPLETED
+			fallthrough
+		case "progress", "failed", "corrupted":
+			if ev.Kind == "corrupted" {
+				outcome = CORRUPTED
+			}
+			if ev.Bytes > sent {
+				sent = ev.Bytes
+			}
+		}
+	}
+	return sent, total, outcome
+}
+
+func ProgressHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	page := ProgressPage{Key: id, Refresh: PROGRESS_REFRESH_SECONDS}
+	page.Sender = CheckSecret(id, SenderSecret(r, id))
+	if transfer, exists := GetTransfer(id); exists {
+		page.Status = transfer.CurrentStatus().String()
+		page.CancelledBy = transfer.CancelledBy()
+		page.Expires = transfer.Deadline()
+		page.Sent, page.Total, _ = timelineProgress(&transfer.timeline)
+	} else if Reserved(id) {
+		page.Status = RESERVED.String()
+	} else if tl, ok := FindTimeline(id); ok {
+		var outcome Status
+		page.Sent, page.Total, outcome = timelineProgress(tl)
+		page.Status = outcome.String()
+	} else {
+		page.Status = EXPIRED.String()
+	}
+	if page.Total > 0 {
+		page.Percent = page.Sent * 100 / page.Total
+	}
+	switch page.Status {
+	case COMPLETED.String(), FAILED.String(), ABORTED.String(), EXPIRED.String(), CORRUPTED.String():
+		page.Refresh = 0
+	}
+
+	if w.Header().Get("X-Frame-Options") != "" {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html")
+	progresstemplate.Execute(w, page)
+}
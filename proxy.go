@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ProxyConfig struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy string
+	Direct  bool
+}
+
+func (p ProxyConfig) set() bool {
+	return p.HTTP != "" || p.HTTPS != "" || p.NoProxy != "" || p.Direct
+}
+
+func ProxySettings(feature string) (ProxyConfig, bool) {
+	if p, ok := conf.Proxies[feature]; ok && p.set() {
+		return p, true
+	}
+	if conf.Proxy.set() {
+		return conf.Proxy, true
+	}
+	return ProxyConfig{}, false
+}
+
+func NoProxyMatch(noProxy, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+		if e := net.ParseIP(entry); e != nil {
+			if ip != nil && e.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if u, err = url.Parse("http://" + s); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func ProxyFor(feature string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		p, ok := ProxySettings(feature)
+		if !ok {
+			return http.ProxyFromEnvironment(req)
+		}
+		if p.Direct || NoProxyMatch(p.NoProxy, req.URL.Host) {
+			return nil, nil
+		}
+		proxy := p.HTTP
+		if req.URL.Scheme == "https" && p.HTTPS != "" {
+			proxy = p.HTTPS
+		}
+		if proxy == "" {
+			return nil, nil
+		}
+		return parseProxy(proxy)
+	}
+}
+
+func OutboundClient(feature string, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = ProxyFor(feature)
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
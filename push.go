@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PushConfig struct {
+	Enabled        bool
+	TimeoutSeconds int
+}
+
+// PushRequest names the destination of a push. Type is "webdav", "s3"
+// or "sftp". An sftp:// URL needs Username, Password and the server's
+// HostKey in authorized_keys form.
+type PushRequest struct {
+	Type      string
+	URL       string
+	Username  string
+	Password  string
+	AccessKey string
+	SecretKey string
+	Region    string
+	HostKey   string
+}
+
+type spoolWriter struct {
+	f      *os.File
+	header http.Header
+	code   int
+}
+
+func (s *spoolWriter) Header() http.Header {
+	return s.header
+}
+
+func (s *spoolWriter) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+}
+
+func (s *spoolWriter) Write(b []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+	if s.code != http.StatusOK {
+		return len(b), nil
+	}
+	return s.f.Write(b)
+}
+
+func SpoolArchive(w http.ResponseWriter, r *http.Request, id, feature string) (*os.File, int64, string, bool) {
+	var archive http.HandlerFunc
+	groupsLock.Lock()
+	_, isGroup := groups[id]
+	groupsLock.Unlock()
+	if isGroup {
+		archive = GroupDownloadHandler
+	} else if _, exists := GetTransfer(id); exists {
+		archive = DownloadHandler
+	} else {
+		ReceiverError(w, r, "notfound", http.StatusBadRequest)
+		return nil, 0, "", false
+	}
+
+	if err := os.MkdirAll(conf.TempDir, 0700); err != nil {
+		RequestLog(r).Error("Create temp dir: %s", err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return nil, 0, "", false
+	}
+	fd, err := ioutil.TempFile(conf.TempDir, TEMP_PREFIX+feature+"-")
+	if err != nil {
+		RequestLog(r).Error("Create %s spool: %s", feature, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return nil, 0, "", false
+	}
+	fail := func() {
+		fd.Close()
+		os.Remove(fd.Name())
+	}
+
+	sw := &spoolWriter{f: fd, header: http.Header{}}
+	archive(sw, r)
+	if sw.code == http.StatusForbidden {
+		fail()
+		ReceiverError(w, r, "forbidden", sw.code)
+		return nil, 0, "", false
+	}
+	if sw.code != http.StatusOK {
+		fail()
+		ReceiverError(w, r, "notfound", sw.code)
+		return nil, 0, "", false
+	}
+	size, err := fd.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = fd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		fail()
+		RequestLog(r).Error("Rewind %s spool: %s", feature, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return nil, 0, "", false
+	}
+	name := id + ".zip"
+	if _, params, err := mime.ParseMediaType(sw.header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	return fd, size, name, true
+}
+
+func PushHandler(w http.ResponseWriter, r *http.Request) {
+	if !conf.Push.Enabled {
+		Error(w, r, "pushing is disabled", http.StatusNotFound)
+		return
+	}
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var pr PushRequest
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(&pr); err != nil {
+		Error(w, r, "invalid push request", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(pr.URL)
+	if err != nil || u.Host == "" || (u.Scheme == "sftp") != (pr.Type == "sftp") ||
+		(u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "sftp") {
+		Error(w, r, "invalid url", http.StatusBadRequest)
+		return
+	}
+	if strings.HasSuffix(u.Path, "/") || u.Path == "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + id + ".zip"
+	}
+	switch pr.Type {
+	case "webdav":
+	case "s3":
+		if pr.AccessKey == "" || pr.SecretKey == "" || pr.Region == "" {
+			Error(w, r, "s3 needs AccessKey, SecretKey and Region", http.StatusBadRequest)
+			return
+		}
+	case "sftp":
+		if pr.Username == "" || pr.Password == "" {
+			Error(w, r, "sftp needs Username and Password", http.StatusBadRequest)
+			return
+		}
+		if _, _, err := ParseHostKey(pr.HostKey); err != nil {
+			Error(w, r, "sftp needs the server's HostKey: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		Error(w, r, "unsupported destination type", http.StatusBadRequest)
+		return
+	}
+
+	fd, size, _, ok := SpoolArchive(w, r, id, "push")
+	if !ok {
+		return
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*time.Duration(conf.Push.TimeoutSeconds))
+	defer cancel()
+	if pr.Type == "sftp" {
+		err := PushSFTP(ctx, u, pr.HostKey, pr.Username, pr.Password, fd)
+		switch {
+		case errors.Is(err, ErrForbiddenAddress):
+			Error(w, r, "url points to a forbidden address", http.StatusForbidden)
+			return
+		case errors.Is(err, ErrHostKeyMismatch), errors.Is(err, ErrSSHAuth):
+			RequestLog(r).Info("Push %s to %s: %s", id, u.Host, err)
+			Error(w, r, err.Error(), http.StatusBadGateway)
+			return
+		case err != nil:
+			RequestLog(r).Info("Push %s to %s: %s", id, u.Host, err)
+			Error(w, r, "push failed", http.StatusBadGateway)
+			return
+		}
+		RequestLog(r).Info("Pushed %s (%d bytes) to %s", id, size, u.Host)
+		writePushResult(w, id, size, u)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.String(), ioutil.NopCloser(fd))
+	if err != nil {
+		Error(w, r, "invalid url", http.StatusBadRequest)
+		return
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/zip")
+	switch pr.Type {
+	case "webdav":
+		if pr.Username != "" {
+			req.SetBasicAuth(pr.Username, pr.Password)
+		}
+	case "s3":
+		SignS3(req, pr.AccessKey, pr.SecretKey, pr.Region, clock.Now())
+	}
+
+	resp, err := fetchClient("push").Do(req)
+	if err != nil {
+		RequestLog(r).Info("Push %s to %s: %s", id, u.Host, err)
+		if errors.Is(err, ErrForbiddenAddress) {
+			Error(w, r, "url points to a forbidden address", http.StatusForbidden)
+			return
+		}
+		Error(w, r, "push failed", http.StatusBadGateway)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		RequestLog(r).Info("Push %s to %s: remote responded %d", id, u.Host, resp.StatusCode)
+		Error(w, r, fmt.Sprintf("remote server responded %d", resp.StatusCode), http.StatusBadGateway)
+		return
+	}
+	RequestLog(r).Info("Pushed %s (%d bytes) to %s", id, size, u.Host)
+	writePushResult(w, id, size, u)
+}
+
+func writePushResult(w http.ResponseWriter, id string, size int64, u *url.URL) {
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(struct {
+		Key  string
+		Size int64
+		URL  string
+	}{
+		id,
+		size,
+		u.String(),
+	})
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but the RFC 3986 unreserved
+// characters, and slashes if path is set.
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return awsEscape(keys[i], false) < awsEscape(keys[j], false) })
+	pairs := []string{}
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// SignS3 signs req with AWS Signature Version 4. The payload is sent
+// unsigned unless the caller already set X-Amz-Content-Sha256.
+func SignS3(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+	}
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscape(path, true),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + stamp,
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		payload,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		accessKey, scope, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateLimitConfig struct {
+	RequestsPerMinute int
+	Burst             int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	buckets     = map[string]*bucket{}
+	bucketsLock sync.Mutex
+)
+
+func Allow(key string) bool {
+	rate := float64(conf.RateLimit.RequestsPerMinute) / 60
+	burst := float64(conf.RateLimit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := clock.Now()
+
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{burst, now}
+		buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func CleanBuckets() {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+	for key, b := range buckets {
+		if clock.Since(b.last) > time.Hour {
+			delete(buckets, key)
+		}
+	}
+}
+
+func RateLimit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf.RateLimit.RequestsPerMinute > 0 && !Allow(ClientIP(r).String()) {
+			w.Header().Set("Retry-After", strconv.Itoa(60/conf.RateLimit.RequestsPerMinute+1))
+			Error(w, r, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
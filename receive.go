@@ -0,0 +1,186 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type attempts struct {
+	count int
+	reset time.Time
+}
+
+var (
+	receivetemplate *template.Template
+	failedCodes     = map[string]*attempts{}
+	failedCodesLock sync.Mutex
+)
+
+type ReceivePage struct {
+	Code        string
+	Error       string
+	Found       bool
+	Group       bool
+	Created     time.Time
+	Expires     time.Time
+	Messages    []string
+	Files       []ReceiveFile
+	Incomplete  []IncompleteFile
+	Download    string
+	Gallery     string
+	Report      bool
+	Encrypted   bool
+	Cancel      bool
+	Compression string
+	Drives      []DriveLink
+}
+
+type ReceiveFile struct {
+	Index int
+	GroupFile
+}
+
+func ValidKey(key string) bool {
+	return keys.Valid(key)
+}
+
+func NormalizeCode(code string) string {
+	return strings.Join(strings.Fields(code), "")
+}
+
+func AttemptsLeft(ip string) bool {
+	failedCodesLock.Lock()
+	defer failedCodesLock.Unlock()
+	a, ok := failedCodes[ip]
+	if !ok || clock.Now().After(a.reset) {
+		return true
+	}
+	return a.count < conf.ReceiveMaxAttempts
+}
+
+func FailedAttempt(ip string) {
+	failedCodesLock.Lock()
+	defer failedCodesLock.Unlock()
+	a, ok := failedCodes[ip]
+	if !ok || clock.Now().After(a.reset) {
+		a = &attempts{0, clock.Now().Add(time.Minute * time.Duration(conf.ReceiveWindowMinutes))}
+		failedCodes[ip] = a
+	}
+	a.count++
+	Anomaly(ip, ANOMALY_KEY)
+}
+
+func CleanAttempts() {
+	failedCodesLock.Lock()
+	defer failedCodesLock.Unlock()
+	for ip, a := range failedCodes {
+		if clock.Now().After(a.reset) {
+			delete(failedCodes, ip)
+		}
+	}
+}
+
+func LookupCode(code string) (ReceivePage, bool) {
+	page := ReceivePage{Code: code, Compression: DefaultZipMode(), Drives: DriveLinks()}
+	if !ValidKey(code) {
+		return page, false
+	}
+
+	if Suspended(code) {
+		page.Error = "This transfer was reported and is suspended pending review."
+		return page, true
+	}
+	transfer, ok := GetTransfer(code)
+	if ok && transfer.CurrentStatus() == WAITING_RECEIVER {
+		page.Found = true
+		page.Cancel = true
+		page.Created = transfer.Created
+		page.Expires = transfer.Deadline()
+		page.Download = "/download/" + code
+		page.Report = conf.Abuse.Enabled
+		page.Encrypted = transfer.passphrase != ""
+		if _, ok := transfer.Gallery(code); ok {
+			page.Gallery = "/gallery/" + code
+		}
+		if transfer.Message != "" {
+			page.Messages = []string{transfer.Message}
+		}
+		return page, true
+	}
+	if ok && transfer.CurrentStatus().Active() {
+		page.Cancel = true
+		page.Error = "The download is in progress."
+		return page, true
+	}
+	if ok {
+		if by := transfer.CancelledBy(); by != "" {
+			page.Error = "This transfer was cancelled by the " + by + "."
+			return page, true
+		}
+	}
+
+	groupsLock.Lock()
+	group, ok := groups[code]
+	groupsLock.Unlock()
+	if ok {
+		group.Lock()
+		defer group.Unlock()
+		if group.Status == WAITING_RECEIVER {
+			page.Found = true
+			page.Group = true
+			page.Created = group.Created
+			page.Expires = group.Expires
+			for _, c := range group.Contributions {
+				if c.Message != "" {
+					page.Messages = append(page.Messages, c.Message)
+				}
+				for _, f := range c.Files {
+					page.Files = append(page.Files, ReceiveFile{len(page.Files) + 1, f})
+				}
+			}
+			page.Incomplete = group.Incomplete
+			page.Download = "/group/" + code + "/download"
+			page.Report = conf.Abuse.Enabled
+			if len(page.Files) > 0 {
+				page.Compression = ZIP_FAST
+				for _, f := range page.Files {
+					if !Stored(f.Name) {
+						page.Compression = DefaultZipMode()
+						break
+					}
+				}
+			}
+			return page, true
+		}
+	}
+	return page, false
+}
+
+func ReceiveHandler(w http.ResponseWriter, r *http.Request) {
+	page := ReceivePage{}
+	code := NormalizeCode(r.URL.Query().Get("code"))
+	status := http.StatusOK
+	if code != "" {
+		ip := ClientIP(r).String()
+		if !AttemptsLeft(ip) {
+			page.Code = code
+			page.Error = "Too many wrong codes. Please wait a few minutes and try again."
+			status = http.StatusTooManyRequests
+		} else if found, ok := LookupCode(code); ok {
+			page = found
+		} else {
+			FailedAttempt(ip)
+			RequestLog(r).Info("Wrong receive code from %s", ip)
+			page.Code = code
+			page.Error = "No transfer is waiting for this code. Check for typos or ask the sender for a new one."
+			status = http.StatusNotFound
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	receivetemplate.Execute(w, page)
+}
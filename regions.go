@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REGION_HEADER = "X-Nethermes-Region"
+
+var (
+	regionPeers     = map[string]*RegionStatus{}
+	regionPeersLock sync.Mutex
+
+	regionClient = OutboundClient("regions", 10*time.Second)
+)
+
+type RegionsConfig struct {
+	Name          string
+	Countries     []string
+	Secret        string
+	GossipSeconds int
+	Nodes         []RegionNode
+}
+
+type RegionNode struct {
+	Name      string
+	URL       string
+	Countries []string
+}
+
+type RegionGossip struct {
+	Region      string
+	Keys        []string
+	Draining    bool
+	Maintenance bool
+}
+
+type RegionStatus struct {
+	Name      string
+	URL       string
+	Healthy   bool
+	RTTMillis int64
+	Keys      int
+	Seen      time.Time
+	Error     string `json:",omitempty"`
+	keys      map[string]bool
+}
+
+func CheckRegionsConfig() error {
+	c := conf.Regions
+	if len(c.Nodes) == 0 {
+		return nil
+	}
+	if c.Name == "" || c.Secret == "" {
+		return errors.New("Regions needs Name and Secret when Nodes are configured")
+	}
+	if c.GossipSeconds < 1 {
+		return errors.New("GossipSeconds must be at least 1")
+	}
+	for _, n := range c.Nodes {
+		u, err := url.Parse(n.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid URL %q for region %s", n.URL, n.Name)
+		}
+		if n.Name == "" || n.Name == c.Name {
+			return fmt.Errorf("region nodes need a name other than %q", c.Name)
+		}
+		regionPeers[n.Name] = &RegionStatus{Name: n.Name, URL: strings.TrimRight(n.URL, "/")}
+	}
+	return nil
+}
+
+func LocalKeys() []string {
+	keys := []string{}
+	transfersLock.Lock()
+	for id, t := range transfers {
+		if t.CurrentStatus() == WAITING_RECEIVER {
+			keys = append(keys, id)
+		}
+	}
+	transfersLock.Unlock()
+	groupsLock.Lock()
+	for id, g := range groups {
+		if g.Open() {
+			keys = append(keys, id)
+		}
+	}
+	groupsLock.Unlock()
+	reservationsLock.Lock()
+	for id, res := range reservations {
+		if clock.Now().Before(res.Expires) {
+			keys = append(keys, id)
+		}
+	}
+	reservationsLock.Unlock()
+	return keys
+}
+
+func HoldsKey(id string) bool {
+	if _, exists := GetTransfer(id); exists {
+		return true
+	}
+	groupsLock.Lock()
+	_, grouped := groups[id]
+	groupsLock.Unlock()
+	return grouped || Reserved(id)
+}
+
+func RegionTaken(key string) bool {
+	regionPeersLock.Lock()
+	defer regionPeersLock.Unlock()
+	for _, peer := range regionPeers {
+		if peer.keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func RegionGossipHandler(w http.ResponseWriter, r *http.Request) {
+	secret := r.Header.Get("X-Region-Secret")
+	if conf.Regions.Secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(conf.Regions.Secret)) != 1 {
+		Error(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(RegionGossip{
+		Region:      conf.Regions.Name,
+		Keys:        LocalKeys(),
+		Draining:    Draining(),
+		Maintenance: CurrentMaintenance() != nil,
+	})
+}
+
+func gossip(peer *RegionStatus) (RegionGossip, time.Duration, error) {
+	var g RegionGossip
+	req, err := http.NewRequest("GET", peer.URL+"/regions/gossip", nil)
+	if err != nil {
+		return g, 0, err
+	}
+	req.Header.Set("X-Region-Secret", conf.Regions.Secret)
+	start := clock.Now()
+	resp, err := regionClient.Do(req)
+	if err != nil {
+		return g, 0, err
+	}
+	defer resp.Body.Close()
+	rtt := clock.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return g, rtt, errors.New("region responded " + resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&g); err != nil {
+		return g, rtt, err
+	}
+	if g.Region != peer.Name {
+		return g, rtt, fmt.Errorf("node at %s calls itself %q", peer.URL, g.Region)
+	}
+	return g, rtt, nil
+}
+
+func GossipRegions() {
+	interval := time.Second * time.Duration(conf.Regions.GossipSeconds)
+	for {
+		for _, n := range conf.Regions.Nodes {
+			regionPeersLock.Lock()
+			peer := regionPeers[n.Name]
+			regionPeersLock.Unlock()
+			g, rtt, err := gossip(peer)
+
+			regionPeersLock.Lock()
+			wasHealthy := peer.Healthy
+			peer.Healthy = err == nil && !g.Draining && !g.Maintenance
+			peer.RTTMillis = rtt.Milliseconds()
+			peer.Error = ""
+			if err != nil {
+				peer.Error = err.Error()
+				peer.keys = nil
+			} else {
+				peer.Seen = clock.Now()
+				peer.keys = map[string]bool{}
+				for _, k := range g.Keys {
+					peer.keys[k] = true
+				}
+			}
+			peer.Keys = len(peer.keys)
+			regionPeersLock.Unlock()
+			if err != nil && wasHealthy {
+				logger.Warn("Region %s is unreachable: %s", n.Name, err)
+			} else if peer.Healthy && !wasHealthy {
+				logger.Info("Region %s is healthy (%dms)", n.Name, peer.RTTMillis)
+			}
+		}
+		Sleep(interval)
+	}
+}
+
+func RegionStatuses() []RegionStatus {
+	regionPeersLock.Lock()
+	defer regionPeersLock.Unlock()
+	list := []RegionStatus{}
+	for _, n := range conf.Regions.Nodes {
+		list = append(list, *regionPeers[n.Name])
+	}
+	return list
+}
+
+func hasCountry(list []string, country string) bool {
+	for _, c := range list {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+func RegionFor(r *http.Request) (*RegionStatus, bool) {
+	key := mux.Vars(r)["id"]
+	if key == "" && r.URL.Path == "/receive" {
+		key = NormalizeCode(r.URL.Query().Get("code"))
+	}
+	if key != "" && HoldsKey(key) {
+		return nil, false
+	}
+
+	regionPeersLock.Lock()
+	defer regionPeersLock.Unlock()
+	if key != "" {
+		for _, n := range conf.Regions.Nodes {
+			if peer := regionPeers[n.Name]; peer.keys[key] {
+				return peer, true
+			}
+		}
+		return nil, false
+	}
+	if r.URL.Path != "/" || geodb == nil {
+		return nil, false
+	}
+	ip := ClientIP(r)
+	if ip == nil {
+		return nil, false
+	}
+	country := geodb.Country(ip)
+	if country == "" || hasCountry(conf.Regions.Countries, country) {
+		return nil, false
+	}
+	var best *RegionStatus
+	for _, n := range conf.Regions.Nodes {
+		peer := regionPeers[n.Name]
+		if peer.Healthy && hasCountry(n.Countries, country) && (best == nil || peer.RTTMillis < best.RTTMillis) {
+			best = peer
+		}
+	}
+	return best, best != nil
+}
+
+func RegionRedirect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(conf.Regions.Nodes) == 0 || (r.Method != "GET" && r.Method != "HEAD") || r.URL.Query().Get("via") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		peer, ok := RegionFor(r)
+		if !ok {
+			w.Header().Set(REGION_HEADER, conf.Regions.Name)
+			handler.ServeHTTP(w, r)
+			return
+		}
+		q := r.URL.Query()
+		q.Set("via", conf.Regions.Name)
+		RequestLog(r).Info("Sending %s %s to region %s", ClientIP(r), r.URL.Path, peer.Name)
+		w.Header().Set(REGION_HEADER, peer.Name)
+		http.Redirect(w, r, peer.URL+r.URL.Path+"?"+q.Encode(), http.StatusTemporaryRedirect)
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	Startup()
+	os.Exit(m.Run())
+}
+
+type testFile struct {
+	Name string
+	Data []byte
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(Identify(http.DefaultServeMux))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func randomFiles(rnd *rand.Rand) []testFile {
+	files := make([]testFile, 1+rnd.Intn(4))
+	for i := range files {
+		data := make([]byte, rnd.Intn(64*1024))
+		rnd.Read(data)
+		files[i] = testFile{fmt.Sprintf("file-%d-%d.bin", i, rnd.Intn(1000)), data}
+	}
+	return files
+}
+
+func multipartBody(t *testing.T, files []testFile) (string, []byte) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, f := range files {
+		fw, err := mw.CreateFormFile("file", f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.Data)
+	}
+	mw.Close()
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func fetchKey(t *testing.T, srv *httptest.Server) string {
+	resp, err := http.Get(srv.URL + "/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var key string
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func waitForTransfer(t *testing.T, key string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, exists := GetTransfer(key); exists {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("transfer %s never showed up", key)
+}
+
+func unzip(t *testing.T, data []byte) map[string][]byte {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("read archive: %s", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("read %s: %s", f.Name, err)
+		}
+		files[f.Name] = b
+	}
+	return files
+}
+
+func relay(t *testing.T, srv *httptest.Server, files []testFile) {
+	key := fetchKey(t, srv)
+	contentType, body := multipartBody(t, files)
+
+	uploaded := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/upload/"+key, contentType, bytes.NewReader(body))
+		if err != nil {
+			uploaded <- err
+			return
+		}
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(msg) != "ok" {
+			uploaded <- fmt.Errorf("upload responded %d: %s", resp.StatusCode, msg)
+			return
+		}
+		uploaded <- nil
+	}()
+	waitForTransfer(t, key)
+
+	resp, err := http.Get(srv.URL + "/download/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-uploaded; err != nil {
+		t.Fatal(err)
+	}
+
+	got := unzip(t, data)
+	if len(got) != len(files) {
+		t.Fatalf("got %d files, want %d", len(got), len(files))
+	}
+	for _, f := range files {
+		if !bytes.Equal(got[f.Name], f.Data) {
+			t.Errorf("%s: content differs", f.Name)
+		}
+	}
+}
+
+func TestRelayConcurrentPairs(t *testing.T) {
+	srv := newTestServer(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			relay(t, srv, randomFiles(rand.New(rand.NewSource(seed))))
+		}(int64(i))
+	}
+	wg.Wait()
+}
+
+func TestRelayRejectsNonMultipart(t *testing.T) {
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+	resp, err := http.Post(srv.URL+"/upload/"+key, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if _, exists := GetTransfer(key); exists {
+		t.Fatal("rejected upload left a transfer behind")
+	}
+}
+
+func TestRelayMalformedMultipart(t *testing.T) {
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+
+	uploaded := make(chan struct{})
+	go func() {
+		defer close(uploaded)
+		resp, err := http.Post(srv.URL+"/upload/"+key, "multipart/form-data; boundary=xyz", strings.NewReader("--xyz\r\nnot a header\r\n\r\ngarbage"))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitForTransfer(t, key)
+
+	resp, err := http.Get(srv.URL + "/download/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	select {
+	case <-uploaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender still blocked after a malformed body was relayed")
+	}
+}
+
+func TestRelaySenderDisconnect(t *testing.T) {
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, _ := mw.CreateFormFile("file", "partial.bin")
+		fw.Write(bytes.Repeat([]byte("x"), 32*1024))
+		pw.CloseWithError(io.ErrUnexpectedEOF)
+	}()
+	go func() {
+		resp, err := http.Post(srv.URL+"/upload/"+key, mw.FormDataContentType(), pr)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitForTransfer(t, key)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(srv.URL + "/download/" + key)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver hung after the sender disconnected")
+	}
+
+	relay(t, srv, []testFile{{"after.txt", []byte("still serving")}})
+}
+
+func TestRelayUnknownKey(t *testing.T) {
+	srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/download/" + strings.Repeat("a", conf.KeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("unknown key was served")
+	}
+}
+
+func TestRelayCorruptedPart(t *testing.T) {
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="a.bin"`)
+	h.Set(CHECKSUM_SHA256, hex.EncodeToString(sha256.New().Sum(nil)))
+	fw, _ := mw.CreatePart(h)
+	fw.Write(bytes.Repeat([]byte("x"), 64*1024))
+	mw.Close()
+
+	uploaded := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/upload/"+key, mw.FormDataContentType(), ioutil.NopCloser(&buf))
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded <- resp
+	}()
+	waitForTransfer(t, key)
+
+	resp, err := http.Get(srv.URL + "/download/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := resp.Trailer.Get(TRAILER_STATUS); !strings.HasPrefix(status, "failed: ") {
+		t.Errorf("receiver trailer is %q", status)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("corrupted transfer produced a valid archive")
+	}
+
+	up := <-uploaded
+	if up == nil {
+		return
+	}
+	up.Body.Close()
+	if up.StatusCode != http.StatusUnprocessableEntity || up.Header.Get("X-Error-Code") != "checksum-mismatch" {
+		t.Errorf("sender got %d %q", up.StatusCode, up.Header.Get("X-Error-Code"))
+	}
+	transfer, _ := GetTransfer(key)
+	if status := transfer.CurrentStatus(); status != CORRUPTED {
+		t.Errorf("transfer is %s", status)
+	}
+}
+
+func TestRelayBufferedChecksum(t *testing.T) {
+	saved := conf.SmallFileBufferBytes
+	conf.SmallFileBufferBytes = 64 * 1024
+	t.Cleanup(func() { conf.SmallFileBufferBytes = saved })
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+	contentType, body := multipartBody(t, []testFile{{"a.txt", []byte("hello")}})
+	sum := md5.Sum(append([]byte{}, body[:len(body)-1]...))
+
+	req, _ := http.NewRequest("POST", srv.URL+"/upload/"+key, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(CHECKSUM_MD5, base64.StdEncoding.EncodeToString(sum[:]))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if _, exists := GetTransfer(key); exists {
+		t.Fatal("corrupted upload left a transfer behind")
+	}
+}
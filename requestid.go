@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+type RequestLogger struct {
+	id string
+}
+
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func WithRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if !ValidRequestID(id) {
+		id = NewRequestID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func RequestLog(r *http.Request) RequestLogger {
+	return RequestLogger{RequestID(r)}
+}
+
+func (l RequestLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{l.id}, args...)
+}
+
+func (l RequestLogger) Info(format string, args ...interface{}) {
+	logger.Info("[%s] "+format, l.args(args)...)
+}
+
+func (l RequestLogger) Warn(format string, args ...interface{}) {
+	logger.Warn("[%s] "+format, l.args(args)...)
+}
+
+func (l RequestLogger) Error(format string, args ...interface{}) {
+	logger.Error("[%s] "+format, l.args(args)...)
+}
+
+func Error(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id := RequestID(r); id != "" {
+		msg += " (request " + id + ")"
+	}
+	http.Error(w, msg, code)
+}
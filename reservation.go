@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Reservation struct {
+	Token   string
+	Expires time.Time
+}
+
+var (
+	reservations     = map[string]Reservation{}
+	reservationsLock sync.Mutex
+)
+
+func ReservationCookie(key string) string {
+	return "reservation-" + key
+}
+
+func Reserve(w http.ResponseWriter, key string) {
+	if conf.ReservationMinutes <= 0 {
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	res := Reservation{
+		hex.EncodeToString(b),
+		clock.Now().Add(time.Minute * time.Duration(conf.ReservationMinutes)),
+	}
+	reservationsLock.Lock()
+	reservations[key] = res
+	reservationsLock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     ReservationCookie(key),
+		Value:    res.Token,
+		Path:     "/upload/" + key,
+		Expires:  res.Expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func Reserved(key string) bool {
+	reservationsLock.Lock()
+	defer reservationsLock.Unlock()
+	res, ok := reservations[key]
+	return ok && clock.Now().Before(res.Expires)
+}
+
+func ClaimReservation(r *http.Request, key string) bool {
+	reservationsLock.Lock()
+	defer reservationsLock.Unlock()
+	res, ok := reservations[key]
+	if !ok || clock.Now().After(res.Expires) {
+		return true
+	}
+
+	token := r.Header.Get("X-Reservation")
+	if c, err := r.Cookie(ReservationCookie(key)); err == nil {
+		token = c.Value
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(res.Token)) != 1 {
+		return false
+	}
+	delete(reservations, key)
+	return true
+}
+
+func CleanReservations() {
+	reservationsLock.Lock()
+	defer reservationsLock.Unlock()
+	for key, res := range reservations {
+		if clock.Now().After(res.Expires) {
+			delete(reservations, key)
+		}
+	}
+}
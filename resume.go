@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ResumeSpool keeps a copy of the archive sent to a receiver. When the
+// receiver's connection breaks, the relay keeps reading the upload into the
+// spool, and the receiver fetches the rest with GET /download/{id}?offset=N
+// and its X-Cancel-Token.
+type ResumeSpool struct {
+	sync.Mutex
+	fd       *os.File
+	size     int64
+	detached bool
+	done     bool
+	wiped    bool
+	expires  time.Time
+	sum      string
+	status   string
+	grown    chan struct{}
+}
+
+func NewResumeSpool() (*ResumeSpool, error) {
+	if err := os.MkdirAll(conf.TempDir, 0700); err != nil {
+		return nil, err
+	}
+	fd, err := ioutil.TempFile(conf.TempDir, TEMP_PREFIX+"resume-")
+	if err != nil {
+		return nil, err
+	}
+	return &ResumeSpool{fd: fd, grown: make(chan struct{})}, nil
+}
+
+func (s *ResumeSpool) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	n, err := s.fd.Write(p)
+	s.size += int64(n)
+	close(s.grown)
+	s.grown = make(chan struct{})
+	return n, err
+}
+
+func (s *ResumeSpool) Size() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+// Open reports whether the receiver can still resume: its connection
+// broke, and the archive is still being spooled or finished less than
+// ResumeMinutes ago.
+func (s *ResumeSpool) Open() bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.detached && !s.wiped && (!s.done || clock.Now().Before(s.expires))
+}
+
+// Finish records the trailers of the finished archive. A spool whose
+// receiver got everything is wiped right away.
+func (s *ResumeSpool) Finish(id string, trailers http.Header) {
+	s.Lock()
+	s.done = true
+	s.sum = trailers.Get(TRAILER_SHA256)
+	s.status = trailers.Get(TRAILER_STATUS)
+	if s.status == "" {
+		s.status = "failed: archive was not finished"
+	}
+	s.expires = clock.Now().Add(time.Minute * time.Duration(conf.ResumeMinutes))
+	close(s.grown)
+	s.grown = make(chan struct{})
+	detached := s.detached
+	s.Unlock()
+	if !detached {
+		s.Wipe(id, "delivered")
+	}
+}
+
+func (s *ResumeSpool) Wipe(id, reason string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.wiped {
+		s.Unlock()
+		return
+	}
+	s.wiped = true
+	s.fd.Close()
+	s.Unlock()
+	n, err := WipeFile(s.fd.Name())
+	AuditWipe(id, reason, WipeResult{1, n}, err)
+}
+
+// Reader reads the spool from offset, waiting for the relay while the
+// archive is still being spooled.
+func (s *ResumeSpool) Reader(ctx context.Context, offset int64) io.Reader {
+	return &spoolReader{s, ctx, offset}
+}
+
+type spoolReader struct {
+	s      *ResumeSpool
+	ctx    context.Context
+	offset int64
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	for {
+		r.s.Lock()
+		size, done, grown := r.s.size, r.s.done, r.s.grown
+		r.s.Unlock()
+		if r.offset < size {
+			if left := size - r.offset; int64(len(p)) > left {
+				p = p[:left]
+			}
+			n, err := r.s.fd.ReadAt(p, r.offset)
+			r.offset += int64(n)
+			return n, err
+		}
+		if done {
+			return 0, io.EOF
+		}
+		select {
+		case <-grown:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// resumeWriter spools the archive before sending it, and only spools once
+// the receiver's connection has failed, so the relay runs to the end.
+type resumeWriter struct {
+	http.ResponseWriter
+	spool    *ResumeSpool
+	detached func(err error)
+}
+
+func (w *resumeWriter) Write(p []byte) (int, error) {
+	if _, err := w.spool.Write(p); err != nil {
+		return 0, err
+	}
+	w.spool.Lock()
+	detached := w.spool.detached
+	w.spool.Unlock()
+	if detached {
+		return len(p), nil
+	}
+	if _, err := w.ResponseWriter.Write(p); err != nil {
+		w.spool.Lock()
+		w.spool.detached = true
+		w.spool.Unlock()
+		w.detached(err)
+	}
+	return len(p), nil
+}
+
+func (w *resumeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *Transfer) Resume() *ResumeSpool {
+	t.Lock()
+	defer t.Unlock()
+	return t.resume
+}
+
+// Supersede lets a sender whose upload broke off while waiting for a
+// receiver send again to the same key: given the key's sender secret, the
+// waiting transfer is aborted and removed.
+func (t *Transfer) Supersede(r *http.Request, id string) bool {
+	if !CheckSecret(id, SenderSecret(r, id)) || t.CurrentStatus() != WAITING_RECEIVER {
+		return false
+	}
+	if err := t.Cancel("sender"); err != nil {
+		return false
+	}
+	t.timeline.Record("superseded", 0, "sender reconnected")
+	RequestLog(r).Info("Replacing the waiting upload of %s with a new one from its sender", id)
+	transfersLock.Lock()
+	if transfers[id] == t {
+		delete(transfers, id)
+	}
+	transfersLock.Unlock()
+	t.RemoveAppended(id, ABORTED.String())
+	BurnBuffer(id, ABORTED.String(), t.buffer)
+	return true
+}
+
+// ResumeDownload serves the rest of an archive whose download broke off,
+// from the byte given by ?offset=N. The trailers cover the whole archive.
+func ResumeDownload(w http.ResponseWriter, r *http.Request, id string, transfer *Transfer) {
+	spool := transfer.Resume()
+	if !spool.Open() {
+		Error(w, r, "transfer cannot be resumed", http.StatusConflict)
+		return
+	}
+	if transfer.Held() {
+		WriteError(w, r, ErrOnHold)
+		return
+	}
+	if Suspended(id) {
+		WriteError(w, r, ErrSuspended)
+		return
+	}
+	if !transfer.receiverToken(r) {
+		RequestLog(r).Info("Rejected resumption of %s without the receiver's token", id)
+		ReceiverError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 || offset > spool.Size() {
+		Error(w, r, "invalid resume offset", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	RequestLog(r).Info("Resuming %s at byte %d", id, offset)
+	transfer.timeline.Record("receiver resumed", offset, ClientIP(r).String())
+	w.Header().Set("Content-Disposition", "attachment; filename="+transfer.ArchiveName(id))
+	w.Header().Set("Trailer", TRAILER_SHA256+", "+TRAILER_STATUS)
+	w.Header().Set("X-Resume-Offset", strconv.FormatInt(offset, 10))
+	if _, err := io.Copy(w, spool.Reader(r.Context(), offset)); err != nil {
+		RequestLog(r).Info("Resumed download of %s broke off: %s", id, err)
+		return
+	}
+	spool.Lock()
+	w.Header().Set(TRAILER_SHA256, spool.sum)
+	w.Header().Set(TRAILER_STATUS, spool.status)
+	spool.Unlock()
+}
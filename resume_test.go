@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func postUpload(srv string, key, contentType string, body io.Reader, header http.Header) chan error {
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", srv+"/upload/"+key, body)
+		req.Header = header
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("upload: %s: %s", resp.Status, msg)
+			}
+		}
+		done <- err
+	}()
+	return done
+}
+
+func TestResumeDownload(t *testing.T) {
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+	data := make([]byte, 24*1024*1024)
+	rand.Read(data)
+	contentType, body := multipartBody(t, []testFile{{"big.bin", data}})
+	uploaded := postUpload(srv.URL, key, contentType, bytes.NewReader(body), http.Header{})
+	waitForTransfer(t, key)
+
+	resp, err := http.Get(srv.URL + "/download/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := resp.Header.Get("X-Cancel-Token")
+	if resp.Header.Get("X-Resumable") != "offset" || token == "" {
+		t.Fatalf("download does not offer resumption: %v", resp.Header)
+	}
+	head := make([]byte, 1024*1024)
+	_, err = io.ReadFull(resp.Body, head)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-uploaded; err != nil {
+		t.Fatal(err)
+	}
+	transfer, _ := GetTransfer(key)
+	if !transfer.Resume().Open() {
+		t.Fatal("dropped download cannot be resumed")
+	}
+
+	resume := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/download/"+key+"?offset="+strconv.Itoa(len(head)), nil)
+		req.Header.Set("X-Cancel-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := resume("wrong"); resp.StatusCode != http.StatusForbidden {
+		resp.Body.Close()
+		t.Errorf("resumed with the wrong token: %s", resp.Status)
+	}
+	resp = resume(token)
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Resume-Offset") != strconv.Itoa(len(head)) {
+		t.Fatalf("resumed at %q", resp.Header.Get("X-Resume-Offset"))
+	}
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := append(head, rest...)
+	sum := sha256.Sum256(archive)
+	if status := resp.Trailer.Get(TRAILER_STATUS); status != "complete" {
+		t.Errorf("transfer status %q", status)
+	}
+	if resp.Trailer.Get(TRAILER_SHA256) != hex.EncodeToString(sum[:]) {
+		t.Error("trailer checksum does not cover the whole archive")
+	}
+	if files := unzip(t, archive); !bytes.Equal(files["big.bin"], data) {
+		t.Error("resumed archive differs from the upload")
+	}
+}
+
+func TestUploadSupersedes(t *testing.T) {
+	srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key string
+	json.NewDecoder(resp.Body).Decode(&key)
+	resp.Body.Close()
+	secret := resp.Header.Get("X-Sender-Secret")
+
+	files := []testFile{{"a.txt", []byte("second attempt")}}
+	contentType, body := multipartBody(t, files)
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	postUpload(srv.URL, key, contentType, pr, http.Header{})
+	waitForTransfer(t, key)
+	first, _ := GetTransfer(key)
+
+	if err := <-postUpload(srv.URL, key, contentType, bytes.NewReader(body), http.Header{}); err == nil {
+		t.Fatal("upload without the sender secret replaced the waiting one")
+	}
+	uploaded := postUpload(srv.URL, key, contentType, bytes.NewReader(body), http.Header{"X-Sender-Secret": {secret}})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if second, _ := GetTransfer(key); second != nil && second != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second upload never replaced the first")
+		}
+	}
+	if first.CurrentStatus() != ABORTED {
+		t.Errorf("replaced transfer is %s", first.CurrentStatus())
+	}
+	resp, err = http.Get(srv.URL + "/download/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := unzip(t, archive)["a.txt"]; string(got) != "second attempt" {
+		t.Errorf("received %q", got)
+	}
+	if err := <-uploaded; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+type Listener struct {
+	Address  string
+	Upload   bool
+	Download bool
+}
+
+func Routes(upload, download bool) *mux.Router {
+	preflight := http.NotFoundHandler()
+
+	r := mux.NewRouter()
+	get := r.Methods("GET", "HEAD").Subrouter()
+	post := r.Methods("POST").Subrouter()
+	options := r.Methods("OPTIONS").Subrouter()
+	del := r.Methods("DELETE").Subrouter()
+	if upload && !conf.Headless {
+		get.Handle("/", ChainFunc("ui", IndexHandler))
+		get.Handle("/shared/{id}", ChainFunc("ui", SharedHandler))
+		get.Handle("/progress/{id}", ChainFunc("ui", ProgressHandler))
+		get.Handle("/presigned/{id}", ChainFunc("partner", PresignedPageHandler))
+	}
+	if upload {
+		get.Handle("/key", ChainFunc("sender", KeyHandler))
+		get.Handle("/api/v1/limits", ChainFunc("sender", LimitsHandler))
+		get.Handle("/status/{id}", ChainFunc("sender", StatusHandler))
+		get.Handle("/status/{id}/events", ChainFunc("sender", StatusEventsHandler))
+		get.Handle("/group/{id}/status", ChainFunc("sender", GroupStatusHandler))
+		post.Handle("/upload/{id}", ChainFunc("sender", UploadHandler))
+		post.Handle("/upload/{id}/append", ChainFunc("sender", AppendHandler))
+		post.Handle("/group/{id}/upload", ChainFunc("sender", GroupUploadHandler))
+		post.Handle("/group/{id}/dedupe", ChainFunc("sender", GroupDedupeHandler))
+		post.Handle("/share", ChainFunc("sender", ShareHandler))
+		post.Handle("/fetch", ChainFunc("sender", FetchHandler))
+		post.Handle("/api/v1/echo", ChainFunc("sender", EchoHandler))
+		post.Handle("/escrow/{id}", ChainFunc("sender", EscrowHandler))
+		post.Handle("/extend/{id}", ChainFunc("sender", ExtendHandler))
+		get.Handle("/commands/{id}", ChainFunc("sender", CommandsHandler))
+		get.Handle("/webpush/key", ChainFunc("sender", WebPushKeyHandler))
+		post.Handle("/webpush/subscribe/{id}", ChainFunc("sender", WebPushSubscribeHandler))
+		post.Handle("/box/{name}", ChainFunc("sender", MailboxDropHandler))
+		post.Handle("/api/v1/presign", ChainFunc("presign", PresignHandler))
+		post.Handle("/presigned/{id}", ChainFunc("partner", PresignedUploadHandler))
+		options.Handle("/key", Chain("sender", preflight))
+		options.Handle("/fetch", Chain("sender", preflight))
+		options.Handle("/api/v1/echo", Chain("sender", preflight))
+		options.Handle("/api/v1/limits", Chain("sender", preflight))
+		options.Handle("/api/v1/presign", Chain("presign", preflight))
+		options.Handle("/presigned/{id}", Chain("partner", preflight))
+		options.Handle("/status/{id}", Chain("sender", preflight))
+		options.Handle("/status/{id}/events", Chain("sender", preflight))
+		options.Handle("/upload/{id}", Chain("sender", preflight))
+		options.Handle("/upload/{id}/append", Chain("sender", preflight))
+		options.Handle("/extend/{id}", Chain("sender", preflight))
+		options.Handle("/commands/{id}", Chain("sender", preflight))
+		options.Handle("/webpush/subscribe/{id}", Chain("sender", preflight))
+		options.Handle("/group/{id}/{_:(status|upload|dedupe)}", Chain("sender", preflight))
+	}
+	if download && !conf.Headless {
+		get.Handle("/receive", ChainFunc("ui", ReceiveHandler))
+	}
+	if download {
+		get.Handle("/download/{id}", ChainFunc("receiver", PreviewGuard(DownloadHandler)))
+		get.Handle("/group/{id}/download", ChainFunc("receiver", PreviewGuard(GroupDownloadHandler)))
+		get.Handle("/download/{id}/parts", ChainFunc("receiver", SplitIndexHandler))
+		get.Handle("/download/{id}/part/{n:[0-9]+}", ChainFunc("receiver", SplitPartHandler))
+		get.Handle("/gallery/{id}", ChainFunc("receiver", PreviewGuard(GalleryHandler)))
+		get.Handle("/gallery/{id}/thumb/{n:[0-9]+}", ChainFunc("receiver", GalleryThumbnailHandler))
+		get.Handle("/gallery/{id}/image/{n:[0-9]+}", ChainFunc("receiver", GalleryImageHandler))
+		post.Handle("/push/{id}", ChainFunc("receiver", PushHandler))
+		get.Handle("/drive/callback", ChainFunc("receiver", DriveCallbackHandler))
+		get.Handle("/drive/{id}", ChainFunc("receiver", DriveStartHandler))
+		get.Handle("/drive/{id}/save", ChainFunc("receiver", DriveSaveHandler))
+		post.Handle("/group/{id}/forward", ChainFunc("receiver", GroupForwardHandler))
+		post.Handle("/report/{id}", ChainFunc("receiver", ReportHandler))
+		get.Handle("/box/{name}", ChainFunc("receiver", MailboxHandler))
+		get.Handle("/box/{name}/collect", ChainFunc("receiver", MailboxCollectHandler))
+		get.Handle("/box/{name}/files/{fid}", ChainFunc("receiver", MailboxFileHandler))
+		del.Handle("/box/{name}/files/{fid}", ChainFunc("receiver", MailboxDeleteFileHandler))
+		options.Handle("/download/{id}", Chain("receiver", preflight))
+		options.Handle("/push/{id}", Chain("receiver", preflight))
+		options.Handle("/report/{id}", Chain("receiver", preflight))
+		options.Handle("/group/{id}/{_:(download|forward)}", Chain("receiver", preflight))
+	}
+	if upload || download {
+		post.Handle("/cancel/{id}", ChainFunc("sender", CancelHandler))
+		options.Handle("/cancel/{id}", Chain("sender", preflight))
+	}
+	get.Handle("/speedtest/download", ChainFunc("diagnostics", SpeedTestDownloadHandler))
+	get.Handle("/stats", ChainFunc("stats", StatsHandler))
+	get.Handle("/version", ChainFunc("stats", VersionHandler))
+	get.Handle("/healthz", ChainFunc("stats", HealthHandler))
+	if conf.Signing.Enabled {
+		get.Handle("/api/v1/signing-keys", ChainFunc("stats", SigningKeysHandler))
+	}
+	if len(conf.Regions.Nodes) > 0 {
+		get.Handle("/regions/gossip", ChainFunc("failover", RegionGossipHandler))
+	}
+	if len(conf.Tunnel.Endpoints) > 0 {
+		get.Handle("/tunnel/connect", ChainFunc("tunnel", TunnelConnectHandler))
+	}
+	if conf.AdminListener.Address == "" || !conf.AdminListener.Exclusive {
+		adminRoutes(get, post, del)
+	}
+	ssoRoutes(get, post)
+	if !conf.Headless {
+		get.Handle("/{_:(.*)}", Chain("ui", http.FileServer(http.Dir("./htdocs"))))
+	}
+	post.Handle("/speedtest/upload", ChainFunc("diagnostics", SpeedTestUploadHandler))
+	post.Handle("/replicate", ChainFunc("failover", ReplicateHandler))
+	post.Handle("/replicate/events", ChainFunc("failover", ReplicateEventsHandler))
+	options.Handle("/speedtest/{_:(download|upload)}", Chain("diagnostics", preflight))
+	return r
+}
+
+func adminRoutes(get, post, del *mux.Router) {
+	get.Handle("/metrics", ChainFunc("admin", MetricsHandler))
+	get.Handle("/admin/transfers", ChainFunc("admin", AdminTransfersHandler))
+	get.Handle("/admin/usage", ChainFunc("admin", AdminUsageHandler))
+	get.Handle("/admin/config", ChainFunc("admin", ConfigHandler))
+	get.Handle("/admin/holds", ChainFunc("admin", HoldsHandler))
+	get.Handle("/admin/maintenance", ChainFunc("admin", MaintenanceHandler))
+	post.Handle("/admin/maintenance", ChainFunc("admin", StartMaintenanceHandler))
+	del.Handle("/admin/maintenance", ChainFunc("admin", EndMaintenanceHandler))
+	post.Handle("/admin/holds/{id}", ChainFunc("admin", PlaceHoldHandler))
+	del.Handle("/admin/holds/{id}", ChainFunc("admin", LiftHoldHandler))
+	get.Handle("/admin/reports", ChainFunc("admin", ReportsHandler))
+	post.Handle("/admin/reports/{id}", ChainFunc("admin", ReviewHandler))
+	del.Handle("/admin/blocks/{ip}", ChainFunc("admin", UnblockHandler))
+	get.Handle("/admin/bans", ChainFunc("admin", BansHandler))
+	del.Handle("/admin/bans/{ip}", ChainFunc("admin", UnbanHandler))
+	get.Handle("/admin/boxes", ChainFunc("admin", MailboxesHandler))
+	post.Handle("/admin/boxes", ChainFunc("admin", CreateMailboxHandler))
+	del.Handle("/admin/boxes/{name}", ChainFunc("admin", DeleteMailboxHandler))
+	get.Handle("/admin/tokens", ChainFunc("admin", TokensHandler))
+	post.Handle("/admin/tokens", ChainFunc("admin", CreateTokenHandler))
+	del.Handle("/admin/tokens/{tid:[0-9a-f]+}", ChainFunc("admin", RevokeTokenHandler))
+	post.Handle("/admin/signing/rotate", ChainFunc("admin", RotateSigningKeyHandler))
+	del.Handle("/admin/signing/keys/{kid:[0-9a-f]+}", ChainFunc("admin", RetireSigningKeyHandler))
+	get.Handle("/api/v1/transfers/{id}/events", ChainFunc("admin", TransferEventsHandler))
+	get.Handle("/api/v1/schedules", ChainFunc("admin", SchedulesHandler))
+	post.Handle("/api/v1/schedules", ChainFunc("admin", CreateScheduleHandler))
+	post.Handle("/api/v1/schedules/{sid:[0-9a-f]+}/run", ChainFunc("admin", RunScheduleHandler))
+	del.Handle("/api/v1/schedules/{sid:[0-9a-f]+}", ChainFunc("admin", DeleteScheduleHandler))
+}
+
+func ssoRoutes(get, post *mux.Router) {
+	get.Handle("/saml/metadata", ChainFunc("sso", SAMLMetadataHandler))
+	get.Handle("/saml/login", ChainFunc("sso", SAMLLoginHandler))
+	post.Handle("/saml/acs", ChainFunc("sso", SAMLACSHandler))
+	post.Handle("/saml/logout", ChainFunc("sso", SAMLLogoutHandler))
+}
+
+func AdminRoutes() *mux.Router {
+	r := mux.NewRouter()
+	get := r.Methods("GET", "HEAD").Subrouter()
+	post := r.Methods("POST").Subrouter()
+	del := r.Methods("DELETE").Subrouter()
+	adminRoutes(get, post, del)
+	ssoRoutes(get, post)
+	return r
+}
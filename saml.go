@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SAML_COOKIE        = "nethermes_sso"
+	SAML_LOGIN_MINUTES = 10
+	SAML_SKEW          = 3 * time.Minute
+
+	XMLNS_SAML_ASSERTION = "urn:oasis:names:tc:SAML:2.0:assertion"
+	XMLNS_SAML_PROTOCOL  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	XMLNS_SAML_METADATA  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	SAML_BINDING_POST    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	SAML_BINDING_REDIR   = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	SAML_NAMEID_ANY      = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	SAML_SUCCESS         = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	SAML_BEARER          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+var (
+	samlIdP      *SAMLIdP
+	samlPending  = map[string]*samlLogin{}
+	samlSessions = map[string]*SAMLSession{}
+	samlLock     sync.Mutex
+
+	ErrSAMLDisabled = errors.New("single sign-on is disabled")
+)
+
+// SAMLConfig makes nethermes a SAML 2.0 service provider. Users get the
+// scopes listed in Roles for each value of RoleAttribute in their
+// assertion, or DefaultScopes when none match.
+type SAMLConfig struct {
+	Enabled        bool
+	IdPMetadata    string
+	EntityID       string
+	UserAttribute  string
+	RoleAttribute  string
+	Roles          map[string][]string
+	DefaultScopes  []string
+	SessionMinutes int
+}
+
+type SAMLIdP struct {
+	EntityID string
+	SSOURL   string
+	Certs    []*x509.Certificate
+}
+
+type SAMLSession struct {
+	Principal string
+	Scopes    []string
+	Expires   time.Time
+}
+
+type samlLogin struct {
+	RequestID string
+	ReturnTo  string
+	Expires   time.Time
+}
+
+type idpMetadata struct {
+	EntityID   string `xml:"entityID,attr"`
+	Descriptor struct {
+		Keys []struct {
+			Use  string `xml:"use,attr"`
+			Cert string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SSO []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+type SAMLAuth struct {
+	Scope string
+}
+
+func CheckSAMLConfig() error {
+	if !conf.SAML.Enabled {
+		return nil
+	}
+	scopes := append([]string{}, conf.SAML.DefaultScopes...)
+	for _, s := range conf.SAML.Roles {
+		scopes = append(scopes, s...)
+	}
+	for _, s := range scopes {
+		if s != SCOPE_UPLOAD && s != SCOPE_DOWNLOAD && s != SCOPE_ADMIN {
+			return fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	if conf.SAML.SessionMinutes <= 0 {
+		return errors.New("SessionMinutes must be positive")
+	}
+	return nil
+}
+
+func LoadSAML() error {
+	if !conf.SAML.Enabled {
+		return nil
+	}
+	b, err := ioutil.ReadFile(conf.SAML.IdPMetadata)
+	if err != nil {
+		return err
+	}
+	var md idpMetadata
+	if err := xml.Unmarshal(b, &md); err != nil {
+		return fmt.Errorf("%s: %s", conf.SAML.IdPMetadata, err)
+	}
+	idp := &SAMLIdP{EntityID: md.EntityID}
+	for _, sso := range md.Descriptor.SSO {
+		if sso.Binding == SAML_BINDING_REDIR {
+			idp.SSOURL = sso.Location
+		}
+	}
+	for _, k := range md.Descriptor.Keys {
+		if k.Use != "" && k.Use != "signing" {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(k.Cert), ""))
+		if err != nil {
+			return fmt.Errorf("%s: bad certificate: %s", conf.SAML.IdPMetadata, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%s: bad certificate: %s", conf.SAML.IdPMetadata, err)
+		}
+		idp.Certs = append(idp.Certs, cert)
+	}
+	if idp.EntityID == "" || idp.SSOURL == "" || len(idp.Certs) == 0 {
+		return fmt.Errorf("%s needs an entityID, an HTTP-Redirect SingleSignOnService and a signing certificate", conf.SAML.IdPMetadata)
+	}
+	samlIdP = idp
+	logger.Info("Single sign-on through %s", idp.EntityID)
+	return nil
+}
+
+func CleanSAML() {
+	samlLock.Lock()
+	defer samlLock.Unlock()
+	now := clock.Now()
+	for state, l := range samlPending {
+		if now.After(l.Expires) {
+			delete(samlPending, state)
+		}
+	}
+	for id, s := range samlSessions {
+		if now.After(s.Expires) {
+			delete(samlSessions, id)
+		}
+	}
+}
+
+func samlEntityID(r *http.Request) string {
+	if conf.SAML.EntityID != "" {
+		return conf.SAML.EntityID
+	}
+	return RequestBaseURL(r) + "/saml/metadata"
+}
+
+func samlACS(r *http.Request) string {
+	return RequestBaseURL(r) + "/saml/acs"
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func SAMLMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if !conf.SAML.Enabled {
+		Error(w, r, ErrSAMLDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="%s" entityID="%s">
+	<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">
+		<md:NameIDFormat>%s</md:NameIDFormat>
+		<md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>
+	</md:SPSSODescriptor>
+</md:EntityDescriptor>
+`, XMLNS_SAML_METADATA, xmlEscape(samlEntityID(r)), XMLNS_SAML_PROTOCOL, SAML_NAMEID_ANY, SAML_BINDING_POST, xmlEscape(samlACS(r)))
+}
+
+func samlReturnTo(s string) string {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return "/"
+	}
+	return s
+}
+
+func SAMLLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !conf.SAML.Enabled {
+		Error(w, r, ErrSAMLDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	now := clock.Now()
+	id := "_" + randomHex(20)
+	state := randomHex(16)
+	request := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s"><saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true" Format="%s"/></samlp:AuthnRequest>`,
+		XMLNS_SAML_PROTOCOL, XMLNS_SAML_ASSERTION, id, now.UTC().Format(time.RFC3339), xmlEscape(samlIdP.SSOURL),
+		xmlEscape(samlACS(r)), SAML_BINDING_POST, xmlEscape(samlEntityID(r)), SAML_NAMEID_ANY)
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write([]byte(request))
+	fw.Close()
+
+	samlLock.Lock()
+	samlPending[state] = &samlLogin{
+		RequestID: id,
+		ReturnTo:  samlReturnTo(r.URL.Query().Get("return")),
+		Expires:   now.Add(SAML_LOGIN_MINUTES * time.Minute),
+	}
+	samlLock.Unlock()
+
+	query := url.Values{}
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	query.Set("RelayState", state)
+	sep := "?"
+	if strings.Contains(samlIdP.SSOURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, samlIdP.SSOURL+sep+query.Encode(), http.StatusFound)
+}
+
+func samlTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339, s)
+}
+
+// verifyAssertion checks a Response against the login it answers and
+// returns the single signed assertion it carries. Everything read from the
+// response afterwards must come from that node, never from a second parse
+// of the document.
+func verifyAssertion(doc *xmlNode, login *samlLogin, r *http.Request) (*xmlNode, error) {
+	if !doc.Is(XMLNS_SAML_PROTOCOL, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+	if status := doc.Child(XMLNS_SAML_PROTOCOL, "Status").Child(XMLNS_SAML_PROTOCOL, "StatusCode").Attr("Value"); status != SAML_SUCCESS {
+		return nil, fmt.Errorf("identity provider answered %s", status)
+	}
+	if dest := doc.Attr("Destination"); dest != "" && dest != samlACS(r) {
+		return nil, fmt.Errorf("response is for %s", dest)
+	}
+	if doc.Attr("InResponseTo") != login.RequestID {
+		return nil, errors.New("response does not answer our request")
+	}
+	assertions := doc.All(XMLNS_SAML_ASSERTION, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("response must carry exactly one unencrypted assertion")
+	}
+	assertion := assertions[0]
+	signed := false
+	for _, n := range []*xmlNode{doc, assertion} {
+		if sig := n.Child(XMLNS_DSIG, "Signature"); sig != nil {
+			if err := VerifySignature(sig, n, samlIdP.Certs); err != nil {
+				return nil, err
+			}
+			signed = true
+		}
+	}
+	if !signed {
+		return nil, errors.New("response is not signed")
+	}
+	if issuer := assertion.Child(XMLNS_SAML_ASSERTION, "Issuer").Text(); issuer != samlIdP.EntityID {
+		return nil, fmt.Errorf("assertion issued by %q", issuer)
+	}
+
+	now := clock.Now()
+	conditions := assertion.Child(XMLNS_SAML_ASSERTION, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("assertion has no conditions")
+	}
+	if s := conditions.Attr("NotBefore"); s != "" {
+		if t, err := samlTime(s); err != nil || now.Add(SAML_SKEW).Before(t) {
+			return nil, errors.New("assertion is not valid yet")
+		}
+	}
+	if t, err := samlTime(conditions.Attr("NotOnOrAfter")); err != nil || !now.Add(-SAML_SKEW).Before(t) {
+		return nil, errors.New("assertion expired")
+	}
+	audience := false
+	for _, ar := range conditions.All(XMLNS_SAML_ASSERTION, "AudienceRestriction") {
+		for _, a := range ar.All(XMLNS_SAML_ASSERTION, "Audience") {
+			audience = audience || a.Text() == samlEntityID(r)
+		}
+	}
+	if !audience {
+		return nil, errors.New("assertion is for another audience")
+	}
+
+	subject := assertion.Child(XMLNS_SAML_ASSERTION, "Subject")
+	confirmed := false
+	for _, sc := range subject.All(XMLNS_SAML_ASSERTION, "SubjectConfirmation") {
+		data := sc.Child(XMLNS_SAML_ASSERTION, "SubjectConfirmationData")
+		t, err := samlTime(data.Attr("NotOnOrAfter"))
+		if sc.Attr("Method") == SAML_BEARER && err == nil && now.Add(-SAML_SKEW).Before(t) &&
+			data.Attr("Recipient") == samlACS(r) && data.Attr("InResponseTo") == login.RequestID {
+			confirmed = true
+		}
+	}
+	if !confirmed {
+		return nil, errors.New("subject confirmation failed")
+	}
+	return assertion, nil
+}
+
+func samlAttribute(assertion *xmlNode, name string) []string {
+	var values []string
+	for _, st := range assertion.All(XMLNS_SAML_ASSERTION, "AttributeStatement") {
+		for _, a := range st.All(XMLNS_SAML_ASSERTION, "Attribute") {
+			if a.Attr("Name") != name && a.Attr("FriendlyName") != name {
+				continue
+			}
+			for _, v := range a.All(XMLNS_SAML_ASSERTION, "AttributeValue") {
+				values = append(values, v.Text())
+			}
+		}
+	}
+	return values
+}
+
+func samlScopes(roles []string) []string {
+	seen := map[string]bool{}
+	var scopes []string
+	for _, role := range roles {
+		for _, s := range conf.SAML.Roles[role] {
+			if !seen[s] {
+				seen[s] = true
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		return conf.SAML.DefaultScopes
+	}
+	return scopes
+}
+
+func SAMLACSHandler(w http.ResponseWriter, r *http.Request) {
+	if !conf.SAML.Enabled {
+		Error(w, r, ErrSAMLDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
+	if err := r.ParseForm(); err != nil {
+		Error(w, r, "invalid SAML response", http.StatusBadRequest)
+		return
+	}
+	samlLock.Lock()
+	login, ok := samlPending[r.PostForm.Get("RelayState")]
+	delete(samlPending, r.PostForm.Get("RelayState"))
+	samlLock.Unlock()
+	if !ok || clock.Now().After(login.Expires) {
+		Error(w, r, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLResponse"))
+	if err != nil {
+		Error(w, r, "invalid SAML response", http.StatusBadRequest)
+		return
+	}
+	doc, err := parseXML(bytes.NewReader(raw))
+	if err == nil {
+		doc, err = verifyAssertion(doc, login, r)
+	}
+	if err != nil {
+		RequestLog(r).Info("Rejected SAML response: %s", err)
+		Error(w, r, "single sign-on failed", http.StatusForbidden)
+		return
+	}
+
+	principal := doc.Child(XMLNS_SAML_ASSERTION, "Subject").Child(XMLNS_SAML_ASSERTION, "NameID").Text()
+	if conf.SAML.UserAttribute != "" {
+		values := samlAttribute(doc, conf.SAML.UserAttribute)
+		principal = ""
+		if len(values) > 0 {
+			principal = values[0]
+		}
+	}
+	if principal == "" {
+		RequestLog(r).Info("Rejected SAML response without a user name")
+		Error(w, r, "single sign-on failed", http.StatusForbidden)
+		return
+	}
+	var roles []string
+	if conf.SAML.RoleAttribute != "" {
+		roles = samlAttribute(doc, conf.SAML.RoleAttribute)
+	}
+	session := &SAMLSession{
+		Principal: principal,
+		Scopes:    samlScopes(roles),
+		Expires:   clock.Now().Add(time.Minute * time.Duration(conf.SAML.SessionMinutes)),
+	}
+	id := randomHex(32)
+	samlLock.Lock()
+	samlSessions[id] = session
+	samlLock.Unlock()
+
+	RequestLog(r).Info("Signed in %s with scopes %v", principal, session.Scopes)
+	Audit(r, "sso login", "", fmt.Sprintf("%s %v", principal, session.Scopes))
+	http.SetCookie(w, &http.Cookie{
+		Name:     SAML_COOKIE,
+		Value:    id,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(RequestBaseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, login.ReturnTo, http.StatusFound)
+}
+
+func SAMLLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(SAML_COOKIE); err == nil {
+		samlLock.Lock()
+		delete(samlSessions, c.Value)
+		samlLock.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: SAML_COOKIE, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Authenticate accepts a browser session from a SAML login. API clients
+// keep using bearer tokens, which are checked like the tokens
+// authenticator does.
+func (a SAMLAuth) Authenticate(r *http.Request) (string, error) {
+	if BearerToken(r) != "" {
+		return TokenAuth{conf.AuthTokens, a.Scope}.Authenticate(r)
+	}
+	c, err := r.Cookie(SAML_COOKIE)
+	if err != nil {
+		return "", &LoginRequired{"/saml/login?return=" + url.QueryEscape(r.URL.RequestURI())}
+	}
+	samlLock.Lock()
+	session, ok := samlSessions[c.Value]
+	samlLock.Unlock()
+	if !ok || clock.Now().After(session.Expires) {
+		return "", &LoginRequired{"/saml/login?return=" + url.QueryEscape(r.URL.RequestURI())}
+	}
+	for _, s := range session.Scopes {
+		if s == a.Scope {
+			return session.Principal, nil
+		}
+	}
+	return session.Principal, &AuthError{http.StatusForbidden, ""}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return key, cert
+}
+
+// signAssertion inserts an enveloped signature after the Issuer of an
+// assertion the way an identity provider would.
+func signAssertion(t *testing.T, key *rsa.PrivateKey, assertion, id string) string {
+	n, err := parseXML(strings.NewReader(assertion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(exclusiveC14N(n, nil, nil))
+	info := fmt.Sprintf(`<ds:SignedInfo xmlns:ds="%s"><ds:CanonicalizationMethod Algorithm="%s"/><ds:SignatureMethod Algorithm="%s"/><ds:Reference URI="#%s"><ds:Transforms><ds:Transform Algorithm="%s"/><ds:Transform Algorithm="%s"/></ds:Transforms><ds:DigestMethod Algorithm="%s"/><ds:DigestValue>%s</ds:DigestValue></ds:Reference></ds:SignedInfo>`,
+		XMLNS_DSIG, DSIG_EXC_C14N, DSIG_RSA_SHA256, id, DSIG_ENVELOPED, DSIG_EXC_C14N, DSIG_SHA256, base64.StdEncoding.EncodeToString(digest[:]))
+	in, err := parseXML(strings.NewReader(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256(exclusiveC14N(in, nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := fmt.Sprintf(`<ds:Signature xmlns:ds="%s">%s<ds:SignatureValue>%s</ds:SignatureValue></ds:Signature>`,
+		XMLNS_DSIG, strings.Replace(info, ` xmlns:ds="`+XMLNS_DSIG+`"`, "", 1), base64.StdEncoding.EncodeToString(value))
+	i := strings.Index(assertion, "</saml:Issuer>") + len("</saml:Issuer>")
+	return assertion[:i] + sig + assertion[i:]
+}
+
+func TestSAMLResponse(t *testing.T) {
+	key, cert := testCert(t)
+	_, other := testCert(t)
+	defer func(idp *SAMLIdP, entity string) {
+		samlIdP, conf.SAML.EntityID = idp, entity
+	}(samlIdP, conf.SAML.EntityID)
+	samlIdP = &SAMLIdP{EntityID: "https://idp.example", Certs: []*x509.Certificate{cert}}
+	conf.SAML.EntityID = "https://nethermes.example/saml/metadata"
+
+	r := httptest.NewRequest("POST", "/saml/acs", nil)
+	acs := samlACS(r)
+	login := &samlLogin{RequestID: "_req1"}
+	later := time.Now().Add(5 * time.Minute).UTC().Format(time.RFC3339)
+	assertion := func(user string) string {
+		return fmt.Sprintf(`<saml:Assertion xmlns:saml="%s" xmlns:xs="http://www.w3.org/2001/XMLSchema" ID="_a1" Version="2.0"><saml:Issuer>https://idp.example</saml:Issuer>`+
+			`<saml:Subject><saml:NameID>%s</saml:NameID><saml:SubjectConfirmation Method="%s"><saml:SubjectConfirmationData InResponseTo="_req1" NotOnOrAfter="%s" Recipient="%s"/></saml:SubjectConfirmation></saml:Subject>`+
+			`<saml:Conditions NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+			"<saml:AttributeStatement>\n  <saml:Attribute Name=\"role\"><saml:AttributeValue>admins &amp; staff</saml:AttributeValue></saml:Attribute>\n</saml:AttributeStatement></saml:Assertion>",
+			XMLNS_SAML_ASSERTION, user, SAML_BEARER, later, acs, later, conf.SAML.EntityID)
+	}
+	response := func(inResponseTo string, assertions ...string) string {
+		return fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" ID="_r1" InResponseTo="%s" Version="2.0"><samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status>%s</samlp:Response>`,
+			XMLNS_SAML_PROTOCOL, inResponseTo, SAML_SUCCESS, strings.Join(assertions, ""))
+	}
+	signed := signAssertion(t, key, assertion("alice"), "_a1")
+	tampered := strings.Replace(signed, ">alice<", ">mallory<", 1)
+
+	for _, c := range []struct {
+		name string
+		doc  string
+		ok   bool
+	}{
+		{"signed", response("_req1", signed), true},
+		{"unsigned", response("_req1", assertion("alice")), false},
+		{"tampered", response("_req1", tampered), false},
+		{"replayed", response("_other", signed), false},
+		{"wrapped", response("_req1", assertion("mallory"), signed), false},
+	} {
+		doc, err := parseXML(strings.NewReader(c.doc))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		a, err := verifyAssertion(doc, login, r)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		if c.ok {
+			if user := a.Child(XMLNS_SAML_ASSERTION, "Subject").Child(XMLNS_SAML_ASSERTION, "NameID").Text(); user != "alice" {
+				t.Errorf("%s: user %q", c.name, user)
+			}
+			if roles := samlAttribute(a, "role"); len(roles) != 1 || roles[0] != "admins & staff" {
+				t.Errorf("%s: roles %q", c.name, roles)
+			}
+		}
+	}
+
+	samlIdP.Certs = []*x509.Certificate{other}
+	doc, _ := parseXML(strings.NewReader(response("_req1", signed)))
+	if _, err := verifyAssertion(doc, login, r); err == nil {
+		t.Error("accepted a signature from an unknown key")
+	}
+}
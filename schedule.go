@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ScheduleConfig struct {
+	File string
+	Dirs []string
+}
+
+func ScheduleDirAllowed(dir string) bool {
+	dir = filepath.Clean(dir)
+	for _, root := range conf.Schedules.Dirs {
+		root = filepath.Clean(root)
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+type cronField uint64
+
+type CronSpec struct {
+	minute, hour, dom, month, dow cronField
+	anyDom, anyDow                bool
+}
+
+func parseCronField(s string, min, max int) (cronField, error) {
+	var f cronField
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+func ParseCron(expr string) (CronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return CronSpec{}, errors.New("cron expression needs 5 fields")
+	}
+	var c CronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return c, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return c, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return c, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return c, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return c, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDom, c.anyDow = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+func (c CronSpec) Matches(t time.Time) bool {
+	has := func(f cronField, v int) bool {
+		return f&(1<<uint(v)) != 0
+	}
+	if !has(c.minute, t.Minute()) || !has(c.hour, t.Hour()) || !has(c.month, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+type Schedule struct {
+	ID            string
+	Name          string
+	Cron          string
+	Dir           string
+	URL           string
+	Authorization string `json:",omitempty"`
+	Webhook       string
+	Owner         string
+	Created       time.Time
+	LastRun       time.Time
+	LastKey       string
+	LastError     string
+	spec          CronSpec
+}
+
+type ScheduledTransfer struct {
+	Schedule string
+	Name     string
+	Key      string
+	Files    []GroupFile
+	Download string
+}
+
+var (
+	schedules     = map[string]*Schedule{}
+	schedulesLock sync.Mutex
+)
+
+func LoadSchedules() error {
+	if conf.Schedules.File == "" {
+		return nil
+	}
+	list := []*Schedule{}
+	if err := LoadJSON(conf.Schedules.File, &list); err != nil {
+		return err
+	}
+	schedulesLock.Lock()
+	defer schedulesLock.Unlock()
+	for _, s := range list {
+		var err error
+		if s.spec, err = ParseCron(s.Cron); err != nil {
+			return fmt.Errorf("schedule %s: %s", s.ID, err)
+		}
+		schedules[s.ID] = s
+	}
+	return nil
+}
+
+func saveSchedules() {
+	if conf.Schedules.File == "" {
+		return
+	}
+	list := []*Schedule{}
+	for _, s := range schedules {
+		list = append(list, s)
+	}
+	if err := SaveJSON(conf.Schedules.File, list); err != nil {
+		logger.Error("Save schedules: %s", err)
+	}
+}
+
+func (s *Schedule) Validate() error {
+	spec, err := ParseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+	s.spec = spec
+	if (s.Dir == "") == (s.URL == "") {
+		return errors.New("exactly one of Dir and URL is required")
+	}
+	if s.URL != "" {
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid url")
+		}
+	}
+	if s.Dir != "" {
+		if !ScheduleDirAllowed(s.Dir) {
+			return errors.New("dir is not below one of the allowed schedule dirs")
+		}
+		info, err := os.Stat(s.Dir)
+		if err != nil || !info.IsDir() {
+			return errors.New("dir is not a directory")
+		}
+	}
+	if s.Webhook == "" {
+		return errors.New("webhook is required")
+	}
+	return nil
+}
+
+func sendDir(group *Group, dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		fd, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = group.AddFile(NewRequestID(), "schedule", info.Name(), fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendURL(group *Group, s *Schedule) error {
+	if conf.Fetch.MaxMB <= 0 {
+		return errors.New("fetching is disabled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(conf.Fetch.TimeoutSeconds))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return err
+	}
+	if s.Authorization != "" {
+		req.Header.Set("Authorization", s.Authorization)
+	}
+	resp, err := fetchClient("fetch").Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote server responded %d", resp.StatusCode)
+	}
+	limit := int64(conf.Fetch.MaxMB) * 1024 * 1024
+	body := &CountingReader{R: io.LimitReader(resp.Body, limit+1)}
+	_, err = group.AddFile(NewRequestID(), req.URL.Host, FetchName(resp, FetchRequest{}), body)
+	if err == nil && body.N > limit {
+		err = ErrTooLarge
+	}
+	return err
+}
+
+func RunSchedule(s *Schedule) (ScheduledTransfer, error) {
+	key, err := GenerateUniqueKey()
+	if err != nil {
+		return ScheduledTransfer{}, err
+	}
+	group, err := CreateGroup(key)
+	if err != nil {
+		return ScheduledTransfer{}, err
+	}
+	if s.Dir != "" {
+		err = sendDir(group, s.Dir)
+	} else {
+		err = sendURL(group, s)
+	}
+	group.Lock()
+	files := []GroupFile{}
+	for _, c := range group.Contributions {
+		files = append(files, c.Files...)
+	}
+	if err == nil && len(files) == 0 {
+		err = errors.New("nothing to send")
+	}
+	if err != nil {
+		group.Status.Set(ABORTED)
+	}
+	group.Unlock()
+	if err != nil {
+		return ScheduledTransfer{}, err
+	}
+
+	st := ScheduledTransfer{
+		s.ID,
+		s.Name,
+		key,
+		files,
+		HotFolderBaseURL() + "/group/" + key + "/download",
+	}
+	b, _ := json.Marshal(st)
+	client := OutboundClient("webhook", 30*time.Second)
+	resp, err := client.Post(s.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return st, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return st, fmt.Errorf("webhook responded %d", resp.StatusCode)
+	}
+	return st, nil
+}
+
+func runAndRecord(s *Schedule) {
+	st, err := RunSchedule(s)
+	schedulesLock.Lock()
+	defer schedulesLock.Unlock()
+	s.LastRun = clock.Now()
+	s.LastKey = st.Key
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+		logger.Error("Schedule %s: %s", s.ID, err)
+	} else {
+		logger.Info("Schedule %s sent %d files as %s", s.ID, len(st.Files), st.Key)
+	}
+	saveSchedules()
+}
+
+func RunSchedules() {
+	for {
+		now := clock.Now()
+		Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		now = clock.Now().Truncate(time.Minute)
+		schedulesLock.Lock()
+		due := []*Schedule{}
+		for _, s := range schedules {
+			if s.spec.Matches(now) {
+				due = append(due, s)
+			}
+		}
+		schedulesLock.Unlock()
+		for _, s := range due {
+			go runAndRecord(s)
+		}
+	}
+}
+
+func scheduleView(s *Schedule) Schedule {
+	v := *s
+	if v.Authorization != "" {
+		v.Authorization = "********"
+	}
+	return v
+}
+
+func SchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	schedulesLock.Lock()
+	list := []Schedule{}
+	for _, s := range schedules {
+		list = append(list, scheduleView(s))
+	}
+	schedulesLock.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(list)
+}
+
+func CreateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	s := &Schedule{}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(s); err != nil {
+		Error(w, r, "invalid schedule", http.StatusBadRequest)
+		return
+	}
+	if err := s.Validate(); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	s.ID = hex.EncodeToString(b)
+	s.Owner = Principal(r)
+	s.Created = clock.Now()
+	s.LastRun, s.LastKey, s.LastError = time.Time{}, "", ""
+
+	schedulesLock.Lock()
+	schedules[s.ID] = s
+	saveSchedules()
+	view := scheduleView(s)
+	schedulesLock.Unlock()
+	RequestLog(r).Info("Created schedule %s (%s)", s.ID, s.Cron)
+	w.Header().Set("Content-Type", "text/javascript")
+	w.WriteHeader(http.StatusCreated)
+	jenc := json.NewEncoder(w)
+	jenc.Encode(view)
+}
+
+func DeleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["sid"]
+
+	schedulesLock.Lock()
+	_, ok := schedules[id]
+	if ok {
+		delete(schedules, id)
+		saveSchedules()
+	}
+	schedulesLock.Unlock()
+	if !ok {
+		Error(w, r, "schedule not found", http.StatusNotFound)
+		return
+	}
+	RequestLog(r).Info("Deleted schedule %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func RunScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["sid"]
+
+	schedulesLock.Lock()
+	s, ok := schedules[id]
+	schedulesLock.Unlock()
+	if !ok {
+		Error(w, r, "schedule not found", http.StatusNotFound)
+		return
+	}
+	go runAndRecord(s)
+	w.WriteHeader(http.StatusAccepted)
+}
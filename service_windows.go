@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"os"
+	"time"
+)
+
+const (
+	SERVICE_NAME         = "nethermes"
+	SERVICE_DISPLAY_NAME = "Net.Hermes"
+	SERVICE_DESCRIPTION  = "Net.Hermes file transfer relay"
+)
+
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go RunServer()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			Shutdown()
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+func installService(name, home string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: SERVICE_DISPLAY_NAME,
+		Description: SERVICE_DESCRIPTION,
+		StartType:   mgr.StartAutomatic,
+	}, "service", "run", "-name", name, "-home", home)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}, 24*60*60)
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	if st, err := s.Control(svc.Stop); err == nil {
+		for i := 0; i < 30 && st.State != svc.Stopped; i++ {
+			Sleep(time.Second)
+			if st, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	return s.Delete()
+}
+
+func runService(name, home string) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return errors.New("\"service run\" is started by the service manager, use \"sc start " + name + "\"")
+	}
+	os.Setenv(HOME_ENV, home)
+	Startup()
+	return svc.Run(name, windowsService{})
+}
+
+func RunService(args []string) int {
+	usage := "usage: nethermes service install|uninstall|run [-name NAME] [-home DIR]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_FAILURE
+	}
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	name := fs.String("name", SERVICE_NAME, "service name")
+	dir := fs.String("home", "", "directory with nethermes.json, defaults to the current directory")
+	if err := fs.Parse(args[1:]); err != nil {
+		return EXIT_FAILURE
+	}
+	home := ""
+	if args[0] != "uninstall" {
+		var err error
+		if home, err = AbsHome(*dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return EXIT_FAILURE
+		}
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(*name, home)
+		if err == nil {
+			fmt.Printf("Installed service %s for %s, start it with \"sc start %s\"\n", *name, home, *name)
+		}
+	case "uninstall":
+		err = uninstallService(*name)
+		if err == nil {
+			fmt.Printf("Removed service %s\n", *name)
+		}
+	case "run":
+		err = runService(*name, home)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_FAILURE
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
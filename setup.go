@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	subcommands = map[string]func(args []string) int{
+		"init":    RunInit,
+		"send":    RunSend,
+		"receive": RunReceive,
+		"status":  RunStatus,
+		"decrypt": RunDecrypt,
+		"daemon":  RunDaemon,
+		"service": RunService,
+		"config":  RunConfig,
+	}
+	templateFiles = []string{
+		"index.html", "shared.html", "stats.html",
+		"error.html", "receive.html", "preview.html",
+		"progress.html", "gallery.html",
+	}
+	templates = map[string]**template.Template{
+		"index.html":    &indextemplate,
+		"shared.html":   &sharedtemplate,
+		"stats.html":    &statstemplate,
+		"error.html":    &errortemplate,
+		"receive.html":  &receivetemplate,
+		"preview.html":  &previewtemplate,
+		"progress.html": &progresstemplate,
+		"gallery.html":  &gallerytemplate,
+	}
+)
+
+func Subcommand() string {
+	if len(os.Args) > 1 {
+		if _, ok := subcommands[os.Args[1]]; ok {
+			return os.Args[1]
+		}
+	}
+	return ""
+}
+
+type prompter struct {
+	in          *bufio.Reader
+	interactive bool
+}
+
+func (p *prompter) ask(question, def string) string {
+	if !p.interactive {
+		return def
+	}
+	fmt.Printf("%s [%s]: ", question, def)
+	line, err := p.in.ReadString('\n')
+	if err != nil {
+		p.interactive = false
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+func (p *prompter) confirm(question string, def bool) bool {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+	switch strings.ToLower(p.ask(question, d)) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	}
+	return def
+}
+
+func CheckPort(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+func GenerateSelfSigned(hosts []string, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"nethermes"}, CommonName: hosts[0]},
+		NotBefore:             clock.Now().Add(-time.Hour),
+		NotAfter:              clock.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+		return err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return ioutil.WriteFile(keyFile, keyPem, 0600)
+}
+
+func RunInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	file := fs.String("config", CONFIG_FILE, "configuration file to write")
+	port := fs.Int("port", 0, "port to listen on")
+	tempDir := fs.String("tempdir", "", "spool directory for buffered uploads")
+	selfSigned := fs.Bool("self-signed", false, "generate a self-signed certificate")
+	hosts := fs.String("hosts", "", "comma separated host names or addresses for the certificate")
+	yes := fs.Bool("yes", false, "do not ask, use flags and defaults")
+	force := fs.Bool("force", false, "overwrite an existing configuration file")
+	if err := fs.Parse(args); err != nil {
+		return EXIT_FAILURE
+	}
+
+	info, _ := os.Stdin.Stat()
+	p := &prompter{
+		in:          bufio.NewReader(os.Stdin),
+		interactive: !*yes && info != nil && info.Mode()&os.ModeCharDevice != 0,
+	}
+
+	if _, err := os.Stat(*file); err == nil && !*force {
+		if !p.confirm(*file+" exists, overwrite it?", false) {
+			fmt.Fprintf(os.Stderr, "%s exists, use -force to overwrite it\n", *file)
+			return EXIT_FAILURE
+		}
+	}
+
+	c := DefaultConfig()
+	if *port == 0 {
+		*port = c.Port
+	}
+	for {
+		v, err := strconv.Atoi(p.ask("Port", strconv.Itoa(*port)))
+		if err != nil || v <= 0 || v > 65535 {
+			fmt.Fprintln(os.Stderr, "Invalid port")
+			if !p.interactive {
+				return EXIT_FAILURE
+			}
+			continue
+		}
+		*port = v
+		if err = CheckPort(v); err == nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Cannot listen on port %d: %s\n", v, err)
+		if !p.interactive {
+			return EXIT_FAILURE
+		}
+	}
+	c.Port = *port
+
+	if *tempDir == "" {
+		*tempDir = c.TempDir
+	}
+	c.TempDir = p.ask("Spool directory", *tempDir)
+	if v, err := strconv.Atoi(p.ask("Key length", strconv.Itoa(c.KeyLength))); err == nil && v > 0 {
+		c.KeyLength = v
+	}
+
+	dirs := []string{filepath.Dir(LOG_FILE), c.TempDir, "./htdocs"}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Create %s: %s\n", dir, err)
+			return EXIT_FAILURE
+		}
+	}
+	fmt.Printf("Created directories %s\n", strings.Join(dirs, ", "))
+
+	if *selfSigned || p.confirm("Generate a self-signed certificate?", false) {
+		if *hosts == "" {
+			*hosts = "localhost"
+		}
+		names := []string{}
+		for _, h := range strings.Split(p.ask("Certificate host names", *hosts), ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				names = append(names, h)
+			}
+		}
+		if len(names) == 0 {
+			fmt.Fprintln(os.Stderr, "A certificate needs at least one host name")
+			return EXIT_FAILURE
+		}
+		c.TLS.CertFile, c.TLS.KeyFile = "./cert.pem", "./key.pem"
+		if err := GenerateSelfSigned(names, c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Generate certificate: %s\n", err)
+			return EXIT_FAILURE
+		}
+		fmt.Printf("Wrote self-signed certificate for %s to %s\n", strings.Join(names, ", "), c.TLS.CertFile)
+	}
+
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err == nil {
+		err = ioutil.WriteFile(*file, append(b, '\n'), 0600)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Write %s: %s\n", *file, err)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("Wrote %s\n", *file)
+
+	missing := []string{}
+	for _, t := range templateFiles {
+		if _, err := os.Stat(t); err != nil {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 && !c.Headless {
+		fmt.Fprintf(os.Stderr, "Missing templates %s: copy them next to the binary or set Headless\n", strings.Join(missing, ", "))
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
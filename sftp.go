@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+)
+
+const (
+	SSH_FXP_INIT    = 1
+	SSH_FXP_VERSION = 2
+	SSH_FXP_OPEN    = 3
+	SSH_FXP_CLOSE   = 4
+	SSH_FXP_WRITE   = 6
+	SSH_FXP_STATUS  = 101
+	SSH_FXP_HANDLE  = 102
+
+	SSH_FXF_WRITE = 0x02
+	SSH_FXF_CREAT = 0x08
+	SSH_FXF_TRUNC = 0x10
+
+	SFTP_CHUNK    = 32 * 1024
+	SFTP_INFLIGHT = 16
+)
+
+type sftpClient struct {
+	c  io.ReadWriter
+	id uint32
+}
+
+func (s *sftpClient) send(msg *sshWriter) error {
+	packet := make([]byte, 4, 4+msg.Len())
+	binary.BigEndian.PutUint32(packet, uint32(msg.Len()))
+	_, err := s.c.Write(append(packet, msg.Bytes()...))
+	return err
+}
+
+func (s *sftpClient) receive() (byte, *sshReader, error) {
+	var length uint32
+	if err := binary.Read(s.c, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > SSH_MAX_PACKET {
+		return 0, nil, errSSHMalformed
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(s.c, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], &sshReader{b: packet[1:]}, nil
+}
+
+// request sends a request with a fresh id in front of the fields built
+// by fill.
+func (s *sftpClient) request(typ byte, fill func(*sshWriter)) error {
+	s.id++
+	msg := newSSHMessage(typ).Uint32(s.id)
+	fill(msg)
+	return s.send(msg)
+}
+
+func (s *sftpClient) status() error {
+	typ, r, err := s.receive()
+	if err != nil {
+		return err
+	}
+	if typ != SSH_FXP_STATUS {
+		return fmt.Errorf("unexpected sftp reply %d", typ)
+	}
+	r.Uint32()
+	code, message := r.Uint32(), r.Text()
+	if r.err != nil {
+		return r.err
+	}
+	if code != 0 {
+		return fmt.Errorf("sftp server: %s (%d)", message, code)
+	}
+	return nil
+}
+
+// Put writes src to path, replacing any existing file, and keeps up to
+// SFTP_INFLIGHT writes outstanding.
+func (s *sftpClient) Put(path string, src io.Reader) error {
+	if err := s.send(newSSHMessage(SSH_FXP_INIT).Uint32(3)); err != nil {
+		return err
+	}
+	typ, _, err := s.receive()
+	if err != nil {
+		return err
+	}
+	if typ != SSH_FXP_VERSION {
+		return errors.New("sftp server did not send its version")
+	}
+
+	err = s.request(SSH_FXP_OPEN, func(w *sshWriter) {
+		w.Text(path).Uint32(SSH_FXF_WRITE | SSH_FXF_CREAT | SSH_FXF_TRUNC).Uint32(0)
+	})
+	if err != nil {
+		return err
+	}
+	typ, r, err := s.receive()
+	if err != nil {
+		return err
+	}
+	if typ == SSH_FXP_STATUS {
+		r.Uint32()
+		r.Uint32()
+		return fmt.Errorf("sftp server cannot open %s: %s", path, r.Text())
+	}
+	r.Uint32()
+	handle := r.Blob()
+	if typ != SSH_FXP_HANDLE || r.err != nil {
+		return errors.New("sftp server did not return a handle")
+	}
+
+	buf := make([]byte, SFTP_CHUNK)
+	var offset uint64
+	inflight := 0
+	done := false
+	for !done || inflight > 0 {
+		if !done && inflight < SFTP_INFLIGHT {
+			n, err := io.ReadFull(src, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				done = true
+			} else if err != nil {
+				return err
+			}
+			if n > 0 {
+				err := s.request(SSH_FXP_WRITE, func(w *sshWriter) {
+					w.Blob(handle).Uint64(offset).Blob(buf[:n])
+				})
+				if err != nil {
+					return err
+				}
+				offset += uint64(n)
+				inflight++
+			}
+			continue
+		}
+		if err := s.status(); err != nil {
+			return err
+		}
+		inflight--
+	}
+
+	if err := s.request(SSH_FXP_CLOSE, func(w *sshWriter) { w.Blob(handle) }); err != nil {
+		return err
+	}
+	return s.status()
+}
+
+// PushSFTP uploads src to an sftp:// URL. The server must present
+// hostKey, and the connection is subject to the fetch address policy.
+func PushSFTP(ctx context.Context, u *url.URL, hostKey, user, password string, src io.Reader) error {
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	if err := checkFetchHost(ctx, u.Hostname()); err != nil {
+		return err
+	}
+	conn, err := fetchDialer().DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	t, err := DialSSH(conn, hostKey, user, password)
+	if err != nil {
+		return err
+	}
+	c, err := t.OpenSubsystem("sftp")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return (&sftpClient{c: c}).Put(u.Path, src)
+}
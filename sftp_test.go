@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+type testSFTPServer struct {
+	sync.Mutex
+	ln       net.Listener
+	key      ed25519.PrivateKey
+	password string
+	files    map[string][]byte
+}
+
+func newTestSFTPServer(t *testing.T) *testSFTPServer {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSFTPServer{ln: ln, key: key, password: "hunter2", files: map[string][]byte{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *testSFTPServer) blob() []byte {
+	return (&sshWriter{}).Text("ssh-ed25519").Blob(s.key.Public().(ed25519.PublicKey)).Bytes()
+}
+
+func (s *testSFTPServer) HostKey() string {
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(s.blob())
+}
+
+func (s *testSFTPServer) URL(path string) *url.URL {
+	return &url.URL{Scheme: "sftp", Host: s.ln.Addr().String(), Path: path}
+}
+
+func (s *testSFTPServer) serve(conn net.Conn) error {
+	t := &sshTransport{conn: conn, r: bufio.NewReader(conn)}
+	clientVersion, err := exchangeVersions(conn, t.r)
+	if err != nil {
+		return err
+	}
+	ours := newKexInit([10]string{
+		"curve25519-sha256,kex-strict-s-v00@openssh.com", "ssh-ed25519",
+		SSH_CIPHERS, SSH_CIPHERS, SSH_MACS, SSH_MACS, "none", "none", "", "",
+	})
+	if err := t.writePacket(ours.payload); err != nil {
+		return err
+	}
+	p, err := t.readPacket()
+	if err != nil {
+		return err
+	}
+	theirs, err := parseKexInit(p)
+	if err != nil {
+		return err
+	}
+	cipherName, err := sshNegotiate(theirs.lists[2], ours.lists[2])
+	if err != nil {
+		return err
+	}
+	for _, k := range theirs.lists[0] {
+		t.strict = t.strict || k == SSH_KEX_STRICT
+	}
+	r, err := t.expect(SSH_MSG_KEX_ECDH_INIT)
+	if err != nil {
+		return err
+	}
+	qc := r.Blob()
+	pub, err := ecdh.X25519().NewPublicKey(qc)
+	if err != nil {
+		return err
+	}
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	k, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	qs := priv.PublicKey().Bytes()
+	h := sshExchangeHash(clientVersion, SSH_VERSION, theirs.payload, ours.payload, s.blob(), qc, qs, k)
+	sig := (&sshWriter{}).Text("ssh-ed25519").Blob(ed25519.Sign(s.key, h)).Bytes()
+	if err := t.writePacket(newSSHMessage(SSH_MSG_KEX_ECDH_REPLY).Blob(s.blob()).Blob(qs).Blob(sig).Bytes()); err != nil {
+		return err
+	}
+	t.setKeys(k, h, cipherName, false)
+	if err := t.writePacket([]byte{SSH_MSG_NEWKEYS}); err != nil {
+		return err
+	}
+	if _, err := t.expect(SSH_MSG_NEWKEYS); err != nil {
+		return err
+	}
+
+	if _, err := t.expect(SSH_MSG_SERVICE_REQUEST); err != nil {
+		return err
+	}
+	t.writePacket(newSSHMessage(SSH_MSG_SERVICE_ACCEPT).Text("ssh-userauth").Bytes())
+	for authed := false; !authed; {
+		r, err := t.expect(SSH_MSG_USERAUTH_REQUEST)
+		if err != nil {
+			return err
+		}
+		r.Text()
+		r.Text()
+		if r.Text() == "password" && !r.Bool() && r.Text() == s.password {
+			authed = true
+			t.writePacket([]byte{SSH_MSG_USERAUTH_SUCCESS})
+		} else {
+			t.writePacket(newSSHMessage(SSH_MSG_USERAUTH_FAILURE).Text("password").Bool(false).Bytes())
+		}
+	}
+
+	r, err = t.expect(SSH_MSG_CHANNEL_OPEN)
+	if err != nil {
+		return err
+	}
+	r.Text()
+	c := &sshChannel{t: t, remote: r.Uint32(), window: r.Uint32(), maxPacket: r.Uint32()}
+	t.writePacket(newSSHMessage(SSH_MSG_CHANNEL_OPEN_CONFIRMATION).Uint32(c.remote).Uint32(0).Uint32(SSH_WINDOW).Uint32(SSH_CHANNEL_MAX).Bytes())
+	if _, err := t.expect(SSH_MSG_CHANNEL_REQUEST); err != nil {
+		return err
+	}
+	t.writePacket(newSSHMessage(SSH_MSG_CHANNEL_SUCCESS).Uint32(c.remote).Bytes())
+
+	sftp := &sftpClient{c: c}
+	var path string
+	var data []byte
+	for {
+		typ, r, err := sftp.receive()
+		if err != nil {
+			return err
+		}
+		if typ == SSH_FXP_INIT {
+			sftp.send(newSSHMessage(SSH_FXP_VERSION).Uint32(3))
+			continue
+		}
+		id := r.Uint32()
+		switch typ {
+		case SSH_FXP_OPEN:
+			path, data = r.Text(), nil
+			sftp.send(newSSHMessage(SSH_FXP_HANDLE).Uint32(id).Text("h"))
+			continue
+		case SSH_FXP_WRITE:
+			r.Blob()
+			offset := r.Uint64()
+			chunk := r.Blob()
+			if end := int(offset) + len(chunk); end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+			copy(data[offset:], chunk)
+		case SSH_FXP_CLOSE:
+			s.Lock()
+			s.files[path] = data
+			s.Unlock()
+		}
+		sftp.send(newSSHMessage(SSH_FXP_STATUS).Uint32(id).Uint32(0).Text("").Text(""))
+	}
+}
+
+func allowPrivateFetches(t *testing.T) {
+	saved := conf.Fetch.AllowPrivate
+	conf.Fetch.AllowPrivate = true
+	t.Cleanup(func() { conf.Fetch.AllowPrivate = saved })
+}
+
+func TestPushSFTP(t *testing.T) {
+	s := newTestSFTPServer(t)
+	allowPrivateFetches(t)
+	data := make([]byte, 3*1024*1024+17)
+	rand.Read(data)
+	if err := PushSFTP(context.Background(), s.URL("/srv/abc.zip"), s.HostKey(), "alice", "hunter2", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	s.Lock()
+	got := s.files["/srv/abc.zip"]
+	s.Unlock()
+	if !bytes.Equal(got, data) {
+		t.Errorf("server received %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestPushSFTPRejects(t *testing.T) {
+	s := newTestSFTPServer(t)
+	other := newTestSFTPServer(t)
+	push := func(hostKey, password string) error {
+		return PushSFTP(context.Background(), s.URL("/x.zip"), hostKey, "alice", password, bytes.NewReader([]byte("x")))
+	}
+	if err := push(s.HostKey(), "hunter2"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("loopback destination: %v", err)
+	}
+	allowPrivateFetches(t)
+	if err := push(other.HostKey(), "hunter2"); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("unknown host key: %v", err)
+	}
+	if err := push(s.HostKey(), "wrong"); !errors.Is(err, ErrSSHAuth) {
+		t.Errorf("wrong password: %v", err)
+	}
+	if len(s.files) != 0 {
+		t.Errorf("rejected pushes stored %d files", len(s.files))
+	}
+}
+
+func TestSSHVerify(t *testing.T) {
+	h := sha256.Sum256([]byte("exchange hash"))
+
+	ec, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ecBlob := (&sshWriter{}).Text("ecdsa-sha2-nistp384").Text("nistp384").Blob(elliptic.Marshal(elliptic.P384(), ec.X, ec.Y)).Bytes()
+	d := sha512.Sum384(h[:])
+	r, s, _ := ecdsa.Sign(rand.Reader, ec, d[:])
+	ecSig := (&sshWriter{}).Text("ecdsa-sha2-nistp384").Blob((&sshWriter{}).Mpint(r.Bytes()).Mpint(s.Bytes()).Bytes()).Bytes()
+
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaBlob := (&sshWriter{}).Text("ssh-rsa").Mpint(big.NewInt(int64(rk.E)).Bytes()).Mpint(rk.N.Bytes()).Bytes()
+	d512 := sha512.Sum512(h[:])
+	rs, _ := rsa.SignPKCS1v15(rand.Reader, rk, crypto.SHA512, d512[:])
+	rsaSig := (&sshWriter{}).Text("rsa-sha2-512").Blob(rs).Bytes()
+
+	if err := sshVerify(ecBlob, ecSig, h[:], "ecdsa-sha2-nistp384"); err != nil {
+		t.Errorf("ecdsa: %s", err)
+	}
+	if err := sshVerify(rsaBlob, rsaSig, h[:], "rsa-sha2-512"); err != nil {
+		t.Errorf("rsa: %s", err)
+	}
+	if err := sshVerify(rsaBlob, rsaSig, h[:], "rsa-sha2-256"); err == nil {
+		t.Error("rsa signature accepted under another algorithm")
+	}
+	other := sha256.Sum256([]byte("other hash"))
+	if err := sshVerify(ecBlob, ecSig, other[:], "ecdsa-sha2-nistp384"); err == nil {
+		t.Error("ecdsa signature over another hash accepted")
+	}
+}
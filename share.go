@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"html/template"
+	"net/http"
+)
+
+var sharedtemplate *template.Template
+
+func ShareHandler(w http.ResponseWriter, r *http.Request) {
+	if !CheckUploader(w, r) {
+		return
+	}
+	checksum, err := CheckBody(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		Error(w, r, "internal error", http.StatusBadRequest)
+		return
+	}
+
+	key, err := GenerateUniqueKey()
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	group, err := CreateGroup(key)
+	if err != nil {
+		RequestLog(r).Error("Create group: %s", err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := group.Receive(r, mr, checksum, "shared"); err != nil {
+		DiscardGroup(key)
+		ReceiveError(w, r, err)
+		return
+	}
+
+	if conf.Headless {
+		w.Header().Set("Content-Type", "text/javascript")
+		jenc := json.NewEncoder(w)
+		jenc.Encode(struct {
+			Key      string
+			Download string
+		}{
+			key,
+			"/group/" + key + "/download",
+		})
+		return
+	}
+	http.Redirect(w, r, "/shared/"+key, http.StatusSeeOther)
+}
+
+func SharedHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	groupsLock.Lock()
+	_, exists := groups[id]
+	groupsLock.Unlock()
+	if !exists {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	sharedtemplate.Execute(w, struct {
+		Key     string
+		BaseURL string
+	}{
+		id,
+		RequestBaseURL(r),
+	})
+}
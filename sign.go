@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SIGNATURE_HEADER  = "X-Signature"
+	SIGNATURE_VERSION = "nethermes-v1"
+)
+
+var (
+	signingKeys     signingKeyFile
+	signingPrivate  ed25519.PrivateKey
+	signingKeysLock sync.RWMutex
+
+	ErrUnknownSigningKey = errors.New("no such signing key")
+	ErrCurrentSigningKey = errors.New("the current signing key cannot be retired, rotate first")
+)
+
+type SigningConfig struct {
+	Enabled  bool
+	KeyFile  string
+	MaxBytes int
+}
+
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	PublicKey string
+	Created   time.Time
+	Current   bool
+}
+
+type signingKeyFile struct {
+	PrivateKey string
+	Keys       []SigningKey
+}
+
+func signingKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newSigningKey() (ed25519.PrivateKey, SigningKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, SigningKey{}, err
+	}
+	return priv, SigningKey{
+		ID:        signingKeyID(pub),
+		Algorithm: "Ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+		Created:   clock.Now(),
+		Current:   true,
+	}, nil
+}
+
+func LoadSigningKeys() error {
+	if !conf.Signing.Enabled {
+		return nil
+	}
+	keys := signingKeyFile{}
+	if err := LoadJSON(conf.Signing.KeyFile, &keys); err != nil {
+		return err
+	}
+	if keys.PrivateKey == "" {
+		priv, key, err := newSigningKey()
+		if err != nil {
+			return err
+		}
+		keys.PrivateKey = base64.StdEncoding.EncodeToString(priv.Seed())
+		keys.Keys = append(keys.Keys, key)
+		if err := SaveJSON(conf.Signing.KeyFile, keys); err != nil {
+			return err
+		}
+		logger.Info("Generated signing key %s in %s", key.ID, conf.Signing.KeyFile)
+	}
+	seed, err := base64.StdEncoding.DecodeString(keys.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return errors.New("invalid signing private key")
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	id := signingKeyID(priv.Public().(ed25519.PublicKey))
+	found := false
+	for i := range keys.Keys {
+		keys.Keys[i].Current = keys.Keys[i].ID == id
+		found = found || keys.Keys[i].Current
+	}
+	if !found {
+		return fmt.Errorf("signing key %s is not listed in %s", id, conf.Signing.KeyFile)
+	}
+
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+	signingKeys = keys
+	signingPrivate = priv
+	return nil
+}
+
+func CurrentSigningKey() (SigningKey, bool) {
+	signingKeysLock.RLock()
+	defer signingKeysLock.RUnlock()
+	for _, k := range signingKeys.Keys {
+		if k.Current {
+			return k, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func AdvertisedSigningKey() *SigningKey {
+	if key, ok := CurrentSigningKey(); ok {
+		return &key
+	}
+	return nil
+}
+
+func SigningKeys() []SigningKey {
+	signingKeysLock.RLock()
+	defer signingKeysLock.RUnlock()
+	return append([]SigningKey{}, signingKeys.Keys...)
+}
+
+func RotateSigningKey() (SigningKey, error) {
+	priv, key, err := newSigningKey()
+	if err != nil {
+		return key, err
+	}
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+	keys := signingKeyFile{PrivateKey: base64.StdEncoding.EncodeToString(priv.Seed())}
+	for _, k := range signingKeys.Keys {
+		k.Current = false
+		keys.Keys = append(keys.Keys, k)
+	}
+	keys.Keys = append(keys.Keys, key)
+	if err := SaveJSON(conf.Signing.KeyFile, keys); err != nil {
+		return key, err
+	}
+	signingKeys = keys
+	signingPrivate = priv
+	return key, nil
+}
+
+func RetireSigningKey(id string) error {
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+	keys := signingKeyFile{PrivateKey: signingKeys.PrivateKey}
+	found := false
+	for _, k := range signingKeys.Keys {
+		if k.ID != id {
+			keys.Keys = append(keys.Keys, k)
+			continue
+		}
+		if k.Current {
+			return ErrCurrentSigningKey
+		}
+		found = true
+	}
+	if !found {
+		return ErrUnknownSigningKey
+	}
+	if err := SaveJSON(conf.Signing.KeyFile, keys); err != nil {
+		return err
+	}
+	signingKeys = keys
+	return nil
+}
+
+func SignedMessage(method, uri string, status int, ts int64, body []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n%s\n%s\n%d\n%d\n", SIGNATURE_VERSION, method, uri, status, ts)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func signResponse(r *http.Request, status int, body []byte) string {
+	key, ok := CurrentSigningKey()
+	if !ok {
+		return ""
+	}
+	signingKeysLock.RLock()
+	priv := signingPrivate
+	signingKeysLock.RUnlock()
+	ts := clock.Now().Unix()
+	sig := ed25519.Sign(priv, SignedMessage(r.Method, r.URL.RequestURI(), status, ts, body))
+	return fmt.Sprintf("keyid=%s;ts=%d;sig=%s", key.ID, ts, base64.StdEncoding.EncodeToString(sig))
+}
+
+func Signable(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediatype == "text/javascript" || mediatype == "application/json"
+}
+
+type signWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	status  int
+	buf     []byte
+	decided bool
+	signing bool
+}
+
+func (s *signWriter) decide() {
+	s.decided = true
+	s.signing = Signable(s.Header().Get("Content-Type"))
+	if !s.signing && s.status != 0 {
+		s.ResponseWriter.WriteHeader(s.status)
+	}
+}
+
+func (s *signWriter) WriteHeader(status int) {
+	if s.decided {
+		if !s.signing {
+			s.ResponseWriter.WriteHeader(status)
+		}
+		return
+	}
+	s.status = status
+	s.decide()
+}
+
+func (s *signWriter) passThrough() error {
+	s.signing = false
+	if s.status != 0 {
+		s.ResponseWriter.WriteHeader(s.status)
+	}
+	buf := s.buf
+	s.buf = nil
+	_, err := s.ResponseWriter.Write(buf)
+	return err
+}
+
+func (s *signWriter) Write(p []byte) (int, error) {
+	if !s.decided {
+		s.decide()
+	}
+	if !s.signing {
+		return s.ResponseWriter.Write(p)
+	}
+	s.buf = append(s.buf, p...)
+	if len(s.buf) > conf.Signing.MaxBytes {
+		if err := s.passThrough(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *signWriter) Flush() {
+	if !s.decided {
+		s.decide()
+	}
+	if s.signing {
+		s.passThrough()
+	}
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *signWriter) Close() {
+	if !s.decided || !s.signing {
+		return
+	}
+	status := s.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if sig := signResponse(s.r, status, s.buf); sig != "" {
+		s.Header().Set(SIGNATURE_HEADER, sig)
+	}
+	s.Header().Set("Content-Length", strconv.Itoa(len(s.buf)))
+	s.passThrough()
+}
+
+func Sign(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !conf.Signing.Enabled || r.Method == "HEAD" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		sw := &signWriter{ResponseWriter: w, r: r}
+		defer sw.Close()
+		handler.ServeHTTP(sw, r)
+	})
+}
+
+func SigningKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(SigningKeys())
+}
+
+func RotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !conf.Signing.Enabled {
+		Error(w, r, "response signing is disabled", http.StatusNotFound)
+		return
+	}
+	key, err := RotateSigningKey()
+	if err != nil {
+		RequestLog(r).Error("Rotate signing key: %s", err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return
+	}
+	Audit(r, "signing key rotated", key.ID, "")
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(key)
+}
+
+func RetireSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["kid"]
+
+	switch err := RetireSigningKey(id); err {
+	case nil:
+		Audit(r, "signing key retired", id, "")
+		w.WriteHeader(http.StatusNoContent)
+	case ErrUnknownSigningKey:
+		Error(w, r, err.Error(), http.StatusNotFound)
+	case ErrCurrentSigningKey:
+		Error(w, r, err.Error(), http.StatusConflict)
+	default:
+		RequestLog(r).Error("Retire signing key %s: %s", id, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+	}
+}
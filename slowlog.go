@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type SlowLogConfig struct {
+	FirstByteSeconds float64
+	StallSeconds     float64
+}
+
+type slowLogKey struct{}
+
+type slowRecorder struct {
+	sync.Mutex
+	start     time.Time
+	last      time.Time
+	firstByte time.Duration
+	stall     time.Duration
+	paused    time.Duration
+	pausedAt  time.Time
+	wrote     bool
+	active    bool
+}
+
+func (s *slowRecorder) touch(write bool) {
+	s.Lock()
+	defer s.Unlock()
+	now := clock.Now()
+	if s.active && s.pausedAt.IsZero() {
+		if gap := now.Sub(s.last); gap > s.stall {
+			s.stall = gap
+		}
+	}
+	if write && !s.wrote {
+		s.wrote = true
+		s.firstByte = now.Sub(s.start) - s.paused
+	}
+	s.active = true
+	s.last = now
+}
+
+func PauseSlowLog(r *http.Request) func() {
+	s, ok := r.Context().Value(slowLogKey{}).(*slowRecorder)
+	if !ok {
+		return func() {}
+	}
+	s.Lock()
+	s.pausedAt = clock.Now()
+	s.Unlock()
+	return func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.pausedAt.IsZero() {
+			return
+		}
+		now := clock.Now()
+		s.paused += now.Sub(s.pausedAt)
+		s.pausedAt = time.Time{}
+		s.last = now
+	}
+}
+
+type slowWriter struct {
+	http.ResponseWriter
+	rec *slowRecorder
+}
+
+func (w *slowWriter) WriteHeader(code int) {
+	w.rec.touch(true)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	w.rec.touch(true)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *slowWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type slowBody struct {
+	io.ReadCloser
+	rec *slowRecorder
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.rec.touch(false)
+	return n, err
+}
+
+func SlowLog(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		firstByte := time.Duration(conf.SlowLog.FirstByteSeconds * float64(time.Second))
+		stall := time.Duration(conf.SlowLog.StallSeconds * float64(time.Second))
+		if firstByte <= 0 && stall <= 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		now := clock.Now()
+		rec := &slowRecorder{start: now, last: now}
+		if r.Body != nil {
+			r.Body = &slowBody{r.Body, rec}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), slowLogKey{}, rec))
+		handler.ServeHTTP(&slowWriter{w, rec}, r)
+
+		rec.Lock()
+		defer rec.Unlock()
+		total := clock.Since(rec.start)
+		if (firstByte > 0 && rec.firstByte > firstByte) || (stall > 0 && rec.stall > stall) {
+			RequestLog(r).Warn("Slow request %s %s from %s: first byte %s, longest stall %s, waited %s, total %s, user agent %q",
+				r.Method, r.URL.Path, r.RemoteAddr, rec.firstByte, rec.stall, rec.paused, total, r.UserAgent())
+		}
+	})
+}
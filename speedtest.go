@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SPEEDTEST_CHUNK = 64 * 1024
+)
+
+var speedtestData = func() []byte {
+	data := make([]byte, SPEEDTEST_CHUNK)
+	rand.New(rand.NewSource(clock.Now().UnixNano())).Read(data)
+	return data
+}()
+
+type SpeedResult struct {
+	Bytes          int64
+	Seconds        float64
+	BytesPerSecond float64
+}
+
+func NewSpeedResult(n int64, d time.Duration) SpeedResult {
+	res := SpeedResult{
+		Bytes:   n,
+		Seconds: d.Seconds(),
+	}
+	if res.Seconds > 0 {
+		res.BytesPerSecond = float64(n) / res.Seconds
+	}
+	return res
+}
+
+func speedtestLimit() int64 {
+	return int64(conf.SpeedTestMaxMB) * 1024 * 1024
+}
+
+func SpeedTestDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if conf.SpeedTestMaxMB <= 0 {
+		Error(w, r, "speed test is disabled", http.StatusNotFound)
+		return
+	}
+
+	size := int64(10 * 1024 * 1024)
+	if s := r.URL.Query().Get("bytes"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			Error(w, r, "invalid size", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	if size > speedtestLimit() {
+		size = speedtestLimit()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	start := clock.Now()
+	var sent int64
+	for sent < size {
+		chunk := speedtestData
+		if rest := size - sent; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		n, err := w.Write(chunk)
+		sent += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	res := NewSpeedResult(sent, clock.Since(start))
+	RequestLog(r).Info("Speed test download %s: %d bytes in %.2fs", r.RemoteAddr, res.Bytes, res.Seconds)
+}
+
+func SpeedTestUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if conf.SpeedTestMaxMB <= 0 {
+		Error(w, r, "speed test is disabled", http.StatusNotFound)
+		return
+	}
+
+	start := clock.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(r.Body, speedtestLimit()))
+	if err != nil {
+		Error(w, r, "upload failed", http.StatusBadRequest)
+		return
+	}
+	res := NewSpeedResult(n, clock.Since(start))
+	RequestLog(r).Info("Speed test upload %s: %d bytes in %.2fs", r.RemoteAddr, res.Bytes, res.Seconds)
+
+	w.Header().Set("Content-Type", "text/javascript")
+	w.Header().Set("Cache-Control", "no-store")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(res)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const MIN_PART_SIZE = 1024 * 1024
+
+type SplitArchive struct {
+	sync.Mutex
+	size   int64
+	served map[int]bool
+}
+
+type SplitPart struct {
+	Index  int
+	Offset int64
+	Length int64
+	URL    string
+}
+
+type SplitIndex struct {
+	Name     string
+	Size     int64
+	PartSize int64
+	Parts    []SplitPart
+}
+
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid size")
+	}
+	return n * unit, nil
+}
+
+func PartSize(r *http.Request) (int64, error) {
+	size, err := ParseSize(r.URL.Query().Get("size"))
+	if err != nil {
+		return 0, errors.New("size must be given, for example ?size=4G")
+	}
+	if size < MIN_PART_SIZE {
+		return 0, fmt.Errorf("size must be at least %d bytes", MIN_PART_SIZE)
+	}
+	return size, nil
+}
+
+func buildArchive(dir string, contributions []Contribution) (string, int64, error) {
+	fd, err := ioutil.TempFile(dir, "archive-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer fd.Close()
+	cw := &CountingWriter{W: fd}
+	zout := NewZipWriter(cw)
+	if err := WriteGroupArchive(zout, contributions, nil); err != nil {
+		return "", 0, err
+	}
+	if err := zout.Close(); err != nil {
+		return "", 0, err
+	}
+	return fd.Name(), cw.N, nil
+}
+
+func (g *Group) Split() (*SplitArchive, bool) {
+	g.Lock()
+	defer g.Unlock()
+	if g.Status != WAITING_RECEIVER {
+		return nil, false
+	}
+	if g.split == nil {
+		g.split = &SplitArchive{served: map[int]bool{}}
+	}
+	return g.split, true
+}
+
+func (g *Group) OpenArchive(id string, s *SplitArchive) (*os.File, error) {
+	key := id + ".zip"
+	s.Lock()
+	defer s.Unlock()
+	if fd, size, ok := archives.Open(key); ok {
+		s.size = size
+		return fd, nil
+	}
+	g.Lock()
+	contributions := g.Contributions
+	g.Unlock()
+	path, size, err := buildArchive(g.dir, contributions)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	s.size = size
+	archives.Add(key, path, size)
+	return fd, nil
+}
+
+func splitGroup(w http.ResponseWriter, r *http.Request, id string) (*Group, *SplitArchive, *os.File, int64, bool) {
+	size, err := PartSize(r)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, 0, false
+	}
+	groupsLock.Lock()
+	group, exists := groups[id]
+	groupsLock.Unlock()
+	if !exists {
+		if _, streaming := GetTransfer(id); streaming {
+			Error(w, r, "only group transfers can be split, direct transfers are streamed", http.StatusBadRequest)
+			return nil, nil, nil, 0, false
+		}
+		ReceiverError(w, r, "notfound", http.StatusBadRequest)
+		return nil, nil, nil, 0, false
+	}
+	if group.Held() {
+		WriteError(w, r, ErrOnHold)
+		return nil, nil, nil, 0, false
+	}
+	if Suspended(id) {
+		WriteError(w, r, ErrSuspended)
+		return nil, nil, nil, 0, false
+	}
+	s, ok := group.Split()
+	if !ok {
+		ReceiverError(w, r, "notfound", http.StatusBadRequest)
+		return nil, nil, nil, 0, false
+	}
+	fd, err := group.OpenArchive(id, s)
+	if err != nil {
+		RequestLog(r).Error("Build split archive %s: %s", id, err)
+		Error(w, r, "internal error", http.StatusInternalServerError)
+		return nil, nil, nil, 0, false
+	}
+	return group, s, fd, size, true
+}
+
+func (s *SplitArchive) Parts(size int64) int {
+	return int((s.size + size - 1) / size)
+}
+
+func SplitIndexHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	_, s, fd, size, ok := splitGroup(w, r, id)
+	if !ok {
+		return
+	}
+	fd.Close()
+	index := SplitIndex{id + ".zip", s.size, size, []SplitPart{}}
+	for n := 1; n <= s.Parts(size); n++ {
+		offset := int64(n-1) * size
+		length := size
+		if offset+length > s.size {
+			length = s.size - offset
+		}
+		url := fmt.Sprintf("/download/%s/part/%d?size=%d", id, n, size)
+		index.Parts = append(index.Parts, SplitPart{n, offset, length, url})
+	}
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(index)
+}
+
+func SplitPartHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	group, s, fd, size, ok := splitGroup(w, r, id)
+	if !ok {
+		return
+	}
+	defer fd.Close()
+	n, _ := strconv.Atoi(vars["n"])
+	parts := s.Parts(size)
+	if n < 1 || n > parts {
+		Error(w, r, fmt.Sprintf("part must be between 1 and %d", parts), http.StatusNotFound)
+		return
+	}
+	archives.Pin(id + ".zip")
+
+	offset := int64(n-1) * size
+	length := size
+	if offset+length > s.size {
+		length = s.size - offset
+	}
+	group.Lock()
+	first := len(s.served) == 0
+	group.Unlock()
+	if first {
+		group.timeline.Record("receiver connected", 0, ClientIP(r).String())
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip.%03d", id, n))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Part-Count", strconv.Itoa(parts))
+	cw := &CountingWriter{W: w}
+	http.ServeContent(&partWriter{w, cw}, r, "", group.Created, io.NewSectionReader(fd, offset, length))
+	if r.Method != "GET" || r.Header.Get("Range") != "" || cw.N != length {
+		return
+	}
+
+	group.Lock()
+	s.served[n] = true
+	complete := len(s.served) == parts && group.Status == WAITING_RECEIVER
+	if complete {
+		group.Status.Set(RECEIVER_CONNECTED)
+		group.Status.Set(STREAMING)
+		group.Status.Set(COMPLETED)
+		JournalClose(id)
+	}
+	group.Unlock()
+	RequestLog(r).Info("Served part %d/%d of %s", n, parts, id)
+	if complete {
+		stats.Completed(s.size)
+		group.timeline.Record("completed", s.size, fmt.Sprintf("%d parts", parts))
+	}
+}
+
+type partWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	return p.body.Write(b)
+}
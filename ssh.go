@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+)
+
+const (
+	SSH_MSG_DISCONNECT                = 1
+	SSH_MSG_IGNORE                    = 2
+	SSH_MSG_UNIMPLEMENTED             = 3
+	SSH_MSG_DEBUG                     = 4
+	SSH_MSG_SERVICE_REQUEST           = 5
+	SSH_MSG_SERVICE_ACCEPT            = 6
+	SSH_MSG_EXT_INFO                  = 7
+	SSH_MSG_KEXINIT                   = 20
+	SSH_MSG_NEWKEYS                   = 21
+	SSH_MSG_KEX_ECDH_INIT             = 30
+	SSH_MSG_KEX_ECDH_REPLY            = 31
+	SSH_MSG_USERAUTH_REQUEST          = 50
+	SSH_MSG_USERAUTH_FAILURE          = 51
+	SSH_MSG_USERAUTH_SUCCESS          = 52
+	SSH_MSG_USERAUTH_BANNER           = 53
+	SSH_MSG_GLOBAL_REQUEST            = 80
+	SSH_MSG_REQUEST_FAILURE           = 82
+	SSH_MSG_CHANNEL_OPEN              = 90
+	SSH_MSG_CHANNEL_OPEN_CONFIRMATION = 91
+	SSH_MSG_CHANNEL_OPEN_FAILURE      = 92
+	SSH_MSG_CHANNEL_WINDOW_ADJUST     = 93
+	SSH_MSG_CHANNEL_DATA              = 94
+	SSH_MSG_CHANNEL_EXTENDED_DATA     = 95
+	SSH_MSG_CHANNEL_EOF               = 96
+	SSH_MSG_CHANNEL_CLOSE             = 97
+	SSH_MSG_CHANNEL_REQUEST           = 98
+	SSH_MSG_CHANNEL_SUCCESS           = 99
+	SSH_MSG_CHANNEL_FAILURE           = 100
+
+	SSH_VERSION     = "SSH-2.0-nethermes"
+	SSH_MAX_PACKET  = 256 * 1024
+	SSH_WINDOW      = 2 * 1024 * 1024
+	SSH_CHANNEL_MAX = 32 * 1024
+
+	SSH_KEX        = "curve25519-sha256,curve25519-sha256@libssh.org"
+	SSH_KEX_STRICT = "kex-strict-c-v00@openssh.com"
+	SSH_CIPHERS    = "aes128-ctr,aes256-ctr"
+	SSH_MACS       = "hmac-sha2-256"
+)
+
+var (
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	ErrSSHAuth         = errors.New("ssh authentication failed")
+
+	errSSHMalformed = errors.New("malformed ssh message")
+)
+
+// sshWriter builds SSH wire encoded messages (RFC 4251 section 5).
+type sshWriter struct {
+	bytes.Buffer
+}
+
+func newSSHMessage(msg byte) *sshWriter {
+	w := &sshWriter{}
+	w.WriteByte(msg)
+	return w
+}
+
+func (w *sshWriter) Uint32(v uint32) *sshWriter {
+	binary.Write(w, binary.BigEndian, v)
+	return w
+}
+
+func (w *sshWriter) Uint64(v uint64) *sshWriter {
+	binary.Write(w, binary.BigEndian, v)
+	return w
+}
+
+func (w *sshWriter) Bool(v bool) *sshWriter {
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+	return w
+}
+
+func (w *sshWriter) Blob(s []byte) *sshWriter {
+	w.Uint32(uint32(len(s)))
+	w.Write(s)
+	return w
+}
+
+func (w *sshWriter) Text(s string) *sshWriter {
+	return w.Blob([]byte(s))
+}
+
+// Mpint encodes the unsigned big-endian magnitude v.
+func (w *sshWriter) Mpint(v []byte) *sshWriter {
+	for len(v) > 0 && v[0] == 0 {
+		v = v[1:]
+	}
+	if len(v) > 0 && v[0]&0x80 != 0 {
+		v = append([]byte{0}, v...)
+	}
+	return w.Blob(v)
+}
+
+type sshReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sshReader) take(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		r.err = errSSHMalformed
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sshReader) Byte() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *sshReader) Bool() bool {
+	return r.Byte() != 0
+}
+
+func (r *sshReader) Uint32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *sshReader) Uint64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *sshReader) Blob() []byte {
+	n := r.Uint32()
+	if n > uint32(len(r.b)) {
+		r.err = errSSHMalformed
+		return nil
+	}
+	return r.take(int(n))
+}
+
+func (r *sshReader) Text() string {
+	return string(r.Blob())
+}
+
+type sshDirection struct {
+	seq    uint32
+	stream cipher.Stream
+	mac    hash.Hash
+	next   *sshDirection
+}
+
+type sshTransport struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	in, out   sshDirection
+	strict    bool
+	sessionID []byte
+}
+
+func (t *sshTransport) writePacket(payload []byte) error {
+	block := 8
+	if t.out.stream != nil {
+		block = aes.BlockSize
+	}
+	padding := block - (5+len(payload))%block
+	if padding < 4 {
+		padding += block
+	}
+	packet := make([]byte, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	packet[4] = byte(padding)
+	copy(packet[5:], payload)
+	rand.Read(packet[5+len(payload):])
+	var mac []byte
+	if t.out.mac != nil {
+		t.out.mac.Reset()
+		binary.Write(t.out.mac, binary.BigEndian, t.out.seq)
+		t.out.mac.Write(packet)
+		mac = t.out.mac.Sum(nil)
+		t.out.stream.XORKeyStream(packet, packet)
+	}
+	t.out.seq++
+	if _, err := t.conn.Write(append(packet, mac...)); err != nil {
+		return err
+	}
+	if len(payload) > 0 && payload[0] == SSH_MSG_NEWKEYS {
+		t.out.activate(t.strict)
+	}
+	return nil
+}
+
+func (t *sshTransport) readPacket() ([]byte, error) {
+	block := 8
+	if t.in.stream != nil {
+		block = aes.BlockSize
+	}
+	first := make([]byte, block)
+	if _, err := io.ReadFull(t.r, first); err != nil {
+		return nil, err
+	}
+	if t.in.stream != nil {
+		t.in.stream.XORKeyStream(first, first)
+	}
+	length := binary.BigEndian.Uint32(first)
+	if length < uint32(block)-4 || length > SSH_MAX_PACKET || (length+4)%uint32(block) != 0 {
+		return nil, errSSHMalformed
+	}
+	packet := make([]byte, length+4)
+	copy(packet, first)
+	if _, err := io.ReadFull(t.r, packet[block:]); err != nil {
+		return nil, err
+	}
+	if t.in.stream != nil {
+		t.in.stream.XORKeyStream(packet[block:], packet[block:])
+		mac := make([]byte, t.in.mac.Size())
+		if _, err := io.ReadFull(t.r, mac); err != nil {
+			return nil, err
+		}
+		t.in.mac.Reset()
+		binary.Write(t.in.mac, binary.BigEndian, t.in.seq)
+		t.in.mac.Write(packet)
+		if !hmac.Equal(mac, t.in.mac.Sum(nil)) {
+			return nil, errors.New("ssh packet authentication failed")
+		}
+	}
+	t.in.seq++
+	padding := int(packet[4])
+	if padding < 4 || 5+padding > len(packet) {
+		return nil, errSSHMalformed
+	}
+	payload := packet[5 : len(packet)-padding]
+	if len(payload) == 0 {
+		return nil, errSSHMalformed
+	}
+	if payload[0] == SSH_MSG_NEWKEYS {
+		t.in.activate(t.strict)
+	}
+	return payload, nil
+}
+
+func (d *sshDirection) activate(strict bool) {
+	if d.next != nil {
+		d.stream, d.mac, d.next = d.next.stream, d.next.mac, nil
+	}
+	if strict {
+		d.seq = 0
+	}
+}
+
+// readMessage returns the next packet that is not transport noise.
+func (t *sshTransport) readMessage() ([]byte, error) {
+	for {
+		msg, err := t.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		switch msg[0] {
+		case SSH_MSG_IGNORE, SSH_MSG_DEBUG, SSH_MSG_UNIMPLEMENTED, SSH_MSG_EXT_INFO:
+			continue
+		case SSH_MSG_DISCONNECT:
+			r := &sshReader{b: msg[1:]}
+			r.Uint32()
+			return nil, fmt.Errorf("ssh server disconnected: %s", r.Text())
+		case SSH_MSG_KEXINIT:
+			return nil, errors.New("ssh server requested a key re-exchange")
+		}
+		return msg, nil
+	}
+}
+
+func (t *sshTransport) expect(msg byte) (*sshReader, error) {
+	p, err := t.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if p[0] != msg {
+		return nil, fmt.Errorf("unexpected ssh message %d, want %d", p[0], msg)
+	}
+	return &sshReader{b: p[1:]}, nil
+}
+
+// exchangeVersions sends our identification string and returns the
+// peer's, skipping any lines the peer sends before it (RFC 4253 4.2).
+func exchangeVersions(conn net.Conn, r *bufio.Reader) (string, error) {
+	if _, err := io.WriteString(conn, SSH_VERSION+"\r\n"); err != nil {
+		return "", err
+	}
+	for i := 0; i < 32; i++ {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				return "", errSSHMalformed
+			}
+			return "", err
+		}
+		v := strings.TrimRight(string(line), "\r\n")
+		if strings.HasPrefix(v, "SSH-2.0-") || strings.HasPrefix(v, "SSH-1.99-") {
+			return v, nil
+		}
+		if strings.HasPrefix(v, "SSH-") {
+			return "", fmt.Errorf("unsupported ssh version %q", v)
+		}
+	}
+	return "", errSSHMalformed
+}
+
+type sshKexInit struct {
+	payload []byte
+	lists   [10][]string
+}
+
+func newKexInit(lists [10]string) sshKexInit {
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	w := newSSHMessage(SSH_MSG_KEXINIT)
+	w.Write(cookie)
+	k := sshKexInit{}
+	for i, l := range lists {
+		w.Text(l)
+		k.lists[i] = strings.Split(l, ",")
+	}
+	w.Bool(false).Uint32(0)
+	k.payload = w.Bytes()
+	return k
+}
+
+func parseKexInit(payload []byte) (sshKexInit, error) {
+	r := &sshReader{b: payload[1:]}
+	r.take(16)
+	k := sshKexInit{payload: payload}
+	for i := range k.lists {
+		k.lists[i] = strings.Split(r.Text(), ",")
+	}
+	if r.Bool() {
+		return k, errors.New("ssh guessed key exchange packets are not supported")
+	}
+	return k, r.err
+}
+
+// sshNegotiate picks the first client algorithm the server also offers.
+func sshNegotiate(client, server []string) (string, error) {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no common ssh algorithm in %s", strings.Join(server, ","))
+}
+
+func sshExchangeHash(vc, vs string, ic, is, ks, qc, qs, k []byte) []byte {
+	w := &sshWriter{}
+	w.Text(vc).Text(vs).Blob(ic).Blob(is).Blob(ks).Blob(qc).Blob(qs).Mpint(k)
+	h := sha256.Sum256(w.Bytes())
+	return h[:]
+}
+
+// setKeys prepares the keys that take effect with the next NEWKEYS in
+// each direction (RFC 4253 section 7.2).
+func (t *sshTransport) setKeys(k, h []byte, cipherName string, client bool) error {
+	keyLen := 16
+	if cipherName == "aes256-ctr" {
+		keyLen = 32
+	}
+	if t.sessionID == nil {
+		t.sessionID = h
+	}
+	derive := func(x byte, n int) []byte {
+		w := &sshWriter{}
+		w.Mpint(k)
+		prefix := w.Bytes()
+		d := sha256.New()
+		d.Write(prefix)
+		d.Write(h)
+		d.Write([]byte{x})
+		d.Write(t.sessionID)
+		out := d.Sum(nil)
+		for len(out) < n {
+			d.Reset()
+			d.Write(prefix)
+			d.Write(h)
+			d.Write(out)
+			out = d.Sum(out)
+		}
+		return out[:n]
+	}
+	direction := func(iv, key, mac byte) (*sshDirection, error) {
+		block, err := aes.NewCipher(derive(key, keyLen))
+		if err != nil {
+			return nil, err
+		}
+		return &sshDirection{
+			stream: cipher.NewCTR(block, derive(iv, aes.BlockSize)),
+			mac:    hmac.New(sha256.New, derive(mac, sha256.Size)),
+		}, nil
+	}
+	c2s, err := direction('A', 'C', 'E')
+	if err != nil {
+		return err
+	}
+	s2c, err := direction('B', 'D', 'F')
+	if err != nil {
+		return err
+	}
+	if client {
+		t.out.next, t.in.next = c2s, s2c
+	} else {
+		t.out.next, t.in.next = s2c, c2s
+	}
+	return nil
+}
+
+// ParseHostKey reads a public key in authorized_keys or known_hosts
+// form and returns its type and wire encoding.
+func ParseHostKey(s string) (string, []byte, error) {
+	fields := strings.Fields(s)
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "ssh-ed25519", "ssh-rsa", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		default:
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err != nil {
+			return "", nil, errors.New("invalid host key encoding")
+		}
+		r := &sshReader{b: blob}
+		if r.Text() != fields[i] {
+			return "", nil, errors.New("host key type does not match its data")
+		}
+		return fields[i], blob, nil
+	}
+	return "", nil, errors.New("unsupported host key")
+}
+
+// hostKeyAlgorithms lists the signature algorithms that can prove
+// possession of a key of the given type.
+func hostKeyAlgorithms(keyType string) string {
+	if keyType == "ssh-rsa" {
+		return "rsa-sha2-512,rsa-sha2-256"
+	}
+	return keyType
+}
+
+// sshVerify checks a host key signature over the exchange hash h.
+func sshVerify(keyBlob, sigBlob, h []byte, algorithm string) error {
+	key := &sshReader{b: keyBlob}
+	keyType := key.Text()
+	sig := &sshReader{b: sigBlob}
+	if sig.Text() != algorithm {
+		return errors.New("host key signature uses the wrong algorithm")
+	}
+	s := sig.Blob()
+	if key.err != nil || sig.err != nil {
+		return errSSHMalformed
+	}
+	ok := false
+	switch keyType {
+	case "ssh-ed25519":
+		pub := key.Blob()
+		ok = key.err == nil && len(pub) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(pub), h, s)
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		curves := map[string]elliptic.Curve{"nistp256": elliptic.P256(), "nistp384": elliptic.P384(), "nistp521": elliptic.P521()}
+		hashes := map[string]crypto.Hash{"nistp256": crypto.SHA256, "nistp384": crypto.SHA384, "nistp521": crypto.SHA512}
+		name := key.Text()
+		curve := curves[name]
+		if curve == nil || "ecdsa-sha2-"+name != keyType {
+			return errSSHMalformed
+		}
+		x, y := elliptic.Unmarshal(curve, key.Blob())
+		rs := &sshReader{b: s}
+		r, ss := new(big.Int).SetBytes(rs.Blob()), new(big.Int).SetBytes(rs.Blob())
+		if x == nil || rs.err != nil {
+			return errSSHMalformed
+		}
+		d := hashes[name].New()
+		d.Write(h)
+		ok = ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, d.Sum(nil), r, ss)
+	case "ssh-rsa":
+		e, n := new(big.Int).SetBytes(key.Blob()), new(big.Int).SetBytes(key.Blob())
+		if key.err != nil || !e.IsInt64() || n.BitLen() < 2048 {
+			return errors.New("unsupported rsa host key")
+		}
+		var digest []byte
+		var hf crypto.Hash
+		switch algorithm {
+		case "rsa-sha2-256":
+			sum := sha256.Sum256(h)
+			digest, hf = sum[:], crypto.SHA256
+		case "rsa-sha2-512":
+			sum := sha512.Sum512(h)
+			digest, hf = sum[:], crypto.SHA512
+		default:
+			return errors.New("host key signature uses the wrong algorithm")
+		}
+		ok = rsa.VerifyPKCS1v15(&rsa.PublicKey{N: n, E: int(e.Int64())}, hf, digest, s) == nil
+	default:
+		return errors.New("unsupported host key")
+	}
+	if !ok {
+		return errors.New("invalid host key signature")
+	}
+	return nil
+}
+
+// DialSSH performs the key exchange over conn, accepts only the pinned
+// host key and authenticates with a password.
+func DialSSH(conn net.Conn, hostKey, user, password string) (*sshTransport, error) {
+	keyType, keyBlob, err := ParseHostKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	t := &sshTransport{conn: conn, r: bufio.NewReaderSize(conn, 64*1024)}
+	serverVersion, err := exchangeVersions(conn, t.r)
+	if err != nil {
+		return nil, err
+	}
+
+	ours := newKexInit([10]string{
+		SSH_KEX + "," + SSH_KEX_STRICT, hostKeyAlgorithms(keyType),
+		SSH_CIPHERS, SSH_CIPHERS, SSH_MACS, SSH_MACS, "none", "none", "", "",
+	})
+	if err := t.writePacket(ours.payload); err != nil {
+		return nil, err
+	}
+	p, err := t.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if p[0] != SSH_MSG_KEXINIT {
+		return nil, errors.New("ssh server did not start the key exchange")
+	}
+	theirs, err := parseKexInit(p)
+	if err != nil {
+		return nil, err
+	}
+	algorithms := [6]string{}
+	for i := range algorithms {
+		if algorithms[i], err = sshNegotiate(ours.lists[i], theirs.lists[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range theirs.lists[0] {
+		t.strict = t.strict || k == "kex-strict-s-v00@openssh.com"
+	}
+	if algorithms[2] != algorithms[3] {
+		return nil, errors.New("ssh server picked different ciphers per direction")
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	qc := priv.PublicKey().Bytes()
+	if err := t.writePacket(newSSHMessage(SSH_MSG_KEX_ECDH_INIT).Blob(qc).Bytes()); err != nil {
+		return nil, err
+	}
+	p, err = t.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if p[0] != SSH_MSG_KEX_ECDH_REPLY {
+		return nil, fmt.Errorf("unexpected ssh message %d during key exchange", p[0])
+	}
+	r := &sshReader{b: p[1:]}
+	ks, qs, sig := r.Blob(), r.Blob(), r.Blob()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !bytes.Equal(ks, keyBlob) {
+		return nil, ErrHostKeyMismatch
+	}
+	pub, err := ecdh.X25519().NewPublicKey(qs)
+	if err != nil {
+		return nil, err
+	}
+	k, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	h := sshExchangeHash(SSH_VERSION, serverVersion, ours.payload, theirs.payload, ks, qc, qs, k)
+	if err := sshVerify(ks, sig, h, algorithms[1]); err != nil {
+		return nil, err
+	}
+	if err := t.setKeys(k, h, algorithms[2], true); err != nil {
+		return nil, err
+	}
+	if err := t.writePacket([]byte{SSH_MSG_NEWKEYS}); err != nil {
+		return nil, err
+	}
+	if p, err = t.readPacket(); err != nil {
+		return nil, err
+	}
+	if p[0] != SSH_MSG_NEWKEYS {
+		return nil, errors.New("ssh server did not finish the key exchange")
+	}
+
+	if err := t.writePacket(newSSHMessage(SSH_MSG_SERVICE_REQUEST).Text("ssh-userauth").Bytes()); err != nil {
+		return nil, err
+	}
+	if _, err := t.expect(SSH_MSG_SERVICE_ACCEPT); err != nil {
+		return nil, err
+	}
+	auth := newSSHMessage(SSH_MSG_USERAUTH_REQUEST).Text(user).Text("ssh-connection").Text("password").Bool(false).Text(password)
+	if err := t.writePacket(auth.Bytes()); err != nil {
+		return nil, err
+	}
+	for {
+		p, err := t.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch p[0] {
+		case SSH_MSG_USERAUTH_BANNER:
+			continue
+		case SSH_MSG_USERAUTH_SUCCESS:
+			return t, nil
+		default:
+			return nil, ErrSSHAuth
+		}
+	}
+}
+
+type sshChannel struct {
+	t         *sshTransport
+	remote    uint32
+	window    uint32
+	maxPacket uint32
+	consumed  uint32
+	buf       []byte
+	closed    bool
+}
+
+// OpenSubsystem opens a session channel and starts the named subsystem
+// on it.
+func (t *sshTransport) OpenSubsystem(name string) (*sshChannel, error) {
+	open := newSSHMessage(SSH_MSG_CHANNEL_OPEN).Text("session").Uint32(0).Uint32(SSH_WINDOW).Uint32(SSH_CHANNEL_MAX)
+	if err := t.writePacket(open.Bytes()); err != nil {
+		return nil, err
+	}
+	c := &sshChannel{t: t}
+	for c.maxPacket == 0 {
+		p, err := t.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		r := &sshReader{b: p[1:]}
+		switch p[0] {
+		case SSH_MSG_CHANNEL_OPEN_CONFIRMATION:
+			r.Uint32()
+			c.remote, c.window, c.maxPacket = r.Uint32(), r.Uint32(), r.Uint32()
+			if r.err != nil || c.maxPacket == 0 {
+				return nil, errSSHMalformed
+			}
+		case SSH_MSG_CHANNEL_OPEN_FAILURE:
+			r.Uint32()
+			r.Uint32()
+			return nil, fmt.Errorf("ssh server refused the session: %s", r.Text())
+		default:
+			if err := c.handle(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	req := newSSHMessage(SSH_MSG_CHANNEL_REQUEST).Uint32(c.remote).Text("subsystem").Bool(true).Text(name)
+	if err := t.writePacket(req.Bytes()); err != nil {
+		return nil, err
+	}
+	for {
+		p, err := t.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch p[0] {
+		case SSH_MSG_CHANNEL_SUCCESS:
+			return c, nil
+		case SSH_MSG_CHANNEL_FAILURE:
+			return nil, fmt.Errorf("ssh server refused the %s subsystem", name)
+		}
+		if err := c.handle(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handle processes a connection protocol message that arrived while
+// the channel was waiting for something else.
+func (c *sshChannel) handle(p []byte) error {
+	r := &sshReader{b: p[1:]}
+	switch p[0] {
+	case SSH_MSG_GLOBAL_REQUEST:
+		r.Text()
+		if r.Bool() {
+			return c.t.writePacket([]byte{SSH_MSG_REQUEST_FAILURE})
+		}
+	case SSH_MSG_CHANNEL_WINDOW_ADJUST:
+		r.Uint32()
+		c.window += r.Uint32()
+	case SSH_MSG_CHANNEL_DATA:
+		r.Uint32()
+		data := r.Blob()
+		if r.err != nil {
+			return r.err
+		}
+		c.buf = append(c.buf, data...)
+		c.consumed += uint32(len(data))
+		if c.consumed >= SSH_WINDOW/2 {
+			adjust := newSSHMessage(SSH_MSG_CHANNEL_WINDOW_ADJUST).Uint32(c.remote).Uint32(c.consumed)
+			c.consumed = 0
+			return c.t.writePacket(adjust.Bytes())
+		}
+	case SSH_MSG_CHANNEL_EXTENDED_DATA:
+	case SSH_MSG_CHANNEL_REQUEST:
+		r.Uint32()
+		r.Text()
+		if r.Bool() {
+			return c.t.writePacket(newSSHMessage(SSH_MSG_CHANNEL_FAILURE).Uint32(c.remote).Bytes())
+		}
+	case SSH_MSG_CHANNEL_EOF, SSH_MSG_CHANNEL_CLOSE:
+		c.closed = true
+	default:
+		return fmt.Errorf("unexpected ssh message %d", p[0])
+	}
+	return r.err
+}
+
+func (c *sshChannel) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if c.closed {
+			return written, io.ErrClosedPipe
+		}
+		if c.window == 0 {
+			p, err := c.t.readMessage()
+			if err != nil {
+				return written, err
+			}
+			if err := c.handle(p); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := uint32(len(b))
+		if n > c.window {
+			n = c.window
+		}
+		if n > c.maxPacket {
+			n = c.maxPacket
+		}
+		data := newSSHMessage(SSH_MSG_CHANNEL_DATA).Uint32(c.remote).Blob(b[:n])
+		if err := c.t.writePacket(data.Bytes()); err != nil {
+			return written, err
+		}
+		c.window -= n
+		written += int(n)
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *sshChannel) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		p, err := c.t.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if err := c.handle(p); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *sshChannel) Close() error {
+	if !c.closed {
+		c.closed = true
+		c.t.writePacket(newSSHMessage(SSH_MSG_CHANNEL_EOF).Uint32(c.remote).Bytes())
+		c.t.writePacket(newSSHMessage(SSH_MSG_CHANNEL_CLOSE).Uint32(c.remote).Bytes())
+	}
+	return c.t.conn.Close()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stats         = &Stats{Started: clock.Now()}
+	statstemplate *template.Template
+)
+
+type CountingWriter struct {
+	W io.Writer
+	N int64
+	D time.Duration
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	start := clock.Now()
+	n, err := c.W.Write(p)
+	c.D += clock.Since(start)
+	c.N += int64(n)
+	return n, err
+}
+
+func (c *CountingWriter) Flush() {
+	if f, ok := c.W.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type Stats struct {
+	sync.Mutex
+	Started        time.Time
+	day            string
+	TransfersToday int
+	TransfersTotal int64
+	BytesRelayed   int64
+}
+
+type StatsReport struct {
+	UptimeSeconds  int64
+	Uptime         string
+	TransfersToday int
+	TransfersTotal int64
+	GBRelayed      float64
+	Waiting        int
+	InProgress     int
+}
+
+func (s *Stats) Completed(bytes int64) {
+	s.Lock()
+	defer s.Unlock()
+	today := clock.Now().Format("2006-01-02")
+	if s.day != today {
+		s.day = today
+		s.TransfersToday = 0
+	}
+	s.TransfersToday++
+	s.TransfersTotal++
+	s.BytesRelayed += bytes
+}
+
+func (s *Stats) Report() StatsReport {
+	s.Lock()
+	uptime := clock.Since(s.Started)
+	rep := StatsReport{
+		UptimeSeconds:  int64(uptime.Seconds()),
+		Uptime:         uptime.Truncate(time.Second).String(),
+		TransfersTotal: s.TransfersTotal,
+		GBRelayed:      float64(s.BytesRelayed) / (1024 * 1024 * 1024),
+	}
+	if s.day == clock.Now().Format("2006-01-02") {
+		rep.TransfersToday = s.TransfersToday
+	}
+	s.Unlock()
+
+	transfersLock.Lock()
+	for _, transfer := range transfers {
+		switch status := transfer.CurrentStatus(); {
+		case status == WAITING_RECEIVER:
+			rep.Waiting++
+		case status.Active():
+			rep.InProgress++
+		}
+	}
+	transfersLock.Unlock()
+	groupsLock.Lock()
+	for _, group := range groups {
+		group.Lock()
+		switch {
+		case group.Status == WAITING_RECEIVER:
+			rep.Waiting++
+		case group.Status.Active():
+			rep.InProgress++
+		}
+		group.Unlock()
+	}
+	groupsLock.Unlock()
+	return rep
+}
+
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	rep := stats.Report()
+	if conf.Headless || r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "text/javascript")
+		jenc := json.NewEncoder(w)
+		jenc.Encode(rep)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	statstemplate.Execute(w, rep)
+}
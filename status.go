@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+type Status uint8
+
+const (
+	RESERVED Status = iota
+	WAITING_RECEIVER
+	RECEIVER_CONNECTED
+	STREAMING
+	COMPLETED
+	FAILED
+	ABORTED
+	EXPIRED
+	CORRUPTED
+)
+
+var statusNames = []string{
+	"RESERVED",
+	"WAITING_RECEIVER",
+	"RECEIVER_CONNECTED",
+	"STREAMING",
+	"COMPLETED",
+	"FAILED",
+	"ABORTED",
+	"EXPIRED",
+	"CORRUPTED",
+}
+
+var transitions = map[Status][]Status{
+	RESERVED:           {WAITING_RECEIVER, ABORTED, EXPIRED},
+	WAITING_RECEIVER:   {RECEIVER_CONNECTED, ABORTED, EXPIRED},
+	RECEIVER_CONNECTED: {STREAMING, FAILED, ABORTED},
+	STREAMING:          {COMPLETED, FAILED, ABORTED, CORRUPTED},
+}
+
+func (s Status) String() string {
+	if int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprintf("Status(%d)", s)
+}
+
+func ParseStatus(name string) (Status, error) {
+	for i, n := range statusNames {
+		if n == name {
+			return Status(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q", name)
+}
+
+func (s Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Status) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	parsed, err := ParseStatus(name)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+func (s Status) Terminal() bool {
+	return len(transitions[s]) == 0
+}
+
+func (s Status) Active() bool {
+	return s == RECEIVER_CONNECTED || s == STREAMING
+}
+
+func (s Status) CanTransition(to Status) bool {
+	for _, t := range transitions[s] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Status) Set(to Status) error {
+	if !s.CanTransition(to) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, *s, to)
+	}
+	*s = to
+	return nil
+}
+
+func (t *Transfer) SetStatus(to Status) error {
+	t.Lock()
+	defer t.Unlock()
+	return t.Status.Set(to)
+}
+
+func (t *Transfer) CurrentStatus() Status {
+	t.Lock()
+	defer t.Unlock()
+	return t.Status
+}
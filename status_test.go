@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	valid := map[[2]Status]bool{
+		{RESERVED, WAITING_RECEIVER}:           true,
+		{RESERVED, ABORTED}:                    true,
+		{RESERVED, EXPIRED}:                    true,
+		{WAITING_RECEIVER, RECEIVER_CONNECTED}: true,
+		{WAITING_RECEIVER, ABORTED}:            true,
+		{WAITING_RECEIVER, EXPIRED}:            true,
+		{RECEIVER_CONNECTED, STREAMING}:        true,
+		{RECEIVER_CONNECTED, FAILED}:           true,
+		{RECEIVER_CONNECTED, ABORTED}:          true,
+		{STREAMING, COMPLETED}:                 true,
+		{STREAMING, FAILED}:                    true,
+		{STREAMING, ABORTED}:                   true,
+		{STREAMING, CORRUPTED}:                 true,
+	}
+	for from := RESERVED; from <= CORRUPTED; from++ {
+		for to := RESERVED; to <= CORRUPTED; to++ {
+			s := from
+			err := s.Set(to)
+			if valid[[2]Status{from, to}] {
+				if err != nil || s != to {
+					t.Errorf("%s -> %s rejected: %v", from, to, err)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrInvalidTransition) {
+				t.Errorf("%s -> %s allowed", from, to)
+			}
+			if s != from {
+				t.Errorf("%s -> %s changed the status to %s", from, to, s)
+			}
+		}
+	}
+}
+
+func TestStatusTerminal(t *testing.T) {
+	for s := RESERVED; s <= CORRUPTED; s++ {
+		want := s == COMPLETED || s == FAILED || s == ABORTED || s == EXPIRED || s == CORRUPTED
+		if s.Terminal() != want {
+			t.Errorf("%s.Terminal() = %v", s, s.Terminal())
+		}
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	for s := RESERVED; s <= CORRUPTED; s++ {
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != `"`+s.String()+`"` {
+			t.Errorf("%s marshals to %s", s, b)
+		}
+		var back Status
+		if err := json.Unmarshal(b, &back); err != nil || back != s {
+			t.Errorf("%s round trips to %s: %v", s, back, err)
+		}
+	}
+	var s Status
+	for _, bad := range []string{`"DONE"`, `1`, `""`} {
+		if err := json.Unmarshal([]byte(bad), &s); err == nil {
+			t.Errorf("%s unmarshalled", bad)
+		}
+	}
+}
+
+func TestStatusLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+	key := fetchKey(t, srv)
+
+	status := func() string {
+		resp, err := http.Get(srv.URL + "/status/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var s string
+		json.NewDecoder(resp.Body).Decode(&s)
+		return s
+	}
+
+	files := []testFile{{"a.txt", []byte("hello")}}
+	contentType, body := multipartBody(t, files)
+	uploaded := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/upload/"+key, contentType, strings.NewReader(string(body)))
+		if err != nil {
+			uploaded <- err.Error()
+			return
+		}
+		resp.Body.Close()
+		uploaded <- resp.Status
+	}()
+	for i := 0; status() != "WAITING_RECEIVER"; i++ {
+		if i > 100 {
+			t.Fatal("upload never started waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(srv.URL + "/download/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := <-uploaded; !strings.HasPrefix(s, "200") {
+		t.Fatalf("upload responded %s", s)
+	}
+	if s := status(); s != "COMPLETED" {
+		t.Fatalf("status after download is %s", s)
+	}
+
+	resp, err = http.Get(srv.URL + "/download/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("completed transfer could be downloaded twice")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	TEMP_PREFIX = "nethermes-"
+)
+
+func NewTempDir(kind string) (string, error) {
+	if err := os.MkdirAll(conf.TempDir, 0700); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(conf.TempDir, TEMP_PREFIX+kind+"-")
+}
+
+func SweepTemp() {
+	fd, err := os.Open(conf.TempDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.Error("Open temp dir: %s", err)
+		return
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		logger.Error("List temp dir: %s", err)
+		return
+	}
+
+	keep := map[string]bool{}
+	groupsLock.Lock()
+	for _, group := range groups {
+		keep[filepath.Base(group.dir)] = true
+	}
+	groupsLock.Unlock()
+	for _, name := range names {
+		if !strings.HasPrefix(name, TEMP_PREFIX) || keep[name] {
+			continue
+		}
+		res, err := WipeDir(filepath.Join(conf.TempDir, name))
+		if res.Files > 0 || err != nil {
+			AuditWipe(name, "stale", res, err)
+		}
+		if err != nil {
+			continue
+		}
+		logger.Info("Removed stale temp %s", name)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TLSConfig struct {
+	CertFile         string
+	KeyFile          string
+	ClientCAFile     string
+	ClientIdentities map[string]string
+	MinVersion       string
+	CurvePreferences []string
+	CipherSuites     []string
+	CipherPolicy     string
+}
+
+type tlsPolicy struct {
+	minVersion   uint16
+	curves       []tls.CurveID
+	cipherSuites []uint16
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+	fipsCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+)
+
+func ParseTLSPolicy(c TLSConfig) (tlsPolicy, error) {
+	p := tlsPolicy{minVersion: tls.VersionTLS12}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return p, fmt.Errorf("unknown MinVersion %q, use 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+		}
+		if v < tls.VersionTLS12 {
+			logger.Warn("TLS MinVersion %s allows deprecated protocol versions", c.MinVersion)
+		}
+		p.minVersion = v
+	}
+	switch c.CipherPolicy {
+	case "":
+	case "fips":
+		p.cipherSuites = fipsCipherSuites
+		p.curves = fipsCurves
+		if p.minVersion < tls.VersionTLS12 {
+			p.minVersion = tls.VersionTLS12
+		}
+	default:
+		return p, fmt.Errorf("unknown CipherPolicy %q, use fips or leave it empty", c.CipherPolicy)
+	}
+	if len(c.CurvePreferences) > 0 {
+		p.curves = nil
+		for _, name := range c.CurvePreferences {
+			id, ok := tlsCurves[strings.ToUpper(name)]
+			if !ok {
+				return p, fmt.Errorf("unknown curve %q", name)
+			}
+			p.curves = append(p.curves, id)
+		}
+	}
+	if len(c.CipherSuites) > 0 {
+		known := map[string]*tls.CipherSuite{}
+		for _, s := range tls.CipherSuites() {
+			known[s.Name] = s
+		}
+		for _, s := range tls.InsecureCipherSuites() {
+			known[s.Name] = s
+		}
+		p.cipherSuites = nil
+		for _, name := range c.CipherSuites {
+			s, ok := known[name]
+			if !ok {
+				return p, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			if s.Insecure {
+				logger.Warn("TLS cipher suite %s is insecure", name)
+			}
+			p.cipherSuites = append(p.cipherSuites, s.ID)
+		}
+	}
+	return p, nil
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+type certReloader struct {
+	sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+	info, err := os.Stat(conf.TLS.CertFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && info.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TLS.CertFile, conf.TLS.KeyFile)
+	if err != nil {
+		if c.cert != nil {
+			logger.Error("Reload certificate: %s", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		logger.Info("Reloaded certificate from %s", conf.TLS.CertFile)
+	}
+	c.cert = &cert
+	c.modTime = info.ModTime()
+	return c.cert, nil
+}
+
+var (
+	certs     = &certReloader{}
+	clientCAs *x509.CertPool
+	policy    = tlsPolicy{minVersion: tls.VersionTLS12}
+)
+
+func ServerTLSConfig() *tls.Config {
+	c := &tls.Config{
+		GetCertificate:   certs.GetCertificate,
+		MinVersion:       policy.minVersion,
+		CurvePreferences: policy.curves,
+		CipherSuites:     policy.cipherSuites,
+	}
+	if clientCAs != nil {
+		c.ClientCAs = clientCAs
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c
+}
+
+func LoadClientCAs(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in " + file)
+	}
+	return pool, nil
+}
+
+func CheckTLSConfig() error {
+	if !conf.TLS.Enabled() {
+		if conf.TLS.ClientCAFile != "" {
+			return errors.New("ClientCAFile needs CertFile and KeyFile")
+		}
+		return nil
+	}
+	p, err := ParseTLSPolicy(conf.TLS)
+	if err != nil {
+		return err
+	}
+	policy = p
+	if conf.TLS.ClientCAFile != "" {
+		pool, err := LoadClientCAs(conf.TLS.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = pool
+	}
+	if _, err := os.Stat(conf.TLS.CertFile); os.IsNotExist(err) && conf.ACME.Enabled() {
+		logger.Warn("No certificate in %s yet, TLS handshakes fail until ACME provides one", conf.TLS.CertFile)
+		return nil
+	}
+	_, err = certs.GetCertificate(nil)
+	return err
+}
+
+func CertIdentity(cert *x509.Certificate) string {
+	subject := cert.Subject.String()
+	if id, ok := conf.TLS.ClientIdentities[subject]; ok {
+		return id
+	}
+	return subject
+}
+
+type ClientCertAuth struct{}
+
+func (ClientCertAuth) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", &AuthError{Status: http.StatusUnauthorized}
+	}
+	id := CertIdentity(r.TLS.VerifiedChains[0][0])
+	RequestLog(r).Info("Client certificate identity %s", id)
+	return id, nil
+}
+
+func Serve(l net.Listener, handler http.Handler) error {
+	if conf.TLS.Enabled() {
+		l = tls.NewListener(l, ServerTLSConfig())
+	}
+	return http.Serve(l, handler)
+}
+
+func ListenAndServe(addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return Serve(l, handler)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SCOPE_UPLOAD   = "upload"
+	SCOPE_DOWNLOAD = "download"
+	SCOPE_ADMIN    = "admin"
+	TOKEN_PREFIX   = "nh_"
+)
+
+var groupScopes = map[string]string{
+	"sender":      SCOPE_UPLOAD,
+	"receiver":    SCOPE_DOWNLOAD,
+	"diagnostics": SCOPE_UPLOAD,
+	"presign":     SCOPE_UPLOAD,
+	"admin":       SCOPE_ADMIN,
+}
+
+func GroupScope(group string) string {
+	if scope, ok := groupScopes[group]; ok {
+		return scope
+	}
+	return SCOPE_ADMIN
+}
+
+type APIToken struct {
+	ID      string
+	Label   string
+	Scopes  []string
+	Hash    string
+	Created time.Time
+	Expires time.Time
+	Revoked time.Time
+}
+
+func (t *APIToken) Valid() bool {
+	return t.Revoked.IsZero() && (t.Expires.IsZero() || clock.Now().Before(t.Expires))
+}
+
+func (t *APIToken) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenView struct {
+	ID      string
+	Label   string
+	Scopes  []string
+	Created time.Time
+	Expires time.Time `json:",omitempty"`
+	Revoked time.Time `json:",omitempty"`
+	Secret  string    `json:",omitempty"`
+}
+
+func (t *APIToken) view() tokenView {
+	return tokenView{t.ID, t.Label, t.Scopes, t.Created, t.Expires, t.Revoked, ""}
+}
+
+var (
+	apiTokens      = map[string]*APIToken{}
+	apiTokensLock  sync.Mutex
+	bootstrapToken string
+)
+
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func LoadTokens() error {
+	if conf.TokensFile == "" {
+		return nil
+	}
+	list := []*APIToken{}
+	if err := LoadJSON(conf.TokensFile, &list); err != nil {
+		return err
+	}
+	apiTokensLock.Lock()
+	defer apiTokensLock.Unlock()
+	for _, t := range list {
+		apiTokens[t.ID] = t
+	}
+	if len(conf.AuthTokens) == 0 && !hasAdminToken() {
+		bootstrapToken = TOKEN_PREFIX + "bootstrap_" + randomHex(16)
+		fmt.Printf("No admin token exists yet. Create one with POST /admin/tokens using this one-time bootstrap token:\n%s\n", bootstrapToken)
+		logger.Info("Issued a bootstrap admin token")
+	}
+	return nil
+}
+
+func hasAdminToken() bool {
+	for _, t := range apiTokens {
+		if t.Valid() && t.Allows(SCOPE_ADMIN) {
+			return true
+		}
+	}
+	return false
+}
+
+func saveTokens() {
+	if conf.TokensFile == "" {
+		return
+	}
+	list := []*APIToken{}
+	for _, t := range apiTokens {
+		list = append(list, t)
+	}
+	if err := SaveJSON(conf.TokensFile, list); err != nil {
+		logger.Error("Save tokens: %s", err)
+	}
+}
+
+func LookupToken(secret string) (*APIToken, bool) {
+	if !strings.HasPrefix(secret, TOKEN_PREFIX) {
+		return nil, false
+	}
+	apiTokensLock.Lock()
+	defer apiTokensLock.Unlock()
+	if bootstrapToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(bootstrapToken)) == 1 {
+		return &APIToken{ID: "bootstrap", Label: "bootstrap", Scopes: []string{SCOPE_ADMIN}}, true
+	}
+	id := strings.SplitN(strings.TrimPrefix(secret, TOKEN_PREFIX), "_", 2)[0]
+	t, ok := apiTokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(t.Hash)) != 1 {
+		return nil, false
+	}
+	return t, true
+}
+
+func CreateToken(label string, scopes []string, expires time.Time) (*APIToken, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		if s != SCOPE_UPLOAD && s != SCOPE_DOWNLOAD && s != SCOPE_ADMIN {
+			return nil, "", fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	id := randomHex(6)
+	secret := TOKEN_PREFIX + id + "_" + randomHex(24)
+	t := &APIToken{
+		ID:      id,
+		Label:   label,
+		Scopes:  scopes,
+		Hash:    hashToken(secret),
+		Created: clock.Now(),
+		Expires: expires,
+	}
+	apiTokensLock.Lock()
+	defer apiTokensLock.Unlock()
+	apiTokens[id] = t
+	if t.Allows(SCOPE_ADMIN) && bootstrapToken != "" {
+		bootstrapToken = ""
+		logger.Info("Bootstrap token retired by admin token %s", id)
+	}
+	saveTokens()
+	return t, secret, nil
+}
+
+func RevokeToken(id string) bool {
+	apiTokensLock.Lock()
+	defer apiTokensLock.Unlock()
+	t, ok := apiTokens[id]
+	if !ok {
+		return false
+	}
+	if t.Revoked.IsZero() {
+		t.Revoked = clock.Now()
+		saveTokens()
+	}
+	return true
+}
+
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	apiTokensLock.Lock()
+	list := []tokenView{}
+	for _, t := range apiTokens {
+		list = append(list, t.view())
+	}
+	apiTokensLock.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(list)
+}
+
+func CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label        string
+		Scopes       []string
+		ExpiresHours int
+	}
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	if err := jdec.Decode(&req); err != nil {
+		Error(w, r, "invalid token request", http.StatusBadRequest)
+		return
+	}
+	var expires time.Time
+	if req.ExpiresHours > 0 {
+		expires = clock.Now().Add(time.Hour * time.Duration(req.ExpiresHours))
+	}
+	t, secret, err := CreateToken(req.Label, req.Scopes, expires)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	RequestLog(r).Info("%s created token %s (%s) with scopes %s", Principal(r), t.ID, t.Label, strings.Join(t.Scopes, ","))
+	view := t.view()
+	view.Secret = secret
+	w.Header().Set("Content-Type", "text/javascript")
+	w.WriteHeader(http.StatusCreated)
+	jenc := json.NewEncoder(w)
+	jenc.Encode(view)
+}
+
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["tid"]
+
+	if !RevokeToken(id) {
+		Error(w, r, "token not found", http.StatusNotFound)
+		return
+	}
+	RequestLog(r).Info("%s revoked token %s", Principal(r), id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+)
+
+const (
+	TRAILER_SHA256 = "X-Content-SHA256"
+	TRAILER_STATUS = "X-Transfer-Status"
+)
+
+// TrailerWriter announces and fills the trailers of a streamed archive.
+// Trailers only reach clients over chunked HTTP/1.1 or HTTP/2, and some
+// proxies drop them, so a missing X-Transfer-Status means "unknown", never
+// "complete".
+type TrailerWriter struct {
+	http.ResponseWriter
+	h hash.Hash
+	n int64
+}
+
+func NewTrailerWriter(w http.ResponseWriter) *TrailerWriter {
+	w.Header().Set("Trailer", TRAILER_SHA256+", "+TRAILER_STATUS)
+	return &TrailerWriter{w, sha256.New(), 0}
+}
+
+func (t *TrailerWriter) Write(p []byte) (int, error) {
+	n, err := t.ResponseWriter.Write(p)
+	t.h.Write(p[:n])
+	t.n += int64(n)
+	return n, err
+}
+
+func (t *TrailerWriter) Written() int64 {
+	return t.n
+}
+
+func (t *TrailerWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *TrailerWriter) Finish(failure error) {
+	t.Header().Set(TRAILER_SHA256, hex.EncodeToString(t.h.Sum(nil)))
+	if failure != nil {
+		t.Header().Set(TRAILER_STATUS, "failed: "+failure.Error())
+		return
+	}
+	t.Header().Set(TRAILER_STATUS, "complete")
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TUNNEL_PROTOCOL      = "nethermes-tunnel"
+	TUNNEL_POOL_SIZE     = 64
+	TUNNEL_WAIT_SECONDS  = 10
+	TUNNEL_CLIENT_HEADER = "X-Tunnel-Client"
+	TUNNEL_PROTO_HEADER  = "X-Tunnel-Proto"
+)
+
+var (
+	tunnelPools = map[string]chan *tunnelConn{}
+
+	ErrTunnelOffline = errors.New("the server behind this address is not connected")
+)
+
+type TunnelConfig struct {
+	Relay           string
+	Name            string
+	Secret          string
+	IdleConnections int
+	Endpoints       []TunnelEndpoint
+}
+
+type TunnelEndpoint struct {
+	Name   string
+	Secret string
+	Host   string
+}
+
+type tunnelConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *tunnelConn) alive() bool {
+	c.SetReadDeadline(clock.Now().Add(time.Millisecond))
+	_, err := c.r.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func CheckTunnelConfig() error {
+	t := conf.Tunnel
+	if t.Relay != "" {
+		u, err := url.Parse(t.Relay)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid relay URL %q", t.Relay)
+		}
+		if t.Name == "" || t.Secret == "" {
+			return errors.New("a tunnel to a relay needs Name and Secret")
+		}
+		if t.IdleConnections < 1 {
+			return errors.New("IdleConnections must be at least 1")
+		}
+	}
+	hosts := map[string]bool{}
+	for _, e := range t.Endpoints {
+		if e.Name == "" || e.Secret == "" || e.Host == "" {
+			return errors.New("tunnel endpoints need Name, Secret and Host")
+		}
+		host := strings.ToLower(e.Host)
+		if hosts[host] {
+			return fmt.Errorf("host %s is used by two tunnel endpoints", e.Host)
+		}
+		hosts[host] = true
+		tunnelPools[e.Name] = make(chan *tunnelConn, TUNNEL_POOL_SIZE)
+	}
+	return nil
+}
+
+func tunnelEndpoint(name, secret string) (TunnelEndpoint, bool) {
+	for _, e := range conf.Tunnel.Endpoints {
+		if e.Name == name && subtle.ConstantTimeCompare([]byte(secret), []byte(e.Secret)) == 1 {
+			return e, true
+		}
+	}
+	return TunnelEndpoint{}, false
+}
+
+func TunnelConnectHandler(w http.ResponseWriter, r *http.Request) {
+	e, ok := tunnelEndpoint(r.Header.Get("X-Tunnel-Name"), r.Header.Get("X-Tunnel-Secret"))
+	if !ok {
+		RequestLog(r).Info("Rejected tunnel connection from %s", r.RemoteAddr)
+		Error(w, r, "unknown tunnel or wrong secret", http.StatusForbidden)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), TUNNEL_PROTOCOL) {
+		Error(w, r, "tunnel connections must upgrade to "+TUNNEL_PROTOCOL, http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		Error(w, r, "connection cannot be taken over", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		RequestLog(r).Error("Hijack tunnel connection: %s", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + TUNNEL_PROTOCOL + "\r\nConnection: Upgrade\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case tunnelPools[e.Name] <- &tunnelConn{conn, rw.Reader}:
+	default:
+		RequestLog(r).Info("Tunnel %s has %d idle connections, closing one more", e.Name, TUNNEL_POOL_SIZE)
+		conn.Close()
+	}
+}
+
+func takeTunnelConn(name string) (*tunnelConn, error) {
+	pool := tunnelPools[name]
+	timeout := clock.NewTimer(time.Second * TUNNEL_WAIT_SECONDS)
+	defer timeout.Stop()
+	for {
+		select {
+		case c := <-pool:
+			if c.alive() {
+				return c, nil
+			}
+			c.Close()
+		case <-timeout.C():
+			return nil, ErrTunnelOffline
+		}
+	}
+}
+
+func tunnelFor(host string) (TunnelEndpoint, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, e := range conf.Tunnel.Endpoints {
+		if strings.EqualFold(e.Host, host) {
+			return e, true
+		}
+	}
+	return TunnelEndpoint{}, false
+}
+
+func Tunnels(handler http.Handler) http.Handler {
+	if len(conf.Tunnel.Endpoints) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := tunnelFor(r.Host)
+		if !ok || r.URL.Path == "/tunnel/connect" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ForwardTunnel(w, r, e)
+	})
+}
+
+func ForwardTunnel(w http.ResponseWriter, r *http.Request, e TunnelEndpoint) {
+	conn, err := takeTunnelConn(e.Name)
+	if err != nil {
+		RequestLog(r).Info("Tunnel %s: %s", e.Name, err)
+		Error(w, r, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Close = true
+	out.Header.Del("Expect")
+	out.Header.Set(TUNNEL_CLIENT_HEADER, r.RemoteAddr)
+	out.Header.Del(TUNNEL_PROTO_HEADER)
+	if r.TLS != nil {
+		out.Header.Set(TUNNEL_PROTO_HEADER, "https")
+	}
+	go func() {
+		if err := out.Write(conn); err != nil {
+			conn.Close()
+		}
+	}()
+	resp, err := http.ReadResponse(conn.r, out)
+	if err != nil {
+		RequestLog(r).Error("Tunnel %s: read response: %s", e.Name, err)
+		Error(w, r, "the server behind this address did not answer", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Connection")
+	w.Header().Del("Transfer-Encoding")
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			RequestLog(r).Info("Tunnel %s: response cut off: %s", e.Name, err)
+			return
+		}
+	}
+	for k, v := range resp.Trailer {
+		w.Header()[k] = v
+	}
+}
+
+type TunnelListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewTunnelListener() *TunnelListener {
+	l := &TunnelListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	for i := 0; i < conf.Tunnel.IdleConnections; i++ {
+		go l.dialLoop()
+	}
+	return l
+}
+
+func (l *TunnelListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("tunnel listener closed")
+	}
+}
+
+func (l *TunnelListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *TunnelListener) Addr() net.Addr {
+	return tunnelAddr(conf.Tunnel.Relay)
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+func dialRelay() (*tunnelConn, error) {
+	u, err := url.Parse(conf.Tunnel.Relay)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if u.Scheme == "https" {
+		if u.Port() == "" {
+			host += ":443"
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		if u.Port() == "" {
+			host += ":80"
+		}
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequest("GET", strings.TrimRight(conf.Tunnel.Relay, "/")+"/tunnel/connect", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", TUNNEL_PROTOCOL)
+	req.Header.Set("X-Tunnel-Name", conf.Tunnel.Name)
+	req.Header.Set("X-Tunnel-Secret", conf.Tunnel.Secret)
+	conn.SetDeadline(clock.Now().Add(30 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errors.New("relay responded " + resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &tunnelConn{conn, br}, nil
+}
+
+func (l *TunnelListener) dialLoop() {
+	backoff := time.Second
+	for {
+		select {
+		case <-l.closed:
+			return
+		default:
+		}
+		c, err := dialRelay()
+		if err != nil {
+			logger.Error("Tunnel to %s: %s", conf.Tunnel.Relay, err)
+			Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		if _, err := c.r.Peek(1); err != nil {
+			c.Close()
+			continue
+		}
+		select {
+		case l.conns <- c:
+		case <-l.closed:
+			c.Close()
+			return
+		}
+	}
+}
+
+func FromTunnel(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client := r.Header.Get(TUNNEL_CLIENT_HEADER); client != "" {
+			r.RemoteAddr = client
+		}
+		if r.Header.Get(TUNNEL_PROTO_HEADER) == "https" {
+			r.TLS = &tls.ConnectionState{}
+		}
+		r.Header.Del(TUNNEL_CLIENT_HEADER)
+		r.Header.Del(TUNNEL_PROTO_HEADER)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func ServeTunnel() {
+	logger.Info("Serving through the relay %s as %s", conf.Tunnel.Relay, conf.Tunnel.Name)
+	err := http.Serve(NewTunnelListener(), FromTunnel(Identify(Routes(true, true))))
+	logger.Critical("Tunnel: %s", err)
+	os.Exit(1)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ANOMALY_TRAVERSAL = "traversal"
+	ANOMALY_HEADERS   = "oversized headers"
+	ANOMALY_KEY       = "invalid key"
+)
+
+var (
+	traversalProbes = []string{"../", "..\\", "/..", "%2e%2e", "%252e", "..%2f", "..%5c", "%00"}
+
+	wafHits      = map[string][]time.Time{}
+	wafBans      = map[string]time.Time{}
+	wafAnomalies = map[string]int64{}
+	wafRejected  int64
+	wafLock      sync.Mutex
+)
+
+// WAFConfig enables heuristics against scanners. Requests that probe for
+// path traversal or carry more than MaxHeaderBytes of headers are refused,
+// and an address that triggers Threshold anomalies, invalid keys included,
+// within WindowMinutes is banned for BanMinutes.
+type WAFConfig struct {
+	Enabled        bool
+	MaxHeaderBytes int
+	Threshold      int
+	WindowMinutes  int
+	BanMinutes     int
+}
+
+func CheckWAFConfig() error {
+	if !conf.WAF.Enabled {
+		return nil
+	}
+	if conf.WAF.MaxHeaderBytes < 1024 {
+		return errors.New("MaxHeaderBytes must be at least 1024")
+	}
+	if conf.WAF.Threshold <= 0 || conf.WAF.WindowMinutes <= 0 || conf.WAF.BanMinutes <= 0 {
+		return errors.New("Threshold, WindowMinutes and BanMinutes must be positive")
+	}
+	return nil
+}
+
+func Banned(ip string) (time.Time, bool) {
+	wafLock.Lock()
+	defer wafLock.Unlock()
+	until, ok := wafBans[ip]
+	return until, ok && clock.Now().Before(until)
+}
+
+// Anomaly counts a suspicious request from ip and bans the address once
+// it reaches the threshold. Clients without an IP address, such as those
+// on a Unix socket, are never counted.
+func Anomaly(ip, kind string) {
+	if !conf.WAF.Enabled || net.ParseIP(ip) == nil {
+		return
+	}
+	now := clock.Now()
+	window := time.Duration(conf.WAF.WindowMinutes) * time.Minute
+	wafLock.Lock()
+	defer wafLock.Unlock()
+	wafAnomalies[kind]++
+	hits := []time.Time{now}
+	for _, t := range wafHits[ip] {
+		if now.Sub(t) < window {
+			hits = append(hits, t)
+		}
+	}
+	if len(hits) < conf.WAF.Threshold {
+		wafHits[ip] = hits
+		return
+	}
+	delete(wafHits, ip)
+	wafBans[ip] = now.Add(time.Duration(conf.WAF.BanMinutes) * time.Minute)
+	logger.Warn("Banned %s for %d minutes after %d anomalies, last: %s", ip, conf.WAF.BanMinutes, len(hits), kind)
+}
+
+func headerBytes(r *http.Request) int {
+	n := len(r.RequestURI)
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+func traversalProbe(r *http.Request) bool {
+	uri := strings.ToLower(r.RequestURI)
+	for _, p := range traversalProbes {
+		if strings.Contains(uri, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func Firewall(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !conf.WAF.Enabled || ClientIP(r) == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ip := ClientIP(r).String()
+		if until, banned := Banned(ip); banned {
+			wafLock.Lock()
+			wafRejected++
+			wafLock.Unlock()
+			w.Header().Set("Retry-After", strconv.Itoa(int(Until(until).Seconds())+1))
+			Error(w, r, "your address is temporarily banned", http.StatusForbidden)
+			return
+		}
+		if traversalProbe(r) {
+			RequestLog(r).Info("Rejected path traversal probe from %s: %s", ip, r.RequestURI)
+			Anomaly(ip, ANOMALY_TRAVERSAL)
+			Error(w, r, "bad request", http.StatusBadRequest)
+			return
+		}
+		if headerBytes(r) > conf.WAF.MaxHeaderBytes {
+			RequestLog(r).Info("Rejected %d bytes of headers from %s", headerBytes(r), ip)
+			Anomaly(ip, ANOMALY_HEADERS)
+			Error(w, r, "request headers too large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func CleanWAF() {
+	now := clock.Now()
+	window := time.Duration(conf.WAF.WindowMinutes) * time.Minute
+	wafLock.Lock()
+	defer wafLock.Unlock()
+	for ip, until := range wafBans {
+		if now.After(until) {
+			delete(wafBans, ip)
+		}
+	}
+	for ip, hits := range wafHits {
+		if len(hits) == 0 || now.Sub(hits[0]) >= window {
+			delete(wafHits, ip)
+		}
+	}
+}
+
+func WriteWAFMetrics(w io.Writer) {
+	wafLock.Lock()
+	defer wafLock.Unlock()
+	for _, kind := range []string{ANOMALY_TRAVERSAL, ANOMALY_HEADERS, ANOMALY_KEY} {
+		fmt.Fprintf(w, "nethermes_waf_anomalies_total{kind=%q} %d\n", kind, wafAnomalies[kind])
+	}
+	fmt.Fprintf(w, "nethermes_waf_rejected_total %d\n", wafRejected)
+	fmt.Fprintf(w, "nethermes_waf_bans %d\n", len(wafBans))
+}
+
+func BansHandler(w http.ResponseWriter, r *http.Request) {
+	bans := map[string]time.Time{}
+	now := clock.Now()
+	wafLock.Lock()
+	for ip, until := range wafBans {
+		if now.Before(until) {
+			bans[ip] = until
+		}
+	}
+	wafLock.Unlock()
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(bans)
+}
+
+func UnbanHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ip := net.ParseIP(vars["ip"])
+	if ip == nil {
+		Error(w, r, "invalid address", http.StatusBadRequest)
+		return
+	}
+	wafLock.Lock()
+	_, ok := wafBans[ip.String()]
+	delete(wafBans, ip.String())
+	delete(wafHits, ip.String())
+	wafLock.Unlock()
+	if !ok {
+		Error(w, r, "address is not banned", http.StatusNotFound)
+		return
+	}
+	Audit(r, "address unbanned", ip.String(), "")
+	w.WriteHeader(http.StatusNoContent)
+}
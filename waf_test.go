@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func enableWAF(t *testing.T) *SimClock {
+	sim := simulate(t)
+	saved := conf.WAF
+	conf.WAF = WAFConfig{Enabled: true, MaxHeaderBytes: 4096, Threshold: 3, WindowMinutes: 10, BanMinutes: 60}
+	t.Cleanup(func() {
+		conf.WAF = saved
+		wafLock.Lock()
+		wafHits, wafBans = map[string][]time.Time{}, map[string]time.Time{}
+		wafLock.Unlock()
+	})
+	return sim
+}
+
+func TestWAFBanThreshold(t *testing.T) {
+	sim := enableWAF(t)
+	ip := "198.51.100.7"
+	Anomaly(ip, ANOMALY_KEY)
+	sim.Advance(11 * time.Minute)
+	Anomaly(ip, ANOMALY_KEY)
+	Anomaly(ip, ANOMALY_KEY)
+	if _, banned := Banned(ip); banned {
+		t.Fatal("banned for anomalies spread over more than the window")
+	}
+	Anomaly(ip, ANOMALY_TRAVERSAL)
+	until, banned := Banned(ip)
+	if !banned {
+		t.Fatal("not banned after reaching the threshold")
+	}
+	if want := sim.Now().Add(time.Hour); !until.Equal(want) {
+		t.Errorf("banned until %s, want %s", until, want)
+	}
+	if _, banned := Banned("198.51.100.8"); banned {
+		t.Error("ban leaked to another address")
+	}
+}
+
+func TestWAFBanExpiry(t *testing.T) {
+	sim := enableWAF(t)
+	ip := "198.51.100.9"
+	for i := 0; i < conf.WAF.Threshold; i++ {
+		Anomaly(ip, ANOMALY_KEY)
+	}
+	handler := Firewall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":4242"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve(); rec.Code != http.StatusForbidden || rec.Header().Get("Retry-After") != "3601" {
+		t.Fatalf("banned request: %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	sim.Advance(time.Hour + time.Second)
+	if rec := serve(); rec.Code != http.StatusOK {
+		t.Fatalf("request after the ban expired: %d", rec.Code)
+	}
+	CleanWAF()
+	wafLock.Lock()
+	_, kept := wafBans[ip]
+	wafLock.Unlock()
+	if kept {
+		t.Error("CleanWAF kept an expired ban")
+	}
+}
+
+func TestWAFSkipsUnixSockets(t *testing.T) {
+	enableWAF(t)
+	handler := Firewall(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i <= conf.WAF.Threshold; i++ {
+		req := httptest.NewRequest("GET", "/download/..%2f..%2fetc", nil)
+		req.RemoteAddr = "@"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d over a Unix socket: %d", i, rec.Code)
+		}
+	}
+	Anomaly(ClientIP(&http.Request{RemoteAddr: "@"}).String(), ANOMALY_KEY)
+	wafLock.Lock()
+	n := len(wafHits) + len(wafBans)
+	wafLock.Unlock()
+	if n != 0 {
+		t.Errorf("counted anomalies for a client without an address")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SUMMARY_INTERVAL = 7 * 24 * time.Hour
+	MIN_STREAM_BYTES = 1024 * 1024
+	GB               = 1024 * 1024 * 1024
+)
+
+var (
+	waitBuckets   = []float64{5, 15, 30, 60, 120, 180, 300, 600, 1800, 3600}
+	streamBuckets = []float64{5, 10, 30, 60, 120, 300, 600, 1800, 3600, 7200}
+
+	waitStats = NewWaitStats()
+)
+
+var outcomeKinds = map[string]bool{
+	"completed":  true,
+	"expired":    true,
+	"cancelled":  true,
+	"aborted":    true,
+	"failed":     true,
+	"corrupted":  true,
+	"moved":      true,
+	"evicted":    true,
+	"incomplete": true,
+}
+
+type Histogram struct {
+	Bounds []float64
+	Counts []int64
+	Sum    float64
+	Count  int64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.Count)))
+	seen := int64(0)
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= rank {
+			if i == len(h.Bounds) {
+				return math.Inf(1)
+			}
+			return h.Bounds[i]
+		}
+	}
+	return math.Inf(1)
+}
+
+func (h *Histogram) WriteProm(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	seen := int64(0)
+	for i, bound := range h.Bounds {
+		seen += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, bound, seen)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.Count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %f\n", name, labels, h.Sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+type waitWindow struct {
+	Since    time.Time
+	Wait     map[string]*Histogram
+	Stream   *Histogram
+	Outcomes map[string]int64
+}
+
+func newWaitWindow() *waitWindow {
+	return &waitWindow{
+		Since:    clock.Now(),
+		Wait:     map[string]*Histogram{},
+		Stream:   NewHistogram(streamBuckets),
+		Outcomes: map[string]int64{},
+	}
+}
+
+func (ww *waitWindow) observe(outcome string, wait float64, connected bool, perGB float64) {
+	label := outcome
+	if connected {
+		label = "connected"
+	}
+	h, ok := ww.Wait[label]
+	if !ok {
+		h = NewHistogram(waitBuckets)
+		ww.Wait[label] = h
+	}
+	h.Observe(wait)
+	if perGB > 0 {
+		ww.Stream.Observe(perGB)
+	}
+	ww.Outcomes[outcome]++
+}
+
+func (ww *waitWindow) timeoutRatio() float64 {
+	total := int64(0)
+	for _, n := range ww.Outcomes {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(ww.Outcomes["expired"]) / float64(total)
+}
+
+type WaitStats struct {
+	sync.Mutex
+	total  *waitWindow
+	weekly *waitWindow
+}
+
+func NewWaitStats() *WaitStats {
+	return &WaitStats{total: newWaitWindow(), weekly: newWaitWindow()}
+}
+
+func (s *WaitStats) Observe(tl *Timeline) {
+	var created, connected, finished time.Time
+	var streamed int64
+	outcome := ""
+	for _, ev := range tl.Events() {
+		switch {
+		case ev.Kind == "created" && created.IsZero():
+			created = ev.Time
+		case ev.Kind == "receiver connected" && connected.IsZero():
+			connected = ev.Time
+		case outcomeKinds[ev.Kind] && outcome == "":
+			outcome = ev.Kind
+			finished = ev.Time
+			streamed = ev.Bytes
+		}
+	}
+	if created.IsZero() || outcome == "" {
+		return
+	}
+	end := finished
+	if !connected.IsZero() {
+		end = connected
+	}
+	wait := end.Sub(created).Seconds()
+	perGB := 0.0
+	if outcome == "completed" && !connected.IsZero() && streamed >= MIN_STREAM_BYTES {
+		perGB = finished.Sub(connected).Seconds() / (float64(streamed) / GB)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.total.observe(outcome, wait, !connected.IsZero(), perGB)
+	s.weekly.observe(outcome, wait, !connected.IsZero(), perGB)
+}
+
+func (s *WaitStats) WriteMetrics(w io.Writer) {
+	s.Lock()
+	defer s.Unlock()
+	labels := []string{}
+	for label := range s.total.Wait {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(w, "# TYPE nethermes_wait_seconds histogram\n")
+	for _, label := range labels {
+		s.total.Wait[label].WriteProm(w, "nethermes_wait_seconds", fmt.Sprintf("status=%q", label))
+	}
+	fmt.Fprintf(w, "# TYPE nethermes_stream_seconds_per_gb histogram\n")
+	s.total.Stream.WriteProm(w, "nethermes_stream_seconds_per_gb", "")
+	outcomes := []string{}
+	for outcome := range s.total.Outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		fmt.Fprintf(w, "nethermes_transfer_outcomes_total{status=%q} %d\n", outcome, s.total.Outcomes[outcome])
+	}
+	fmt.Fprintf(w, "nethermes_timeout_ratio %f\n", s.total.timeoutRatio())
+}
+
+func (s *WaitStats) Summary() string {
+	ww := s.weekly
+	connected := ww.Wait["connected"]
+	if connected == nil {
+		connected = NewHistogram(waitBuckets)
+	}
+	parts := []string{}
+	for outcome, n := range ww.Outcomes {
+		parts = append(parts, fmt.Sprintf("%s=%d", outcome, n))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("Wait summary since %s: %s; timeout ratio %.1f%% with a %d minute timeout; receivers connected within p50 %gs, p90 %gs, p99 %gs; streaming took p50 %gs per GB",
+		ww.Since.Format("2006-01-02"), strings.Join(parts, " "), ww.timeoutRatio()*100, conf.TimeoutMinutes,
+		connected.Quantile(0.5), connected.Quantile(0.9), connected.Quantile(0.99), ww.Stream.Quantile(0.5))
+}
+
+func LogWaitSummary() {
+	waitStats.Lock()
+	defer waitStats.Unlock()
+	if clock.Now().Sub(waitStats.weekly.Since) < SUMMARY_INTERVAL {
+		return
+	}
+	logger.Info("%s", waitStats.Summary())
+	waitStats.weekly = newWaitWindow()
+}
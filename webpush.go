@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	WEBPUSH_TTL         = 86400
+	WEBPUSH_RECORD_SIZE = 4096
+	MAX_SUBSCRIPTIONS   = 5
+)
+
+type WebPushConfig struct {
+	Enabled bool
+	Subject string
+	KeyFile string
+}
+
+type PushSubscription struct {
+	Endpoint string
+	Keys     struct {
+		P256dh string
+		Auth   string
+	}
+}
+
+type WebPushMessage struct {
+	Title string
+	Body  string
+	Key   string
+	Event string
+}
+
+type vapidKeys struct {
+	PrivateKey string
+	PublicKey  string
+}
+
+var (
+	vapidKey      *ecdsa.PrivateKey
+	vapidPublic   string
+	subscriptions = map[string][]PushSubscription{}
+	watchers      = map[string]bool{}
+	webPushLock   sync.Mutex
+
+	b64 = base64.RawURLEncoding
+)
+
+func LoadVAPIDKeys() error {
+	if !conf.WebPush.Enabled {
+		return nil
+	}
+	keys := vapidKeys{}
+	if err := LoadJSON(conf.WebPush.KeyFile, &keys); err != nil {
+		return err
+	}
+	if keys.PrivateKey == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		priv, err := key.ECDH()
+		if err != nil {
+			return err
+		}
+		keys.PrivateKey = b64.EncodeToString(priv.Bytes())
+		keys.PublicKey = b64.EncodeToString(priv.PublicKey().Bytes())
+		if err := SaveJSON(conf.WebPush.KeyFile, keys); err != nil {
+			return err
+		}
+		logger.Info("Generated VAPID keys in %s", conf.WebPush.KeyFile)
+	}
+	raw, err := b64.DecodeString(keys.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid VAPID private key: %s", err)
+	}
+	priv, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return fmt.Errorf("invalid VAPID private key: %s", err)
+	}
+	pub := priv.PublicKey().Bytes()
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	vapidKey = &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+		D:         new(big.Int).SetBytes(raw),
+	}
+	vapidPublic = b64.EncodeToString(pub)
+	return nil
+}
+
+func vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": clock.Now().Add(12 * time.Hour).Unix(),
+		"sub": conf.WebPush.Subject,
+	})
+	signed := header + "." + b64.EncodeToString(claims)
+	h := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, vapidKey, h[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return "vapid t=" + signed + "." + b64.EncodeToString(sig) + ", k=" + vapidPublic, nil
+}
+
+func EncryptWebPush(sub PushSubscription, payload []byte) ([]byte, error) {
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWebPush(sub, payload, asPrivate, salt)
+}
+
+func encryptWebPush(sub PushSubscription, payload []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaRaw, err := b64.DecodeString(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := b64.DecodeString(sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaRaw)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asRaw := asPrivate.PublicKey().Bytes()
+
+	info := append(append([]byte("WebPush: info\x00"), uaRaw...), asRaw...)
+	ikm, err := hkdf.Key(sha256.New, shared, auth, string(info), 32)
+	if err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(salt)
+	binary.Write(&out, binary.BigEndian, uint32(WEBPUSH_RECORD_SIZE))
+	out.WriteByte(byte(len(asRaw)))
+	out.Write(asRaw)
+	out.Write(gcm.Seal(nil, nonce, append(payload, 2), nil))
+	return out.Bytes(), nil
+}
+
+func SendWebPush(sub PushSubscription, msg WebPushMessage) (gone bool, err error) {
+	payload, _ := json.Marshal(msg)
+	body, err := EncryptWebPush(sub, payload)
+	if err != nil {
+		return true, err
+	}
+	authorization, err := vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return true, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(WEBPUSH_TTL))
+	req.Header.Set("Authorization", authorization)
+	resp, err := fetchClient("webpush").Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return true, fmt.Errorf("subscription expired (%d)", resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return false, fmt.Errorf("push service responded %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+func NotifyWebPush(id string, msg WebPushMessage) {
+	if vapidKey == nil {
+		return
+	}
+	webPushLock.Lock()
+	subs := subscriptions[id]
+	webPushLock.Unlock()
+	for _, sub := range subs {
+		gone, err := SendWebPush(sub, msg)
+		if err == nil {
+			continue
+		}
+		logger.Error("Web push for %s: %s", id, err)
+		if gone {
+			webPushLock.Lock()
+			list := []PushSubscription{}
+			for _, s := range subscriptions[id] {
+				if s.Endpoint != sub.Endpoint {
+					list = append(list, s)
+				}
+			}
+			subscriptions[id] = list
+			webPushLock.Unlock()
+		}
+	}
+}
+
+func DropWebPush(id string) {
+	webPushLock.Lock()
+	defer webPushLock.Unlock()
+	delete(subscriptions, id)
+}
+
+func pushDeadline(id string) (time.Time, bool) {
+	if transfer, ok := GetTransfer(id); ok {
+		return transfer.Deadline(), transfer.CurrentStatus() == WAITING_RECEIVER
+	}
+	groupsLock.Lock()
+	group, ok := groups[id]
+	groupsLock.Unlock()
+	if !ok {
+		return time.Time{}, false
+	}
+	group.Lock()
+	defer group.Unlock()
+	return group.Expires, group.Status == WAITING_RECEIVER
+}
+
+func watchExpiring(id string) {
+	defer func() {
+		webPushLock.Lock()
+		delete(watchers, id)
+		webPushLock.Unlock()
+	}()
+	var warned time.Time
+	for {
+		deadline, waiting := pushDeadline(id)
+		if !waiting {
+			return
+		}
+		left := Until(deadline)
+		if left <= 0 {
+			return
+		}
+		if left > ExpiryWindow() {
+			Sleep(left - ExpiryWindow())
+			continue
+		}
+		if !warned.Equal(deadline) {
+			warned = deadline
+			NotifyWebPush(id, WebPushMessage{
+				conf.Branding.SiteName,
+				fmt.Sprintf("No receiver yet, %s expires in %d seconds.", id, int(left.Seconds())),
+				id,
+				"expiring",
+			})
+		}
+		Sleep(time.Second * 5)
+	}
+}
+
+func WebPushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if vapidKey == nil {
+		Error(w, r, "web push is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript")
+	jenc := json.NewEncoder(w)
+	jenc.Encode(vapidPublic)
+}
+
+func WebPushSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if vapidKey == nil {
+		Error(w, r, "web push is disabled", http.StatusNotFound)
+		return
+	}
+	secret := r.Header.Get("X-Sender-Secret")
+	if !CheckSecret(id, secret) {
+		Error(w, r, "wrong sender secret", http.StatusForbidden)
+		return
+	}
+	var sub PushSubscription
+	jdec := json.NewDecoder(io.LimitReader(r.Body, 16*1024))
+	if err := jdec.Decode(&sub); err != nil {
+		Error(w, r, "invalid subscription", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		Error(w, r, "invalid subscription endpoint", http.StatusBadRequest)
+		return
+	}
+	if raw, err := b64.DecodeString(sub.Keys.P256dh); err != nil || len(raw) != 65 {
+		Error(w, r, "invalid subscription key", http.StatusBadRequest)
+		return
+	}
+	if raw, err := b64.DecodeString(sub.Keys.Auth); err != nil || len(raw) != 16 {
+		Error(w, r, "invalid subscription auth secret", http.StatusBadRequest)
+		return
+	}
+
+	webPushLock.Lock()
+	if len(subscriptions[id]) >= MAX_SUBSCRIPTIONS {
+		webPushLock.Unlock()
+		Error(w, r, "too many subscriptions", http.StatusBadRequest)
+		return
+	}
+	subscriptions[id] = append(subscriptions[id], sub)
+	watch := !watchers[id]
+	watchers[id] = true
+	webPushLock.Unlock()
+	if watch {
+		go watchExpiring(id)
+	}
+	RequestLog(r).Info("Web push subscription for %s at %s", id, u.Host)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// RFC 8291 Appendix A.
+func TestEncryptWebPushVector(t *testing.T) {
+	raw, _ := b64.DecodeString("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	asPrivate, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, _ := b64.DecodeString("DGv6ra1nlYgDCS1FRnbzlw")
+	sub := PushSubscription{}
+	sub.Keys.P256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	sub.Keys.Auth = "BTBZMqHH6r4Tts7J_aSIgg"
+
+	body, err := encryptWebPush(sub, []byte("When I grow up, I want to be a watermelon"), asPrivate, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := b64.EncodeToString(body); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestVAPIDAuthorization(t *testing.T) {
+	defer func(k *ecdsa.PrivateKey, p string) { vapidKey, vapidPublic = k, p }(vapidKey, vapidPublic)
+	vapidKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	vapidPublic = b64.EncodeToString(elliptic.Marshal(elliptic.P256(), vapidKey.X, vapidKey.Y))
+
+	auth, err := vapidAuthorization("https://push.example.net:8443/wpush/v2/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token, k string
+	if _, err := fmt.Sscanf(auth, "vapid t=%s k=%s", &token, &k); err != nil {
+		t.Fatalf("%s: %s", auth, err)
+	}
+	token = strings.TrimSuffix(token, ",")
+	if k != vapidPublic {
+		t.Errorf("k=%s", k)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %s", token)
+	}
+	sig, _ := b64.DecodeString(parts[2])
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(sig) != 64 || !ecdsa.Verify(&vapidKey.PublicKey, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("bad signature")
+	}
+	raw, _ := b64.DecodeString(parts[1])
+	var claims struct {
+		Aud string
+		Exp int64
+	}
+	json.Unmarshal(raw, &claims)
+	if claims.Aud != "https://push.example.net:8443" {
+		t.Errorf("aud %q", claims.Aud)
+	}
+	if d := claims.Exp - clock.Now().Unix(); d <= 0 || d > 24*3600 {
+		t.Errorf("exp is %d seconds away", d)
+	}
+}
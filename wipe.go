@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	WIPE_DELETE    = "delete"
+	WIPE_ZERO      = "zero"
+	WIPE_ENCRYPTED = "encrypted"
+	WIPE_CHUNK     = 64 * 1024
+)
+
+var wipeModes = map[string]string{
+	WIPE_DELETE:    "deleted",
+	WIPE_ZERO:      "zero-filled and deleted",
+	WIPE_ENCRYPTED: "deleted from encrypted spool",
+}
+
+type WipeResult struct {
+	Files int
+	Bytes int64
+}
+
+func CheckWipeConfig() error {
+	if _, ok := wipeModes[conf.SpoolWipe]; !ok {
+		return fmt.Errorf("unknown SpoolWipe mode %q, use delete, zero or encrypted", conf.SpoolWipe)
+	}
+	return nil
+}
+
+func zeroFill(path string, size int64) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	zeros := make([]byte, WIPE_CHUNK)
+	for left := size; left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := fd.Write(zeros[:n]); err != nil {
+			return err
+		}
+		left -= n
+	}
+	return fd.Sync()
+}
+
+func WipeFile(path string) (int64, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if conf.SpoolWipe == WIPE_ZERO && info.Mode().IsRegular() && linkCount(path, info) <= 1 {
+		if err := zeroFill(path, info.Size()); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return 0, err
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		return 0, errors.New(path + " still exists after removal")
+	}
+	return info.Size(), nil
+}
+
+func WipeDir(dir string) (WipeResult, error) {
+	var res WipeResult
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	for _, path := range files {
+		n, err := WipeFile(path)
+		if err != nil {
+			return res, err
+		}
+		res.Files++
+		res.Bytes += n
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return res, err
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		return res, errors.New(dir + " still exists after removal")
+	}
+	return res, nil
+}
+
+func AuditWipe(key, reason string, res WipeResult, err error) {
+	if err != nil {
+		logger.Error("Wipe spool of %s: %s", key, err)
+		AuditSystem("spool wipe failed", key, fmt.Sprintf("%s: %s after %d files", reason, err, res.Files))
+		return
+	}
+	AuditSystem("spool wiped", key, fmt.Sprintf("%s: %d files, %d bytes %s, verified gone", reason, res.Files, res.Bytes, wipeModes[conf.SpoolWipe]))
+}
+
+func BurnSpool(key, reason, dir string) {
+	if dir == "" {
+		return
+	}
+	res, err := WipeDir(dir)
+	if err == nil && res.Files == 0 {
+		return
+	}
+	AuditWipe(key, reason, res, err)
+}
+
+func BurnBuffer(key, reason string, buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	AuditSystem("spool wiped", key, fmt.Sprintf("%s: %d bytes zeroed in memory", reason, len(buf)))
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func linkCount(path string, info os.FileInfo) uint64 {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer fd.Close()
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(fd.Fd()), &d); err != nil {
+		return 1
+	}
+	return uint64(d.NumberOfLinks)
+}
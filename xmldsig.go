@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const (
+	XMLNS_DSIG      = "http://www.w3.org/2000/09/xmldsig#"
+	DSIG_EXC_C14N   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	DSIG_ENVELOPED  = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	DSIG_SHA256     = "http://www.w3.org/2001/04/xmlenc#sha256"
+	DSIG_RSA_SHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	DSIG_EC_SHA256  = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+)
+
+// xmlNode keeps the prefixes and namespace declarations of the document as
+// written, which encoding/xml resolves away but canonicalization needs.
+type xmlNode struct {
+	Prefix   string
+	Local    string
+	Attrs    []xml.Attr
+	NS       map[string]string
+	Parent   *xmlNode
+	Children []xmlChild
+}
+
+type xmlChild struct {
+	Node *xmlNode
+	Text string
+}
+
+func parseXML(r io.Reader) (*xmlNode, error) {
+	d := xml.NewDecoder(r)
+	var root, cur *xmlNode
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{Prefix: t.Name.Space, Local: t.Name.Local, NS: map[string]string{}, Parent: cur}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					n.NS[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.NS[""] = a.Value
+				default:
+					n.Attrs = append(n.Attrs, a)
+				}
+			}
+			if cur == nil {
+				if root != nil {
+					return nil, errors.New("more than one root element")
+				}
+				root = n
+			} else {
+				cur.Children = append(cur.Children, xmlChild{Node: n})
+			}
+			cur = n
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.Prefix || t.Name.Local != cur.Local {
+				return nil, errors.New("mismatched end element")
+			}
+			cur = cur.Parent
+		case xml.CharData:
+			if cur != nil {
+				cur.Children = append(cur.Children, xmlChild{Text: string(t)})
+			}
+		case xml.Directive:
+			return nil, errors.New("document type declarations are not allowed")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("incomplete document")
+	}
+	return root, nil
+}
+
+func (n *xmlNode) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return "http://www.w3.org/XML/1998/namespace", true
+	}
+	for e := n; e != nil; e = e.Parent {
+		if uri, ok := e.NS[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", prefix == ""
+}
+
+func (n *xmlNode) Space() string {
+	uri, _ := n.lookup(n.Prefix)
+	return uri
+}
+
+func (n *xmlNode) Is(space, local string) bool {
+	return n != nil && n.Local == local && n.Space() == space
+}
+
+func (n *xmlNode) All(space, local string) []*xmlNode {
+	var found []*xmlNode
+	for _, c := range n.Children {
+		if c.Node.Is(space, local) {
+			found = append(found, c.Node)
+		}
+	}
+	return found
+}
+
+func (n *xmlNode) Child(space, local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.Node.Is(space, local) {
+			return c.Node
+		}
+	}
+	return nil
+}
+
+func (n *xmlNode) Attr(name string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) Text() string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, c := range n.Children {
+		if c.Node == nil {
+			b.WriteString(c.Text)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func qname(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var (
+	c14nText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	c14nAttr = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// c14n writes n in exclusive XML canonicalization without comments,
+// leaving out skip, which is how the enveloped-signature transform drops
+// the Signature element from the data it signs.
+func c14n(w *bytes.Buffer, n *xmlNode, rendered map[string]string, inclusive []string, skip *xmlNode) {
+	used := map[string]bool{n.Prefix: true}
+	for _, a := range n.Attrs {
+		if a.Name.Space != "" && a.Name.Space != "xml" {
+			used[a.Name.Space] = true
+		}
+	}
+	for _, p := range inclusive {
+		if _, ok := n.lookup(p); ok {
+			used[p] = true
+		}
+	}
+	prefixes := make([]string, 0, len(used))
+	for p := range used {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	scope := map[string]string{}
+	for p, uri := range rendered {
+		scope[p] = uri
+	}
+	w.WriteString("<" + qname(n.Prefix, n.Local))
+	for _, p := range prefixes {
+		uri, _ := n.lookup(p)
+		if have, ok := scope[p]; ok && have == uri || !ok && p == "" && uri == "" {
+			continue
+		}
+		scope[p] = uri
+		if p == "" {
+			w.WriteString(` xmlns="` + c14nAttr.Replace(uri) + `"`)
+		} else {
+			w.WriteString(" xmlns:" + p + `="` + c14nAttr.Replace(uri) + `"`)
+		}
+	}
+	attrs := append([]xml.Attr(nil), n.Attrs...)
+	space := func(a xml.Attr) string {
+		if a.Name.Space == "" {
+			return ""
+		}
+		uri, _ := n.lookup(a.Name.Space)
+		return uri
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		si, sj := space(attrs[i]), space(attrs[j])
+		if si != sj {
+			return si < sj
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+	for _, a := range attrs {
+		w.WriteString(" " + qname(a.Name.Space, a.Name.Local) + `="` + c14nAttr.Replace(a.Value) + `"`)
+	}
+	w.WriteString(">")
+	for _, c := range n.Children {
+		switch {
+		case c.Node == nil:
+			w.WriteString(c14nText.Replace(c.Text))
+		case c.Node != skip:
+			c14n(w, c.Node, scope, inclusive, skip)
+		}
+	}
+	w.WriteString("</" + qname(n.Prefix, n.Local) + ">")
+}
+
+func exclusiveC14N(n *xmlNode, transform *xmlNode, skip *xmlNode) []byte {
+	var inclusive []string
+	if list := transform.Child(DSIG_EXC_C14N, "InclusiveNamespaces").Attr("PrefixList"); list != "" {
+		for _, p := range strings.Fields(list) {
+			if p == "#default" {
+				p = ""
+			}
+			inclusive = append(inclusive, p)
+		}
+	}
+	var buf bytes.Buffer
+	c14n(&buf, n, map[string]string{}, inclusive, skip)
+	return buf.Bytes()
+}
+
+// VerifySignature checks an enveloped XML signature sig over its parent
+// element signed. Only exclusive canonicalization with SHA-256 digests and
+// RSA or ECDSA SHA-256 signatures are accepted.
+func VerifySignature(sig, signed *xmlNode, certs []*x509.Certificate) error {
+	info := sig.Child(XMLNS_DSIG, "SignedInfo")
+	if info == nil {
+		return errors.New("signature has no SignedInfo")
+	}
+	canon := info.Child(XMLNS_DSIG, "CanonicalizationMethod")
+	if canon.Attr("Algorithm") != DSIG_EXC_C14N {
+		return fmt.Errorf("unsupported canonicalization %q", canon.Attr("Algorithm"))
+	}
+	method := info.Child(XMLNS_DSIG, "SignatureMethod").Attr("Algorithm")
+	refs := info.All(XMLNS_DSIG, "Reference")
+	if len(refs) != 1 {
+		return errors.New("signature must have exactly one reference")
+	}
+	ref := refs[0]
+	if id := signed.Attr("ID"); id == "" || ref.Attr("URI") != "#"+id {
+		return errors.New("signature does not reference the signed element")
+	}
+	var c14nTransform *xmlNode
+	for _, t := range ref.Child(XMLNS_DSIG, "Transforms").All(XMLNS_DSIG, "Transform") {
+		switch t.Attr("Algorithm") {
+		case DSIG_ENVELOPED:
+		case DSIG_EXC_C14N:
+			c14nTransform = t
+		default:
+			return fmt.Errorf("unsupported transform %q", t.Attr("Algorithm"))
+		}
+	}
+	if c14nTransform == nil {
+		return errors.New("reference is not canonicalized")
+	}
+	if alg := ref.Child(XMLNS_DSIG, "DigestMethod").Attr("Algorithm"); alg != DSIG_SHA256 {
+		return fmt.Errorf("unsupported digest %q", alg)
+	}
+	want, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(ref.Child(XMLNS_DSIG, "DigestValue").Text()), ""))
+	if err != nil {
+		return errors.New("malformed digest")
+	}
+	digest := sha256.Sum256(exclusiveC14N(signed, c14nTransform, sig))
+	if subtle.ConstantTimeCompare(digest[:], want) != 1 {
+		return errors.New("digest mismatch")
+	}
+
+	value, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sig.Child(XMLNS_DSIG, "SignatureValue").Text()), ""))
+	if err != nil {
+		return errors.New("malformed signature value")
+	}
+	hashed := sha256.Sum256(exclusiveC14N(info, canon, nil))
+	for _, cert := range certs {
+		switch pub := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			if method == DSIG_RSA_SHA256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], value) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			half := len(value) / 2
+			if method == DSIG_EC_SHA256 && len(value)%2 == 0 &&
+				ecdsa.Verify(pub, hashed[:], new(big.Int).SetBytes(value[:half]), new(big.Int).SetBytes(value[half:])) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("bad %s signature", method)
+}
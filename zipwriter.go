@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+const (
+	ZIP_FAST  = "fast"
+	ZIP_SMALL = "small"
+)
+
+type ZipEntry struct {
+	Name string
+	Path string
+}
+
+func Stored(name string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	for _, s := range conf.ZipStore {
+		if strings.EqualFold(s, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func EntryPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+strings.Replace(name, "\\", "/", -1)), "/")
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+func PartPath(p *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return EntryPath(p.FileName())
+	}
+	return EntryPath(params["filename"])
+}
+
+func CreateDir(zout *ZipWriter, name string) error {
+	header := &zip.FileHeader{
+		Name:     EntryPath(name) + "/",
+		Method:   zip.Store,
+		Modified: clock.Now(),
+	}
+	header.SetMode(os.ModeDir | 0755)
+	_, err := zout.CreateHeader(header)
+	return err
+}
+
+func CreateSymlink(zout *ZipWriter, name, target string) error {
+	header := &zip.FileHeader{
+		Name:     EntryPath(name),
+		Method:   zip.Store,
+		Modified: clock.Now(),
+	}
+	header.SetMode(os.ModeSymlink | 0777)
+	out, err := zout.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, target)
+	return err
+}
+
+type ZipWriter struct {
+	*zip.Writer
+	flusher http.Flusher
+	store   bool
+	level   int
+}
+
+func NewZipWriter(w io.Writer) *ZipWriter {
+	flusher, _ := w.(http.Flusher)
+	z := &ZipWriter{zip.NewWriter(w), flusher, false, conf.ZipLevel}
+	z.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, z.level)
+	})
+	return z
+}
+
+func ZipMode(r *http.Request) (string, error) {
+	switch mode := strings.ToLower(r.URL.Query().Get("compression")); mode {
+	case "", ZIP_FAST, ZIP_SMALL:
+		return mode, nil
+	}
+	return "", errors.New("compression must be fast or small")
+}
+
+func DefaultZipMode() string {
+	if conf.ZipLevel == flate.NoCompression {
+		return ZIP_FAST
+	}
+	return ZIP_SMALL
+}
+
+func (z *ZipWriter) SetMode(mode string) {
+	switch mode {
+	case ZIP_FAST:
+		z.store = true
+	case ZIP_SMALL:
+		z.store = false
+		z.level = flate.BestCompression
+	}
+}
+
+func (z *ZipWriter) flush() error {
+	if err := z.Writer.Flush(); err != nil {
+		return err
+	}
+	if z.flusher != nil {
+		z.flusher.Flush()
+	}
+	return nil
+}
+
+func (z *ZipWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	out, err := z.Writer.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return out, z.flush()
+}
+
+func (z *ZipWriter) CreateRaw(header *zip.FileHeader) (io.Writer, error) {
+	out, err := z.Writer.CreateRaw(header)
+	if err != nil {
+		return nil, err
+	}
+	return out, z.flush()
+}
+
+func CreateEntry(zout *ZipWriter, name string) (io.Writer, error) {
+	method := zip.Deflate
+	if zout.store || Stored(name) {
+		method = zip.Store
+	}
+	return zout.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Modified: clock.Now(),
+	})
+}
+
+type segment struct {
+	header *zip.FileHeader
+	spool  *os.File
+	err    error
+}
+
+func compressSegment(e ZipEntry, store bool, level int) segment {
+	in, err := os.Open(e.Path)
+	if err != nil {
+		return segment{err: err}
+	}
+	defer in.Close()
+
+	spool, err := ioutil.TempFile(conf.TempDir, TEMP_PREFIX+"zip-")
+	if err != nil {
+		return segment{err: err}
+	}
+	fail := func(err error) segment {
+		spool.Close()
+		os.Remove(spool.Name())
+		return segment{err: err}
+	}
+
+	crc := crc32.NewIEEE()
+	counter := &CountingWriter{W: spool}
+	method := zip.Deflate
+	var fw io.WriteCloser
+	if store || Stored(e.Name) {
+		method = zip.Store
+		fw = nopCloser{counter}
+	} else {
+		fw, err = flate.NewWriter(counter, level)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	n, err := io.Copy(io.MultiWriter(fw, crc), in)
+	if err != nil {
+		return fail(err)
+	}
+	if err := fw.Close(); err != nil {
+		return fail(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	header := &zip.FileHeader{
+		Name:               e.Name,
+		Method:             method,
+		CRC32:              crc.Sum32(),
+		CompressedSize64:   uint64(counter.N),
+		UncompressedSize64: uint64(n),
+		Modified:           clock.Now(),
+	}
+	return segment{header: header, spool: spool}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func writeSequential(zout *ZipWriter, entries []ZipEntry) error {
+	for _, e := range entries {
+		fd, err := os.Open(e.Path)
+		if err != nil {
+			logger.Error("Open zip entry %s: %s", e.Name, err)
+			continue
+		}
+		out, err := CreateEntry(zout, e.Name)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+		_, err = io.Copy(out, fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func WriteEntries(zout *ZipWriter, entries []ZipEntry) error {
+	workers := conf.ZipWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers <= 1 || len(entries) <= 1 {
+		return writeSequential(zout, entries)
+	}
+
+	results := make([]chan segment, len(entries))
+	for i := range results {
+		results[i] = make(chan segment, 1)
+	}
+	slots := make(chan struct{}, workers)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for i, e := range entries {
+			select {
+			case slots <- struct{}{}:
+			case <-quit:
+				return
+			}
+			go func(i int, e ZipEntry) {
+				results[i] <- compressSegment(e, zout.store, zout.level)
+			}(i, e)
+		}
+	}()
+
+	var failed error
+	for i := range entries {
+		seg := <-results[i]
+		<-slots
+		if seg.err != nil {
+			logger.Error("Compress zip entry %s: %s", entries[i].Name, seg.err)
+			continue
+		}
+		if failed == nil {
+			var out io.Writer
+			out, failed = zout.CreateRaw(seg.header)
+			if failed == nil {
+				_, failed = io.Copy(out, seg.spool)
+			}
+		}
+		seg.spool.Close()
+		os.Remove(seg.spool.Name())
+	}
+	return failed
+}